@@ -0,0 +1,85 @@
+package integrationtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	userDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/user"
+)
+
+func (s *TestSuite) TestCreateAttribute() {
+	requestBody := s.loader.LoadString("fixtures/api/create_attribute.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/attributes", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var created userDto.AttributeResponse
+	err = json.Unmarshal(bodyBytes, &created)
+	s.Require().NoError(err)
+	s.Require().Equal(201, resp.StatusCode)
+	s.Require().Equal("beta", created.Name)
+	s.Require().Equal("boolean", created.Type)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/attributes")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err = io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var list userDto.GetAttributesResponse
+	err = json.Unmarshal(bodyBytes, &list)
+	s.Require().NoError(err)
+	s.Require().Equal(200, listResp.StatusCode)
+	names := make([]string, len(list.Attributes))
+	for i := range list.Attributes {
+		names[i] = list.Attributes[i].Name
+	}
+	s.Require().Equal([]string{"beta", "city", "country", "platform", "signup_date"}, names)
+
+	userBody := s.loader.LoadString("fixtures/api/create_user_unregistered_attribute.json")
+	userResp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(userBody))
+	s.Require().NoError(err)
+	defer userResp.Body.Close()
+	s.Require().Equal(201, userResp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateAttributeAlreadyExists() {
+	requestBody := s.loader.LoadString("fixtures/api/create_attribute_already_exists.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/attributes", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Attribute already exists", got.Error())
+	s.Require().Equal(409, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateUserUnregisteredAttribute() {
+	requestBody := s.loader.LoadString("fixtures/api/create_user_unregistered_attribute.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal(`Invalid attributes: attribute "beta" is not registered`, got.Error())
+	s.Require().Equal(400, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateUserInvalidAttribute() {
+	requestBody := s.loader.LoadString("fixtures/api/create_user_invalid_attribute.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal(`Invalid attributes: attribute "signup_date" must be a date`, got.Error())
+	s.Require().Equal(400, resp.StatusCode)
+}
@@ -0,0 +1,60 @@
+package integrationtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	auditDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/audit"
+)
+
+func (s *TestSuite) TestSegmentAuditRecordsUpdate() {
+	requestBody := s.loader.LoadString("fixtures/api/update_segment_metadata.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/segments/test_name_2", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	req.Header.Set("X-Actor", "pricing-admin")
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	auditResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments/test_name_2/audit")
+	s.Require().NoError(err)
+	defer auditResp.Body.Close()
+	bodyBytes, err := io.ReadAll(auditResp.Body)
+	s.Require().NoError(err)
+	var response auditDto.GetSegmentAuditResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, auditResp.StatusCode)
+	s.Require().Len(response.Events, 1)
+	s.Require().Equal("pricing-admin", response.Events[0].Actor)
+	s.Require().Equal("updated", response.Events[0].Operation)
+	s.Require().Equal("", response.Events[0].Before["owner"])
+	s.Require().Equal("pricing-team", response.Events[0].After["owner"])
+
+	csvResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments/test_name_2/audit?format=csv")
+	s.Require().NoError(err)
+	defer csvResp.Body.Close()
+	csvBytes, err := io.ReadAll(csvResp.Body)
+	s.Require().NoError(err)
+	s.Require().Equal(200, csvResp.StatusCode)
+	s.Require().True(strings.HasPrefix(string(csvBytes), "ID,Segment,Actor,Operation,Before,After,Time\n"))
+	s.Require().Contains(string(csvBytes), "pricing-admin")
+}
+
+func (s *TestSuite) TestSegmentAuditNotFound() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments/test_name_3/audit")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	err = json.Unmarshal(bodyBytes, &got)
+	s.Require().NoError(err)
+	s.Require().Equal("No audit events were found for the specified segment", got.Error())
+	s.Require().Equal(404, resp.StatusCode)
+}
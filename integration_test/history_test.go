@@ -59,6 +59,8 @@ func (s *TestSuite) TestDownload() {
 	bodyBytes, err := io.ReadAll(resp.Body)
 	s.Require().NoError(err)
 	s.Require().Equal("attachment; filename=history-for-2023-8.csv", resp.Header.Get("Content-Disposition"))
-	expectedCSV := []byte("ID,UserID,Segment,Operation,Time\n3,test_name_3,added,2023-08-31 03:00:00\n3,test_name_4,added,2023-08-31 03:00:00\n")
+	expectedCSV := []byte("UserID,Segment,Variant,Operation,Time,city,country,platform,signup_date\n" +
+		"3,test_name_3,,added,2023-08-31 03:00:00,,RU,ios,2023-08-01\n" +
+		"3,test_name_4,,added,2023-08-31 03:00:00,,RU,ios,2023-08-01\n")
 	s.Require().Equal(string(expectedCSV), string(bodyBytes))
 }
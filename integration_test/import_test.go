@@ -0,0 +1,83 @@
+package integrationtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	membrDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership"
+)
+
+func (s *TestSuite) TestImportUsersCSV() {
+	segmentBody := s.loader.LoadString("fixtures/api/create_segment_rule.json")
+	segmentResp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(segmentBody))
+	s.Require().NoError(err)
+	defer segmentResp.Body.Close()
+	s.Require().Equal(201, segmentResp.StatusCode)
+
+	requestBody := s.loader.LoadString("fixtures/api/import_users.csv")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users/import", "text/csv", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var report membrDto.ImportUsersResponse
+	err = json.Unmarshal(bodyBytes, &report)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal(2, report.Created)
+	s.Require().Equal(2, report.Duplicate)
+	s.Require().Equal(2, report.Invalid)
+	statuses := make([]string, len(report.Rows))
+	for i := range report.Rows {
+		statuses[i] = report.Rows[i].Status
+	}
+	s.Require().Equal([]string{"created", "created", "duplicate", "duplicate", "invalid", "invalid"}, statuses)
+	s.Require().Equal("email is repeated from row 2", report.Rows[3].Reason)
+	s.Require().Equal(`attribute "beta" is not registered`, report.Rows[5].Reason)
+
+	membershipResp, err := s.server.Client().Get(fmt.Sprintf("%s/api/v1/users/%d", s.server.URL, report.Rows[0].UserID))
+	s.Require().NoError(err)
+	defer membershipResp.Body.Close()
+	bodyBytes, err = io.ReadAll(membershipResp.Body)
+	s.Require().NoError(err)
+	var response membrDto.GetUserMembershipResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	names := make([]string, len(response.Memberships))
+	for i := range response.Memberships {
+		names[i] = response.Memberships[i].SegmentName
+	}
+	s.Require().Contains(names, "test_name_kazan")
+}
+
+func (s *TestSuite) TestImportUsersNDJSON() {
+	requestBody := s.loader.LoadString("fixtures/api/import_users.ndjson")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users/import", "application/x-ndjson", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var report membrDto.ImportUsersResponse
+	err = json.Unmarshal(bodyBytes, &report)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal(1, report.Created)
+	s.Require().Equal(1, report.Invalid)
+	s.Require().Equal(2, report.Rows[1].Row)
+	s.Require().Equal("invalid", report.Rows[1].Status)
+}
+
+func (s *TestSuite) TestImportUsersUnsupportedContentType() {
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users/import", "application/json", bytes.NewBufferString("[]"))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Unsupported content type, expected text/csv or application/x-ndjson", got.Error())
+	s.Require().Equal(415, resp.StatusCode)
+}
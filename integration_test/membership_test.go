@@ -9,6 +9,7 @@ import (
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
 	membrDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership"
+	segmentDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/segment"
 )
 
 func (s *TestSuite) TestSuccessfulGetUserSegments() {
@@ -41,6 +42,52 @@ func (s *TestSuite) TestUserNotFound() {
 	s.Require().Equal(404, resp.StatusCode)
 }
 
+func (s *TestSuite) TestCheckUserSegment() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/3/segments/limited_segment")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response membrDto.UserResponseInfo
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal("limited_segment", response.SegmentName)
+	s.Require().Equal(response.ExpiredAt.Format(time.RFC3339), resp.Header.Get("X-Expired-At"))
+
+	headResp, err := s.server.Client().Head(s.server.URL + "/api/v1/users/3/segments/limited_segment")
+	s.Require().NoError(err)
+	defer headResp.Body.Close()
+	s.Require().Equal(200, headResp.StatusCode)
+	s.Require().NotEmpty(headResp.Header.Get("X-Expired-At"))
+}
+
+func (s *TestSuite) TestCheckUserSegmentNotAssigned() {
+	resp, err := s.server.Client().Head(s.server.URL + "/api/v1/users/3/segments/test_name_2")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(404, resp.StatusCode)
+}
+
+func (s *TestSuite) TestBatchGetUserSegments() {
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users/segments:batchGet", "", bytes.NewBufferString(`{"userIDs": [2, 3]}`))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response membrDto.BatchGetMembershipResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Len(response.Memberships, 2)
+	s.Require().Empty(response.Memberships[2])
+	names := make([]string, len(response.Memberships[3]))
+	for i := range response.Memberships[3] {
+		names[i] = response.Memberships[3][i].SegmentName
+	}
+	s.Require().Contains(names, "limited_segment")
+}
+
 func (s *TestSuite) TestUpdateUserSegmentsAddNew() {
 	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_add.json")
 	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
@@ -68,6 +115,33 @@ func (s *TestSuite) TestUpdateUserSegmentsAddAndDelete() {
 	s.Require().Equal(200, resp.StatusCode)
 }
 
+func (s *TestSuite) TestUpdateUserSegmentsLayerConflict() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_layer_conflict.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().NoError(err)
+	s.Require().Equal("Attempt to add more than one segment of the same layer to the user", got.Error())
+	s.Require().Equal(422, resp.StatusCode)
+}
+
+func (s *TestSuite) TestUpdateUserSegmentsSegmentFull() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_segment_full.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal(apierror.CodeSegmentFull, got.Code)
+	s.Require().Equal("Segment limited_segment is full, its capacity is 1", got.Error())
+	s.Require().Equal(409, resp.StatusCode)
+}
+
 func (s *TestSuite) TestUpdateUserSegmentsUserNotFount() {
 	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_not_found.json")
 	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
@@ -95,6 +169,28 @@ func (s *TestSuite) TestUpdateUserSegmentsAssignedSegment() {
 	s.Require().Equal(409, resp.StatusCode)
 }
 
+func (s *TestSuite) TestUpdateUserSegmentsUpsertAssignedSegment() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_upsert.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+}
+
+func (s *TestSuite) TestUpdateUserSegmentsScheduled() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_scheduled.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	checkResp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/3/segments/test_name_4")
+	s.Require().NoError(err)
+	defer checkResp.Body.Close()
+	s.Require().Equal(404, checkResp.StatusCode)
+}
+
 func (s *TestSuite) TestUpdateUserSegmentsEmptyReq() {
 	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_empty.json")
 	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
@@ -123,7 +219,8 @@ func (s *TestSuite) TestUpdateUserSegmentsDeleteNotAssigned() {
 }
 
 func (s *TestSuite) TestSuccessfullyDeleteSegment() {
-	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/test_name_6", nil)
+	token := s.deletionToken("test_name_6")
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/test_name_6?confirmationToken="+token, nil)
 	s.Require().NoError(err)
 	resp, err := s.server.Client().Do(req)
 	s.Require().NoError(err)
@@ -141,3 +238,99 @@ func (s *TestSuite) TestSuccessfullyDeleteSegmentNotFound() {
 	s.Require().NoError(err)
 	s.Require().Equal(404, resp.StatusCode)
 }
+
+func (s *TestSuite) TestArchiveAndRestoreSegment() {
+	token := s.deletionToken("test_name_6")
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/test_name_6?confirmationToken="+token, nil)
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name_6&archived=true")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var segments segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &segments)
+	s.Require().NoError(err)
+	s.Require().Len(segments.Segments, 1)
+	s.Require().NotNil(segments.Segments[0].ArchivedAt)
+
+	restoreResp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments/test_name_6/restore", "", nil)
+	s.Require().NoError(err)
+	defer restoreResp.Body.Close()
+	s.Require().Equal(200, restoreResp.StatusCode)
+}
+
+func (s *TestSuite) TestRestoreSegmentGracePeriodExpired() {
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments/archived_segment/restore", "", nil)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Segment grace period has expired", got.Error())
+	s.Require().Equal(410, resp.StatusCode)
+}
+
+func (s *TestSuite) TestDeleteSegmentDryRun() {
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/test_name?dryRun=true", nil)
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var preview membrDto.DeletePreviewResponse
+	err = json.Unmarshal(bodyBytes, &preview)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal("test_name", preview.Segment)
+	s.Require().Equal(preview.ManualUsers+preview.AutomaticUsers, preview.AffectedUsers)
+	s.Require().Len(preview.SampleUserIDs, int(preview.AffectedUsers))
+	s.Require().NotEmpty(preview.ConfirmationToken)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name&limit=1")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err = io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var segments segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &segments)
+	s.Require().NoError(err)
+	s.Require().Len(segments.Segments, 1)
+	s.Require().Equal("test_name", segments.Segments[0].Name)
+}
+
+func (s *TestSuite) TestDeleteSegmentWithoutConfirmation() {
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/test_name_6", nil)
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Confirmation token from the dry run is required", got.Error())
+	s.Require().Equal(428, resp.StatusCode)
+}
+
+func (s *TestSuite) deletionToken(segmentName string) string {
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/segments/"+segmentName+"?dryRun=true", nil)
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var preview membrDto.DeletePreviewResponse
+	err = json.Unmarshal(bodyBytes, &preview)
+	s.Require().NoError(err)
+	return preview.ConfirmationToken
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"net/http"
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	membrDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership"
 	segmentDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/segment"
 )
 
@@ -36,3 +38,191 @@ func (s *TestSuite) TestSegmentAlreadyExists() {
 	s.Require().Equal("Segment already exists", got.Error())
 	s.Require().Equal(409, resp.StatusCode)
 }
+
+func (s *TestSuite) TestGetSegmentsPage() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name_&limit=2")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 2)
+	s.Require().Equal("test_name_2", response.Segments[0].Name)
+	s.Require().Equal("test_name_3", response.Segments[1].Name)
+	s.Require().Equal(int64(3), response.NextCursor)
+	s.Require().Equal(200, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateSegmentAssignExisting() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_assign_existing.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(201, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name_assign")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 1)
+	s.Require().Equal(int64(3), response.Segments[0].Members)
+}
+
+func (s *TestSuite) TestCreateSegmentWithVariants() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_variants.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(201, resp.StatusCode)
+
+	userResp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/1")
+	s.Require().NoError(err)
+	defer userResp.Body.Close()
+	bodyBytes, err := io.ReadAll(userResp.Body)
+	s.Require().NoError(err)
+	var response membrDto.GetUserMembershipResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+
+	var variant string
+	for _, m := range response.Memberships {
+		if m.SegmentName == "test_name_experiment" {
+			variant = m.Variant
+		}
+	}
+	s.Require().Contains([]string{"control", "treatment"}, variant)
+}
+
+func (s *TestSuite) TestUpdateSegmentPercentage() {
+	requestBody := s.loader.LoadString("fixtures/api/update_segment_percentage.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/segments/test_name_5", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name_5")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 1)
+	s.Require().Equal(100, response.Segments[0].Percentage)
+	s.Require().Equal(int64(3), response.Segments[0].Members)
+}
+
+func (s *TestSuite) TestUpdateSegmentPercentageNotFound() {
+	requestBody := s.loader.LoadString("fixtures/api/update_segment_percentage.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/segments/unknown_segment", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().NoError(err)
+	s.Require().Equal("Segment with the specified name wasn't found", got.Error())
+	s.Require().Equal(404, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateSegmentWithMetadata() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_metadata.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(201, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?tag=checkout&owner=checkout-team")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 1)
+	s.Require().Equal("test_name_metadata", response.Segments[0].Name)
+	s.Require().Equal("Segment for the new checkout page", response.Segments[0].Description)
+	s.Require().Equal([]string{"checkout", "web"}, response.Segments[0].Tags)
+	s.Require().Equal("CHK-42", response.Segments[0].Attributes["ticket"])
+}
+
+func (s *TestSuite) TestUpdateSegmentMetadata() {
+	requestBody := s.loader.LoadString("fixtures/api/update_segment_metadata.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/segments/test_name_2", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?owner=pricing-team")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 1)
+	s.Require().Equal("test_name_2", response.Segments[0].Name)
+	s.Require().Equal([]string{"pricing"}, response.Segments[0].Tags)
+}
+
+func (s *TestSuite) TestCreateSegmentWithActiveWindow() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_window.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(201, resp.StatusCode)
+
+	listResp, err := s.server.Client().Get(s.server.URL + "/api/v1/segments?prefix=test_name_campaign")
+	s.Require().NoError(err)
+	defer listResp.Body.Close()
+	bodyBytes, err := io.ReadAll(listResp.Body)
+	s.Require().NoError(err)
+	var response segmentDto.GetSegmentsResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Len(response.Segments, 1)
+	s.Require().NotNil(response.Segments[0].ActiveFrom)
+	s.Require().NotNil(response.Segments[0].ActiveUntil)
+	s.Require().True(response.Segments[0].ActiveUntil.After(*response.Segments[0].ActiveFrom))
+}
+
+func (s *TestSuite) TestCreateSegmentInvalidActiveWindow() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_invalid_window.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Segment active window must end after it starts", got.Error())
+	s.Require().Equal(400, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateSegmentPrerequisiteNotFound() {
+	requestBody := s.loader.LoadString("fixtures/api/create_segment_prerequisite_not_found.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Not all prerequisite segments were found", got.Error())
+	s.Require().Equal(400, resp.StatusCode)
+}
@@ -11,12 +11,17 @@ import (
 	"github.com/VrMolodyakov/segment-api/internal/cache"
 	"github.com/VrMolodyakov/segment-api/internal/config"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver"
+	auditDomain "github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	exportDomain "github.com/VrMolodyakov/segment-api/internal/domain/export"
 	historyDomain "github.com/VrMolodyakov/segment-api/internal/domain/history"
 	membershipDomain "github.com/VrMolodyakov/segment-api/internal/domain/membership"
 	segmentDomain "github.com/VrMolodyakov/segment-api/internal/domain/segment"
+	userDomain "github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/internal/repository/audit"
 	"github.com/VrMolodyakov/segment-api/internal/repository/history"
 	"github.com/VrMolodyakov/segment-api/internal/repository/membership"
 	"github.com/VrMolodyakov/segment-api/internal/repository/segment"
+	"github.com/VrMolodyakov/segment-api/internal/repository/user"
 	"github.com/VrMolodyakov/segment-api/pkg/clock"
 	"github.com/VrMolodyakov/segment-api/pkg/csv"
 	"github.com/VrMolodyakov/segment-api/pkg/logging"
@@ -44,6 +49,7 @@ const (
 	host              string        = "localhost"
 	port              int           = 8081
 	CSVExpiration     int           = 50
+	archiveGrace      int           = 3600
 )
 
 func (s *TestSuite) SetupSuite() {
@@ -68,23 +74,28 @@ func (s *TestSuite) SetupSuite() {
 	s.logger, err = logging.MockLogger()
 	s.Require().NoError(err)
 
-	generator := random.NewRandomGenerator(100)
+	bucketing := random.NewHashBucketing(100)
 	clock := clock.New()
 
 	historyRepo := history.New(s.client)
 	membershipRepo := membership.New(s.client, clock)
-	segmentRepo := segment.New(s.client)
+	segmentRepo := segment.New(s.client, clock)
+	auditRepo := audit.New(s.client)
+	userRepo := user.New(s.client, membershipRepo)
 
 	dataCache := cache.New[int64, []membershipDomain.MembershipInfo](cleanUpInterval)
 	historyCache := cache.New[int, []historyDomain.History](cleanUpInterval)
 
-	segmentService := segmentDomain.New(segmentRepo, s.logger)
+	segmentService := segmentDomain.New(segmentRepo, dataCache, s.logger)
 
 	membershipService := membershipDomain.New(
 		membershipRepo,
+		userRepo,
 		dataCache,
 		time.Duration(segmentExpiration)*time.Second,
-		generator,
+		time.Duration(archiveGrace)*time.Second,
+		[]byte("secret"),
+		bucketing,
 		s.logger,
 	)
 
@@ -95,9 +106,14 @@ func (s *TestSuite) SetupSuite() {
 		s.logger,
 	)
 
+	auditService := auditDomain.New(auditRepo, s.logger)
+	userService := userDomain.New(userRepo, membershipService, s.logger)
+	exportService := exportDomain.New(userRepo, membershipRepo, historyRepo, s.logger)
+
 	pool := bufferpool.New()
 	f := csv.Write[historyDomain.History]
 	writer := csv.NewCSVWriter[historyDomain.History](f)
+	auditWriter := csv.NewCSVWriter[auditDomain.Event](csv.Write[auditDomain.Event])
 	cfgHTTP := config.HTTP{
 		Host:         host,
 		Port:         port,
@@ -108,7 +124,19 @@ func (s *TestSuite) SetupSuite() {
 		Host: host,
 		Port: port,
 	}
-	server := apiserver.New(cfgHTTP, cfgDownload, segmentService, historyService, membershipService, pool, &writer)
+	server := apiserver.New(
+		cfgHTTP,
+		cfgDownload,
+		segmentService,
+		historyService,
+		membershipService,
+		auditService,
+		userService,
+		exportService,
+		pool,
+		&writer,
+		&auditWriter,
+	)
 	s.server = httptest.NewServer(server.Handler)
 
 	s.loader = NewFixtureLoader(s.T(), Fixtures)
@@ -1,12 +1,19 @@
 package integrationtest
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
+	"strings"
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	exportDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/export"
 	membrDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership"
+	userDto "github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/user"
 )
 
 func (s *TestSuite) TestSuccessCreateUser() {
@@ -36,3 +43,273 @@ func (s *TestSuite) TestUserAlreadyExists() {
 	s.Require().Equal("User already exists", got.Error())
 	s.Require().Equal(409, resp.StatusCode)
 }
+
+func (s *TestSuite) TestCreateUserMatchingRuleSegment() {
+	segmentBody := s.loader.LoadString("fixtures/api/create_segment_rule.json")
+	segmentResp, err := s.server.Client().Post(s.server.URL+"/api/v1/segments", "", bytes.NewBufferString(segmentBody))
+	s.Require().NoError(err)
+	defer segmentResp.Body.Close()
+	s.Require().Equal(201, segmentResp.StatusCode)
+
+	requestBody := s.loader.LoadString("fixtures/api/create_user_attributes.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var created membrDto.CreateUserResponse
+	err = json.Unmarshal(bodyBytes, &created)
+	s.Require().NoError(err)
+	s.Require().Equal(201, resp.StatusCode)
+
+	membershipResp, err := s.server.Client().Get(fmt.Sprintf("%s/api/v1/users/%d", s.server.URL, created.ID))
+	s.Require().NoError(err)
+	defer membershipResp.Body.Close()
+	bodyBytes, err = io.ReadAll(membershipResp.Body)
+	s.Require().NoError(err)
+	var response membrDto.GetUserMembershipResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	names := make([]string, len(response.Memberships))
+	for i := range response.Memberships {
+		names[i] = response.Memberships[i].SegmentName
+	}
+	s.Require().Contains(names, "test_name_kazan")
+}
+
+func (s *TestSuite) TestGetUserProfile() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/1/profile")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response userDto.UserResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal(int64(1), response.ID)
+	s.Require().Equal("example@example.com", response.Email)
+}
+
+func (s *TestSuite) TestGetUserProfileNotFound() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/100/profile")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("User with the specified id wasn't found", got.Error())
+	s.Require().Equal(404, resp.StatusCode)
+}
+
+func (s *TestSuite) TestUpdateUser() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/users/1", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response userDto.UserResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal("test_name", response.FirstName)
+	s.Require().Equal("Doe", response.LastName)
+	s.Require().Equal("Kazan", response.Attributes["city"])
+}
+
+func (s *TestSuite) TestUpdateUserEmailTaken() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_email_taken.json")
+	req, err := http.NewRequest(http.MethodPatch, s.server.URL+"/api/v1/users/1", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("User already exists", got.Error())
+	s.Require().Equal(409, resp.StatusCode)
+}
+
+func (s *TestSuite) TestGetUsersByEmail() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users?email=example2@&limit=10")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var response userDto.GetUsersResponse
+	err = json.Unmarshal(bodyBytes, &response)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Len(response.Users, 1)
+	s.Require().Equal(int64(2), response.Users[0].ID)
+	s.Require().Equal(int64(0), response.NextCursor)
+}
+
+func (s *TestSuite) TestEraseUser() {
+	req, err := http.NewRequest(http.MethodDelete, s.server.URL+"/api/v1/users/1", nil)
+	s.Require().NoError(err)
+	resp, err := s.server.Client().Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	profileResp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/1/profile")
+	s.Require().NoError(err)
+	defer profileResp.Body.Close()
+	s.Require().Equal(404, profileResp.StatusCode)
+
+	var linked, added, deleted int
+	err = s.client.QueryRow(
+		context.Background(),
+		`SELECT
+			COUNT(*) FILTER (WHERE user_id = 1),
+			COUNT(*) FILTER (WHERE anonymous_id IS NOT NULL AND operation = 'added'),
+			COUNT(*) FILTER (WHERE anonymous_id IS NOT NULL AND operation = 'deleted')
+		FROM segment_history`,
+	).Scan(&linked, &added, &deleted)
+	s.Require().NoError(err)
+	s.Require().Equal(0, linked)
+	s.Require().Equal(1, added)
+	s.Require().Equal(1, deleted)
+}
+
+func (s *TestSuite) TestExportUser() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/3/export")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+	s.Require().Equal("application/zip", resp.Header.Get("Content-Type"))
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+
+	archive, err := zip.NewReader(bytes.NewReader(bodyBytes), int64(len(bodyBytes)))
+	s.Require().NoError(err)
+	files := make(map[string][]byte, len(archive.File))
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		s.Require().NoError(err)
+		content, err := io.ReadAll(rc)
+		s.Require().NoError(err)
+		rc.Close()
+		files[f.Name] = content
+	}
+
+	var exported exportDto.UserExport
+	err = json.Unmarshal(files["export.json"], &exported)
+	s.Require().NoError(err)
+	s.Require().Equal("example3@example.com", exported.Profile.Email)
+	s.Require().NotEmpty(exported.History)
+	s.Require().True(strings.HasPrefix(string(files["history.csv"]), "UserID,Segment,Variant,Operation,Time\n"))
+}
+
+func (s *TestSuite) TestExportUserNotFound() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/100/export")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(404, resp.StatusCode)
+}
+
+func (s *TestSuite) TestCreateUserWithExternalIDs() {
+	requestBody := s.loader.LoadString("fixtures/api/create_user_external_ids.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var created membrDto.CreateUserResponse
+	err = json.Unmarshal(bodyBytes, &created)
+	s.Require().NoError(err)
+	s.Require().Equal(201, resp.StatusCode)
+
+	profileResp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/billing:6ba7b810-9dad-11d1-80b4-00c04fd430c8/profile")
+	s.Require().NoError(err)
+	defer profileResp.Body.Close()
+	bodyBytes, err = io.ReadAll(profileResp.Body)
+	s.Require().NoError(err)
+	var profile userDto.UserResponse
+	err = json.Unmarshal(bodyBytes, &profile)
+	s.Require().NoError(err)
+	s.Require().Equal(200, profileResp.StatusCode)
+	s.Require().Equal(created.ID, profile.ID)
+	s.Require().Equal([]userDto.ExternalIDResponse{
+		{Namespace: "billing", ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{Namespace: "crm", ID: "b-1"},
+	}, profile.ExternalIDs)
+}
+
+func (s *TestSuite) TestCreateUserExternalIDTaken() {
+	requestBody := s.loader.LoadString("fixtures/api/create_user_external_id_taken.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/users", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("External id is already used by another user", got.Error())
+	s.Require().Equal(409, resp.StatusCode)
+
+	var count int
+	err = s.client.QueryRow(context.Background(), "SELECT COUNT(*) FROM users WHERE email = 'external@example.com'").Scan(&count)
+	s.Require().NoError(err)
+	s.Require().Equal(0, count)
+}
+
+func (s *TestSuite) TestGetUserSegmentsByExternalID() {
+	for _, ref := range []string{"crm:a-17", "crm:a-18"} {
+		resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/" + ref)
+		s.Require().NoError(err)
+		defer resp.Body.Close()
+		bodyBytes, err := io.ReadAll(resp.Body)
+		s.Require().NoError(err)
+		var response membrDto.GetUserMembershipResponse
+		err = json.Unmarshal(bodyBytes, &response)
+		s.Require().NoError(err)
+		s.Require().Equal(200, resp.StatusCode)
+		s.Require().Equal(int64(1), response.Memberships[0].UserID)
+		s.Require().Equal("test_name", response.Memberships[0].SegmentName)
+	}
+}
+
+func (s *TestSuite) TestExternalIDNotFound() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/crm:unknown/profile")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("User with the specified id wasn't found", got.Error())
+	s.Require().Equal(404, resp.StatusCode)
+}
+
+func (s *TestSuite) TestInvalidUserReference() {
+	resp, err := s.server.Client().Get(s.server.URL + "/api/v1/users/unknown/profile")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	var got apierror.ErrorResponse
+	json.Unmarshal(bodyBytes, &got)
+	s.Require().Equal("Invalid user id parameter", got.Error())
+	s.Require().Equal(400, resp.StatusCode)
+}
+
+func (s *TestSuite) TestUpdateUserSegmentsByExternalID() {
+	requestBody := s.loader.LoadString("fixtures/api/update_user_segments_external_id.json")
+	resp, err := s.server.Client().Post(s.server.URL+"/api/v1/membership/update", "", bytes.NewBufferString(requestBody))
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(200, resp.StatusCode)
+
+	var count int
+	err = s.client.QueryRow(context.Background(), "SELECT COUNT(*) FROM user_segments WHERE user_id = 3 AND segment_id = 4").Scan(&count)
+	s.Require().NoError(err)
+	s.Require().Equal(1, count)
+}
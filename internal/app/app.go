@@ -70,6 +70,10 @@ func (a *app) Start(ctx context.Context) {
 		a.deps.cleaner.Start(ctx, time.Duration(a.cfg.Cleaner.Interval)*time.Second)
 	}()
 
+	go func() {
+		a.deps.ramp.Start(ctx, time.Duration(a.cfg.Ramp.Interval)*time.Second)
+	}()
+
 	<-ctx.Done()
 }
 
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
 	"net/http"
 	"time"
 
@@ -9,13 +10,19 @@ import (
 	"github.com/VrMolodyakov/segment-api/internal/cache"
 	"github.com/VrMolodyakov/segment-api/internal/config"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver"
+	auditDomain "github.com/VrMolodyakov/segment-api/internal/domain/audit"
 	"github.com/VrMolodyakov/segment-api/internal/domain/cleaner"
+	exportDomain "github.com/VrMolodyakov/segment-api/internal/domain/export"
 	historyDomain "github.com/VrMolodyakov/segment-api/internal/domain/history"
 	membershipDomain "github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/ramp"
 	segmentDomain "github.com/VrMolodyakov/segment-api/internal/domain/segment"
+	userDomain "github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/internal/repository/audit"
 	"github.com/VrMolodyakov/segment-api/internal/repository/history"
 	"github.com/VrMolodyakov/segment-api/internal/repository/membership"
 	"github.com/VrMolodyakov/segment-api/internal/repository/segment"
+	"github.com/VrMolodyakov/segment-api/internal/repository/user"
 	"github.com/VrMolodyakov/segment-api/pkg/client/postgresql"
 	"github.com/VrMolodyakov/segment-api/pkg/clock"
 	"github.com/VrMolodyakov/segment-api/pkg/csv"
@@ -33,10 +40,15 @@ type Cleaner interface {
 	Start(ctx context.Context, interval time.Duration)
 }
 
+type Ramp interface {
+	Start(ctx context.Context, interval time.Duration)
+}
+
 type Deps struct {
 	server   *http.Server
 	psqlPool *pgxpool.Pool
 	cleaner  Cleaner
+	ramp     Ramp
 }
 
 func (d *Deps) Setup(ctx context.Context, cfg *config.Config, logger logging.Logger) error {
@@ -57,23 +69,38 @@ func (d *Deps) Setup(ctx context.Context, cfg *config.Config, logger logging.Log
 	}
 	d.psqlPool = client
 
-	generator := random.NewRandomGenerator(maximumPercentage)
+	bucketing := random.NewHashBucketing(maximumPercentage)
 	clock := clock.New()
 
 	historyRepo := history.New(d.psqlPool)
 	membershipRepo := membership.New(d.psqlPool, clock)
-	segmentRepo := segment.New(d.psqlPool)
+	segmentRepo := segment.New(d.psqlPool, clock)
+	auditRepo := audit.New(d.psqlPool)
+	userRepo := user.New(d.psqlPool, membershipRepo)
 
 	dataCache := cache.New[int64, []membershipDomain.MembershipInfo](cleanUpInterval)
 	historyCache := cache.New[int, []historyDomain.History](cleanUpInterval)
 
-	segmentService := segmentDomain.New(segmentRepo, logger)
+	segmentService := segmentDomain.New(segmentRepo, dataCache, logger)
+
+	tokenSecret := []byte(cfg.Archive.TokenSecret)
+	if len(tokenSecret) == 0 {
+		logger.Warn("ARCHIVE_TOKEN_SECRET is not set, deletion previews are valid until restart only")
+		tokenSecret = make([]byte, 32)
+		if _, err = rand.Read(tokenSecret); err != nil {
+			logger.Errorf("couldn't generate archive token secret %s", err.Error())
+			return err
+		}
+	}
 
 	membershipService := membershipDomain.New(
 		membershipRepo,
+		userRepo,
 		dataCache,
 		time.Duration(cfg.Cachce.SegmentExpiration)*time.Second,
-		generator,
+		time.Duration(cfg.Archive.GracePeriod)*time.Second,
+		tokenSecret,
+		bucketing,
 		logger,
 	)
 
@@ -84,14 +111,30 @@ func (d *Deps) Setup(ctx context.Context, cfg *config.Config, logger logging.Log
 		logger,
 	)
 
-	d.cleaner = cleaner.New(membershipRepo, logger)
+	auditService := auditDomain.New(auditRepo, logger)
+	userService := userDomain.New(userRepo, membershipService, logger)
+	exportService := exportDomain.New(userRepo, membershipRepo, historyRepo, logger)
 
 	pool := bufferpool.New()
 	f := csv.Write[historyDomain.History]
 	writer := csv.NewCSVWriter[historyDomain.History](f)
-
-	d.cleaner = cleaner.New(membershipRepo, logger)
-	d.server = apiserver.New(cfg.HTTP, cfg.Download, segmentService, historyService, membershipService, pool, &writer)
+	auditWriter := csv.NewCSVWriter[auditDomain.Event](csv.Write[auditDomain.Event])
+
+	d.cleaner = cleaner.New(membershipRepo, time.Duration(cfg.Archive.GracePeriod)*time.Second, logger)
+	d.ramp = ramp.New(membershipRepo, dataCache, logger)
+	d.server = apiserver.New(
+		cfg.HTTP,
+		cfg.Download,
+		segmentService,
+		historyService,
+		membershipService,
+		auditService,
+		userService,
+		exportService,
+		pool,
+		&writer,
+		&auditWriter,
+	)
 
 	return nil
 }
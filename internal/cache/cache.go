@@ -52,6 +52,13 @@ func (ch *Cache[K, V]) Delete(key K) {
 	ch.values.Delete(key)
 }
 
+func (ch *Cache[K, V]) Clear() {
+	ch.values.Range(func(key, value interface{}) bool {
+		ch.values.Delete(key)
+		return true
+	})
+}
+
 func (ch *Cache[K, V]) Clean() {
 	if ch.cleaner.interval > 0 {
 		go ch.clean()
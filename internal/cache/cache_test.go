@@ -40,3 +40,14 @@ func TestDelete(t *testing.T) {
 	_, inCache := cache.Get("abc")
 	assert.False(t, inCache)
 }
+
+func TestClear(t *testing.T) {
+	cache := New[string, string](1 * time.Second)
+	_ = cache.Set("abc", "d", 10*time.Second)
+	_ = cache.Set("efg", "h", 10*time.Second)
+	cache.Clear()
+	_, inCache := cache.Get("abc")
+	assert.False(t, inCache)
+	_, inCache = cache.Get("efg")
+	assert.False(t, inCache)
+}
@@ -45,9 +45,20 @@ type Cleaner struct {
 	Interval int `env:"CLEANUP_INTERVAL"`
 }
 
+type Ramp struct {
+	Interval int `env:"RAMP_INTERVAL"`
+}
+
+type Archive struct {
+	GracePeriod int    `env:"ARCHIVE_GRACE_PERIOD" env-default:"604800"`
+	TokenSecret string `env:"ARCHIVE_TOKEN_SECRET"`
+}
+
 type Config struct {
 	Download Download
 	Cleaner  Cleaner
+	Ramp     Ramp
+	Archive  Archive
 	Cachce   Cachce
 	Logger   Logger
 	Postgres Postgres
@@ -58,6 +58,9 @@ func TestConfigEnvironmentSetCorrectly(t *testing.T) {
 			PoolSize: 10,
 			SSLMode:  "disable",
 		},
+		Archive: Archive{
+			GracePeriod: 604800,
+		},
 	}
 	assert.Equal(t, expectedConfig, config, "unexpected config")
 }
@@ -0,0 +1,24 @@
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+)
+
+const (
+	actorHeader    string = "X-Actor"
+	anonymousActor string = "anonymous"
+)
+
+// withActor puts the caller named by the X-Actor header into the request context,
+// so the segment audit can tell who made a change.
+func withActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := r.Header.Get(actorHeader)
+		if actor == "" {
+			actor = anonymousActor
+		}
+		next.ServeHTTP(w, r.WithContext(audit.WithActor(r.Context(), actor)))
+	})
+}
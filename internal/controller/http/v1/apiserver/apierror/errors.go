@@ -11,8 +11,12 @@ import (
 type ErrorResponse struct {
 	Ok      bool   `json:"ok" default:"false"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
 }
 
+// CodeSegmentFull tells the client that the segment has reached its capacity.
+const CodeSegmentFull = "segment_full"
+
 func NewErrorResponse(message string) ErrorResponse {
 	return ErrorResponse{
 		Message: message,
@@ -34,3 +38,17 @@ func WriteErrorMessage(writer io.Writer, message string) (int, error) {
 
 	return writer.Write(buf)
 }
+
+// WriteErrorCode writes the error message together with a machine readable code.
+func WriteErrorCode(writer io.Writer, code string, message string) (int, error) {
+	buf, err := json.Marshal(ErrorResponse{
+		Message: message,
+		Code:    code,
+	})
+
+	if err != nil {
+		return writer.Write([]byte(message))
+	}
+
+	return writer.Write(buf)
+}
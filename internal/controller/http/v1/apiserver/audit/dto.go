@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+)
+
+type GetSegmentAuditResponse struct {
+	Events []AuditEventResponse `json:"events"`
+}
+
+type AuditEventResponse struct {
+	ID          int64                  `json:"id"`
+	SegmentName string                 `json:"segmentName"`
+	Actor       string                 `json:"actor"`
+	Operation   string                 `json:"operation"`
+	Before      map[string]interface{} `json:"before,omitempty"`
+	After       map[string]interface{} `json:"after,omitempty"`
+	Time        time.Time              `json:"time"`
+}
+
+func NewGetSegmentAuditResponse(events []AuditEventResponse) GetSegmentAuditResponse {
+	return GetSegmentAuditResponse{
+		Events: events,
+	}
+}
+
+func NewAuditEventResponse(e audit.Event) AuditEventResponse {
+	return AuditEventResponse{
+		ID:          e.ID,
+		SegmentName: e.Segment,
+		Actor:       e.Actor,
+		Operation:   string(e.Operation),
+		Before:      e.Before,
+		After:       e.After,
+		Time:        e.Time,
+	}
+}
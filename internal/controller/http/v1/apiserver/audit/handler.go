@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	formatJSON string = "json"
+	formatCSV  string = "csv"
+)
+
+type AuditService interface {
+	GetSegmentAudit(ctx context.Context, segmentName string) ([]audit.Event, error)
+}
+
+type BufferPool interface {
+	Get() *bytes.Buffer
+	Release(buf *bytes.Buffer)
+}
+
+type CSVWriter interface {
+	Write(w io.Writer, args []audit.Event) error
+}
+
+type handler struct {
+	writer CSVWriter
+	pool   BufferPool
+	audit  AuditService
+}
+
+func New(audit AuditService, pool BufferPool, writer CSVWriter) *handler {
+	return &handler{
+		pool:   pool,
+		writer: writer,
+		audit:  audit,
+	}
+}
+
+// @Summary Get segment audit
+// @Description Get the mutations of the segment with their actor and before/after values, format=csv downloads them as a csv file
+// @Tags Segments
+// @Accept json
+// @Produce json,text/csv
+// @Param  segmentName   path string  true "Segment name"
+// @Param  format   query string  false "Response format" Enums(json, csv)
+// @Success 200 {object} GetSegmentAuditResponse "Segment audit events"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments/{segmentName}/audit [get]
+func (h *handler) GetSegmentAudit(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "segmentName")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
+	}
+	if format != formatJSON && format != formatCSV {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid format parameter, expected json or csv")
+		return
+	}
+
+	events, err := h.audit.GetSegmentAudit(r.Context(), name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get segment audit")
+		return
+	}
+
+	if len(events) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		apierror.WriteErrorMessage(w, "No audit events were found for the specified segment")
+		return
+	}
+
+	if format == formatCSV {
+		h.writeCSV(w, name, events)
+		return
+	}
+
+	response := make([]AuditEventResponse, len(events))
+	for i, e := range events {
+		response[i] = NewAuditEventResponse(e)
+	}
+
+	jsonResponse, err := json.Marshal(NewGetSegmentAuditResponse(response))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+func (h *handler) writeCSV(w http.ResponseWriter, name string, events []audit.Event) {
+	buffer := h.pool.Get()
+	defer h.pool.Release(buffer)
+
+	if err := h.writer.Write(buffer, events); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Couldn't create a csv file, %s", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=audit-for-%s.csv", name))
+
+	_, err := io.Copy(w, buffer)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Internal Server Error: %v", err))
+		return
+	}
+}
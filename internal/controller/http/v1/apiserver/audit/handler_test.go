@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/audit/mocks"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/VrMolodyakov/segment-api/pkg/csv"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockBufferPool struct {
+}
+
+func (m *mockBufferPool) Get() *bytes.Buffer {
+	return &bytes.Buffer{}
+}
+func (m *mockBufferPool) Release(buf *bytes.Buffer) {}
+
+func AddChiURLParams(r *http.Request, params map[string]string) *http.Request {
+	ctx := chi.NewRouteContext()
+	for k, v := range params {
+		ctx.URLParams.Add(k, v)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+}
+
+func TestGetSegmentAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockAuditService(ctrl)
+	handler := New(mockService, &mockBufferPool{}, nil)
+
+	events := []audit.Event{
+		{
+			ID:        1,
+			SegmentID: 1,
+			Segment:   "seg-1",
+			Actor:     "admin",
+			Operation: audit.Updated,
+			Before:    audit.Values{"owner": "search-team"},
+			After:     audit.Values{"owner": "pricing-team"},
+			Time:      time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	type args struct {
+		format string
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		writerCallMock   func(w io.Writer, args []audit.Event) error
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully get audit as json",
+			mockCall: func() {
+				mockService.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(events, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetSegmentAuditResponse([]AuditEventResponse{NewAuditEventResponse(events[0])}))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should successfully download audit as csv",
+			mockCall: func() {
+				mockService.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(events, nil)
+			},
+			expectedResponse: func() string {
+				return "hello audit"
+			},
+			args: args{
+				format: "csv",
+			},
+			writerCallMock: func(w io.Writer, args []audit.Event) error {
+				_, err := w.Write([]byte("hello audit"))
+				assert.NoError(t, err)
+				return err
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Invalid format parameter",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid format parameter, expected json or csv"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				format: "xml",
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "No audit events",
+			mockCall: func() {
+				mockService.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(nil, nil)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "No audit events were found for the specified segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(nil, errors.New("internal error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get segment audit"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+		{
+			title: "Couldn't create csv data",
+			mockCall: func() {
+				mockService.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(events, nil)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Couldn't create a csv file, error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				format: "csv",
+			},
+			writerCallMock: func(w io.Writer, args []audit.Event) error {
+				return errors.New("error")
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+
+			target := "/"
+			if test.args.format != "" {
+				target += "?format=" + test.args.format
+			}
+			req, err := http.NewRequest(http.MethodGet, target, nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, map[string]string{"segmentName": "seg-1"})
+
+			testCSV := csv.NewCSVWriter[audit.Event](test.writerCallMock)
+			handler.writer = &testCSV
+			handler.GetSegmentAudit(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: internal/controller/http/v1/apiserver/audit/handler.go
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	bytes "bytes"
+	context "context"
+	io "io"
+	reflect "reflect"
+
+	audit "github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockAuditService is a mock of AuditService interface.
+type MockAuditService struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditServiceMockRecorder
+}
+
+// MockAuditServiceMockRecorder is the mock recorder for MockAuditService.
+type MockAuditServiceMockRecorder struct {
+	mock *MockAuditService
+}
+
+// NewMockAuditService creates a new mock instance.
+func NewMockAuditService(ctrl *gomock.Controller) *MockAuditService {
+	mock := &MockAuditService{ctrl: ctrl}
+	mock.recorder = &MockAuditServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuditService) EXPECT() *MockAuditServiceMockRecorder {
+	return m.recorder
+}
+
+// GetSegmentAudit mocks base method.
+func (m *MockAuditService) GetSegmentAudit(ctx context.Context, segmentName string) ([]audit.Event, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentAudit", ctx, segmentName)
+	ret0, _ := ret[0].([]audit.Event)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentAudit indicates an expected call of GetSegmentAudit.
+func (mr *MockAuditServiceMockRecorder) GetSegmentAudit(ctx, segmentName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentAudit", reflect.TypeOf((*MockAuditService)(nil).GetSegmentAudit), ctx, segmentName)
+}
+
+// MockBufferPool is a mock of BufferPool interface.
+type MockBufferPool struct {
+	ctrl     *gomock.Controller
+	recorder *MockBufferPoolMockRecorder
+}
+
+// MockBufferPoolMockRecorder is the mock recorder for MockBufferPool.
+type MockBufferPoolMockRecorder struct {
+	mock *MockBufferPool
+}
+
+// NewMockBufferPool creates a new mock instance.
+func NewMockBufferPool(ctrl *gomock.Controller) *MockBufferPool {
+	mock := &MockBufferPool{ctrl: ctrl}
+	mock.recorder = &MockBufferPoolMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBufferPool) EXPECT() *MockBufferPoolMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockBufferPool) Get() *bytes.Buffer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get")
+	ret0, _ := ret[0].(*bytes.Buffer)
+	return ret0
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockBufferPoolMockRecorder) Get() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockBufferPool)(nil).Get))
+}
+
+// Release mocks base method.
+func (m *MockBufferPool) Release(buf *bytes.Buffer) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Release", buf)
+}
+
+// Release indicates an expected call of Release.
+func (mr *MockBufferPoolMockRecorder) Release(buf interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockBufferPool)(nil).Release), buf)
+}
+
+// MockCSVWriter is a mock of CSVWriter interface.
+type MockCSVWriter struct {
+	ctrl     *gomock.Controller
+	recorder *MockCSVWriterMockRecorder
+}
+
+// MockCSVWriterMockRecorder is the mock recorder for MockCSVWriter.
+type MockCSVWriterMockRecorder struct {
+	mock *MockCSVWriter
+}
+
+// NewMockCSVWriter creates a new mock instance.
+func NewMockCSVWriter(ctrl *gomock.Controller) *MockCSVWriter {
+	mock := &MockCSVWriter{ctrl: ctrl}
+	mock.recorder = &MockCSVWriterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCSVWriter) EXPECT() *MockCSVWriterMockRecorder {
+	return m.recorder
+}
+
+// Write mocks base method.
+func (m *MockCSVWriter) Write(w io.Writer, args []audit.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Write", w, args)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Write indicates an expected call of Write.
+func (mr *MockCSVWriterMockRecorder) Write(w, args interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockCSVWriter)(nil).Write), w, args)
+}
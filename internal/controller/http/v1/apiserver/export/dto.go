@@ -0,0 +1,95 @@
+package export
+
+import (
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/export"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+)
+
+type UserExport struct {
+	Profile     ExportProfile      `json:"profile"`
+	Memberships []ExportMembership `json:"memberships"`
+	History     []ExportEvent      `json:"history"`
+}
+
+type ExportProfile struct {
+	ID          int64                  `json:"userID"`
+	FirstName   string                 `json:"firsName"`
+	LastName    string                 `json:"lastName"`
+	Email       string                 `json:"email"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	ExternalIDs []ExternalIDResponse   `json:"externalIDs,omitempty"`
+}
+
+type ExternalIDResponse struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+}
+
+type ExportMembership struct {
+	SegmentName string    `json:"segmentName"`
+	Variant     string    `json:"variant,omitempty"`
+	ExpiredAt   time.Time `json:"expiredAt"`
+}
+
+type ExportEvent struct {
+	Segment   string    `json:"segment"`
+	Variant   string    `json:"variant,omitempty"`
+	Operation string    `json:"operation"`
+	Time      time.Time `json:"time"`
+}
+
+func NewUserExport(data export.UserData) UserExport {
+	memberships := make([]ExportMembership, len(data.Memberships))
+	for i, m := range data.Memberships {
+		memberships[i] = NewExportMembership(m)
+	}
+	events := make([]ExportEvent, len(data.History))
+	for i, h := range data.History {
+		events[i] = NewExportEvent(h)
+	}
+	return UserExport{
+		Profile:     NewExportProfile(data.User),
+		Memberships: memberships,
+		History:     events,
+	}
+}
+
+func NewExportProfile(u user.User) ExportProfile {
+	attributes := u.Attributes
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	var externalIDs []ExternalIDResponse
+	for _, external := range u.ExternalIDs {
+		externalIDs = append(externalIDs, ExternalIDResponse{Namespace: external.Namespace, ID: external.ID})
+	}
+	return ExportProfile{
+		ID:          u.ID,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Email:       u.Email,
+		Attributes:  attributes,
+		ExternalIDs: externalIDs,
+	}
+}
+
+func NewExportMembership(m membership.MembershipInfo) ExportMembership {
+	return ExportMembership{
+		SegmentName: m.SegmentName,
+		Variant:     m.Variant,
+		ExpiredAt:   m.ExpiredAt,
+	}
+}
+
+func NewExportEvent(h history.History) ExportEvent {
+	return ExportEvent{
+		Segment:   h.Segment,
+		Variant:   h.Variant,
+		Operation: string(h.Operation),
+		Time:      h.Time,
+	}
+}
@@ -0,0 +1,128 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/domain/export"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	jsonFile string = "export.json"
+	csvFile  string = "history.csv"
+)
+
+type ExportService interface {
+	ExportUser(ctx context.Context, userID int64) (export.UserData, error)
+}
+
+type BufferPool interface {
+	Get() *bytes.Buffer
+	Release(buf *bytes.Buffer)
+}
+
+type CSVWriter interface {
+	Write(w io.Writer, args []history.History) error
+}
+
+type handler struct {
+	writer CSVWriter
+	pool   BufferPool
+	export ExportService
+}
+
+func New(export ExportService, pool BufferPool, writer CSVWriter) *handler {
+	return &handler{
+		export: export,
+		pool:   pool,
+		writer: writer,
+	}
+}
+
+// @Summary Export user data
+// @Description Download a zip archive with everything stored about the user: export.json with the profile, current memberships and segment history,
+// @Description and history.csv with the same history, omitted when the user has no history
+// @Tags Users
+// @Produce application/zip
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
+// @Success 200 {file} file "Zip archive"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/{userID}/export [get]
+func (h *handler) ExportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid user id parameter")
+		return
+	}
+
+	data, err := h.export.ExportUser(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "User with the specified id wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Export user error")
+		return
+	}
+
+	buffer := h.pool.Get()
+	defer h.pool.Release(buffer)
+
+	if err := h.writeArchive(buffer, data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Couldn't create an export archive, %s", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=user-%d-export.zip", userID))
+
+	_, err = io.Copy(w, buffer)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Internal Server Error: %v", err))
+		return
+	}
+}
+
+func (h *handler) writeArchive(w io.Writer, data export.UserData) error {
+	archive := zip.NewWriter(w)
+
+	file, err := archive.Create(jsonFile)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(NewUserExport(data)); err != nil {
+		return err
+	}
+
+	if len(data.History) > 0 {
+		file, err = archive.Create(csvFile)
+		if err != nil {
+			return err
+		}
+		if err := h.writer.Write(file, data.History); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,213 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/export/mocks"
+	"github.com/VrMolodyakov/segment-api/internal/domain/export"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/pkg/csv"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockBufferPool struct {
+}
+
+func (m *mockBufferPool) Get() *bytes.Buffer {
+	return &bytes.Buffer{}
+}
+func (m *mockBufferPool) Release(buf *bytes.Buffer) {}
+
+func AddChiURLParams(r *http.Request, params map[string]string) *http.Request {
+	ctx := chi.NewRouteContext()
+	for k, v := range params {
+		ctx.URLParams.Add(k, v)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+}
+
+func readArchive(t *testing.T, body []byte) map[string]string {
+	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.NoError(t, err)
+	files := make(map[string]string, len(reader.File))
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestExportUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockExportService(ctrl)
+	handler := New(mockService, &mockBufferPool{}, nil)
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	data := export.UserData{
+		User:        user.User{ID: 1, FirstName: "Arnold", LastName: "Jones", Email: "t2000@mail.ru"},
+		Memberships: []membership.MembershipInfo{{UserID: 1, SegmentName: "segment1", ExpiredAt: testTime}},
+		History:     []history.History{{ID: 1, UserID: 1, Segment: "segment1", Operation: history.Added, Time: testTime}},
+	}
+	withoutHistory := export.UserData{User: data.User}
+
+	expectedJSON := func(d export.UserData) string {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		assert.NoError(t, encoder.Encode(NewUserExport(d)))
+		return buf.String()
+	}
+
+	type args struct {
+		userID string
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		writerCallMock   func(w io.Writer, args []history.History) error
+		mockCall         func()
+		expectedFiles    func() map[string]string
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully export user data",
+			mockCall: func() {
+				mockService.EXPECT().ExportUser(gomock.Any(), int64(1)).Return(data, nil)
+			},
+			args: args{
+				userID: "1",
+			},
+			writerCallMock: func(w io.Writer, args []history.History) error {
+				_, err := w.Write([]byte("hello history"))
+				return err
+			},
+			expectedFiles: func() map[string]string {
+				return map[string]string{
+					"export.json": expectedJSON(data),
+					"history.csv": "hello history",
+				}
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "User without history gets only json",
+			mockCall: func() {
+				mockService.EXPECT().ExportUser(gomock.Any(), int64(1)).Return(withoutHistory, nil)
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedFiles: func() map[string]string {
+				return map[string]string{
+					"export.json": expectedJSON(withoutHistory),
+				}
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:    "Invalid user id",
+			mockCall: func() {},
+			args: args{
+				userID: "user",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid user id parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockService.EXPECT().ExportUser(gomock.Any(), int64(1)).Return(export.UserData{}, user.ErrUserNotFound)
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User with the specified id wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().ExportUser(gomock.Any(), int64(1)).Return(export.UserData{}, errors.New("service error"))
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Export user error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+		{
+			title: "Couldn't create csv data",
+			mockCall: func() {
+				mockService.EXPECT().ExportUser(gomock.Any(), int64(1)).Return(data, nil)
+			},
+			args: args{
+				userID: "1",
+			},
+			writerCallMock: func(w io.Writer, args []history.History) error {
+				return errors.New("error")
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Couldn't create an export archive, error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, map[string]string{"userID": test.args.userID})
+
+			testCSV := csv.NewCSVWriter[history.History](test.writerCallMock)
+			handler.writer = &testCSV
+			handler.ExportUser(w, req)
+
+			assert.Equal(t, test.exoectedCode, w.Code)
+			if test.expectedFiles != nil {
+				assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+				assert.Equal(t, test.expectedFiles(), readArchive(t, w.Body.Bytes()))
+			} else {
+				assert.Equal(t, test.expectedResponse(), w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: internal/controller/http/v1/apiserver/export/handler.go
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	bytes "bytes"
+	context "context"
+	io "io"
+	reflect "reflect"
+
+	export "github.com/VrMolodyakov/segment-api/internal/domain/export"
+	history "github.com/VrMolodyakov/segment-api/internal/domain/history"
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockExportService is a mock of ExportService interface.
+type MockExportService struct {
+	ctrl     *gomock.Controller
+	recorder *MockExportServiceMockRecorder
+}
+
+// MockExportServiceMockRecorder is the mock recorder for MockExportService.
+type MockExportServiceMockRecorder struct {
+	mock *MockExportService
+}
+
+// NewMockExportService creates a new mock instance.
+func NewMockExportService(ctrl *gomock.Controller) *MockExportService {
+	mock := &MockExportService{ctrl: ctrl}
+	mock.recorder = &MockExportServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockExportService) EXPECT() *MockExportServiceMockRecorder {
+	return m.recorder
+}
+
+// ExportUser mocks base method.
+func (m *MockExportService) ExportUser(ctx context.Context, userID int64) (export.UserData, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportUser", ctx, userID)
+	ret0, _ := ret[0].(export.UserData)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportUser indicates an expected call of ExportUser.
+func (mr *MockExportServiceMockRecorder) ExportUser(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportUser", reflect.TypeOf((*MockExportService)(nil).ExportUser), ctx, userID)
+}
+
+// MockBufferPool is a mock of BufferPool interface.
+type MockBufferPool struct {
+	ctrl     *gomock.Controller
+	recorder *MockBufferPoolMockRecorder
+}
+
+// MockBufferPoolMockRecorder is the mock recorder for MockBufferPool.
+type MockBufferPoolMockRecorder struct {
+	mock *MockBufferPool
+}
+
+// NewMockBufferPool creates a new mock instance.
+func NewMockBufferPool(ctrl *gomock.Controller) *MockBufferPool {
+	mock := &MockBufferPool{ctrl: ctrl}
+	mock.recorder = &MockBufferPoolMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBufferPool) EXPECT() *MockBufferPoolMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockBufferPool) Get() *bytes.Buffer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get")
+	ret0, _ := ret[0].(*bytes.Buffer)
+	return ret0
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockBufferPoolMockRecorder) Get() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockBufferPool)(nil).Get))
+}
+
+// Release mocks base method.
+func (m *MockBufferPool) Release(buf *bytes.Buffer) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Release", buf)
+}
+
+// Release indicates an expected call of Release.
+func (mr *MockBufferPoolMockRecorder) Release(buf interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockBufferPool)(nil).Release), buf)
+}
+
+// MockCSVWriter is a mock of CSVWriter interface.
+type MockCSVWriter struct {
+	ctrl     *gomock.Controller
+	recorder *MockCSVWriterMockRecorder
+}
+
+// MockCSVWriterMockRecorder is the mock recorder for MockCSVWriter.
+type MockCSVWriterMockRecorder struct {
+	mock *MockCSVWriter
+}
+
+// NewMockCSVWriter creates a new mock instance.
+func NewMockCSVWriter(ctrl *gomock.Controller) *MockCSVWriter {
+	mock := &MockCSVWriter{ctrl: ctrl}
+	mock.recorder = &MockCSVWriterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCSVWriter) EXPECT() *MockCSVWriterMockRecorder {
+	return m.recorder
+}
+
+// Write mocks base method.
+func (m *MockCSVWriter) Write(w io.Writer, args []history.History) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Write", w, args)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Write indicates an expected call of Write.
+func (mr *MockCSVWriterMockRecorder) Write(w, args interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockCSVWriter)(nil).Write), w, args)
+}
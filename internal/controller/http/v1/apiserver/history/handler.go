@@ -123,7 +123,7 @@ func (h *handler) CreateLink(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Download history
-// @Description Download history
+// @Description Download history, the columns after Time hold the current values of the user attributes, not the values at the time of the event
 // @Tags History
 // @Accept json
 // @Param  year   path int  true "Year"
@@ -3,6 +3,7 @@ package membership
 import (
 	"time"
 
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	"github.com/VrMolodyakov/segment-api/internal/domain/user"
 )
@@ -12,9 +13,42 @@ var (
 )
 
 type CreateUserRequest struct {
-	FirstName string `json:"firsName" validate:"required,min=3"`
-	LastName  string `json:"lastName" validate:"required,min=3"`
-	Email     string `json:"email" validate:"required,min=5"`
+	FirstName   string                 `json:"firsName" validate:"required,min=3"`
+	LastName    string                 `json:"lastName" validate:"required,min=3"`
+	Email       string                 `json:"email" validate:"required,min=5"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	ExternalIDs []ExternalIDRequest    `json:"externalIDs" validate:"omitempty,dive"`
+}
+
+// ExternalIDRequest is an id the user is known by in an upstream system, several ids may share a namespace.
+type ExternalIDRequest struct {
+	Namespace string `json:"namespace" validate:"required,max=64"`
+	ID        string `json:"id" validate:"required,max=255"`
+}
+
+// ImportUserRequest is a single record of the users import, external ids can't be imported.
+type ImportUserRequest struct {
+	FirstName  string                 `json:"firsName" validate:"required,min=3"`
+	LastName   string                 `json:"lastName" validate:"required,min=3"`
+	Email      string                 `json:"email" validate:"required,min=5"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// ImportUsersResponse is the import report, Error is set when the import stopped before the end.
+type ImportUsersResponse struct {
+	Created   int                 `json:"created"`
+	Duplicate int                 `json:"duplicate"`
+	Invalid   int                 `json:"invalid"`
+	Failed    int                 `json:"failed"`
+	Rows      []ImportRowResponse `json:"rows"`
+	Error     string              `json:"error,omitempty"`
+}
+
+type ImportRowResponse struct {
+	Row    int    `json:"row"`
+	Status string `json:"status"`
+	UserID int64  `json:"userID,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type CreateUserResponse struct {
@@ -24,15 +58,23 @@ type CreateUserResponse struct {
 	Email     string `json:"email"`
 }
 
+// UpdateUserRequest addresses the user either by userID or by externalID. With upsert the added segments
+// the user already has get a new expiration according to the policy.
 type UpdateUserRequest struct {
-	UserID int64           `json:"userID" validate:"required,gt=0"`
-	Update []UpdateSegment `json:"update" validate:"dive"`
-	Delete []DeleteSegment `json:"delete"`
+	UserID     int64              `json:"userID" validate:"required_without=ExternalID,excluded_with=ExternalID,omitempty,gt=0"`
+	ExternalID *ExternalIDRequest `json:"externalID"`
+	Update     []UpdateSegment    `json:"update" validate:"dive"`
+	Delete     []DeleteSegment    `json:"delete"`
+	Upsert     string             `json:"upsert" validate:"omitempty,oneof=replace extend max"`
 }
 
+// UpdateSegment expires either after ttl seconds or at expiresAt, a segment with startsAt
+// stays invisible until it starts and the ttl is counted from the start.
 type UpdateSegment struct {
-	Name string `json:"name" validate:"required,min=6"`
-	TTL  int    `json:"ttl"`
+	Name      string     `json:"name" validate:"required,min=6"`
+	TTL       int        `json:"ttl"`
+	ExpiresAt *time.Time `json:"expiresAt" validate:"excluded_with=TTL"`
+	StartsAt  *time.Time `json:"startsAt"`
 }
 
 type DeleteSegment struct {
@@ -43,25 +85,86 @@ type DeleteSegmentRequest struct {
 	Name string `json:"name" validate:"required,min=6"`
 }
 
+type UpdateSegmentRequest struct {
+	HitPercentage *int                   `json:"hitPercentage" validate:"omitempty,gte=0,lte=100"`
+	Description   *string                `json:"description" validate:"omitempty,max=1024"`
+	Owner         *string                `json:"owner" validate:"omitempty,max=255"`
+	Tags          []string               `json:"tags" validate:"omitempty,unique,dive,required,max=64"`
+	Attributes    map[string]interface{} `json:"attributes"`
+}
+
+func (u UpdateSegmentRequest) ToModel() segment.Update {
+	update := segment.Update{
+		Description: u.Description,
+		Owner:       u.Owner,
+		Tags:        u.Tags,
+		Attributes:  u.Attributes,
+	}
+	if u.HitPercentage != nil {
+		percentage := maxPercentage - *u.HitPercentage
+		update.AutomaticPercentage = &percentage
+	}
+	return update
+}
+
+type SetRampRequest struct {
+	Steps []RampStep `json:"steps" validate:"required,min=1,dive"`
+}
+
+// RampStep sets the hit percentage once After, a duration like "24h", has passed since the ramp was set.
+type RampStep struct {
+	HitPercentage int    `json:"hitPercentage" validate:"gte=0,lte=100"`
+	After         string `json:"after" validate:"required"`
+}
+
+func (s SetRampRequest) ToModel() ([]segment.RampStep, error) {
+	steps := make([]segment.RampStep, len(s.Steps))
+	for i := range s.Steps {
+		after, err := time.ParseDuration(s.Steps[i].After)
+		if err != nil {
+			return nil, err
+		}
+		steps[i] = segment.NewRampStep(maxPercentage-s.Steps[i].HitPercentage, after)
+	}
+	return steps, nil
+}
+
+type PauseRampRequest struct {
+	Paused *bool `json:"paused" validate:"required"`
+}
+
 type GetUserMembershipResponse struct {
 	Memberships []UserResponseInfo `json:"memberships"`
 }
 
+type BatchGetMembershipRequest struct {
+	UserIDs []int64 `json:"userIDs" validate:"required,min=1,max=100,unique,dive,gt=0"`
+}
+
+// BatchGetMembershipResponse maps every requested user id to its active segments.
+type BatchGetMembershipResponse struct {
+	Memberships map[int64][]UserResponseInfo `json:"memberships"`
+}
+
 type UserResponseInfo struct {
 	UserID      int64     `json:"userID"`
 	SegmentName string    `json:"segmentName"`
+	Variant     string    `json:"variant,omitempty"`
 	ExpiredAt   time.Time `json:"expiredAt"`
 }
 
 func (u UpdateSegment) ToModel() segment.Segment {
-	var expired time.Time
-	if u.TTL > 0 {
-		expired = time.Now().Add(time.Second * time.Duration(u.TTL))
+	s := segment.Segment{
+		Name: u.Name,
+		TTL:  time.Second * time.Duration(u.TTL),
+	}
+	if u.ExpiresAt != nil {
+		s.ExpiredAt = *u.ExpiresAt
 	}
-	return segment.Segment{
-		Name:      u.Name,
-		ExpiredAt: expired,
+	if u.StartsAt != nil {
+		s.StartsAt = *u.StartsAt
 	}
+	return s
 }
 
 func NewUserMembershipResponse(info []UserResponseInfo) GetUserMembershipResponse {
@@ -70,10 +173,25 @@ func NewUserMembershipResponse(info []UserResponseInfo) GetUserMembershipRespons
 	}
 }
 
-func NewUserResponseInfo(id int64, segment string, expiredAt time.Time) UserResponseInfo {
+func NewBatchGetMembershipResponse(memberships map[int64][]membership.MembershipInfo) BatchGetMembershipResponse {
+	response := make(map[int64][]UserResponseInfo, len(memberships))
+	for userID, data := range memberships {
+		info := make([]UserResponseInfo, len(data))
+		for i, d := range data {
+			info[i] = NewUserResponseInfo(d.UserID, d.SegmentName, d.Variant, d.ExpiredAt)
+		}
+		response[userID] = info
+	}
+	return BatchGetMembershipResponse{
+		Memberships: response,
+	}
+}
+
+func NewUserResponseInfo(id int64, segment string, variant string, expiredAt time.Time) UserResponseInfo {
 	return UserResponseInfo{
 		UserID:      id,
 		SegmentName: segment,
+		Variant:     variant,
 		ExpiredAt:   expiredAt.In(location),
 	}
 }
@@ -95,13 +213,23 @@ func (u UpdateUserRequest) GetDeletedSegments() []string {
 }
 
 func (c CreateUserRequest) ToModel() user.User {
+	var externalIDs []user.ExternalID
+	for _, external := range c.ExternalIDs {
+		externalIDs = append(externalIDs, external.ToModel())
+	}
 	return user.User{
-		FirstName: c.FirstName,
-		LastName:  c.LastName,
-		Email:     c.Email,
+		FirstName:   c.FirstName,
+		LastName:    c.LastName,
+		Email:       c.Email,
+		Attributes:  c.Attributes,
+		ExternalIDs: externalIDs,
 	}
 }
 
+func (e ExternalIDRequest) ToModel() user.ExternalID {
+	return user.NewExternalID(e.Namespace, e.ID)
+}
+
 func NewCreateUserResponse(id int64, firstName string, lastName string, email string) CreateUserResponse {
 	return CreateUserResponse{
 		ID:        id,
@@ -110,3 +238,55 @@ func NewCreateUserResponse(id int64, firstName string, lastName string, email st
 		Email:     email,
 	}
 }
+
+func (i ImportUserRequest) ToModel() user.User {
+	return user.User{
+		FirstName:  i.FirstName,
+		LastName:   i.LastName,
+		Email:      i.Email,
+		Attributes: i.Attributes,
+	}
+}
+
+func NewImportUsersResponse(report membership.ImportReport) ImportUsersResponse {
+	rows := make([]ImportRowResponse, len(report.Rows))
+	for i, row := range report.Rows {
+		rows[i] = ImportRowResponse{
+			Row:    row.Row,
+			Status: string(row.Status),
+			UserID: row.UserID,
+			Reason: row.Reason,
+		}
+	}
+	return ImportUsersResponse{
+		Created:   report.Count(membership.ImportCreated),
+		Duplicate: report.Count(membership.ImportDuplicate),
+		Invalid:   report.Count(membership.ImportInvalid),
+		Failed:    report.Count(membership.ImportFailed),
+		Rows:      rows,
+	}
+}
+
+type DeletePreviewResponse struct {
+	Segment           string  `json:"segment"`
+	AffectedUsers     int64   `json:"affectedUsers"`
+	ManualUsers       int64   `json:"manualUsers"`
+	AutomaticUsers    int64   `json:"automaticUsers"`
+	SampleUserIDs     []int64 `json:"sampleUserIDs"`
+	ConfirmationToken string  `json:"confirmationToken"`
+}
+
+func NewDeletePreviewResponse(preview membership.DeletePreview) DeletePreviewResponse {
+	sample := preview.Sample
+	if sample == nil {
+		sample = []int64{}
+	}
+	return DeletePreviewResponse{
+		Segment:           preview.Segment.Name,
+		AffectedUsers:     preview.Affected(),
+		ManualUsers:       preview.Manual,
+		AutomaticUsers:    preview.Automatic,
+		SampleUserIDs:     sample,
+		ConfirmationToken: preview.Token,
+	}
+}
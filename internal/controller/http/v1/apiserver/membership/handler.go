@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/validator"
@@ -18,18 +20,43 @@ import (
 
 type MembershipService interface {
 	CreateUser(ctx context.Context, user user.User) (int64, error)
-	DeleteMembership(ctx context.Context, segmentName string) error
+	ImportUsers(ctx context.Context, source membership.UserSource) (membership.ImportReport, error)
+	EraseUser(ctx context.Context, userID int64) error
+	PreviewSegmentDeletion(ctx context.Context, segmentName string) (membership.DeletePreview, error)
+	ArchiveSegment(ctx context.Context, segmentName string, token string) error
+	RestoreSegment(ctx context.Context, segmentName string) error
+	UpdateSegment(ctx context.Context, segmentName string, update segment.Update) error
+	SetRamp(ctx context.Context, segmentName string, steps []segment.RampStep) error
+	PauseRamp(ctx context.Context, segmentName string, paused bool) error
 	GetUserMembership(ctx context.Context, userID int64) ([]membership.MembershipInfo, error)
-	UpdateUserMembership(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string) error
+	CheckUserMembership(ctx context.Context, userID int64, segmentName string) (membership.MembershipInfo, error)
+	GetUsersMembership(ctx context.Context, userIDs []int64) (map[int64][]membership.MembershipInfo, error)
+	UpdateUserMembership(
+		ctx context.Context,
+		userID int64,
+		addSegments []segment.Segment,
+		deleteSegments []string,
+		policy membership.UpsertPolicy,
+	) error
 }
 
+type UserResolver interface {
+	ResolveUser(ctx context.Context, ref string) (int64, error)
+}
+
+const (
+	maxPercentage int = 100
+)
+
 type handler struct {
 	membership MembershipService
+	users      UserResolver
 }
 
-func New(membership MembershipService) *handler {
+func New(membership MembershipService, users UserResolver) *handler {
 	return &handler{
 		membership: membership,
+		users:      users,
 	}
 }
 
@@ -63,15 +90,28 @@ func (h *handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	newUser := userReq.ToModel()
 	id, err := h.membership.CreateUser(r.Context(), newUser)
 	if err != nil {
+		var attributeErr *user.AttributeError
 		switch {
+		case errors.As(err, &attributeErr):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid attributes: %s", attributeErr.Error()))
+			return
 		case errors.Is(err, user.ErrInvalidEmail):
 			w.WriteHeader(http.StatusBadRequest)
 			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid email: %s", err.Error()))
 			return
+		case errors.Is(err, user.ErrInvalidExternalID):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid external id: %s", err.Error()))
+			return
 		case errors.Is(err, user.ErrUserAlreadyExist):
 			w.WriteHeader(http.StatusConflict)
 			apierror.WriteErrorMessage(w, "User already exists")
 			return
+		case errors.Is(err, user.ErrExternalIDAlreadyExist):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorMessage(w, "External id is already used by another user")
+			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		apierror.WriteErrorMessage(w, "Create user error")
@@ -89,8 +129,95 @@ func (h *handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResponse)
 }
 
+// @Summary Import users
+// @Description Create users from a csv or ndjson body in batches, automatic segments are assigned as on user creation.
+// @Description The csv has a header with the firsName, lastName, email and optional attributes columns, attributes are a json object.
+// @Description The ndjson has a create user request without external ids on every line.
+// @Description A malformed record (400) or an internal error (500) stops the import, the batches created before it stay
+// @Description and the response is the report of the rows read so far with the error, rows that weren't saved are failed.
+// @Tags Users
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Produce json
+// @Param users body string true "Users csv or ndjson"
+// @Success 200 {object} ImportUsersResponse "Per row import report"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 415 {object} apierror.ErrorResponse
+// @Failure 500 {object} ImportUsersResponse "Report of the rows read before the error"
+// @Router /users/import [post]
+func (h *handler) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	source, err := newUserSource(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		if errors.Is(err, errUnsupportedContentType) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Unsupported content type, expected %s or %s", csvContentType, ndjsonContentType))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid import: %s", err.Error()))
+		return
+	}
+
+	report, err := h.membership.ImportUsers(r.Context(), source)
+	response := NewImportUsersResponse(report)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		response.Error = "Import users error"
+		if errors.Is(err, membership.ErrMalformedImport) {
+			status = http.StatusBadRequest
+			response.Error = fmt.Sprintf("Invalid import: %s", err.Error())
+		}
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// @Summary Erase user
+// @Description Delete the user with its memberships, the segment history of the user is kept under an anonymous id
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
+// @Success 200
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/{userID} [delete]
+func (h *handler) EraseUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid user id parameter")
+		return
+	}
+
+	err = h.membership.EraseUser(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "User with the specified id wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Erase user error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 // @Summary Update user segments
-// @Description Update user segments
+// @Description Update user segments, the user is addressed either by userID or by externalID
 // @Tags Membership
 // @Accept json
 // @Produce json
@@ -99,6 +226,7 @@ func (h *handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {object} apierror.ErrorResponse
 // @Failure 404 {object} apierror.ErrorResponse
 // @Failure 409 {object} apierror.ErrorResponse
+// @Failure 422 {object} apierror.ErrorResponse
 // @Failure 500 {object} apierror.ErrorResponse
 // @Router /membership/update [post]
 func (h *handler) UpdateUserMembership(w http.ResponseWriter, r *http.Request) {
@@ -117,19 +245,59 @@ func (h *handler) UpdateUserMembership(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.membership.UpdateUserMembership(
-		r.Context(),
-		updateReq.UserID,
-		updateReq.GetUpdatedSegments(),
-		updateReq.GetDeletedSegments(),
-	)
+	userID := updateReq.UserID
+	var err error
+	if updateReq.ExternalID != nil {
+		userID, err = h.users.ResolveUser(r.Context(), updateReq.ExternalID.ToModel().String())
+	}
+	if err == nil {
+		err = h.membership.UpdateUserMembership(
+			r.Context(),
+			userID,
+			updateReq.GetUpdatedSegments(),
+			updateReq.GetDeletedSegments(),
+			membership.UpsertPolicy(updateReq.Upsert),
+		)
+	}
 
 	if err != nil {
+		var layerErr *membership.LayerConflictError
+		var missingErr *membership.MissingPrerequisiteError
+		var dependentErr *membership.DependentSegmentError
+		var fullErr *membership.SegmentFullError
 		switch {
 		case errors.Is(err, segment.ErrSegmentNotFound):
 			w.WriteHeader(http.StatusNotFound)
 			apierror.WriteErrorMessage(w, "Not all segments with the specified names were found or adding/removing one segment multiple times")
 			return
+		case errors.As(err, &layerErr):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			apierror.WriteErrorMessage(w, "Attempt to add more than one segment of the same layer to the user")
+			return
+		case errors.As(err, &missingErr):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			apierror.WriteErrorMessage(w, fmt.Sprintf(
+				"Segment %s requires segments the user doesn't have: %s",
+				missingErr.Segment,
+				strings.Join(missingErr.Prerequisites, ", "),
+			))
+			return
+		case errors.As(err, &dependentErr):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorMessage(w, fmt.Sprintf(
+				"Segment %s is required by the user segments: %s",
+				dependentErr.Segment,
+				strings.Join(dependentErr.Dependents, ", "),
+			))
+			return
+		case errors.As(err, &fullErr):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorCode(w, apierror.CodeSegmentFull, fmt.Sprintf(
+				"Segment %s is full, its capacity is %d",
+				fullErr.Segment,
+				fullErr.Capacity,
+			))
+			return
 		case errors.Is(err, membership.ErrSegmentAlreadyAssigned):
 			w.WriteHeader(http.StatusConflict)
 			apierror.WriteErrorMessage(w, "Attempt to add segments that the user already belongs to")
@@ -138,6 +306,10 @@ func (h *handler) UpdateUserMembership(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 			apierror.WriteErrorMessage(w, "Attempt to update the data of a non-existent user")
 			return
+		case errors.Is(err, user.ErrInvalidRef):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid external id: %s", err.Error()))
+			return
 		case errors.Is(err, membership.ErrEmptyData):
 			w.WriteHeader(http.StatusBadRequest)
 			apierror.WriteErrorMessage(w, "Data for update and delete cannot be empty at the same time")
@@ -146,6 +318,10 @@ func (h *handler) UpdateUserMembership(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			apierror.WriteErrorMessage(w, "Attempt to add and remove the same segment")
 			return
+		case errors.Is(err, membership.ErrInvalidSchedule):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Segment expiration has passed or is before its start")
+			return
 		case errors.Is(err, membership.ErrSegmentNotAssigned):
 			w.WriteHeader(http.StatusConflict)
 			apierror.WriteErrorMessage(w, "Attempt to delete a segment unassigned to the user")
@@ -161,25 +337,55 @@ func (h *handler) UpdateUserMembership(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// @Summary Delete segment
-// @Description Delete segment
+// @Summary Archive segment
+// @Description Archive segment, its members are hidden until the segment is restored or purged after the grace period.
+// @Description With dryRun=true nothing is changed and the deletion impact with a confirmation token is returned,
+// @Description the token must be passed in confirmationToken to perform the deletion.
 // @Tags Segments
 // @Accept json
 // @Produce json
-// @Param  segmentName   path string  true "Segment name"
-// @Success 200
+// @Param  segmentName        path  string true  "Segment name"
+// @Param  dryRun             query bool   false "Only preview the deletion"
+// @Param  confirmationToken  query string false "Token from the deletion preview"
+// @Success 200 {object} DeletePreviewResponse "Deletion preview, returned only for dryRun"
+// @Failure 400 {object} apierror.ErrorResponse
 // @Failure 404 {object} apierror.ErrorResponse
+// @Failure 409 {object} apierror.ErrorResponse
+// @Failure 428 {object} apierror.ErrorResponse
 // @Failure 500 {object} apierror.ErrorResponse
 // @Router /segments/{segmentName} [delete]
-func (h *handler) DeleteMembership(w http.ResponseWriter, r *http.Request) {
+func (h *handler) ArchiveSegment(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "segmentName")
-	err := h.membership.DeleteMembership(r.Context(), name)
+	query := r.URL.Query()
+
+	if dryRun := query.Get("dryRun"); dryRun != "" {
+		preview, err := strconv.ParseBool(dryRun)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid dryRun parameter")
+			return
+		}
+		if preview {
+			h.previewDeletion(w, r, name)
+			return
+		}
+	}
+
+	err := h.membership.ArchiveSegment(r.Context(), name, query.Get("confirmationToken"))
 	if err != nil {
 		switch {
 		case errors.Is(err, segment.ErrSegmentNotFound):
 			w.WriteHeader(http.StatusNotFound)
 			apierror.WriteErrorMessage(w, "Segment with the specified name wasn't found")
 			return
+		case errors.Is(err, membership.ErrConfirmationRequired):
+			w.WriteHeader(http.StatusPreconditionRequired)
+			apierror.WriteErrorMessage(w, "Confirmation token from the dry run is required")
+			return
+		case errors.Is(err, membership.ErrConfirmationMismatch):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorMessage(w, "Confirmation token is invalid or outdated, repeat the dry run")
+			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		apierror.WriteErrorMessage(w, "Delete segment")
@@ -190,12 +396,236 @@ func (h *handler) DeleteMembership(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *handler) previewDeletion(w http.ResponseWriter, r *http.Request, name string) {
+	preview, err := h.membership.PreviewSegmentDeletion(r.Context(), name)
+	if err != nil {
+		switch {
+		case errors.Is(err, segment.ErrSegmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Segment with the specified name wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Preview segment deletion")
+		return
+	}
+
+	jsonResponse, err := json.Marshal(NewDeletePreviewResponse(preview))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// @Summary Restore segment
+// @Description Restore archived segment together with its members within the grace period
+// @Tags Segments
+// @Accept json
+// @Produce json
+// @Param  segmentName   path string  true "Segment name"
+// @Success 200
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 410 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments/{segmentName}/restore [post]
+func (h *handler) RestoreSegment(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "segmentName")
+	err := h.membership.RestoreSegment(r.Context(), name)
+	if err != nil {
+		switch {
+		case errors.Is(err, segment.ErrSegmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Archived segment with the specified name wasn't found")
+			return
+		case errors.Is(err, segment.ErrGracePeriodExpired):
+			w.WriteHeader(http.StatusGone)
+			apierror.WriteErrorMessage(w, "Segment grace period has expired")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Restore segment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Summary Update segment
+// @Description Update segment metadata and automatic hit percentage, members are reconciled when the percentage changes
+// @Tags Segments
+// @Accept json
+// @Produce json
+// @Param  segmentName   path string  true "Segment name"
+// @Param updateReq body UpdateSegmentRequest true "Update segment request"
+// @Success 200
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments/{segmentName} [patch]
+func (h *handler) UpdateSegment(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "segmentName")
+	var updateReq UpdateSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(updateReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	err := h.membership.UpdateSegment(r.Context(), name, updateReq.ToModel())
+	if err != nil {
+		switch {
+		case errors.Is(err, segment.ErrNothingToUpdate):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "At least one segment field must be specified for update")
+			return
+		case errors.Is(err, segment.ErrRuleWithPercentage):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Rule based segment can't have hitPercentage")
+			return
+		case errors.Is(err, segment.ErrSegmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Segment with the specified name wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Update segment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Summary Set segment ramp
+// @Description Replace the ramp schedule of the segment, every step sets the hit percentage once its delay has passed
+// @Tags Segments
+// @Accept json
+// @Produce json
+// @Param  segmentName   path string  true "Segment name"
+// @Param rampReq body SetRampRequest true "Set ramp request"
+// @Success 200
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments/{segmentName}/ramp [put]
+func (h *handler) SetRamp(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "segmentName")
+	var rampReq SetRampRequest
+	if err := json.NewDecoder(r.Body).Decode(&rampReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(rampReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	steps, err := rampReq.ToModel()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid step delay: %s", err.Error()))
+		return
+	}
+
+	err = h.membership.SetRamp(r.Context(), name, steps)
+	if err != nil {
+		switch {
+		case errors.Is(err, segment.ErrInvalidRamp):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Ramp step delays must be non-negative and strictly increasing")
+			return
+		case errors.Is(err, segment.ErrRuleWithPercentage):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Rule based segment can't have hitPercentage")
+			return
+		case errors.Is(err, segment.ErrSegmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Segment with the specified name wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Set segment ramp")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Summary Pause segment ramp
+// @Description Pause or resume the ramp of the segment, pending steps are postponed by the paused time
+// @Tags Segments
+// @Accept json
+// @Produce json
+// @Param  segmentName   path string  true "Segment name"
+// @Param pauseReq body PauseRampRequest true "Pause ramp request"
+// @Success 200
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments/{segmentName}/ramp [patch]
+func (h *handler) PauseRamp(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "segmentName")
+	var pauseReq PauseRampRequest
+	if err := json.NewDecoder(r.Body).Decode(&pauseReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(pauseReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	err := h.membership.PauseRamp(r.Context(), name, *pauseReq.Paused)
+	if err != nil {
+		switch {
+		case errors.Is(err, segment.ErrSegmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Segment with the specified name wasn't found")
+			return
+		case errors.Is(err, segment.ErrRampNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "Segment has no ramp")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Pause segment ramp")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 // @Summary Get user segments
 // @Description Get user segments
 // @Tags Users
 // @Accept json
 // @Produce json
-// @Param  userID   path int  true "User id"
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
 // @Success 200 {object} GetUserMembershipResponse "User segment info"
 // @Failure 400 {object} apierror.ErrorResponse
 // @Failure 404 {object} apierror.ErrorResponse
@@ -225,7 +655,7 @@ func (h *handler) GetUserMembership(w http.ResponseWriter, r *http.Request) {
 
 	response := make([]UserResponseInfo, len(data))
 	for i, d := range data {
-		response[i] = NewUserResponseInfo(d.UserID, d.SegmentName, d.ExpiredAt)
+		response[i] = NewUserResponseInfo(d.UserID, d.SegmentName, d.Variant, d.ExpiredAt)
 	}
 
 	jsonResponse, err := json.Marshal(NewUserMembershipResponse(response))
@@ -238,3 +668,100 @@ func (h *handler) GetUserMembership(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonResponse)
 }
+
+// @Summary Get segments of several users
+// @Description Get active segments of up to 100 users, every requested user is present in the response, users without segments get an empty list
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param batchReq body BatchGetMembershipRequest true "User ids"
+// @Success 200 {object} BatchGetMembershipResponse
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/segments:batchGet [post]
+func (h *handler) BatchGetUserMembership(w http.ResponseWriter, r *http.Request) {
+	var batchReq BatchGetMembershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(batchReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	data, err := h.membership.GetUsersMembership(r.Context(), batchReq.UserIDs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get users membership segment")
+		return
+	}
+
+	jsonResponse, err := json.Marshal(NewBatchGetMembershipResponse(data))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// @Summary Check user segment
+// @Description Check whether the user is in the segment, HEAD returns only the status and the X-Expired-At header
+// @Tags Users
+// @Produce json
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
+// @Param  segmentName   path string  true "Segment name"
+// @Success 200 {object} UserResponseInfo
+// @Header 200 {string} X-Expired-At "Expiration time of the membership"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/{userID}/segments/{segmentName} [get]
+// @Router /users/{userID}/segments/{segmentName} [head]
+func (h *handler) CheckUserMembership(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "userID")
+	segmentName := chi.URLParam(r, "segmentName")
+
+	userID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid user id parameter")
+		return
+	}
+	info, err := h.membership.CheckUserMembership(r.Context(), userID, segmentName)
+	if err != nil {
+		if errors.Is(err, membership.ErrSegmentNotAssigned) {
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "User isn't in the segment")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Check user membership error")
+		return
+	}
+
+	response := NewUserResponseInfo(info.UserID, info.SegmentName, info.Variant, info.ExpiredAt)
+	w.Header().Set("X-Expired-At", response.ExpiredAt.Format(time.RFC3339))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
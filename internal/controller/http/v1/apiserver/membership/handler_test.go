@@ -5,9 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership/mocks"
@@ -33,7 +37,7 @@ func TestCreateUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockService := mocks.NewMockMembershipService(ctrl)
-	handler := New(mockService)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
 
 	userID := int64(1)
 	emptyID := int64(0)
@@ -127,6 +131,47 @@ func TestCreateUser(t *testing.T) {
 			},
 			exoectedCode: 409,
 		},
+		{
+			title: "Attribute has another type",
+			mockCall: func() {
+				mockService.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(emptyID, &user.AttributeError{Name: "age", Expected: user.AttributeNumber})
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: `Invalid attributes: attribute "age" must be a number`})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				CreateUserRequest{FirstName: "Bob", LastName: "Bob", Email: "email@email.com", Attributes: map[string]interface{}{"age": "31"}},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "External id already used",
+			mockCall: func() {
+				withExternalIDs := user.User{
+					FirstName:   "Bob",
+					LastName:    "Bob",
+					Email:       "email@email.com",
+					ExternalIDs: []user.ExternalID{user.NewExternalID("crm", "a-17")},
+				}
+				mockService.EXPECT().CreateUser(gomock.Any(), withExternalIDs).Return(emptyID, user.ErrExternalIDAlreadyExist)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "External id is already used by another user"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				CreateUserRequest{
+					FirstName:   "Bob",
+					LastName:    "Bob",
+					Email:       "email@email.com",
+					ExternalIDs: []ExternalIDRequest{{Namespace: "crm", ID: "a-17"}},
+				},
+			},
+			exoectedCode: 409,
+		},
 		{
 			title: "Error while creating new user",
 			mockCall: func() {
@@ -160,13 +205,280 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+// drain reads the whole source, an invalid record is kept as its reason.
+func drain(t *testing.T, source membership.UserSource) []interface{} {
+	var records []interface{}
+	for {
+		u, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			return records
+		}
+		var rowErr *membership.InvalidRowError
+		if errors.As(err, &rowErr) {
+			records = append(records, rowErr.Reason)
+			continue
+		}
+		assert.NoError(t, err)
+		records = append(records, u)
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	report := membership.ImportReport{Rows: []membership.ImportRow{
+		{Row: 1, Status: membership.ImportCreated, UserID: 1},
+		{Row: 2, Status: membership.ImportInvalid, Reason: "invalid json"},
+		{Row: 3, Status: membership.ImportDuplicate, Reason: user.ErrUserAlreadyExist.Error()},
+	}}
+	failed := membership.ImportReport{Rows: []membership.ImportRow{
+		{Row: 1, Status: membership.ImportCreated, UserID: 1},
+		{Row: 2, Status: membership.ImportFailed, Reason: "import stopped before the row was saved"},
+	}}
+	errorResponse := func(message string) func() string {
+		return func() string {
+			resp, err := json.Marshal(apierror.ErrorResponse{Message: message})
+			assert.NoError(t, err)
+			return string(resp)
+		}
+	}
+
+	tests := []struct {
+		title            string
+		contentType      string
+		body             string
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title:       "Should import users from csv",
+			contentType: "text/csv; charset=utf-8",
+			body: "email,firsName,lastName,attributes\n" +
+				"bob@email.com,Bob,Smith,\"{\"\"country\"\": \"\"RU\"\"}\"\n" +
+				"ann@email.com,An,Smith,\n" +
+				"kim@email.com,Kim,Smith,{country}\n" +
+				"joe@email.com,Joe,Smith\n",
+			mockCall: func() {
+				mockService.EXPECT().ImportUsers(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, source membership.UserSource) (membership.ImportReport, error) {
+						records := drain(t, source)
+						assert.Len(t, records, 4)
+						assert.Equal(t, user.User{
+							FirstName:  "Bob",
+							LastName:   "Smith",
+							Email:      "bob@email.com",
+							Attributes: map[string]interface{}{"country": "RU"},
+						}, records[0])
+						assert.Equal(t, `[{"field":"FirstName","tag":"min","param":"3"}]`, records[1])
+						assert.Contains(t, records[2], "invalid attributes")
+						assert.Equal(t, user.User{FirstName: "Joe", LastName: "Smith", Email: "joe@email.com"}, records[3])
+						return report, nil
+					})
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewImportUsersResponse(report))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:       "Should import users from ndjson",
+			contentType: "application/x-ndjson",
+			body: `{"firsName":"Bob","lastName":"Smith","email":"bob@email.com"}` + "\n\n" +
+				`{"firsName":"Ann","lastName":"Smith","email":"ann@email.com","externalIDs":[]}` + "\n" +
+				`{"firsName":"Kim",` + "\n",
+			mockCall: func() {
+				mockService.EXPECT().ImportUsers(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, source membership.UserSource) (membership.ImportReport, error) {
+						records := drain(t, source)
+						assert.Len(t, records, 3)
+						assert.Equal(t, user.User{FirstName: "Bob", LastName: "Smith", Email: "bob@email.com"}, records[0])
+						assert.Contains(t, records[1], "unknown field")
+						assert.Contains(t, records[2], "invalid json")
+						return report, nil
+					})
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewImportUsersResponse(report))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:            "Unsupported content type",
+			contentType:      "application/json",
+			body:             "[]",
+			mockCall:         func() {},
+			expectedResponse: errorResponse("Unsupported content type, expected text/csv or application/x-ndjson"),
+			exoectedCode:     415,
+		},
+		{
+			title:            "Csv header without email column",
+			contentType:      "text/csv",
+			body:             "firsName,lastName\nBob,Smith\n",
+			mockCall:         func() {},
+			expectedResponse: errorResponse("Invalid import: malformed import body: csv header has no email column"),
+			exoectedCode:     400,
+		},
+		{
+			title:       "Malformed csv record",
+			contentType: "text/csv",
+			body:        "firsName,lastName,email\nBob,Sm\"ith,bob@email.com\n",
+			mockCall: func() {
+				mockService.EXPECT().ImportUsers(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, source membership.UserSource) (membership.ImportReport, error) {
+						_, err := source.Next()
+						return failed, err
+					})
+			},
+			expectedResponse: func() string {
+				response := NewImportUsersResponse(failed)
+				response.Error = `Invalid import: malformed import body: parse error on line 2, column 7: bare " in non-quoted-field`
+				expectedJSON, err := json.Marshal(response)
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title:       "Import users error",
+			contentType: "application/x-ndjson",
+			body:        `{"firsName":"Bob","lastName":"Smith","email":"bob@email.com"}`,
+			mockCall: func() {
+				mockService.EXPECT().ImportUsers(gomock.Any(), gomock.Any()).Return(failed, errors.New("error"))
+			},
+			expectedResponse: func() string {
+				response := NewImportUsersResponse(failed)
+				response.Error = "Import users error"
+				expectedJSON, err := json.Marshal(response)
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "", strings.NewReader(test.body))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", test.contentType)
+			handler.ImportUsers(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	type args struct {
+		param map[string]string
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully erase user",
+			mockCall: func() {
+				mockService.EXPECT().EraseUser(gomock.Any(), int64(1)).Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				map[string]string{"userID": "1"},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:    "Invalid user id",
+			mockCall: func() {},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid user id parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"userID": "user"},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockService.EXPECT().EraseUser(gomock.Any(), int64(1)).Return(user.ErrUserNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User with the specified id wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"userID": "1"},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().EraseUser(gomock.Any(), int64(1)).Return(errors.New("service error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Erase user error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"userID": "1"},
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodDelete, "", nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, test.args.param)
+			handler.EraseUser(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+
+		})
+	}
+}
+
 func TestUpdateUserSegments(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockService := mocks.NewMockMembershipService(ctrl)
-	handler := New(mockService)
+	mockResolver := mocks.NewMockUserResolver(ctrl)
+	handler := New(mockService, mockResolver)
 
 	userID := int64(1)
+	externalID := &ExternalIDRequest{Namespace: "crm", ID: "a-17"}
+	startsAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := startsAt.Add(24 * time.Hour)
 
 	type args struct {
 		req UpdateUserRequest
@@ -182,7 +494,7 @@ func TestUpdateUserSegments(t *testing.T) {
 		{
 			title: "Should successfully update user segments",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+				mockService.EXPECT().UpdateUserMembership(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 			},
 			expectedResponse: func() string {
 				return ""
@@ -190,7 +502,7 @@ func TestUpdateUserSegments(t *testing.T) {
 			args: args{
 				UpdateUserRequest{
 					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
 					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
 				},
 			},
@@ -222,156 +534,1030 @@ func TestUpdateUserSegments(t *testing.T) {
 			args: args{
 				UpdateUserRequest{
 					UserID: int64(-1),
-					Update: []UpdateSegment{{"s", 10}, {"segment-2", 20}},
+					Update: []UpdateSegment{{Name: "s", TTL: 10}, {Name: "segment-2", TTL: 20}},
 					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
 				},
 			},
 			exoectedCode: 400,
 		},
 		{
-			title: "Segment already assigned to user",
+			title: "Should pass the upsert policy to the service",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), userID, gomock.Len(1), gomock.Len(0), membership.UpsertExtend).
+					Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}},
+					Upsert: "extend",
+				},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Validate upsert policy error",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "Upsert",
+						Tag:   "oneof",
+						Param: "replace extend max",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}},
+					Upsert: "merge",
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Should pass the absolute expiration and the start to the service",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(),
+					userID,
+					[]segment.Segment{{Name: "segment-1", StartsAt: startsAt, ExpiredAt: expiresAt}},
+					gomock.Len(0),
+					membership.UpsertNone).
+					Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", StartsAt: &startsAt, ExpiresAt: &expiresAt}},
+				},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Validate ttl together with the absolute expiration error",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "ExpiresAt",
+						Tag:   "excluded_with",
+						Param: "TTL",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10, ExpiresAt: &expiresAt}},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Segment expires before it starts",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(membership.ErrInvalidSchedule)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment expiration has passed or is before its start"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", StartsAt: &expiresAt, ExpiresAt: &startsAt}},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Segment already assigned to user",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(membership.ErrSegmentAlreadyAssigned)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to add segments that the user already belongs to"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Segment does not exists",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(segment.ErrSegmentNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Not all segments with the specified names were found or adding/removing one segment multiple times"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "User does not exists",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(user.ErrUserNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to update the data of a non-existent user"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Both add and delete array is empty",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(membership.ErrEmptyData)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Data for update and delete cannot be empty at the same time"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{},
+					Delete: []DeleteSegment{},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Attempty to add and delete the same segment",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(membership.ErrIncorrectData)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to add and remove the same segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Attempty to delete unassigned segment",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(membership.ErrSegmentNotAssigned)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to delete a segment unassigned to the user"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Attempt to add a segment without its prerequisites",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(fmt.Errorf("insert user: %w", &membership.MissingPrerequisiteError{
+						Segment:       "segment-1",
+						Prerequisites: []string{"segment-3", "segment-4"},
+					}))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment segment-1 requires segments the user doesn't have: segment-3, segment-4"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 422,
+		},
+		{
+			title: "Attempt to delete a prerequisite of a segment with the refuse policy",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(fmt.Errorf("delete user segments: %w", &membership.DependentSegmentError{
+						Segment:    "segment-3",
+						Dependents: []string{"segment-1"},
+					}))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment segment-3 is required by the user segments: segment-1"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Delete: []DeleteSegment{{"segment-3"}},
+				},
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Attempt to add a segment that reached its capacity",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(fmt.Errorf("insert user: %w", &membership.SegmentFullError{Segment: "segment-1", Capacity: 100}))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{
+					Message: "Segment segment-1 is full, its capacity is 100",
+					Code:    apierror.CodeSegmentFull,
+				})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Attempt to add second segment of the same layer",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(fmt.Errorf("insert user: %w", &membership.LayerConflictError{Layer: "checkout"}))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to add more than one segment of the same layer to the user"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}, {Name: "segment-2", TTL: 20}},
+				},
+			},
+			exoectedCode: 422,
+		},
+		{
+			title: "Error while updating user segments",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUserMembership(
+					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(errors.New("service error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Update user segments"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID: userID,
+					Update: []UpdateSegment{{Name: "segment-4", TTL: 10}, {Name: "segment-2", TTL: 20}},
+					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
+				},
+			},
+			exoectedCode: 500,
+		},
+		{
+			title: "Should update segments of the user addressed by external id",
+			mockCall: func() {
+				mockResolver.EXPECT().ResolveUser(gomock.Any(), "crm:a-17").Return(int64(7), nil)
+				mockService.EXPECT().UpdateUserMembership(gomock.Any(), int64(7), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				UpdateUserRequest{
+					ExternalID: externalID,
+					Update:     []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Unknown external id",
+			mockCall: func() {
+				mockResolver.EXPECT().ResolveUser(gomock.Any(), "crm:a-17").Return(int64(0), user.ErrUserNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to update the data of a non-existent user"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					ExternalID: externalID,
+					Update:     []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Invalid external id",
+			mockCall: func() {
+				mockResolver.EXPECT().ResolveUser(gomock.Any(), "CRM:a-17").Return(int64(0), user.ErrInvalidRef)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid external id: " + user.ErrInvalidRef.Error()})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					ExternalID: &ExternalIDRequest{Namespace: "CRM", ID: "a-17"},
+					Update:     []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Neither user id nor external id",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "UserID",
+						Tag:   "required_without",
+						Param: "ExternalID",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					Update: []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Both user id and external id",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "UserID",
+						Tag:   "excluded_with",
+						Param: "ExternalID",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				UpdateUserRequest{
+					UserID:     userID,
+					ExternalID: externalID,
+					Update:     []UpdateSegment{{Name: "segment-1", TTL: 10}},
+				},
+			},
+			exoectedCode: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			reqBody, err := json.Marshal(test.args.req)
+			assert.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(reqBody))
+			assert.NoError(t, err)
+			handler.UpdateUserMembership(w, req)
+			assert.Equal(t, test.exoectedCode, w.Code)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+		})
+	}
+}
+
+func TestArchiveSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	type args struct {
+		param map[string]string
+		query string
+	}
+
+	preview := membership.DeletePreview{
+		Segment:   segment.SegmentInfo{ID: 1, Name: "segment-1", Salt: "salt"},
+		Manual:    1,
+		Automatic: 2,
+		Sample:    []int64{1, 2, 3},
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully archive segment",
+			mockCall: func() {
+				mockService.EXPECT().ArchiveSegment(gomock.Any(), "segment-1", "token").Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?confirmationToken=token",
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should return deletion preview for dry run",
+			mockCall: func() {
+				mockService.EXPECT().PreviewSegmentDeletion(gomock.Any(), "segment-1").Return(preview, nil)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(NewDeletePreviewResponse(preview))
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?dryRun=true",
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Invalid dry run parameter",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid dryRun parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?dryRun=yes",
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Confirmation token is required",
+			mockCall: func() {
+				mockService.EXPECT().ArchiveSegment(gomock.Any(), "segment-1", "").Return(membership.ErrConfirmationRequired)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Confirmation token from the dry run is required"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+			},
+			exoectedCode: 428,
+		},
+		{
+			title: "Outdated confirmation token",
+			mockCall: func() {
+				mockService.EXPECT().ArchiveSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(membership.ErrConfirmationMismatch)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Confirmation token is invalid or outdated, repeat the dry run"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?confirmationToken=old",
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Segment not found",
+			mockCall: func() {
+				mockService.EXPECT().ArchiveSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment with the specified name wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?confirmationToken=token",
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().ArchiveSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("service error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Delete segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				query: "?confirmationToken=token",
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodDelete, "/"+test.args.query, nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, test.args.param)
+			handler.ArchiveSegment(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+
+		})
+	}
+}
+
+func TestRestoreSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	type args struct {
+		param map[string]string
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully restore segment",
+			mockCall: func() {
+				mockService.EXPECT().RestoreSegment(gomock.Any(), gomock.Any()).Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				map[string]string{"segmentName": "segment-1"},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Segment not found",
+			mockCall: func() {
+				mockService.EXPECT().RestoreSegment(gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Archived segment with the specified name wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"segmentName": "segment-1"},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Grace period expired",
+			mockCall: func() {
+				mockService.EXPECT().RestoreSegment(gomock.Any(), gomock.Any()).Return(segment.ErrGracePeriodExpired)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment grace period has expired"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"segmentName": "segment-1"},
+			},
+			exoectedCode: 410,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().RestoreSegment(gomock.Any(), gomock.Any()).Return(errors.New("service error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Restore segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				map[string]string{"segmentName": "segment-1"},
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "", nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, test.args.param)
+			handler.RestoreSegment(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+
+		})
+	}
+}
+
+func TestUpdateSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	type args struct {
+		param map[string]string
+		req   UpdateSegmentRequest
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully update segment percentage",
+			mockCall: func() {
+				percentage := 70
+				mockService.EXPECT().
+					UpdateSegment(gomock.Any(), "segment-1", segment.Update{AutomaticPercentage: &percentage}).
+					Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{HitPercentage: intPtr(30)},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should successfully update segment metadata",
+			mockCall: func() {
+				owner := "growth"
+				mockService.EXPECT().
+					UpdateSegment(gomock.Any(), "segment-1", segment.Update{Owner: &owner, Tags: []string{"checkout"}}).
+					Return(nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{Owner: strPtr("growth"), Tags: []string{"checkout"}},
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Rule based segment can't have hit percentage",
+			mockCall: func() {
+				mockService.EXPECT().
+					UpdateSegment(gomock.Any(), "segment-1", gomock.Any()).
+					Return(segment.ErrRuleWithPercentage)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Rule based segment can't have hitPercentage"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{HitPercentage: intPtr(30)},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Nothing to update",
+			mockCall: func() {
+				mockService.EXPECT().
+					UpdateSegment(gomock.Any(), "segment-1", segment.Update{}).
+					Return(segment.ErrNothingToUpdate)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "At least one segment field must be specified for update"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Validate request error",
+			mockCall: func() {
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "HitPercentage",
+						Tag:   "lte",
+						Param: "100",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{HitPercentage: intPtr(101)},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Segment not found",
+			mockCall: func() {
+				mockService.EXPECT().UpdateSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment with the specified name wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{HitPercentage: intPtr(30)},
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.EXPECT().UpdateSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("service error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Update segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   UpdateSegmentRequest{HitPercentage: intPtr(30)},
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			reqBody, err := json.Marshal(test.args.req)
+			assert.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPatch, "", bytes.NewBuffer(reqBody))
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, test.args.param)
+			handler.UpdateSegment(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestSetRamp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	type args struct {
+		param map[string]string
+		req   SetRampRequest
+	}
+
+	validReq := SetRampRequest{
+		Steps: []RampStep{
+			{HitPercentage: 1, After: "0s"},
+			{HitPercentage: 5, After: "24h"},
+			{HitPercentage: 25, After: "72h"},
+		},
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully set segment ramp",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(membership.ErrSegmentAlreadyAssigned)
+				mockService.EXPECT().
+					SetRamp(gomock.Any(), "segment-1", []segment.RampStep{
+						segment.NewRampStep(99, 0),
+						segment.NewRampStep(95, 24*time.Hour),
+						segment.NewRampStep(75, 72*time.Hour),
+					}).
+					Return(nil)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to add segments that the user already belongs to"})
-				assert.NoError(t, err)
-				return string(resp)
+				return ""
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   validReq,
 			},
-			exoectedCode: 409,
+			exoectedCode: 200,
 		},
 		{
-			title: "Segment does not exists",
+			title: "Rule based segment can't have a ramp",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(segment.ErrSegmentNotFound)
+				mockService.EXPECT().
+					SetRamp(gomock.Any(), "segment-1", gomock.Any()).
+					Return(segment.ErrRuleWithPercentage)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Not all segments with the specified names were found or adding/removing one segment multiple times"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Rule based segment can't have hitPercentage"})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   validReq,
 			},
-			exoectedCode: 404,
+			exoectedCode: 400,
 		},
 		{
-			title: "User does not exists",
+			title: "Validate request error",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(user.ErrUserNotFound)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to update the data of a non-existent user"})
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "Steps",
+						Tag:   "min",
+						Param: "1",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   SetRampRequest{Steps: []RampStep{}},
 			},
-			exoectedCode: 404,
+			exoectedCode: 400,
 		},
 		{
-			title: "Both add and delete array is empty",
+			title: "Invalid step delay",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(membership.ErrEmptyData)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Data for update and delete cannot be empty at the same time"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: `Invalid step delay: time: invalid duration "soon"`})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{},
-					Delete: []DeleteSegment{},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   SetRampRequest{Steps: []RampStep{{HitPercentage: 5, After: "soon"}}},
 			},
 			exoectedCode: 400,
 		},
 		{
-			title: "Attempty to add and delete the same segment",
+			title: "Unordered steps",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(membership.ErrIncorrectData)
+				mockService.EXPECT().SetRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrInvalidRamp)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to add and remove the same segment"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Ramp step delays must be non-negative and strictly increasing"})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   validReq,
 			},
 			exoectedCode: 400,
 		},
 		{
-			title: "Attempty to delete unassigned segment",
+			title: "Segment not found",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(membership.ErrSegmentNotAssigned)
+				mockService.EXPECT().SetRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attempt to delete a segment unassigned to the user"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment with the specified name wasn't found"})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-1", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   validReq,
 			},
-			exoectedCode: 409,
+			exoectedCode: 404,
 		},
 		{
-			title: "Error while updating user segments",
+			title: "Service error",
 			mockCall: func() {
-				mockService.EXPECT().UpdateUserMembership(
-					gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-					Return(errors.New("service error"))
+				mockService.EXPECT().SetRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("service error"))
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Update user segments"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Set segment ramp"})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				UpdateUserRequest{
-					UserID: userID,
-					Update: []UpdateSegment{{"segment-4", 10}, {"segment-2", 20}},
-					Delete: []DeleteSegment{{"segment-3"}, {"segment-4"}},
-				},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   validReq,
 			},
 			exoectedCode: 500,
 		},
@@ -383,25 +1569,29 @@ func TestUpdateUserSegments(t *testing.T) {
 			w := httptest.NewRecorder()
 			reqBody, err := json.Marshal(test.args.req)
 			assert.NoError(t, err)
-			req, err := http.NewRequest(http.MethodPost, "", bytes.NewBuffer(reqBody))
+			req, err := http.NewRequest(http.MethodPut, "", bytes.NewBuffer(reqBody))
 			assert.NoError(t, err)
-			handler.UpdateUserMembership(w, req)
-			assert.Equal(t, test.exoectedCode, w.Code)
+			req = AddChiURLParams(req, test.args.param)
+			handler.SetRamp(w, req)
 			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
 		})
 	}
 }
 
-func TestDeleteMembership(t *testing.T) {
+func TestPauseRamp(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockService := mocks.NewMockMembershipService(ctrl)
-	handler := New(mockService)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
 
 	type args struct {
 		param map[string]string
+		req   PauseRampRequest
 	}
 
+	paused := true
+
 	tests := []struct {
 		title            string
 		args             args
@@ -410,45 +1600,70 @@ func TestDeleteMembership(t *testing.T) {
 		expectedResponse func() string
 	}{
 		{
-			title: "Should successfully create new segment",
+			title: "Should successfully pause segment ramp",
 			mockCall: func() {
-				mockService.EXPECT().DeleteMembership(gomock.Any(), gomock.Any()).Return(nil)
+				mockService.EXPECT().PauseRamp(gomock.Any(), "segment-1", true).Return(nil)
 			},
 			expectedResponse: func() string {
 				return ""
 			},
 			args: args{
-				map[string]string{"segmentName": "segment-1"},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   PauseRampRequest{Paused: &paused},
 			},
 			exoectedCode: 200,
 		},
 		{
-			title: "Segment not found",
+			title: "Validate request error",
 			mockCall: func() {
-				mockService.EXPECT().DeleteMembership(gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment with the specified name wasn't found"})
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "Paused",
+						Tag:   "required",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				map[string]string{"segmentName": "segment-1"},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   PauseRampRequest{},
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Ramp not found",
+			mockCall: func() {
+				mockService.EXPECT().PauseRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrRampNotFound)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment has no ramp"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			args: args{
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   PauseRampRequest{Paused: &paused},
 			},
 			exoectedCode: 404,
 		},
 		{
 			title: "Service error",
 			mockCall: func() {
-				mockService.EXPECT().DeleteMembership(gomock.Any(), gomock.Any()).Return(errors.New("service error"))
+				mockService.EXPECT().PauseRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("service error"))
 			},
 			expectedResponse: func() string {
-				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Delete segment"})
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Pause segment ramp"})
 				assert.NoError(t, err)
 				return string(resp)
 			},
 			args: args{
-				map[string]string{"segmentName": "segment-1"},
+				param: map[string]string{"segmentName": "segment-1"},
+				req:   PauseRampRequest{Paused: &paused},
 			},
 			exoectedCode: 500,
 		},
@@ -458,13 +1673,14 @@ func TestDeleteMembership(t *testing.T) {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
 			w := httptest.NewRecorder()
-			req, err := http.NewRequest(http.MethodDelete, "", nil)
+			reqBody, err := json.Marshal(test.args.req)
+			assert.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPatch, "", bytes.NewBuffer(reqBody))
 			assert.NoError(t, err)
 			req = AddChiURLParams(req, test.args.param)
-			handler.DeleteMembership(w, req)
+			handler.PauseRamp(w, req)
 			assert.Equal(t, test.expectedResponse(), w.Body.String())
 			assert.Equal(t, test.exoectedCode, w.Code)
-
 		})
 	}
 }
@@ -473,13 +1689,13 @@ func TestGetUserMembership(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockService := mocks.NewMockMembershipService(ctrl)
-	handler := New(mockService)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
 
 	type args struct {
 		param map[string]string
 	}
 
-	info := []membership.MembershipInfo{{UserID: 1, SegmentName: "seg-1"}, {UserID: 2, SegmentName: "seg-2"}}
+	info := []membership.MembershipInfo{{UserID: 1, SegmentName: "seg-1", Variant: "control"}, {UserID: 2, SegmentName: "seg-2"}}
 
 	tests := []struct {
 		title            string
@@ -501,7 +1717,7 @@ func TestGetUserMembership(t *testing.T) {
 			expectedResponse: func() string {
 				data := make([]UserResponseInfo, len(info))
 				for i := range data {
-					data[i] = NewUserResponseInfo(info[i].UserID, info[i].SegmentName, info[i].ExpiredAt)
+					data[i] = NewUserResponseInfo(info[i].UserID, info[i].SegmentName, info[i].Variant, info[i].ExpiredAt)
 				}
 				expectedJSON, err := json.Marshal(NewUserMembershipResponse(data))
 				assert.NoError(t, err)
@@ -579,3 +1795,212 @@ func TestGetUserMembership(t *testing.T) {
 		})
 	}
 }
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestCheckUserMembership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	userID := int64(1)
+	segmentName := "segment1"
+	expiredAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	info := membership.MembershipInfo{UserID: userID, SegmentName: segmentName, Variant: "control", ExpiredAt: expiredAt}
+	expiredHeader := expiredAt.In(location).Format(time.RFC3339)
+
+	tests := []struct {
+		title            string
+		method           string
+		userID           string
+		exoectedCode     int
+		expectedHeader   string
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title:  "Should return the membership",
+			method: http.MethodGet,
+			userID: "1",
+			mockCall: func() {
+				mockService.EXPECT().CheckUserMembership(gomock.Any(), userID, segmentName).Return(info, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewUserResponseInfo(userID, segmentName, "control", expiredAt))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			expectedHeader: expiredHeader,
+			exoectedCode:   200,
+		},
+		{
+			title:  "Should return only the status and the expiry on head",
+			method: http.MethodHead,
+			userID: "1",
+			mockCall: func() {
+				mockService.EXPECT().CheckUserMembership(gomock.Any(), userID, segmentName).Return(info, nil)
+			},
+			expectedResponse: func() string {
+				return ""
+			},
+			expectedHeader: expiredHeader,
+			exoectedCode:   200,
+		},
+		{
+			title:  "User isn't in the segment",
+			method: http.MethodGet,
+			userID: "1",
+			mockCall: func() {
+				mockService.EXPECT().CheckUserMembership(gomock.Any(), userID, segmentName).Return(membership.MembershipInfo{}, membership.ErrSegmentNotAssigned)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User isn't in the segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 404,
+		},
+		{
+			title:    "Invalid user id",
+			method:   http.MethodGet,
+			userID:   "abc",
+			mockCall: func() {},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid user id parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title:  "Check user membership error",
+			method: http.MethodGet,
+			userID: "1",
+			mockCall: func() {
+				mockService.EXPECT().CheckUserMembership(gomock.Any(), userID, segmentName).Return(membership.MembershipInfo{}, errors.New("error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Check user membership error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(test.method, "", nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, map[string]string{"userID": test.userID, "segmentName": segmentName})
+			handler.CheckUserMembership(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.expectedHeader, w.Header().Get("X-Expired-At"))
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestBatchGetUserMembership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockMembershipService(ctrl)
+	handler := New(mockService, mocks.NewMockUserResolver(ctrl))
+
+	expiredAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	memberships := map[int64][]membership.MembershipInfo{
+		1: {{UserID: 1, SegmentName: "segment1", Variant: "control", ExpiredAt: expiredAt}},
+		2: {},
+	}
+	tooMany := make([]int64, 101)
+	for i := range tooMany {
+		tooMany[i] = int64(i + 1)
+	}
+
+	tests := []struct {
+		title            string
+		body             string
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should return segments of every requested user",
+			body:  `{"userIDs": [1, 2]}`,
+			mockCall: func() {
+				mockService.EXPECT().GetUsersMembership(gomock.Any(), []int64{1, 2}).Return(memberships, nil)
+			},
+			expectedResponse: func() string {
+				return fmt.Sprintf(
+					`{"memberships":{"1":[{"userID":1,"segmentName":"segment1","variant":"control","expiredAt":"%s"}],"2":[]}}`,
+					expiredAt.In(location).Format(time.RFC3339),
+				)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Too many users",
+			body: func() string {
+				body, err := json.Marshal(BatchGetMembershipRequest{UserIDs: tooMany})
+				assert.NoError(t, err)
+				return string(body)
+			}(),
+			mockCall: func() {},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{{Field: "UserIDs", Tag: "max", Param: "100"}})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title:    "Repeated user ids",
+			body:     `{"userIDs": [1, 1]}`,
+			mockCall: func() {},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{{Field: "UserIDs", Tag: "unique"}})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Get users membership error",
+			body:  `{"userIDs": [1]}`,
+			mockCall: func() {
+				mockService.EXPECT().GetUsersMembership(gomock.Any(), []int64{1}).Return(nil, errors.New("error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get users membership segment"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "", strings.NewReader(test.body))
+			assert.NoError(t, err)
+			handler.BatchGetUserMembership(w, req)
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func strPtr(v string) *string {
+	return &v
+}
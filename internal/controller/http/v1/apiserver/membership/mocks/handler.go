@@ -37,6 +37,35 @@ func (m *MockMembershipService) EXPECT() *MockMembershipServiceMockRecorder {
 	return m.recorder
 }
 
+// ArchiveSegment mocks base method.
+func (m *MockMembershipService) ArchiveSegment(ctx context.Context, segmentName, token string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ArchiveSegment", ctx, segmentName, token)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ArchiveSegment indicates an expected call of ArchiveSegment.
+func (mr *MockMembershipServiceMockRecorder) ArchiveSegment(ctx, segmentName, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ArchiveSegment", reflect.TypeOf((*MockMembershipService)(nil).ArchiveSegment), ctx, segmentName, token)
+}
+
+// CheckUserMembership mocks base method.
+func (m *MockMembershipService) CheckUserMembership(ctx context.Context, userID int64, segmentName string) (membership.MembershipInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckUserMembership", ctx, userID, segmentName)
+	ret0, _ := ret[0].(membership.MembershipInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckUserMembership indicates an expected call of CheckUserMembership.
+func (mr *MockMembershipServiceMockRecorder) CheckUserMembership(ctx, userID, segmentName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckUserMembership", reflect.TypeOf((*MockMembershipService)(nil).CheckUserMembership), ctx, userID, segmentName)
+}
+
 // CreateUser mocks base method.
 func (m *MockMembershipService) CreateUser(ctx context.Context, user user.User) (int64, error) {
 	m.ctrl.T.Helper()
@@ -52,18 +81,18 @@ func (mr *MockMembershipServiceMockRecorder) CreateUser(ctx, user interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockMembershipService)(nil).CreateUser), ctx, user)
 }
 
-// DeleteMembership mocks base method.
-func (m *MockMembershipService) DeleteMembership(ctx context.Context, segmentName string) error {
+// EraseUser mocks base method.
+func (m *MockMembershipService) EraseUser(ctx context.Context, userID int64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteMembership", ctx, segmentName)
+	ret := m.ctrl.Call(m, "EraseUser", ctx, userID)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// DeleteMembership indicates an expected call of DeleteMembership.
-func (mr *MockMembershipServiceMockRecorder) DeleteMembership(ctx, segmentName interface{}) *gomock.Call {
+// EraseUser indicates an expected call of EraseUser.
+func (mr *MockMembershipServiceMockRecorder) EraseUser(ctx, userID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMembership", reflect.TypeOf((*MockMembershipService)(nil).DeleteMembership), ctx, segmentName)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EraseUser", reflect.TypeOf((*MockMembershipService)(nil).EraseUser), ctx, userID)
 }
 
 // GetUserMembership mocks base method.
@@ -81,16 +110,155 @@ func (mr *MockMembershipServiceMockRecorder) GetUserMembership(ctx, userID inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserMembership", reflect.TypeOf((*MockMembershipService)(nil).GetUserMembership), ctx, userID)
 }
 
+// GetUsersMembership mocks base method.
+func (m *MockMembershipService) GetUsersMembership(ctx context.Context, userIDs []int64) (map[int64][]membership.MembershipInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUsersMembership", ctx, userIDs)
+	ret0, _ := ret[0].(map[int64][]membership.MembershipInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUsersMembership indicates an expected call of GetUsersMembership.
+func (mr *MockMembershipServiceMockRecorder) GetUsersMembership(ctx, userIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsersMembership", reflect.TypeOf((*MockMembershipService)(nil).GetUsersMembership), ctx, userIDs)
+}
+
+// ImportUsers mocks base method.
+func (m *MockMembershipService) ImportUsers(ctx context.Context, source membership.UserSource) (membership.ImportReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ImportUsers", ctx, source)
+	ret0, _ := ret[0].(membership.ImportReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImportUsers indicates an expected call of ImportUsers.
+func (mr *MockMembershipServiceMockRecorder) ImportUsers(ctx, source interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImportUsers", reflect.TypeOf((*MockMembershipService)(nil).ImportUsers), ctx, source)
+}
+
+// PauseRamp mocks base method.
+func (m *MockMembershipService) PauseRamp(ctx context.Context, segmentName string, paused bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PauseRamp", ctx, segmentName, paused)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PauseRamp indicates an expected call of PauseRamp.
+func (mr *MockMembershipServiceMockRecorder) PauseRamp(ctx, segmentName, paused interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PauseRamp", reflect.TypeOf((*MockMembershipService)(nil).PauseRamp), ctx, segmentName, paused)
+}
+
+// PreviewSegmentDeletion mocks base method.
+func (m *MockMembershipService) PreviewSegmentDeletion(ctx context.Context, segmentName string) (membership.DeletePreview, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PreviewSegmentDeletion", ctx, segmentName)
+	ret0, _ := ret[0].(membership.DeletePreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PreviewSegmentDeletion indicates an expected call of PreviewSegmentDeletion.
+func (mr *MockMembershipServiceMockRecorder) PreviewSegmentDeletion(ctx, segmentName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PreviewSegmentDeletion", reflect.TypeOf((*MockMembershipService)(nil).PreviewSegmentDeletion), ctx, segmentName)
+}
+
+// RestoreSegment mocks base method.
+func (m *MockMembershipService) RestoreSegment(ctx context.Context, segmentName string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreSegment", ctx, segmentName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestoreSegment indicates an expected call of RestoreSegment.
+func (mr *MockMembershipServiceMockRecorder) RestoreSegment(ctx, segmentName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreSegment", reflect.TypeOf((*MockMembershipService)(nil).RestoreSegment), ctx, segmentName)
+}
+
+// SetRamp mocks base method.
+func (m *MockMembershipService) SetRamp(ctx context.Context, segmentName string, steps []segment.RampStep) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRamp", ctx, segmentName, steps)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetRamp indicates an expected call of SetRamp.
+func (mr *MockMembershipServiceMockRecorder) SetRamp(ctx, segmentName, steps interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRamp", reflect.TypeOf((*MockMembershipService)(nil).SetRamp), ctx, segmentName, steps)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockMembershipService) UpdateSegment(ctx context.Context, segmentName string, update segment.Update) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, segmentName, update)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockMembershipServiceMockRecorder) UpdateSegment(ctx, segmentName, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockMembershipService)(nil).UpdateSegment), ctx, segmentName, update)
+}
+
 // UpdateUserMembership mocks base method.
-func (m *MockMembershipService) UpdateUserMembership(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string) error {
+func (m *MockMembershipService) UpdateUserMembership(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string, policy membership.UpsertPolicy) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateUserMembership", ctx, userID, addSegments, deleteSegments)
+	ret := m.ctrl.Call(m, "UpdateUserMembership", ctx, userID, addSegments, deleteSegments, policy)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateUserMembership indicates an expected call of UpdateUserMembership.
-func (mr *MockMembershipServiceMockRecorder) UpdateUserMembership(ctx, userID, addSegments, deleteSegments interface{}) *gomock.Call {
+func (mr *MockMembershipServiceMockRecorder) UpdateUserMembership(ctx, userID, addSegments, deleteSegments, policy interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserMembership", reflect.TypeOf((*MockMembershipService)(nil).UpdateUserMembership), ctx, userID, addSegments, deleteSegments, policy)
+}
+
+// MockUserResolver is a mock of UserResolver interface.
+type MockUserResolver struct {
+	ctrl     *gomock.Controller
+	recorder *MockUserResolverMockRecorder
+}
+
+// MockUserResolverMockRecorder is the mock recorder for MockUserResolver.
+type MockUserResolverMockRecorder struct {
+	mock *MockUserResolver
+}
+
+// NewMockUserResolver creates a new mock instance.
+func NewMockUserResolver(ctrl *gomock.Controller) *MockUserResolver {
+	mock := &MockUserResolver{ctrl: ctrl}
+	mock.recorder = &MockUserResolverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUserResolver) EXPECT() *MockUserResolverMockRecorder {
+	return m.recorder
+}
+
+// ResolveUser mocks base method.
+func (m *MockUserResolver) ResolveUser(ctx context.Context, ref string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveUser", ctx, ref)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveUser indicates an expected call of ResolveUser.
+func (mr *MockUserResolverMockRecorder) ResolveUser(ctx, ref interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserMembership", reflect.TypeOf((*MockMembershipService)(nil).UpdateUserMembership), ctx, userID, addSegments, deleteSegments)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveUser", reflect.TypeOf((*MockUserResolver)(nil).ResolveUser), ctx, ref)
 }
@@ -0,0 +1,144 @@
+package membership
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/validator"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+)
+
+const (
+	csvContentType    string = "text/csv"
+	ndjsonContentType string = "application/x-ndjson"
+	maxImportLineSize int    = 1 << 20
+)
+
+var (
+	errUnsupportedContentType = errors.New("unsupported content type")
+	requiredColumns           = []string{"firsName", "lastName", "email"}
+)
+
+// newUserSource reads the import body according to its content type.
+func newUserSource(contentType string, body io.Reader) (membership.UserSource, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errUnsupportedContentType
+	}
+	switch mediaType {
+	case csvContentType:
+		return newCSVSource(body)
+	case ndjsonContentType:
+		return newNDJSONSource(body), nil
+	}
+	return nil, errUnsupportedContentType
+}
+
+// csvSource reads users from a csv with a header, the columns are matched by the header names,
+// attributes are a json object.
+type csvSource struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCSVSource(body io.Reader) (*csvSource, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't read csv header: %s", membership.ErrMalformedImport, err.Error())
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: csv header has no %s column", membership.ErrMalformedImport, name)
+		}
+	}
+	return &csvSource{
+		reader:  reader,
+		columns: columns,
+	}, nil
+}
+
+func (s *csvSource) Next() (user.User, error) {
+	record, err := s.reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return user.User{}, err
+		}
+		return user.User{}, fmt.Errorf("%w: %s", membership.ErrMalformedImport, err.Error())
+	}
+
+	userReq := ImportUserRequest{
+		FirstName: s.field(record, "firsName"),
+		LastName:  s.field(record, "lastName"),
+		Email:     s.field(record, "email"),
+	}
+	if attributes := s.field(record, "attributes"); attributes != "" {
+		if err := json.Unmarshal([]byte(attributes), &userReq.Attributes); err != nil {
+			return user.User{}, &membership.InvalidRowError{Reason: fmt.Sprintf("invalid attributes: %s", err.Error())}
+		}
+	}
+	return userReq.toUser()
+}
+
+func (s *csvSource) field(record []string, name string) string {
+	column, ok := s.columns[name]
+	if !ok || column >= len(record) {
+		return ""
+	}
+	return record[column]
+}
+
+// ndjsonSource reads users from json objects one per line, blank lines are skipped.
+type ndjsonSource struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONSource(body io.Reader) *ndjsonSource {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+	return &ndjsonSource{
+		scanner: scanner,
+	}
+}
+
+func (s *ndjsonSource) Next() (user.User, error) {
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var userReq ImportUserRequest
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&userReq); err != nil {
+			return user.User{}, &membership.InvalidRowError{Reason: fmt.Sprintf("invalid json: %s", err.Error())}
+		}
+		return userReq.toUser()
+	}
+	if err := s.scanner.Err(); err != nil {
+		return user.User{}, fmt.Errorf("%w: %s", membership.ErrMalformedImport, err.Error())
+	}
+	return user.User{}, io.EOF
+}
+
+func (u ImportUserRequest) toUser() (user.User, error) {
+	if errs := validator.Validate(u); errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		return user.User{}, &membership.InvalidRowError{Reason: string(jsonErr)}
+	}
+	return u.ToModel(), nil
+}
@@ -0,0 +1,53 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	userParam string = "userID"
+)
+
+type UserResolver interface {
+	ResolveUser(ctx context.Context, ref string) (int64, error)
+}
+
+// withUser lets the user routes address the user by an external id, a {userID} parameter
+// written as <namespace>:<external id> is replaced with the id of the user it belongs to.
+func withUser(users UserResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := users.ResolveUser(r.Context(), chi.URLParam(r, userParam))
+			if err != nil {
+				switch {
+				case errors.Is(err, user.ErrInvalidRef):
+					w.WriteHeader(http.StatusBadRequest)
+					apierror.WriteErrorMessage(w, "Invalid user id parameter")
+					return
+				case errors.Is(err, user.ErrUserNotFound):
+					w.WriteHeader(http.StatusNotFound)
+					apierror.WriteErrorMessage(w, "User with the specified id wasn't found")
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				apierror.WriteErrorMessage(w, "Resolve user error")
+				return
+			}
+
+			params := &chi.RouteContext(r.Context()).URLParams
+			for i := range params.Keys {
+				if params.Keys[i] == userParam {
+					params.Values[i] = strconv.FormatInt(userID, 10)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
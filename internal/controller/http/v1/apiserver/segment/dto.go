@@ -1,20 +1,214 @@
 package segment
 
+import (
+	"math"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
+)
+
 type CreateSegmentRequest struct {
-	Name          string `json:"name" validate:"required,min=6"`
-	HitPercentage int    `json:"hitPercentage" validate:"gt=-1"`
+	Name           string                 `json:"name" validate:"required,min=6"`
+	HitPercentage  int                    `json:"hitPercentage" validate:"gt=-1"`
+	AssignExisting bool                   `json:"assignExisting"`
+	Layer          string                 `json:"layer" validate:"omitempty,max=255"`
+	Variants       []VariantRequest       `json:"variants" validate:"omitempty,min=2,unique=Name,dive"`
+	Description    string                 `json:"description" validate:"max=1024"`
+	Owner          string                 `json:"owner" validate:"max=255"`
+	Tags           []string               `json:"tags" validate:"omitempty,unique,dive,required,max=64"`
+	Attributes     map[string]interface{} `json:"attributes"`
+	ActiveFrom     *time.Time             `json:"activeFrom"`
+	ActiveUntil    *time.Time             `json:"activeUntil"`
+	Rule           string                 `json:"rule" validate:"max=1024"`
+	Prerequisites  []string               `json:"prerequisites" validate:"omitempty,unique,dive,required,max=255"`
+	Policy         string                 `json:"prerequisitePolicy" validate:"omitempty,oneof=refuse cascade"`
+	Capacity       *int                   `json:"capacity" validate:"omitempty,gte=1"`
+}
+
+type SegmentMetadata struct {
+	Description string                 `json:"description,omitempty"`
+	Owner       string                 `json:"owner,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Attributes  map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func NewSegmentMetadata(description string, owner string, tags []string, attributes map[string]interface{}) SegmentMetadata {
+	return SegmentMetadata{
+		Description: description,
+		Owner:       owner,
+		Tags:        tags,
+		Attributes:  attributes,
+	}
+}
+
+type SegmentWindow struct {
+	ActiveFrom  *time.Time `json:"activeFrom,omitempty"`
+	ActiveUntil *time.Time `json:"activeUntil,omitempty"`
+}
+
+func NewSegmentWindow(activeFrom *time.Time, activeUntil *time.Time) SegmentWindow {
+	return SegmentWindow{
+		ActiveFrom:  activeFrom,
+		ActiveUntil: activeUntil,
+	}
+}
+
+type SegmentPrerequisites struct {
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	Policy        string   `json:"prerequisitePolicy,omitempty"`
+}
+
+func NewSegmentPrerequisites(prerequisites []string, policy string) SegmentPrerequisites {
+	if len(prerequisites) == 0 {
+		return SegmentPrerequisites{}
+	}
+	return SegmentPrerequisites{
+		Prerequisites: prerequisites,
+		Policy:        policy,
+	}
+}
+
+// SegmentCapacity shows how full a capacity limited segment is, fillLevel is a percentage of the capacity.
+type SegmentCapacity struct {
+	Capacity  *int     `json:"capacity,omitempty"`
+	FillLevel *float64 `json:"fillLevel,omitempty"`
+}
+
+func NewSegmentCapacity(capacity *int, members int64) SegmentCapacity {
+	if capacity == nil {
+		return SegmentCapacity{}
+	}
+	fillLevel := math.Round(float64(members)*10000/float64(*capacity)) / 100
+	return SegmentCapacity{
+		Capacity:  capacity,
+		FillLevel: &fillLevel,
+	}
+}
+
+type VariantRequest struct {
+	Name   string `json:"name" validate:"required,max=255"`
+	Weight int    `json:"weight" validate:"gte=1"`
 }
 
 type CreateSegmentResponse struct {
 	ID         int64  `json:"segmentID"`
 	Name       string `json:"name"`
 	Percentage int    `json:"hitPercentage"`
+	Layer      string `json:"layer,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	Capacity   *int   `json:"capacity,omitempty"`
+	SegmentWindow
+	SegmentPrerequisites
+	SegmentMetadata
 }
 
-func NewSegmentResponse(id int64, name string, percentage int) CreateSegmentResponse {
+func NewSegmentResponse(
+	id int64,
+	name string,
+	percentage int,
+	layer string,
+	rule string,
+	capacity *int,
+	window SegmentWindow,
+	prerequisites SegmentPrerequisites,
+	metadata SegmentMetadata,
+) CreateSegmentResponse {
 	return CreateSegmentResponse{
-		ID:         id,
-		Name:       name,
-		Percentage: percentage,
+		ID:                   id,
+		Name:                 name,
+		Percentage:           percentage,
+		Layer:                layer,
+		Rule:                 rule,
+		Capacity:             capacity,
+		SegmentWindow:        window,
+		SegmentPrerequisites: prerequisites,
+		SegmentMetadata:      metadata,
+	}
+}
+
+func (c CreateSegmentRequest) ToModel() segment.SegmentInfo {
+	variants := make([]segment.Variant, len(c.Variants))
+	for i := range variants {
+		variants[i] = segment.NewVariant(c.Variants[i].Name, c.Variants[i].Weight)
+	}
+	return segment.SegmentInfo{
+		Name:                c.Name,
+		Layer:               c.Layer,
+		AutomaticPercentage: max - c.HitPercentage,
+		Variants:            variants,
+		Description:         c.Description,
+		Owner:               c.Owner,
+		Tags:                c.Tags,
+		Attributes:          c.Attributes,
+		ActiveFrom:          c.ActiveFrom,
+		ActiveUntil:         c.ActiveUntil,
+		Rule:                c.Rule,
+		Prerequisites:       c.Prerequisites,
+		PrerequisitePolicy:  c.Policy,
+		Capacity:            c.Capacity,
+	}
+}
+
+type GetSegmentsRequest struct {
+	Prefix   string `json:"prefix"`
+	Tag      string `json:"tag" validate:"max=64"`
+	Owner    string `json:"owner" validate:"max=255"`
+	Archived bool   `json:"archived"`
+	Cursor   int64  `json:"cursor" validate:"gte=0"`
+	Limit    uint64 `json:"limit" validate:"gte=1,lte=100"`
+}
+
+type GetSegmentsResponse struct {
+	Segments   []SegmentResponseInfo `json:"segments"`
+	NextCursor int64                 `json:"nextCursor,omitempty"`
+}
+
+type SegmentResponseInfo struct {
+	ID         int64      `json:"segmentID"`
+	Name       string     `json:"name"`
+	Percentage int        `json:"hitPercentage"`
+	Members    int64      `json:"members"`
+	Rule       string     `json:"rule,omitempty"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"`
+	SegmentCapacity
+	SegmentWindow
+	SegmentPrerequisites
+	SegmentMetadata
+}
+
+func (g GetSegmentsRequest) ToModel() segment.Filter {
+	return segment.NewFilter(g.Prefix, g.Tag, g.Owner, g.Archived, g.Cursor, g.Limit)
+}
+
+func NewSegmentResponseInfo(
+	id int64,
+	name string,
+	percentage int,
+	members int64,
+	rule string,
+	archivedAt *time.Time,
+	capacity SegmentCapacity,
+	window SegmentWindow,
+	prerequisites SegmentPrerequisites,
+	metadata SegmentMetadata,
+) SegmentResponseInfo {
+	return SegmentResponseInfo{
+		ID:                   id,
+		Name:                 name,
+		Percentage:           percentage,
+		Members:              members,
+		Rule:                 rule,
+		ArchivedAt:           archivedAt,
+		SegmentCapacity:      capacity,
+		SegmentWindow:        window,
+		SegmentPrerequisites: prerequisites,
+		SegmentMetadata:      metadata,
+	}
+}
+
+func NewGetSegmentsResponse(segments []SegmentResponseInfo, nextCursor int64) GetSegmentsResponse {
+	return GetSegmentsResponse{
+		Segments:   segments,
+		NextCursor: nextCursor,
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/validator"
@@ -13,11 +14,13 @@ import (
 )
 
 const (
-	max int = 100
+	max          int    = 100
+	defaultLimit uint64 = 20
 )
 
 type SegmentService interface {
-	CreateSegment(ctx context.Context, name string, percentage int) (int64, error)
+	CreateSegment(ctx context.Context, segment segment.SegmentInfo, assignExisting bool) (int64, error)
+	GetAllSegments(ctx context.Context, filter segment.Filter) ([]segment.SegmentInfo, error)
 }
 
 type handler struct {
@@ -57,20 +60,50 @@ func (h *handler) CreateSegment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := h.segment.CreateSegment(r.Context(), segmentReq.Name, max-segmentReq.HitPercentage)
+	id, err := h.segment.CreateSegment(r.Context(), segmentReq.ToModel(), segmentReq.AssignExisting)
 	if err != nil {
 		switch {
 		case errors.Is(err, segment.ErrSegmentAlreadyExists):
 			w.WriteHeader(http.StatusConflict)
 			apierror.WriteErrorMessage(w, "Segment already exists")
 			return
+		case errors.Is(err, segment.ErrInvalidWindow):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Segment active window must end after it starts")
+			return
+		case errors.Is(err, segment.ErrInvalidRule):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, err.Error())
+			return
+		case errors.Is(err, segment.ErrRuleWithPercentage):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Rule based segment can't have hitPercentage")
+			return
+		case errors.Is(err, segment.ErrPrerequisiteNotFound):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Not all prerequisite segments were found")
+			return
+		case errors.Is(err, segment.ErrSelfPrerequisite):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Segment can't be a prerequisite of itself")
+			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		apierror.WriteErrorMessage(w, "Create segment error")
 		return
 	}
 
-	jsonResponse, err := json.Marshal(NewSegmentResponse(id, segmentReq.Name, segmentReq.HitPercentage))
+	jsonResponse, err := json.Marshal(NewSegmentResponse(
+		id,
+		segmentReq.Name,
+		segmentReq.HitPercentage,
+		segmentReq.Layer,
+		segmentReq.Rule,
+		segmentReq.Capacity,
+		NewSegmentWindow(segmentReq.ActiveFrom, segmentReq.ActiveUntil),
+		NewSegmentPrerequisites(segmentReq.Prerequisites, segment.PolicyOrDefault(segmentReq.Policy)),
+		NewSegmentMetadata(segmentReq.Description, segmentReq.Owner, segmentReq.Tags, segmentReq.Attributes),
+	))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		apierror.WriteErrorMessage(w, "Internal server error")
@@ -80,3 +113,104 @@ func (h *handler) CreateSegment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	w.Write(jsonResponse)
 }
+
+// @Summary Get segments
+// @Description Get segments page with the number of active members
+// @Tags Segments
+// @Accept json
+// @Produce json
+// @Param  prefix  query string  false "Segment name prefix"
+// @Param  tag     query string  false "Segment tag"
+// @Param  owner   query string  false "Segment owner"
+// @Param  archived query bool   false "List archived segments instead of active ones"
+// @Param  cursor  query int     false "ID of the last segment from the previous page"
+// @Param  limit   query int     false "Page size (1-100)"
+// @Success 200 {object} GetSegmentsResponse "Segments page"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /segments [get]
+func (h *handler) GetAllSegments(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	segmentsReq := GetSegmentsRequest{
+		Prefix: query.Get("prefix"),
+		Tag:    query.Get("tag"),
+		Owner:  query.Get("owner"),
+		Limit:  defaultLimit,
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid cursor parameter")
+			return
+		}
+		segmentsReq.Cursor = id
+	}
+
+	if archived := query.Get("archived"); archived != "" {
+		flag, err := strconv.ParseBool(archived)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid archived parameter")
+			return
+		}
+		segmentsReq.Archived = flag
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		size, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid limit parameter")
+			return
+		}
+		segmentsReq.Limit = size
+	}
+
+	errs := validator.Validate(segmentsReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	data, err := h.segment.GetAllSegments(r.Context(), segmentsReq.ToModel())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get segments error")
+		return
+	}
+
+	response := make([]SegmentResponseInfo, len(data))
+	for i, d := range data {
+		response[i] = NewSegmentResponseInfo(
+			d.ID,
+			d.Name,
+			max-d.AutomaticPercentage,
+			d.Members,
+			d.Rule,
+			d.ArchivedAt,
+			NewSegmentCapacity(d.Capacity, d.Members),
+			NewSegmentWindow(d.ActiveFrom, d.ActiveUntil),
+			NewSegmentPrerequisites(d.Prerequisites, d.PrerequisitePolicy),
+			NewSegmentMetadata(d.Description, d.Owner, d.Tags, d.Attributes),
+		)
+	}
+
+	var nextCursor int64
+	if uint64(len(data)) == segmentsReq.Limit {
+		nextCursor = data[len(data)-1].ID
+	}
+
+	jsonResponse, err := json.Marshal(NewGetSegmentsResponse(response, nextCursor))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -36,6 +37,33 @@ func TestCreateSegment(t *testing.T) {
 		HitPercentage: 10,
 	}
 
+	variantsReq := CreateSegmentRequest{
+		Name:          "experiment",
+		HitPercentage: 100,
+		Layer:         "checkout",
+		Variants: []VariantRequest{
+			{Name: "control", Weight: 50},
+			{Name: "treatment", Weight: 50},
+		},
+	}
+
+	metadataReq := CreateSegmentRequest{
+		Name:          "checkout-redesign",
+		HitPercentage: 20,
+		Description:   "New checkout page",
+		Owner:         "growth",
+		Tags:          []string{"checkout", "web"},
+		Attributes:    map[string]interface{}{"jira": "GRW-1"},
+	}
+
+	duplicateVariantsReq := CreateSegmentRequest{
+		Name: "experiment",
+		Variants: []VariantRequest{
+			{Name: "control", Weight: 50},
+			{Name: "control", Weight: 50},
+		},
+	}
+
 	newSegmentID := int64(1)
 	emptyID := int64(0)
 
@@ -76,6 +104,84 @@ func TestCreateSegment(t *testing.T) {
 			},
 			exoectedCode: 201,
 		},
+		{
+			title: "Should successfully create new segment with layer and variants",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), segmentService.SegmentInfo{
+						Name:                "experiment",
+						Layer:               "checkout",
+						AutomaticPercentage: 0,
+						Variants: []segmentService.Variant{
+							segmentService.NewVariant("control", 50),
+							segmentService.NewVariant("treatment", 50),
+						},
+					}, false).
+					Return(newSegmentID, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewSegmentResponse(newSegmentID, "experiment", 100, "checkout", "", nil, SegmentWindow{}, SegmentPrerequisites{}, SegmentMetadata{}))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			args: args{
+				req: variantsReq,
+			},
+			exoectedCode: 201,
+		},
+		{
+			title: "Should successfully create new segment with metadata",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), segmentService.SegmentInfo{
+						Name:                "checkout-redesign",
+						AutomaticPercentage: 80,
+						Variants:            []segmentService.Variant{},
+						Description:         "New checkout page",
+						Owner:               "growth",
+						Tags:                []string{"checkout", "web"},
+						Attributes:          map[string]interface{}{"jira": "GRW-1"},
+					}, false).
+					Return(newSegmentID, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewSegmentResponse(
+					newSegmentID,
+					"checkout-redesign",
+					20,
+					"",
+					"",
+					nil,
+					SegmentWindow{},
+					SegmentPrerequisites{},
+					NewSegmentMetadata("New checkout page", "growth", []string{"checkout", "web"}, map[string]interface{}{"jira": "GRW-1"}),
+				))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			args: args{
+				req: metadataReq,
+			},
+			exoectedCode: 201,
+		},
+		{
+			title: "Duplicate variant names",
+			mockCall: func() {
+			},
+			args: args{
+				req: duplicateVariantsReq,
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{{Field: "Variants", Tag: "unique", Param: "Name"}})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
 		{
 			title: "Validate segment error",
 			mockCall: func() {
@@ -110,6 +216,80 @@ func TestCreateSegment(t *testing.T) {
 			},
 			exoectedCode: 409,
 		},
+		{
+			title: "Active window ends before it starts",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(emptyID, segmentService.ErrInvalidWindow)
+			},
+			args: args{
+				req: segmentReq,
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment active window must end after it starts"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Invalid segment rule",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(emptyID, fmt.Errorf("%w, rule syntax error at position 15: expected string, number or boolean", segmentService.ErrInvalidRule))
+			},
+			args: args{
+				req: segmentReq,
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{
+					Message: "invalid segment rule, rule syntax error at position 15: expected string, number or boolean",
+				})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Prerequisite segment not found",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(emptyID, segmentService.ErrPrerequisiteNotFound)
+			},
+			args: args{
+				req: segmentReq,
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Not all prerequisite segments were found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Segment requires itself",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					CreateSegment(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(emptyID, segmentService.ErrSelfPrerequisite)
+			},
+			args: args{
+				req: segmentReq,
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Segment can't be a prerequisite of itself"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
 		{
 			title: "Service error",
 			mockCall: func() {
@@ -147,3 +327,170 @@ func TestCreateSegment(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAllSegments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockSegmentService(ctrl)
+	handler := New(mockService)
+
+	type args struct {
+		query string
+	}
+
+	capacity := 8
+	segments := []segmentService.SegmentInfo{
+		{ID: 1, Name: "segment1", AutomaticPercentage: 90, Members: 3, Capacity: &capacity},
+		{ID: 2, Name: "segment2", AutomaticPercentage: 100, Members: 0},
+	}
+
+	taggedSegments := []segmentService.SegmentInfo{
+		{ID: 3, Name: "segment3", AutomaticPercentage: 50, Members: 7, Owner: "growth", Tags: []string{"checkout"}},
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully get the last segments page",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					GetAllSegments(gomock.Any(), segmentService.NewFilter("seg", "", "", false, 0, 20)).
+					Return(segments, nil)
+			},
+			args: args{
+				query: "?prefix=seg",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetSegmentsResponse([]SegmentResponseInfo{
+					NewSegmentResponseInfo(1, "segment1", 10, 3, "", nil, NewSegmentCapacity(&capacity, 3), SegmentWindow{}, SegmentPrerequisites{}, SegmentMetadata{}),
+					NewSegmentResponseInfo(2, "segment2", 0, 0, "", nil, SegmentCapacity{}, SegmentWindow{}, SegmentPrerequisites{}, SegmentMetadata{}),
+				}, 0))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should return next cursor for the full page",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					GetAllSegments(gomock.Any(), segmentService.NewFilter("", "", "", false, 5, 2)).
+					Return(segments, nil)
+			},
+			args: args{
+				query: "?cursor=5&limit=2",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetSegmentsResponse([]SegmentResponseInfo{
+					NewSegmentResponseInfo(1, "segment1", 10, 3, "", nil, NewSegmentCapacity(&capacity, 3), SegmentWindow{}, SegmentPrerequisites{}, SegmentMetadata{}),
+					NewSegmentResponseInfo(2, "segment2", 0, 0, "", nil, SegmentCapacity{}, SegmentWindow{}, SegmentPrerequisites{}, SegmentMetadata{}),
+				}, 2))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should filter segments by tag and owner",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					GetAllSegments(gomock.Any(), segmentService.NewFilter("", "checkout", "growth", false, 0, 20)).
+					Return(taggedSegments, nil)
+			},
+			args: args{
+				query: "?tag=checkout&owner=growth",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetSegmentsResponse([]SegmentResponseInfo{
+					NewSegmentResponseInfo(3, "segment3", 50, 7, "", nil, SegmentCapacity{}, SegmentWindow{}, SegmentPrerequisites{}, NewSegmentMetadata("", "growth", []string{"checkout"}, nil)),
+				}, 0))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Invalid archived parameter",
+			mockCall: func() {
+			},
+			args: args{
+				query: "?archived=maybe",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid archived parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Invalid cursor parameter",
+			mockCall: func() {
+			},
+			args: args{
+				query: "?cursor=abc",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid cursor parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Limit validation error",
+			mockCall: func() {
+			},
+			args: args{
+				query: "?limit=1000",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{{Field: "Limit", Tag: "lte", Param: "100"}})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Service error",
+			mockCall: func() {
+				mockService.
+					EXPECT().
+					GetAllSegments(gomock.Any(), gomock.Any()).
+					Return(nil, errors.New("service error"))
+			},
+			args: args{
+				query: "",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get segments error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/segments"+test.args.query, nil)
+			assert.NoError(t, err)
+			handler.GetAllSegments(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
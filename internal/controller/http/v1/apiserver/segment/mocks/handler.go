@@ -8,6 +8,7 @@ import (
 	context "context"
 	reflect "reflect"
 
+	segment "github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -35,16 +36,31 @@ func (m *MockSegmentService) EXPECT() *MockSegmentServiceMockRecorder {
 }
 
 // CreateSegment mocks base method.
-func (m *MockSegmentService) CreateSegment(ctx context.Context, name string, percentage int) (int64, error) {
+func (m *MockSegmentService) CreateSegment(ctx context.Context, segment segment.SegmentInfo, assignExisting bool) (int64, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateSegment", ctx, name, percentage)
+	ret := m.ctrl.Call(m, "CreateSegment", ctx, segment, assignExisting)
 	ret0, _ := ret[0].(int64)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CreateSegment indicates an expected call of CreateSegment.
-func (mr *MockSegmentServiceMockRecorder) CreateSegment(ctx, name, percentage interface{}) *gomock.Call {
+func (mr *MockSegmentServiceMockRecorder) CreateSegment(ctx, segment, assignExisting interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegmentService)(nil).CreateSegment), ctx, name, percentage)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegmentService)(nil).CreateSegment), ctx, segment, assignExisting)
+}
+
+// GetAllSegments mocks base method.
+func (m *MockSegmentService) GetAllSegments(ctx context.Context, filter segment.Filter) ([]segment.SegmentInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAllSegments", ctx, filter)
+	ret0, _ := ret[0].([]segment.SegmentInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAllSegments indicates an expected call of GetAllSegments.
+func (mr *MockSegmentServiceMockRecorder) GetAllSegments(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllSegments", reflect.TypeOf((*MockSegmentService)(nil).GetAllSegments), ctx, filter)
 }
@@ -6,9 +6,12 @@ import (
 	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/config"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/audit"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/export"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/history"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/membership"
 	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/segment"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/user"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -19,24 +22,38 @@ func New(
 	segmentService segment.SegmentService,
 	historyService history.HistoryService,
 	membershipService membership.MembershipService,
+	auditService audit.AuditService,
+	userService user.UserService,
+	exportService export.ExportService,
 	pool history.BufferPool,
 	writer history.CSVWriter,
+	auditWriter audit.CSVWriter,
 ) *http.Server {
 
 	segmentHandler := segment.New(segmentService)
 	historyHandler := history.New(historyService, history.NewLinkParam(download.Host, download.Port), pool, writer)
-	membershipHandler := membership.New(membershipService)
+	membershipHandler := membership.New(membershipService, userService)
+	auditHandler := audit.New(auditService, pool, auditWriter)
+	userHandler := user.New(userService)
+	exportHandler := export.New(exportService, pool, writer)
 
 	router := chi.NewRouter()
 
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
+	router.Use(withActor)
 
 	router.Route("/api/v1", func(r chi.Router) {
 		r.Route("/segments", func(r chi.Router) {
 			r.Post("/", segmentHandler.CreateSegment)
+			r.Get("/", segmentHandler.GetAllSegments)
 			r.Route("/{segmentName}", func(r chi.Router) {
-				r.Delete("/", membershipHandler.DeleteMembership)
+				r.Delete("/", membershipHandler.ArchiveSegment)
+				r.Patch("/", membershipHandler.UpdateSegment)
+				r.Post("/restore", membershipHandler.RestoreSegment)
+				r.Put("/ramp", membershipHandler.SetRamp)
+				r.Patch("/ramp", membershipHandler.PauseRamp)
+				r.Get("/audit", auditHandler.GetSegmentAudit)
 			})
 		})
 
@@ -46,11 +63,26 @@ func New(
 
 		r.Route("/users", func(r chi.Router) {
 			r.Post("/", membershipHandler.CreateUser)
+			r.Post("/import", membershipHandler.ImportUsers)
+			r.Post("/segments:batchGet", membershipHandler.BatchGetUserMembership)
+			r.Get("/", userHandler.GetUsers)
 			r.Route("/{userID}", func(r chi.Router) {
+				r.Use(withUser(userService))
 				r.Get("/", membershipHandler.GetUserMembership)
+				r.Patch("/", userHandler.UpdateUser)
+				r.Delete("/", membershipHandler.EraseUser)
+				r.Get("/profile", userHandler.GetUserProfile)
+				r.Get("/export", exportHandler.ExportUser)
+				r.Get("/segments/{segmentName}", membershipHandler.CheckUserMembership)
+				r.Head("/segments/{segmentName}", membershipHandler.CheckUserMembership)
 			})
 		})
 
+		r.Route("/attributes", func(r chi.Router) {
+			r.Post("/", userHandler.CreateAttribute)
+			r.Get("/", userHandler.GetAttributes)
+		})
+
 		r.Route("/history", func(r chi.Router) {
 			r.Post("/link", historyHandler.CreateLink)
 			r.Route("/download/{year}", func(r chi.Router) {
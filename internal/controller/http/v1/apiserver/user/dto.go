@@ -0,0 +1,114 @@
+package user
+
+import (
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+)
+
+type UpdateUserRequest struct {
+	FirstName  *string                `json:"firsName" validate:"omitempty,min=3,max=20"`
+	LastName   *string                `json:"lastName" validate:"omitempty,min=3,max=20"`
+	Email      *string                `json:"email" validate:"omitempty,min=5,max=254"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type GetUsersRequest struct {
+	Email  string `json:"email" validate:"max=254"`
+	Cursor int64  `json:"cursor" validate:"gte=0"`
+	Limit  uint64 `json:"limit" validate:"gte=1,lte=100"`
+}
+
+type CreateAttributeRequest struct {
+	Name        string `json:"name" validate:"required,max=64"`
+	Type        string `json:"type" validate:"required,oneof=string number boolean date"`
+	Description string `json:"description" validate:"max=1024"`
+}
+
+type AttributeResponse struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type GetAttributesResponse struct {
+	Attributes []AttributeResponse `json:"attributes"`
+}
+
+type UserResponse struct {
+	ID          int64                  `json:"userID"`
+	FirstName   string                 `json:"firsName"`
+	LastName    string                 `json:"lastName"`
+	Email       string                 `json:"email"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	ExternalIDs []ExternalIDResponse   `json:"externalIDs,omitempty"`
+}
+
+type ExternalIDResponse struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+}
+
+type GetUsersResponse struct {
+	Users      []UserResponse `json:"users"`
+	NextCursor int64          `json:"nextCursor,omitempty"`
+}
+
+func (u UpdateUserRequest) ToModel() user.Update {
+	return user.Update{
+		FirstName:  u.FirstName,
+		LastName:   u.LastName,
+		Email:      u.Email,
+		Attributes: u.Attributes,
+	}
+}
+
+func (g GetUsersRequest) ToModel() user.Filter {
+	return user.NewFilter(g.Email, g.Cursor, g.Limit)
+}
+
+func NewUserResponse(u user.User) UserResponse {
+	attributes := u.Attributes
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	var externalIDs []ExternalIDResponse
+	for _, external := range u.ExternalIDs {
+		externalIDs = append(externalIDs, ExternalIDResponse{Namespace: external.Namespace, ID: external.ID})
+	}
+	return UserResponse{
+		ID:          u.ID,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Email:       u.Email,
+		Attributes:  attributes,
+		ExternalIDs: externalIDs,
+	}
+}
+
+func NewGetUsersResponse(users []UserResponse, nextCursor int64) GetUsersResponse {
+	return GetUsersResponse{
+		Users:      users,
+		NextCursor: nextCursor,
+	}
+}
+
+func (c CreateAttributeRequest) ToModel() user.Attribute {
+	return user.NewAttribute(c.Name, user.AttributeType(c.Type), c.Description)
+}
+
+func NewAttributeResponse(a user.Attribute) AttributeResponse {
+	return AttributeResponse{
+		Name:        a.Name,
+		Type:        string(a.Type),
+		Description: a.Description,
+		CreatedAt:   a.CreatedAt,
+	}
+}
+
+func NewGetAttributesResponse(attributes []AttributeResponse) GetAttributesResponse {
+	return GetAttributesResponse{
+		Attributes: attributes,
+	}
+}
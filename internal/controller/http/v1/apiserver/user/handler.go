@@ -0,0 +1,316 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/validator"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultLimit uint64 = 20
+)
+
+type UserService interface {
+	GetUser(ctx context.Context, userID int64) (user.User, error)
+	GetUsers(ctx context.Context, filter user.Filter) ([]user.User, error)
+	UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error)
+	ResolveUser(ctx context.Context, ref string) (int64, error)
+	CreateAttribute(ctx context.Context, attribute user.Attribute) (user.Attribute, error)
+	GetAttributes(ctx context.Context) ([]user.Attribute, error)
+}
+
+type handler struct {
+	user UserService
+}
+
+func New(user UserService) *handler {
+	return &handler{
+		user: user,
+	}
+}
+
+// @Summary Get user profile
+// @Description Get the user with its attributes
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
+// @Success 200 {object} UserResponse "User profile"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/{userID}/profile [get]
+func (h *handler) GetUserProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid user id parameter")
+		return
+	}
+
+	u, err := h.user.GetUser(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "User with the specified id wasn't found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get user error")
+		return
+	}
+
+	h.writeUser(w, u)
+}
+
+// @Summary Update user
+// @Description Update the given user fields, the given attributes are merged into the stored ones
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param  userID   path string  true "User ID or <namespace>:<external id>"
+// @Param updateReq body UpdateUserRequest true "Update user request"
+// @Success 200 {object} UserResponse "Updated user"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 404 {object} apierror.ErrorResponse
+// @Failure 409 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users/{userID} [patch]
+func (h *handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, "Invalid user id parameter")
+		return
+	}
+
+	var updateReq UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(updateReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	u, err := h.user.UpdateUser(r.Context(), userID, updateReq.ToModel())
+	if err != nil {
+		var attributeErr *user.AttributeError
+		switch {
+		case errors.As(err, &attributeErr):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid attributes: %s", attributeErr.Error()))
+			return
+		case errors.Is(err, user.ErrNothingToUpdate):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "At least one user field must be specified for update")
+			return
+		case errors.Is(err, user.ErrInvalidEmail):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid email: %s", err.Error()))
+			return
+		case errors.Is(err, user.ErrUserNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			apierror.WriteErrorMessage(w, "User with the specified id wasn't found")
+			return
+		case errors.Is(err, user.ErrUserAlreadyExist):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorMessage(w, "User already exists")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Update user error")
+		return
+	}
+
+	h.writeUser(w, u)
+}
+
+// @Summary Get users
+// @Description Get a page of users ordered by id, optionally searching by a part of the email
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param  email   query string  false "Part of the user email"
+// @Param  cursor  query int     false "ID of the last user from the previous page"
+// @Param  limit   query int     false "Page size (1-100)"
+// @Success 200 {object} GetUsersResponse "Users page"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /users [get]
+func (h *handler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	usersReq := GetUsersRequest{
+		Email: query.Get("email"),
+		Limit: defaultLimit,
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid cursor parameter")
+			return
+		}
+		usersReq.Cursor = id
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		size, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, "Invalid limit parameter")
+			return
+		}
+		usersReq.Limit = size
+	}
+
+	errs := validator.Validate(usersReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	data, err := h.user.GetUsers(r.Context(), usersReq.ToModel())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get users error")
+		return
+	}
+
+	response := make([]UserResponse, len(data))
+	for i, u := range data {
+		response[i] = NewUserResponse(u)
+	}
+
+	var nextCursor int64
+	if uint64(len(data)) == usersReq.Limit {
+		nextCursor = data[len(data)-1].ID
+	}
+
+	jsonResponse, err := json.Marshal(NewGetUsersResponse(response, nextCursor))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// @Summary Register user attribute
+// @Description Register a typed user attribute, only registered attributes can be set on users.
+// @Description Date attributes are strings like 2023-08-25.
+// @Tags Attributes
+// @Accept json
+// @Produce json
+// @Param attributeReq body CreateAttributeRequest true "Register attribute request"
+// @Success 201 {object} AttributeResponse "Registered attribute"
+// @Failure 400 {object} apierror.ErrorResponse
+// @Failure 409 {object} apierror.ErrorResponse
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /attributes [post]
+func (h *handler) CreateAttribute(w http.ResponseWriter, r *http.Request) {
+	var attributeReq CreateAttributeRequest
+	if err := json.NewDecoder(r.Body).Decode(&attributeReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	errs := validator.Validate(attributeReq)
+	if errs != nil {
+		jsonErr, _ := json.Marshal(errs)
+		w.WriteHeader(http.StatusBadRequest)
+		apierror.WriteErrorMessage(w, string(jsonErr))
+		return
+	}
+
+	attribute, err := h.user.CreateAttribute(r.Context(), attributeReq.ToModel())
+	if err != nil {
+		switch {
+		case errors.Is(err, user.ErrInvalidAttribute):
+			w.WriteHeader(http.StatusBadRequest)
+			apierror.WriteErrorMessage(w, fmt.Sprintf("Invalid attribute: %s", err.Error()))
+			return
+		case errors.Is(err, user.ErrAttributeAlreadyExist):
+			w.WriteHeader(http.StatusConflict)
+			apierror.WriteErrorMessage(w, "Attribute already exists")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Register attribute error")
+		return
+	}
+
+	jsonResponse, err := json.Marshal(NewAttributeResponse(attribute))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// @Summary Get user attributes
+// @Description Get the registered user attributes
+// @Tags Attributes
+// @Accept json
+// @Produce json
+// @Success 200 {object} GetAttributesResponse "Registered attributes"
+// @Failure 500 {object} apierror.ErrorResponse
+// @Router /attributes [get]
+func (h *handler) GetAttributes(w http.ResponseWriter, r *http.Request) {
+	attributes, err := h.user.GetAttributes(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, "Get attributes error")
+		return
+	}
+
+	response := make([]AttributeResponse, len(attributes))
+	for i, a := range attributes {
+		response[i] = NewAttributeResponse(a)
+	}
+
+	jsonResponse, err := json.Marshal(NewGetAttributesResponse(response))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+func (h *handler) writeUser(w http.ResponseWriter, u user.User) {
+	jsonResponse, err := json.Marshal(NewUserResponse(u))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		apierror.WriteErrorMessage(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,550 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/apierror"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/apiserver/user/mocks"
+	"github.com/VrMolodyakov/segment-api/internal/controller/http/v1/validator"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func AddChiURLParams(r *http.Request, params map[string]string) *http.Request {
+	ctx := chi.NewRouteContext()
+	for k, v := range params {
+		ctx.URLParams.Add(k, v)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, ctx))
+}
+
+func TestGetUserProfile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockUserService(ctrl)
+	handler := New(mockService)
+
+	profile := user.User{
+		ID:         1,
+		FirstName:  "Arnold",
+		LastName:   "Jones",
+		Email:      "t2000@mail.ru",
+		Attributes: map[string]interface{}{"city": "Moscow"},
+	}
+
+	type args struct {
+		userID string
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully get the user profile",
+			mockCall: func() {
+				mockService.EXPECT().GetUser(gomock.Any(), int64(1)).Return(profile, nil)
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewUserResponse(profile))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:    "Invalid user id",
+			mockCall: func() {},
+			args: args{
+				userID: "user",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid user id parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockService.EXPECT().GetUser(gomock.Any(), int64(1)).Return(user.User{}, user.ErrUserNotFound)
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User with the specified id wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Service internal error",
+			mockCall: func() {
+				mockService.EXPECT().GetUser(gomock.Any(), int64(1)).Return(user.User{}, errors.New("internal error"))
+			},
+			args: args{
+				userID: "1",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get user error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, map[string]string{"userID": test.args.userID})
+			handler.GetUserProfile(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockUserService(ctrl)
+	handler := New(mockService)
+
+	email := "t1000@mail.ru"
+	updated := user.User{
+		ID:        1,
+		FirstName: "Arnold",
+		LastName:  "Jones",
+		Email:     email,
+	}
+
+	type args struct {
+		req UpdateUserRequest
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully update the user",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), user.Update{Email: &email}).Return(updated, nil)
+			},
+			args: args{
+				req: UpdateUserRequest{Email: &email},
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewUserResponse(updated))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Nothing to update",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, user.ErrNothingToUpdate)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "At least one user field must be specified for update"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Invalid email",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, user.ErrInvalidEmail)
+			},
+			args: args{
+				req: UpdateUserRequest{Email: &email},
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: fmt.Sprintf("Invalid email: %s", user.ErrInvalidEmail.Error())})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, user.ErrUserNotFound)
+			},
+			args: args{
+				req: UpdateUserRequest{Email: &email},
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User with the specified id wasn't found"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 404,
+		},
+		{
+			title: "Email already taken",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, user.ErrUserAlreadyExist)
+			},
+			args: args{
+				req: UpdateUserRequest{Email: &email},
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "User already exists"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Attribute is not registered",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, &user.AttributeError{Name: "city"})
+			},
+			args: args{
+				req: UpdateUserRequest{Attributes: map[string]interface{}{"city": "Moscow"}},
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: `Invalid attributes: attribute "city" is not registered`})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Service internal error",
+			mockCall: func() {
+				mockService.EXPECT().UpdateUser(gomock.Any(), int64(1), gomock.Any()).Return(user.User{}, errors.New("internal error"))
+			},
+			args: args{
+				req: UpdateUserRequest{Email: &email},
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Update user error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			body, err := json.Marshal(test.args.req)
+			assert.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPatch, "/", bytes.NewBuffer(body))
+			assert.NoError(t, err)
+			req = AddChiURLParams(req, map[string]string{"userID": "1"})
+			handler.UpdateUser(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockUserService(ctrl)
+	handler := New(mockService)
+
+	type args struct {
+		query string
+	}
+
+	users := []user.User{
+		{ID: 1, FirstName: "Arnold", LastName: "Jones", Email: "t2000@mail.ru"},
+		{ID: 2, FirstName: "Sarah", LastName: "Connor", Email: "s_connor@mail.ru"},
+	}
+
+	tests := []struct {
+		title            string
+		args             args
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully get the last users page",
+			mockCall: func() {
+				mockService.EXPECT().GetUsers(gomock.Any(), user.NewFilter("mail.ru", 0, 20)).Return(users, nil)
+			},
+			args: args{
+				query: "?email=mail.ru",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetUsersResponse([]UserResponse{
+					NewUserResponse(users[0]),
+					NewUserResponse(users[1]),
+				}, 0))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Should return next cursor for a full page",
+			mockCall: func() {
+				mockService.EXPECT().GetUsers(gomock.Any(), user.NewFilter("", 5, 2)).Return(users, nil)
+			},
+			args: args{
+				query: "?cursor=5&limit=2",
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetUsersResponse([]UserResponse{
+					NewUserResponse(users[0]),
+					NewUserResponse(users[1]),
+				}, 2))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title:    "Invalid cursor parameter",
+			mockCall: func() {},
+			args: args{
+				query: "?cursor=abc",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid cursor parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title:    "Invalid limit parameter",
+			mockCall: func() {},
+			args: args{
+				query: "?limit=-1",
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Invalid limit parameter"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Service internal error",
+			mockCall: func() {
+				mockService.EXPECT().GetUsers(gomock.Any(), gomock.Any()).Return(nil, errors.New("internal error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get users error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/users"+test.args.query, nil)
+			assert.NoError(t, err)
+			handler.GetUsers(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestCreateAttribute(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockUserService(ctrl)
+	handler := New(mockService)
+
+	attribute := user.NewAttribute("signup_date", user.AttributeDate, "First visit")
+	created := attribute
+	created.CreatedAt = time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		title            string
+		req              CreateAttributeRequest
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully register the attribute",
+			req:   CreateAttributeRequest{Name: "signup_date", Type: "date", Description: "First visit"},
+			mockCall: func() {
+				mockService.EXPECT().CreateAttribute(gomock.Any(), attribute).Return(created, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewAttributeResponse(created))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 201,
+		},
+		{
+			title:    "Unknown attribute type",
+			req:      CreateAttributeRequest{Name: "signup_date", Type: "timestamp"},
+			mockCall: func() {},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal([]validator.ValidateError{
+					{
+						Field: "Type",
+						Tag:   "oneof",
+						Param: "string number boolean date",
+					},
+				})
+				assert.NoError(t, err)
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: string(expectedJSON)})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Invalid attribute name",
+			req:   CreateAttributeRequest{Name: "Signup-Date", Type: "date"},
+			mockCall: func() {
+				mockService.EXPECT().CreateAttribute(gomock.Any(), gomock.Any()).Return(user.Attribute{}, user.ErrInvalidAttribute)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: fmt.Sprintf("Invalid attribute: %s", user.ErrInvalidAttribute.Error())})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 400,
+		},
+		{
+			title: "Attribute already registered",
+			req:   CreateAttributeRequest{Name: "signup_date", Type: "date", Description: "First visit"},
+			mockCall: func() {
+				mockService.EXPECT().CreateAttribute(gomock.Any(), attribute).Return(user.Attribute{}, user.ErrAttributeAlreadyExist)
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Attribute already exists"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 409,
+		},
+		{
+			title: "Service internal error",
+			req:   CreateAttributeRequest{Name: "signup_date", Type: "date", Description: "First visit"},
+			mockCall: func() {
+				mockService.EXPECT().CreateAttribute(gomock.Any(), attribute).Return(user.Attribute{}, errors.New("internal error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Register attribute error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			body, err := json.Marshal(test.req)
+			assert.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+			assert.NoError(t, err)
+			handler.CreateAttribute(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
+
+func TestGetAttributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockService := mocks.NewMockUserService(ctrl)
+	handler := New(mockService)
+
+	attributes := []user.Attribute{
+		{Name: "country", Type: user.AttributeString, CreatedAt: time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)},
+	}
+
+	tests := []struct {
+		title            string
+		exoectedCode     int
+		mockCall         func()
+		expectedResponse func() string
+	}{
+		{
+			title: "Should successfully get the attributes",
+			mockCall: func() {
+				mockService.EXPECT().GetAttributes(gomock.Any()).Return(attributes, nil)
+			},
+			expectedResponse: func() string {
+				expectedJSON, err := json.Marshal(NewGetAttributesResponse([]AttributeResponse{NewAttributeResponse(attributes[0])}))
+				assert.NoError(t, err)
+				return string(expectedJSON)
+			},
+			exoectedCode: 200,
+		},
+		{
+			title: "Service internal error",
+			mockCall: func() {
+				mockService.EXPECT().GetAttributes(gomock.Any()).Return(nil, errors.New("internal error"))
+			},
+			expectedResponse: func() string {
+				resp, err := json.Marshal(apierror.ErrorResponse{Message: "Get attributes error"})
+				assert.NoError(t, err)
+				return string(resp)
+			},
+			exoectedCode: 500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			assert.NoError(t, err)
+			handler.GetAttributes(w, req)
+
+			assert.Equal(t, test.expectedResponse(), w.Body.String())
+			assert.Equal(t, test.exoectedCode, w.Code)
+		})
+	}
+}
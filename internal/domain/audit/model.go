@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	// SystemActor is recorded for the mutations made by background jobs.
+	SystemActor string = "system"
+	timeFormat  string = "2006-01-02 15:04:05"
+)
+
+type Operation string
+
+var (
+	Created     = Operation("created")
+	Updated     = Operation("updated")
+	Archived    = Operation("archived")
+	Restored    = Operation("restored")
+	Purged      = Operation("purged")
+	RampSet     = Operation("ramp_set")
+	RampPaused  = Operation("ramp_paused")
+	RampResumed = Operation("ramp_resumed")
+	RampStep    = Operation("ramp_step")
+	location, _ = time.LoadLocation("Europe/Moscow")
+)
+
+// Values holds the segment fields touched by a mutation, keyed by their API names.
+type Values map[string]interface{}
+
+type Event struct {
+	ID        int64
+	SegmentID int64
+	Segment   string
+	Actor     string
+	Operation Operation
+	Before    Values
+	After     Values
+	Time      time.Time
+}
+
+func (e Event) Row() []string {
+	return []string{
+		strconv.FormatInt(e.ID, 10),
+		e.Segment,
+		e.Actor,
+		string(e.Operation),
+		e.Before.String(),
+		e.After.String(),
+		e.Time.In(location).Format(timeFormat),
+	}
+}
+
+func (e Event) Headers() []string {
+	return []string{"ID", "Segment", "Actor", "Operation", "Before", "After", "Time"}
+}
+
+func (v Values) String() string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type actorKey struct{}
+
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor of the request, SystemActor when there is none.
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return SystemActor
+}
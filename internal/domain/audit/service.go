@@ -0,0 +1,32 @@
+package audit
+
+import (
+	"context"
+
+	"github.com/VrMolodyakov/segment-api/pkg/logging"
+)
+
+type AuditRepository interface {
+	GetSegmentAudit(ctx context.Context, segmentName string) ([]Event, error)
+}
+
+type service struct {
+	logger logging.Logger
+	audit  AuditRepository
+}
+
+func New(audit AuditRepository, logger logging.Logger) *service {
+	return &service{
+		audit:  audit,
+		logger: logger,
+	}
+}
+
+func (s *service) GetSegmentAudit(ctx context.Context, segmentName string) ([]Event, error) {
+	s.logger.Debugf("try to get %s segment audit", segmentName)
+	events, err := s.audit.GetSegmentAudit(ctx, segmentName)
+	if err != nil {
+		s.logger.Errorf("cannot get %s segment audit due to %s", segmentName, err.Error())
+	}
+	return events, err
+}
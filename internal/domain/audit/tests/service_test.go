@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit/mocks"
+	"github.com/VrMolodyakov/segment-api/pkg/logging"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSegmentAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockRepo := mocks.NewMockAuditRepository(ctrl)
+	auditService := audit.New(mockRepo, mockLogger)
+	ctx := context.Background()
+
+	type mockCall func()
+	type args struct {
+		segmentName string
+	}
+	events := []audit.Event{{ID: 1, Segment: "seg-1", Actor: "admin", Operation: audit.Created}}
+	testCases := []struct {
+		title    string
+		mockCall mockCall
+		args     args
+		expected []audit.Event
+		isError  bool
+	}{
+		{
+			title: "Successfully retrieved from the repo",
+			mockCall: func() {
+				mockRepo.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(events, nil)
+			},
+			args: args{
+				segmentName: "seg-1",
+			},
+			expected: events,
+		},
+		{
+			title: "Repo error",
+			mockCall: func() {
+				mockRepo.EXPECT().GetSegmentAudit(gomock.Any(), "seg-1").Return(nil, errors.New("repo error"))
+			},
+			args: args{
+				segmentName: "seg-1",
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := auditService.GetSegmentAudit(ctx, test.args.segmentName)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, got)
+			}
+		})
+	}
+}
@@ -8,18 +8,24 @@ import (
 )
 
 type MembershipRepository interface {
+	ActivateScheduled(ctx context.Context) error
 	DeleteExpired(ctx context.Context) error
+	PurgeArchived(ctx context.Context, grace time.Duration) error
+	RetireEnded(ctx context.Context) error
+	ReconcileRules(ctx context.Context) error
 }
 
 type service struct {
-	logger     logging.Logger
-	membership MembershipRepository
+	logger       logging.Logger
+	archiveGrace time.Duration
+	membership   MembershipRepository
 }
 
-func New(membership MembershipRepository, logger logging.Logger) *service {
+func New(membership MembershipRepository, archiveGrace time.Duration, logger logging.Logger) *service {
 	return &service{
-		membership: membership,
-		logger:     logger,
+		membership:   membership,
+		archiveGrace: archiveGrace,
+		logger:       logger,
 	}
 }
 
@@ -42,6 +48,19 @@ func (s *service) deleteExpired(ctx context.Context, interval time.Duration) {
 			if err := s.membership.DeleteExpired(childCtx); err != nil {
 				s.logger.Errorf("couldn't delete expired rows, %s", err.Error())
 			}
+			if err := s.membership.RetireEnded(childCtx); err != nil {
+				s.logger.Errorf("couldn't retire ended segments, %s", err.Error())
+			}
+			// scheduled memberships are admitted once expired and ended ones have freed their layers
+			if err := s.membership.ActivateScheduled(childCtx); err != nil {
+				s.logger.Errorf("couldn't activate scheduled memberships, %s", err.Error())
+			}
+			if err := s.membership.ReconcileRules(childCtx); err != nil {
+				s.logger.Errorf("couldn't reconcile rule based segments, %s", err.Error())
+			}
+			if err := s.membership.PurgeArchived(childCtx, s.archiveGrace); err != nil {
+				s.logger.Errorf("couldn't purge archived segments, %s", err.Error())
+			}
 			cancel()
 		}
 	}
@@ -0,0 +1,14 @@
+package export
+
+import (
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+)
+
+// UserData is everything stored about a single user.
+type UserData struct {
+	User        user.User
+	Memberships []membership.MembershipInfo
+	History     []history.History
+}
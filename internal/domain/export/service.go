@@ -0,0 +1,65 @@
+package export
+
+import (
+	"context"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/pkg/logging"
+)
+
+type UserRepository interface {
+	Get(ctx context.Context, userID int64) (user.User, error)
+}
+
+type MembershipRepository interface {
+	GetUserSegments(ctx context.Context, userID int64) ([]membership.MembershipInfo, error)
+}
+
+type HistoryRepository interface {
+	GetUserHistory(ctx context.Context, userID int64) ([]history.History, error)
+}
+
+type service struct {
+	logger     logging.Logger
+	user       UserRepository
+	membership MembershipRepository
+	history    HistoryRepository
+}
+
+func New(user UserRepository, membership MembershipRepository, history HistoryRepository, logger logging.Logger) *service {
+	return &service{
+		user:       user,
+		membership: membership,
+		history:    history,
+		logger:     logger,
+	}
+}
+
+func (s *service) ExportUser(ctx context.Context, userID int64) (UserData, error) {
+	s.logger.Debugf("try to export user %d data", userID)
+	u, err := s.user.Get(ctx, userID)
+	if err != nil {
+		s.logger.Errorf("cannot get user %d for export due to %s", userID, err.Error())
+		return UserData{}, err
+	}
+
+	memberships, err := s.membership.GetUserSegments(ctx, userID)
+	if err != nil {
+		s.logger.Errorf("cannot get user %d segments for export due to %s", userID, err.Error())
+		return UserData{}, err
+	}
+
+	trail, err := s.history.GetUserHistory(ctx, userID)
+	if err != nil {
+		s.logger.Errorf("cannot get user %d history for export due to %s", userID, err.Error())
+		return UserData{}, err
+	}
+
+	return UserData{
+		User:        u,
+		Memberships: memberships,
+		History:     trail,
+	}, nil
+}
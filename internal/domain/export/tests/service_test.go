@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/export"
+	"github.com/VrMolodyakov/segment-api/internal/domain/export/mocks"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/pkg/logging"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockUser := mocks.NewMockUserRepository(ctrl)
+	mockMembership := mocks.NewMockMembershipRepository(ctrl)
+	mockHistory := mocks.NewMockHistoryRepository(ctrl)
+	exportService := export.New(mockUser, mockMembership, mockHistory, mockLogger)
+	ctx := context.Background()
+
+	userID := int64(1)
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	profile := user.User{ID: userID, Email: "example@example.com"}
+	memberships := []membership.MembershipInfo{{UserID: userID, SegmentName: "segment1", ExpiredAt: testTime}}
+	trail := []history.History{{ID: 1, UserID: userID, Segment: "segment1", Operation: history.Added, Time: testTime}}
+
+	type mockCall func()
+	testCases := []struct {
+		title         string
+		mockCall      mockCall
+		expected      export.UserData
+		expectedError error
+		isError       bool
+	}{
+		{
+			title: "Successfully collected user data",
+			mockCall: func() {
+				mockUser.EXPECT().Get(gomock.Any(), userID).Return(profile, nil)
+				mockMembership.EXPECT().GetUserSegments(gomock.Any(), userID).Return(memberships, nil)
+				mockHistory.EXPECT().GetUserHistory(gomock.Any(), userID).Return(trail, nil)
+			},
+			expected: export.UserData{
+				User:        profile,
+				Memberships: memberships,
+				History:     trail,
+			},
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockUser.EXPECT().Get(gomock.Any(), userID).Return(user.User{}, user.ErrUserNotFound)
+			},
+			expectedError: user.ErrUserNotFound,
+			isError:       true,
+		},
+		{
+			title: "History repo error",
+			mockCall: func() {
+				mockUser.EXPECT().Get(gomock.Any(), userID).Return(profile, nil)
+				mockMembership.EXPECT().GetUserSegments(gomock.Any(), userID).Return(memberships, nil)
+				mockHistory.EXPECT().GetUserHistory(gomock.Any(), userID).Return(nil, errors.New("repo error"))
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := exportService.ExportUser(ctx, userID)
+			if test.isError {
+				assert.Error(t, err)
+				if test.expectedError != nil {
+					assert.ErrorIs(t, err, test.expectedError)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
@@ -16,15 +16,23 @@ type Operation string
 var (
 	Deleted     = Operation("deleted")
 	Added       = Operation("added")
+	Archived    = Operation("archived")
+	Restored    = Operation("restored")
+	Purged      = Operation("purged")
+	Extended    = Operation("extended")
 	location, _ = time.LoadLocation("Europe/Moscow")
 )
 
 type History struct {
-	ID        int64
-	UserID    int64
-	Segment   string
-	Operation Operation
-	Time      time.Time
+	ID             int64
+	UserID         int64
+	AnonymousID    string
+	Segment        string
+	Variant        string
+	Operation      Operation
+	Time           time.Time
+	Attributes     map[string]interface{}
+	AttributeNames []string
 }
 
 type Date struct {
@@ -54,14 +62,39 @@ func (d Date) Validate() error {
 }
 
 func (h History) Row() []string {
-	return []string{
-		strconv.FormatInt(h.UserID, 10),
+	user := strconv.FormatInt(h.UserID, 10)
+	if h.AnonymousID != "" {
+		user = h.AnonymousID
+	}
+	row := []string{
+		user,
 		h.Segment,
+		h.Variant,
 		string(h.Operation),
 		h.Time.In(location).Format(timeFormat),
 	}
+	for _, name := range h.AttributeNames {
+		row = append(row, formatAttribute(h.Attributes[name]))
+	}
+	return row
 }
 
+// Headers are followed by a column per registered user attribute, filled with the current
+// value of the attribute rather than the one the user had when the event happened.
 func (h History) Headers() []string {
-	return []string{"ID", "UserID", "Segment", "Operation", "Time"}
+	return append([]string{"UserID", "Segment", "Variant", "Operation", "Time"}, h.AttributeNames...)
+}
+
+func formatAttribute(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
 }
@@ -0,0 +1,23 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryRowWithAttributes(t *testing.T) {
+	record := history.History{
+		UserID:         1,
+		Segment:        "segment1",
+		Operation:      history.Added,
+		Time:           time.Date(2023, 8, 25, 9, 0, 0, 0, time.UTC),
+		Attributes:     map[string]interface{}{"age": float64(31), "beta": true, "country": "RU"},
+		AttributeNames: []string{"age", "beta", "country", "platform"},
+	}
+
+	assert.Equal(t, []string{"UserID", "Segment", "Variant", "Operation", "Time", "age", "beta", "country", "platform"}, record.Headers())
+	assert.Equal(t, []string{"1", "segment1", "", "added", "2023-08-25 12:00:00", "31", "true", "RU", ""}, record.Row())
+}
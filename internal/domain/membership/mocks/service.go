@@ -12,6 +12,7 @@ import (
 	membership "github.com/VrMolodyakov/segment-api/internal/domain/membership"
 	segment "github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	user "github.com/VrMolodyakov/segment-api/internal/domain/user"
+	random "github.com/VrMolodyakov/segment-api/pkg/random"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -38,62 +39,230 @@ func (m *MockMembershipRepository) EXPECT() *MockMembershipRepositoryMockRecorde
 	return m.recorder
 }
 
-// CreateUser mocks base method.
-func (m *MockMembershipRepository) CreateUser(ctx context.Context, user user.User, hitPercentage int) (int64, error) {
+// ArchiveSegment mocks base method.
+func (m *MockMembershipRepository) ArchiveSegment(ctx context.Context, name string, confirm func(membership.DeletePreview) error) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateUser", ctx, user, hitPercentage)
-	ret0, _ := ret[0].(int64)
+	ret := m.ctrl.Call(m, "ArchiveSegment", ctx, name, confirm)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ArchiveSegment indicates an expected call of ArchiveSegment.
+func (mr *MockMembershipRepositoryMockRecorder) ArchiveSegment(ctx, name, confirm interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ArchiveSegment", reflect.TypeOf((*MockMembershipRepository)(nil).ArchiveSegment), ctx, name, confirm)
+}
+
+// GetUserSegments mocks base method.
+func (m *MockMembershipRepository) GetUserSegments(ctx context.Context, userID int64) ([]membership.MembershipInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegments", ctx, userID)
+	ret0, _ := ret[0].([]membership.MembershipInfo)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CreateUser indicates an expected call of CreateUser.
-func (mr *MockMembershipRepositoryMockRecorder) CreateUser(ctx, user, hitPercentage interface{}) *gomock.Call {
+// GetUserSegments indicates an expected call of GetUserSegments.
+func (mr *MockMembershipRepositoryMockRecorder) GetUserSegments(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegments", reflect.TypeOf((*MockMembershipRepository)(nil).GetUserSegments), ctx, userID)
+}
+
+// GetUsersSegments mocks base method.
+func (m *MockMembershipRepository) GetUsersSegments(ctx context.Context, userIDs []int64) ([]membership.MembershipInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUsersSegments", ctx, userIDs)
+	ret0, _ := ret[0].([]membership.MembershipInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUsersSegments indicates an expected call of GetUsersSegments.
+func (mr *MockMembershipRepositoryMockRecorder) GetUsersSegments(ctx, userIDs interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockMembershipRepository)(nil).CreateUser), ctx, user, hitPercentage)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsersSegments", reflect.TypeOf((*MockMembershipRepository)(nil).GetUsersSegments), ctx, userIDs)
 }
 
-// DeleteSegment mocks base method.
-func (m *MockMembershipRepository) DeleteSegment(ctx context.Context, name string) error {
+// PauseRamp mocks base method.
+func (m *MockMembershipRepository) PauseRamp(ctx context.Context, name string, paused bool) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteSegment", ctx, name)
+	ret := m.ctrl.Call(m, "PauseRamp", ctx, name, paused)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// DeleteSegment indicates an expected call of DeleteSegment.
-func (mr *MockMembershipRepositoryMockRecorder) DeleteSegment(ctx, name interface{}) *gomock.Call {
+// PauseRamp indicates an expected call of PauseRamp.
+func (mr *MockMembershipRepositoryMockRecorder) PauseRamp(ctx, name, paused interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegment", reflect.TypeOf((*MockMembershipRepository)(nil).DeleteSegment), ctx, name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PauseRamp", reflect.TypeOf((*MockMembershipRepository)(nil).PauseRamp), ctx, name, paused)
 }
 
-// GetUserSegments mocks base method.
-func (m *MockMembershipRepository) GetUserSegments(ctx context.Context, userID int64) ([]membership.MembershipInfo, error) {
+// PreviewDelete mocks base method.
+func (m *MockMembershipRepository) PreviewDelete(ctx context.Context, name string, sampleSize int) (membership.DeletePreview, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserSegments", ctx, userID)
-	ret0, _ := ret[0].([]membership.MembershipInfo)
+	ret := m.ctrl.Call(m, "PreviewDelete", ctx, name, sampleSize)
+	ret0, _ := ret[0].(membership.DeletePreview)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetUserSegments indicates an expected call of GetUserSegments.
-func (mr *MockMembershipRepositoryMockRecorder) GetUserSegments(ctx, userID interface{}) *gomock.Call {
+// PreviewDelete indicates an expected call of PreviewDelete.
+func (mr *MockMembershipRepositoryMockRecorder) PreviewDelete(ctx, name, sampleSize interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegments", reflect.TypeOf((*MockMembershipRepository)(nil).GetUserSegments), ctx, userID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PreviewDelete", reflect.TypeOf((*MockMembershipRepository)(nil).PreviewDelete), ctx, name, sampleSize)
+}
+
+// RestoreSegment mocks base method.
+func (m *MockMembershipRepository) RestoreSegment(ctx context.Context, name string, grace time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreSegment", ctx, name, grace)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestoreSegment indicates an expected call of RestoreSegment.
+func (mr *MockMembershipRepositoryMockRecorder) RestoreSegment(ctx, name, grace interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreSegment", reflect.TypeOf((*MockMembershipRepository)(nil).RestoreSegment), ctx, name, grace)
+}
+
+// SetRamp mocks base method.
+func (m *MockMembershipRepository) SetRamp(ctx context.Context, name string, steps []segment.RampStep) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRamp", ctx, name, steps)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetRamp indicates an expected call of SetRamp.
+func (mr *MockMembershipRepositoryMockRecorder) SetRamp(ctx, name, steps interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRamp", reflect.TypeOf((*MockMembershipRepository)(nil).SetRamp), ctx, name, steps)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockMembershipRepository) UpdateSegment(ctx context.Context, name string, update segment.Update) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, name, update)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockMembershipRepositoryMockRecorder) UpdateSegment(ctx, name, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockMembershipRepository)(nil).UpdateSegment), ctx, name, update)
 }
 
 // UpdateUserSegments mocks base method.
-func (m *MockMembershipRepository) UpdateUserSegments(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string) error {
+func (m *MockMembershipRepository) UpdateUserSegments(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string, policy membership.UpsertPolicy) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateUserSegments", ctx, userID, addSegments, deleteSegments)
+	ret := m.ctrl.Call(m, "UpdateUserSegments", ctx, userID, addSegments, deleteSegments, policy)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateUserSegments indicates an expected call of UpdateUserSegments.
-func (mr *MockMembershipRepositoryMockRecorder) UpdateUserSegments(ctx, userID, addSegments, deleteSegments interface{}) *gomock.Call {
+func (mr *MockMembershipRepositoryMockRecorder) UpdateUserSegments(ctx, userID, addSegments, deleteSegments, policy interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserSegments", reflect.TypeOf((*MockMembershipRepository)(nil).UpdateUserSegments), ctx, userID, addSegments, deleteSegments)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUserSegments", reflect.TypeOf((*MockMembershipRepository)(nil).UpdateUserSegments), ctx, userID, addSegments, deleteSegments, policy)
+}
+
+// MockUserRepository is a mock of UserRepository interface.
+type MockUserRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockUserRepositoryMockRecorder
+}
+
+// MockUserRepositoryMockRecorder is the mock recorder for MockUserRepository.
+type MockUserRepositoryMockRecorder struct {
+	mock *MockUserRepository
+}
+
+// NewMockUserRepository creates a new mock instance.
+func NewMockUserRepository(ctrl *gomock.Controller) *MockUserRepository {
+	mock := &MockUserRepository{ctrl: ctrl}
+	mock.recorder = &MockUserRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUserRepository) EXPECT() *MockUserRepositoryMockRecorder {
+	return m.recorder
+}
+
+// CreateUser mocks base method.
+func (m *MockUserRepository) CreateUser(ctx context.Context, user user.User, bucketing random.Bucketing) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, user, bucketing)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockUserRepositoryMockRecorder) CreateUser(ctx, user, bucketing interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUserRepository)(nil).CreateUser), ctx, user, bucketing)
+}
+
+// EraseUser mocks base method.
+func (m *MockUserRepository) EraseUser(ctx context.Context, userID int64, anonymousID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EraseUser", ctx, userID, anonymousID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EraseUser indicates an expected call of EraseUser.
+func (mr *MockUserRepositoryMockRecorder) EraseUser(ctx, userID, anonymousID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EraseUser", reflect.TypeOf((*MockUserRepository)(nil).EraseUser), ctx, userID, anonymousID)
+}
+
+// GetAttributes mocks base method.
+func (m *MockUserRepository) GetAttributes(ctx context.Context) ([]user.Attribute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAttributes", ctx)
+	ret0, _ := ret[0].([]user.Attribute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAttributes indicates an expected call of GetAttributes.
+func (mr *MockUserRepositoryMockRecorder) GetAttributes(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttributes", reflect.TypeOf((*MockUserRepository)(nil).GetAttributes), ctx)
+}
+
+// ImportUsers mocks base method.
+func (m *MockUserRepository) ImportUsers(ctx context.Context, users []user.User, bucketing random.Bucketing) ([]int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ImportUsers", ctx, users, bucketing)
+	ret0, _ := ret[0].([]int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ImportUsers indicates an expected call of ImportUsers.
+func (mr *MockUserRepositoryMockRecorder) ImportUsers(ctx, users, bucketing interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImportUsers", reflect.TypeOf((*MockUserRepository)(nil).ImportUsers), ctx, users, bucketing)
+}
+
+// UpdateUser mocks base method.
+func (m *MockUserRepository) UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateUser", ctx, userID, update)
+	ret0, _ := ret[0].(user.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateUser indicates an expected call of UpdateUser.
+func (mr *MockUserRepositoryMockRecorder) UpdateUser(ctx, userID, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockUserRepository)(nil).UpdateUser), ctx, userID, update)
 }
 
 // MockCache is a mock of Cache interface.
@@ -119,6 +288,30 @@ func (m *MockCache) EXPECT() *MockCacheMockRecorder {
 	return m.recorder
 }
 
+// Clear mocks base method.
+func (m *MockCache) Clear() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Clear")
+}
+
+// Clear indicates an expected call of Clear.
+func (mr *MockCacheMockRecorder) Clear() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clear", reflect.TypeOf((*MockCache)(nil).Clear))
+}
+
+// Delete mocks base method.
+func (m *MockCache) Delete(key int64) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Delete", key)
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockCacheMockRecorder) Delete(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockCache)(nil).Delete), key)
+}
+
 // Get mocks base method.
 func (m *MockCache) Get(key int64) ([]membership.MembershipInfo, bool) {
 	m.ctrl.T.Helper()
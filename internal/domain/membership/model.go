@@ -1,22 +1,108 @@
 package membership
 
-import "time"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+)
 
 type MembershipInfo struct {
 	UserID      int64
 	SegmentName string
+	Variant     string
 	ExpiredAt   time.Time
 }
 
+// UpsertPolicy decides the new expiration of a segment that is added to a user who already has it.
+type UpsertPolicy string
+
+const (
+	// UpsertNone refuses to add an assigned segment.
+	UpsertNone UpsertPolicy = ""
+	// UpsertReplace sets the expiration from the new ttl.
+	UpsertReplace UpsertPolicy = "replace"
+	// UpsertExtend adds the ttl to the current expiration, or to now if it has already passed.
+	UpsertExtend UpsertPolicy = "extend"
+	// UpsertMax keeps the later of the current and the new expiration.
+	UpsertMax UpsertPolicy = "max"
+)
+
 type Membership struct {
 	UserID    int64
 	SegmentID int64
 	ExpiredAt time.Time
 }
 
+// DeletePreview describes the members that lose the segment when it's deleted,
+// Token confirms the deletion of exactly these members.
+type DeletePreview struct {
+	Segment   segment.SegmentInfo
+	Manual    int64
+	Automatic int64
+	// MembersDigest is a hash of the ordered ids of the members.
+	MembersDigest string
+	Sample        []int64
+	Token         string
+}
+
+func (d DeletePreview) Affected() int64 {
+	return d.Manual + d.Automatic
+}
+
+// ConfirmationToken changes together with the segment members, so a token from an outdated
+// preview can't confirm the deletion. It's signed with the server secret and can't be made
+// up from the member counts.
+func (d DeletePreview) ConfirmationToken(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d:%s:%d:%d:%s", d.Segment.ID, d.Segment.Salt, d.Manual, d.Automatic, d.MembersDigest)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
 type FullMembershipInfo struct {
 	UserID      int64
 	SegmentID   int64
 	SegmentName string
 	ExpiredAt   time.Time
 }
+
+type ImportStatus string
+
+const (
+	ImportCreated   ImportStatus = "created"
+	ImportDuplicate ImportStatus = "duplicate"
+	ImportInvalid   ImportStatus = "invalid"
+	// ImportFailed marks the rows that weren't saved because the import stopped at an error.
+	ImportFailed ImportStatus = "failed"
+)
+
+// UserSource yields the users of an import one by one, io.EOF ends the import.
+type UserSource interface {
+	Next() (user.User, error)
+}
+
+// ImportRow is the outcome of a single record of the import, records are numbered from 1.
+type ImportRow struct {
+	Row    int
+	Status ImportStatus
+	UserID int64
+	Reason string
+}
+
+type ImportReport struct {
+	Rows []ImportRow
+}
+
+func (r ImportReport) Count(status ImportStatus) int {
+	count := 0
+	for i := range r.Rows {
+		if r.Rows[i].Status == status {
+			count++
+		}
+	}
+	return count
+}
@@ -2,7 +2,13 @@ package membership
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
@@ -18,50 +24,211 @@ var (
 	ErrSegmentNotExists       = errors.New("not all segments were found")
 	ErrEmptyData              = errors.New("data for updating and for deletion were not provided")
 	ErrIncorrectData          = errors.New("attempt to add and remove the same segment")
+	ErrConfirmationRequired   = errors.New("confirmation token is required")
+	ErrConfirmationMismatch   = errors.New("confirmation token doesn't match the current segment state")
+	ErrMalformedImport        = errors.New("malformed import body")
+	ErrInvalidSchedule        = errors.New("membership expires before it starts")
 )
 
+const (
+	previewSampleSize int = 10
+	importBatchSize   int = 100
+)
+
+// LayerConflictError is returned when an assignment would put the user
+// into a second segment of the same mutually exclusive layer.
+type LayerConflictError struct {
+	Layer string
+}
+
+func (e *LayerConflictError) Error() string {
+	return fmt.Sprintf("user already belongs to a segment of layer %q", e.Layer)
+}
+
+// MissingPrerequisiteError is returned when the user lacks segments
+// required by the segment being added.
+type MissingPrerequisiteError struct {
+	Segment       string
+	Prerequisites []string
+}
+
+func (e *MissingPrerequisiteError) Error() string {
+	return fmt.Sprintf("segment %q requires %s", e.Segment, strings.Join(e.Prerequisites, ", "))
+}
+
+// DependentSegmentError is returned when the removed segment is a prerequisite
+// of user segments whose policy refuses the removal.
+type DependentSegmentError struct {
+	Segment    string
+	Dependents []string
+}
+
+func (e *DependentSegmentError) Error() string {
+	return fmt.Sprintf("segment %q is required by %s", e.Segment, strings.Join(e.Dependents, ", "))
+}
+
+// SegmentFullError is returned when the segment already has as many members as its capacity allows.
+type SegmentFullError struct {
+	Segment  string
+	Capacity int
+}
+
+func (e *SegmentFullError) Error() string {
+	return fmt.Sprintf("segment %q is full, capacity %d", e.Segment, e.Capacity)
+}
+
+// InvalidRowError is returned by a UserSource for a record that can't be read as a user,
+// the import goes on with the next record.
+type InvalidRowError struct {
+	Reason string
+}
+
+func (e *InvalidRowError) Error() string {
+	return e.Reason
+}
+
 type MembershipRepository interface {
-	UpdateUserSegments(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string) error
-	DeleteSegment(ctx context.Context, name string) error
+	UpdateUserSegments(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string, policy UpsertPolicy) error
+	PreviewDelete(ctx context.Context, name string, sampleSize int) (DeletePreview, error)
+	ArchiveSegment(ctx context.Context, name string, confirm func(DeletePreview) error) error
+	RestoreSegment(ctx context.Context, name string, grace time.Duration) error
+	UpdateSegment(ctx context.Context, name string, update segment.Update) error
+	SetRamp(ctx context.Context, name string, steps []segment.RampStep) error
+	PauseRamp(ctx context.Context, name string, paused bool) error
 	GetUserSegments(ctx context.Context, userID int64) ([]MembershipInfo, error)
-	CreateUser(ctx context.Context, user user.User, hitPercentage int) (int64, error)
+	GetUsersSegments(ctx context.Context, userIDs []int64) ([]MembershipInfo, error)
+}
+
+// UserRepository stores the users, assigning new users their automatic segments and keeping
+// the memberships in line with the user writes. The registered attributes new users are validated against
+// come from it too.
+type UserRepository interface {
+	GetAttributes(ctx context.Context) ([]user.Attribute, error)
+	CreateUser(ctx context.Context, user user.User, bucketing random.Bucketing) (int64, error)
+	ImportUsers(ctx context.Context, users []user.User, bucketing random.Bucketing) ([]int64, error)
+	EraseUser(ctx context.Context, userID int64, anonymousID string) error
+	UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error)
 }
 
 type Cache interface {
 	Set(key int64, value []MembershipInfo, expireAt time.Duration) []MembershipInfo
 	Get(key int64) ([]MembershipInfo, bool)
+	Delete(key int64)
+	Clear()
 }
 
 type service struct {
 	logger          logging.Logger
 	cache           Cache
 	cacheExpiration time.Duration
-	generator       random.Rand
+	archiveGrace    time.Duration
+	tokenSecret     []byte
+	bucketing       random.Bucketing
 	membership      MembershipRepository
+	users           UserRepository
 }
 
 func New(
 	membership MembershipRepository,
+	users UserRepository,
 	cache Cache,
 	expiration time.Duration,
-	generator random.Rand,
+	archiveGrace time.Duration,
+	tokenSecret []byte,
+	bucketing random.Bucketing,
 	logger logging.Logger,
 ) *service {
 
 	return &service{
 		membership:      membership,
+		users:           users,
 		cache:           cache,
-		generator:       generator,
+		bucketing:       bucketing,
 		cacheExpiration: expiration,
+		archiveGrace:    archiveGrace,
+		tokenSecret:     tokenSecret,
 		logger:          logger,
 	}
 }
 
-func (s *service) DeleteMembership(ctx context.Context, segmentName string) error {
-	s.logger.Debugf("try to delete %s segment", segmentName)
-	err := s.membership.DeleteSegment(ctx, segmentName)
+func (s *service) PreviewSegmentDeletion(ctx context.Context, segmentName string) (DeletePreview, error) {
+	s.logger.Debugf("try to preview %s segment deletion", segmentName)
+	preview, err := s.membership.PreviewDelete(ctx, segmentName, previewSampleSize)
+	if err != nil {
+		s.logger.Errorf("cannot preview %s segment deletion due to %s", segmentName, err.Error())
+		return DeletePreview{}, err
+	}
+	preview.Token = preview.ConfirmationToken(s.tokenSecret)
+	return preview, nil
+}
+
+// ArchiveSegment archives the segment if the token confirms its current members,
+// the token is checked inside the archive transaction.
+func (s *service) ArchiveSegment(ctx context.Context, segmentName string, token string) error {
+	s.logger.Debugf("try to archive %s segment", segmentName)
+	err := s.membership.ArchiveSegment(ctx, segmentName, func(preview DeletePreview) error {
+		if token == "" {
+			return ErrConfirmationRequired
+		}
+		if !hmac.Equal([]byte(token), []byte(preview.ConfirmationToken(s.tokenSecret))) {
+			return ErrConfirmationMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("cannot archive %s segment due to %s", segmentName, err.Error())
+		return err
+	}
+	// the members of the segment aren't known here, so every cached list is dropped
+	s.cache.Clear()
+	return nil
+}
+
+func (s *service) RestoreSegment(ctx context.Context, segmentName string) error {
+	s.logger.Debugf("try to restore %s segment", segmentName)
+	err := s.membership.RestoreSegment(ctx, segmentName, s.archiveGrace)
+	if err != nil {
+		s.logger.Errorf("cannot restore %s segment due to %s", segmentName, err.Error())
+		return err
+	}
+	s.cache.Clear()
+	return nil
+}
+
+func (s *service) UpdateSegment(ctx context.Context, segmentName string, update segment.Update) error {
+	s.logger.Debugf("try to update %s segment", segmentName)
+	if update.IsEmpty() {
+		return segment.ErrNothingToUpdate
+	}
+	err := s.membership.UpdateSegment(ctx, segmentName, update)
 	if err != nil {
-		s.logger.Errorf("cannot delete %s segment due to %s", segmentName, err.Error())
+		s.logger.Errorf("cannot update %s segment due to %s", segmentName, err.Error())
+		return err
+	}
+	// a new percentage adds and removes automatic members
+	if update.AutomaticPercentage != nil {
+		s.cache.Clear()
+	}
+	return nil
+}
+
+func (s *service) SetRamp(ctx context.Context, segmentName string, steps []segment.RampStep) error {
+	s.logger.Debugf("try to set %s segment ramp", segmentName)
+	if err := validateRamp(steps); err != nil {
+		return err
+	}
+	err := s.membership.SetRamp(ctx, segmentName, steps)
+	if err != nil {
+		s.logger.Errorf("cannot set %s segment ramp due to %s", segmentName, err.Error())
+	}
+	return err
+}
+
+func (s *service) PauseRamp(ctx context.Context, segmentName string, paused bool) error {
+	s.logger.Debugf("try to set %s segment ramp paused = %t", segmentName, paused)
+	err := s.membership.PauseRamp(ctx, segmentName, paused)
+	if err != nil {
+		s.logger.Errorf("cannot pause %s segment ramp due to %s", segmentName, err.Error())
 	}
 	return err
 }
@@ -82,34 +249,234 @@ func (s *service) GetUserMembership(ctx context.Context, userID int64) ([]Member
 	return info, nil
 }
 
-func (s *service) CreateUser(ctx context.Context, user user.User) (int64, error) {
-	s.logger.Debugf("try to create user %s ", user.Email)
-	if err := user.Valid(); err != nil {
-		s.logger.Errorf("invalid email %s", user.Email)
+// CheckUserMembership finds the segment among the active segments of the user,
+// the segments are served from the cache the same way as by GetUserMembership.
+func (s *service) CheckUserMembership(ctx context.Context, userID int64, segmentName string) (MembershipInfo, error) {
+	info, err := s.GetUserMembership(ctx, userID)
+	if err != nil {
+		return MembershipInfo{}, err
+	}
+	// the cached list may outlive a membership until the cleaner removes it
+	now := time.Now()
+	for i := range info {
+		if info[i].SegmentName == segmentName && info[i].ExpiredAt.After(now) {
+			return info[i], nil
+		}
+	}
+	return MembershipInfo{}, ErrSegmentNotAssigned
+}
+
+// GetUsersMembership returns the segments of every requested user, the users missing in the cache
+// are loaded with a single query. A user without segments gets an empty list.
+func (s *service) GetUsersMembership(ctx context.Context, userIDs []int64) (map[int64][]MembershipInfo, error) {
+	s.logger.Debugf("try to get segments of %d users", len(userIDs))
+	memberships := make(map[int64][]MembershipInfo, len(userIDs))
+	misses := make([]int64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if info, inCache := s.cache.Get(userID); inCache {
+			memberships[userID] = info
+			continue
+		}
+		memberships[userID] = []MembershipInfo{}
+		misses = append(misses, userID)
+	}
+	if len(misses) == 0 {
+		return memberships, nil
+	}
+
+	info, err := s.membership.GetUsersSegments(ctx, misses)
+	if err != nil {
+		s.logger.Errorf("error in getting membership info, %s", err.Error())
+		return nil, err
+	}
+	for i := range info {
+		memberships[info[i].UserID] = append(memberships[info[i].UserID], info[i])
+	}
+	for _, userID := range misses {
+		if len(memberships[userID]) > 0 {
+			s.cache.Set(userID, memberships[userID], s.cacheExpiration)
+		}
+	}
+	return memberships, nil
+}
+
+func (s *service) CreateUser(ctx context.Context, newUser user.User) (int64, error) {
+	s.logger.Debugf("try to create user %s ", newUser.Email)
+	var schema user.Schema
+	if len(newUser.Attributes) > 0 {
+		attributes, err := s.users.GetAttributes(ctx)
+		if err != nil {
+			s.logger.Errorf("cannot get attributes schema due to %s", err.Error())
+			return 0, err
+		}
+		schema = user.NewSchema(attributes)
+	}
+	if err := newUser.Valid(schema); err != nil {
+		s.logger.Errorf("invalid user %s, %s", newUser.Email, err.Error())
 		return 0, err
 	}
-	id, err := s.membership.CreateUser(ctx, user, s.generator.Next())
+	id, err := s.users.CreateUser(ctx, newUser, s.bucketing)
 	if err != nil {
 		s.logger.Errorf("error in creating user, %s", err.Error())
 	}
 	return id, err
 }
 
+// ImportUsers creates the users of the source in batches. Invalid records and emails that are
+// already taken or repeated in the source are reported and skipped. An error stops the import,
+// the batches created before it stay and the report returned with the error marks the rows
+// read but not saved as failed.
+func (s *service) ImportUsers(ctx context.Context, source UserSource) (ImportReport, error) {
+	s.logger.Debugf("try to import users")
+	var report ImportReport
+	var schema user.Schema
+	schemaLoaded := false
+	seen := make(map[string]int)
+	batch := make([]user.User, 0, importBatchSize)
+	pending := make([]int, 0, importBatchSize)
+
+	stop := func(err error) (ImportReport, error) {
+		for _, i := range pending {
+			report.Rows[i].Status = ImportFailed
+			report.Rows[i].Reason = "import stopped before the row was saved"
+		}
+		return report, err
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids, err := s.users.ImportUsers(ctx, batch, s.bucketing)
+		if err != nil {
+			s.logger.Errorf("error in importing users, %s", err.Error())
+			return err
+		}
+		for i, id := range ids {
+			row := &report.Rows[pending[i]]
+			if id == 0 {
+				row.Status = ImportDuplicate
+				row.Reason = user.ErrUserAlreadyExist.Error()
+				continue
+			}
+			row.Status = ImportCreated
+			row.UserID = id
+		}
+		batch = batch[:0]
+		pending = pending[:0]
+		return nil
+	}
+
+	for row := 1; ; row++ {
+		newUser, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *InvalidRowError
+		if errors.As(err, &rowErr) {
+			report.Rows = append(report.Rows, ImportRow{Row: row, Status: ImportInvalid, Reason: rowErr.Reason})
+			continue
+		}
+		if err != nil {
+			s.logger.Errorf("cannot read imported users due to %s", err.Error())
+			report.Rows = append(report.Rows, ImportRow{Row: row, Status: ImportFailed, Reason: err.Error()})
+			return stop(err)
+		}
+
+		if len(newUser.Attributes) > 0 && !schemaLoaded {
+			attributes, err := s.users.GetAttributes(ctx)
+			if err != nil {
+				s.logger.Errorf("cannot get attributes schema due to %s", err.Error())
+				return stop(err)
+			}
+			schema = user.NewSchema(attributes)
+			schemaLoaded = true
+		}
+		if err := newUser.Valid(schema); err != nil {
+			report.Rows = append(report.Rows, ImportRow{Row: row, Status: ImportInvalid, Reason: err.Error()})
+			continue
+		}
+		if first, ok := seen[newUser.Email]; ok {
+			report.Rows = append(report.Rows, ImportRow{
+				Row:    row,
+				Status: ImportDuplicate,
+				Reason: fmt.Sprintf("email is repeated from row %d", first),
+			})
+			continue
+		}
+		seen[newUser.Email] = row
+
+		pending = append(pending, len(report.Rows))
+		report.Rows = append(report.Rows, ImportRow{Row: row})
+		batch = append(batch, newUser)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return stop(err)
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return stop(err)
+	}
+	return report, nil
+}
+
+// EraseUser deletes the user, its history is kept under a random anonymous id
+// that can't be traced back to the user.
+func (s *service) EraseUser(ctx context.Context, userID int64) error {
+	s.logger.Debugf("try to erase user %d", userID)
+	anonymousID, err := newAnonymousID()
+	if err != nil {
+		s.logger.Errorf("cannot generate anonymous id, %s", err.Error())
+		return err
+	}
+	if err = s.users.EraseUser(ctx, userID, anonymousID); err != nil {
+		s.logger.Errorf("error in erasing user %d, %s", userID, err.Error())
+		return err
+	}
+	s.cache.Delete(userID)
+	return nil
+}
+
+// UpdateUser stores the validated update and drops the cached segments of the user,
+// its rule based segments are re-evaluated against the new fields.
+func (s *service) UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error) {
+	updated, err := s.users.UpdateUser(ctx, userID, update)
+	if err != nil {
+		s.logger.Errorf("cannot update user %d due to %s", userID, err.Error())
+		return user.User{}, err
+	}
+	s.cache.Delete(userID)
+	return updated, nil
+}
+
 func (s *service) UpdateUserMembership(
 	ctx context.Context,
 	userID int64,
 	addSegments []segment.Segment,
 	deleteSegments []string,
+	policy UpsertPolicy,
 ) error {
 	s.logger.Debugf("try to update user = %d segments %v delete segments %v", addSegments, deleteSegments)
 	if err := validateUpdatedData(addSegments, deleteSegments); err != nil {
 		return err
 	}
-	err := s.membership.UpdateUserSegments(ctx, userID, addSegments, deleteSegments)
+	err := s.membership.UpdateUserSegments(ctx, userID, addSegments, deleteSegments, policy)
 	if err != nil {
 		s.logger.Errorf("error in updating user segments, %s", err.Error())
+		return err
 	}
-	return err
+	s.cache.Delete(userID)
+	return nil
+}
+
+func newAnonymousID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
 }
 
 func validateUpdatedData(add []segment.Segment, delete []string) error {
@@ -128,6 +495,19 @@ func validateUpdatedData(add []segment.Segment, delete []string) error {
 	return nil
 }
 
+// validateRamp requires at least one step, the steps follow each other strictly in time.
+func validateRamp(steps []segment.RampStep) error {
+	if len(steps) == 0 {
+		return segment.ErrInvalidRamp
+	}
+	for i := range steps {
+		if steps[i].After < 0 || (i > 0 && steps[i].After <= steps[i-1].After) {
+			return segment.ErrInvalidRamp
+		}
+	}
+	return nil
+}
+
 func max(a, b int) int {
 	if a < b {
 		return a
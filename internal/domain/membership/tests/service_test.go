@@ -3,6 +3,8 @@ package membership
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -15,18 +17,19 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-type mockRandom struct{}
+type mockBucketing struct{}
 
-func (m *mockRandom) Next() int { return 0 }
+func (m *mockBucketing) Bucket(userID int64, salt string) int { return 0 }
 
 func TestUpdateUserMembership(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
 	mockCache := mocks.NewMockCache(ctrl)
-	membershipService := membership.New(mockRepo, mockCache, 1*time.Minute, &mockRandom{}, mockLogger)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -34,6 +37,7 @@ func TestUpdateUserMembership(t *testing.T) {
 		userID int64
 		add    []segment.Segment
 		delete []string
+		policy membership.UpsertPolicy
 	}
 
 	userID := int64(1)
@@ -54,9 +58,10 @@ func TestUpdateUserMembership(t *testing.T) {
 		isError   bool
 	}{
 		{
-			title: "Successful update user segments",
+			title: "Successful update user segments drops cached memberships",
 			mockCall: func() {
-				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+				mockCache.EXPECT().Delete(userID)
 			},
 			args: args{
 				add:    add,
@@ -64,10 +69,23 @@ func TestUpdateUserMembership(t *testing.T) {
 				userID: userID,
 			},
 		},
+		{
+			title: "Successful upsert user segments with the extend policy",
+			mockCall: func() {
+				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), userID, add, delete, membership.UpsertExtend).Return(nil)
+				mockCache.EXPECT().Delete(userID)
+			},
+			args: args{
+				add:    add,
+				delete: delete,
+				userID: userID,
+				policy: membership.UpsertExtend,
+			},
+		},
 		{
 			title: "Segment already assigned error",
 			mockCall: func() {
-				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(membership.ErrSegmentAlreadyAssigned)
+				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(membership.ErrSegmentAlreadyAssigned)
 			},
 			args: args{
 				add:    add,
@@ -80,7 +98,7 @@ func TestUpdateUserMembership(t *testing.T) {
 		{
 			title: "User not found error",
 			mockCall: func() {
-				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(user.ErrUserNotFound)
+				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(user.ErrUserNotFound)
 			},
 			args: args{
 				add:    add,
@@ -93,7 +111,7 @@ func TestUpdateUserMembership(t *testing.T) {
 		{
 			title: "Segment not found error",
 			mockCall: func() {
-				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+				mockRepo.EXPECT().UpdateUserSegments(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
 			},
 			args: args{
 				add:    add,
@@ -131,7 +149,134 @@ func TestUpdateUserMembership(t *testing.T) {
 	for _, test := range testCases {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			err := membershipService.UpdateUserMembership(ctx, test.args.userID, test.args.add, test.args.delete)
+			err := membershipService.UpdateUserMembership(ctx, test.args.userID, test.args.add, test.args.delete, test.args.policy)
+			if test.isError {
+				assert.Error(t, err)
+				assert.Equal(t, test.expectErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestArchiveSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	type args struct {
+		name  string
+		token string
+	}
+
+	preview := membership.DeletePreview{
+		Segment:       segment.SegmentInfo{ID: 1, Name: "seg-1", Salt: "salt"},
+		Manual:        1,
+		Automatic:     2,
+		MembersDigest: "digest",
+	}
+
+	secret := []byte("secret")
+	confirmWith := func(current membership.DeletePreview) func(context.Context, string, func(membership.DeletePreview) error) error {
+		return func(ctx context.Context, name string, confirm func(membership.DeletePreview) error) error {
+			return confirm(current)
+		}
+	}
+
+	testCases := []struct {
+		title     string
+		mockCall  mockCall
+		args      args
+		expectErr error
+		isError   bool
+	}{
+		{
+			title: "Successful segment archiving drops cached memberships",
+			mockCall: func() {
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).DoAndReturn(confirmWith(preview))
+				mockCache.EXPECT().Clear()
+			},
+			args: args{
+				name:  "seg-1",
+				token: preview.ConfirmationToken(secret),
+			},
+		},
+		{
+			title: "Missing token and should return ErrConfirmationRequired",
+			mockCall: func() {
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).DoAndReturn(confirmWith(preview))
+			},
+			args: args{
+				name: "seg-1",
+			},
+			isError:   true,
+			expectErr: membership.ErrConfirmationRequired,
+		},
+		{
+			title: "Outdated token and should return ErrConfirmationMismatch",
+			mockCall: func() {
+				changed := preview
+				changed.Manual++
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).DoAndReturn(confirmWith(changed))
+			},
+			args: args{
+				name:  "seg-1",
+				token: preview.ConfirmationToken(secret),
+			},
+			isError:   true,
+			expectErr: membership.ErrConfirmationMismatch,
+		},
+		{
+			title: "Members swapped with the same counts and should return ErrConfirmationMismatch",
+			mockCall: func() {
+				changed := preview
+				changed.MembersDigest = "other digest"
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).DoAndReturn(confirmWith(changed))
+			},
+			args: args{
+				name:  "seg-1",
+				token: preview.ConfirmationToken(secret),
+			},
+			isError:   true,
+			expectErr: membership.ErrConfirmationMismatch,
+		},
+		{
+			title: "Token signed without the server secret and should return ErrConfirmationMismatch",
+			mockCall: func() {
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).DoAndReturn(confirmWith(preview))
+			},
+			args: args{
+				name:  "seg-1",
+				token: preview.ConfirmationToken(nil),
+			},
+			isError:   true,
+			expectErr: membership.ErrConfirmationMismatch,
+		},
+		{
+			title: "Segment not found and should return ErrSegmentNotFound",
+			mockCall: func() {
+				mockRepo.EXPECT().ArchiveSegment(gomock.Any(), "seg-1", gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			args: args{
+				name:  "seg-1",
+				token: "token",
+			},
+			isError:   true,
+			expectErr: segment.ErrSegmentNotFound,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := membershipService.ArchiveSegment(ctx, test.args.name, test.args.token)
 			if test.isError {
 				assert.Error(t, err)
 				assert.Equal(t, test.expectErr, err)
@@ -142,14 +287,70 @@ func TestUpdateUserMembership(t *testing.T) {
 	}
 }
 
-func TestDeleteMembership(t *testing.T) {
+func TestPreviewSegmentDeletion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+
+	preview := membership.DeletePreview{
+		Segment:   segment.SegmentInfo{ID: 1, Name: "seg-1", Salt: "salt"},
+		Manual:    1,
+		Automatic: 2,
+		Sample:    []int64{1, 2, 3},
+	}
+	signed := preview
+	signed.Token = preview.ConfirmationToken([]byte("secret"))
+
+	testCases := []struct {
+		title    string
+		mockCall func()
+		expected membership.DeletePreview
+		isError  bool
+	}{
+		{
+			title: "Successful deletion preview",
+			mockCall: func() {
+				mockRepo.EXPECT().PreviewDelete(gomock.Any(), "seg-1", 10).Return(preview, nil)
+			},
+			expected: signed,
+		},
+		{
+			title: "Segment not found and should return ErrSegmentNotFound",
+			mockCall: func() {
+				mockRepo.EXPECT().PreviewDelete(gomock.Any(), "seg-1", 10).Return(membership.DeletePreview{}, segment.ErrSegmentNotFound)
+			},
+			isError: true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := membershipService.PreviewSegmentDeletion(ctx, "seg-1")
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestRestoreSegment(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
 	mockCache := mocks.NewMockCache(ctrl)
-	membershipService := membership.New(mockRepo, mockCache, 1*time.Minute, &mockRandom{}, mockLogger)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -165,18 +366,30 @@ func TestDeleteMembership(t *testing.T) {
 		isError   bool
 	}{
 		{
-			title: "Successful segment deletion",
+			title: "Successful segment restoring drops cached memberships",
 			mockCall: func() {
-				mockRepo.EXPECT().DeleteSegment(gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().RestoreSegment(gomock.Any(), gomock.Any(), 24*time.Hour).Return(nil)
+				mockCache.EXPECT().Clear()
 			},
 			args: args{
 				name: "seg-1",
 			},
 		},
+		{
+			title: "Grace period expired and should return ErrGracePeriodExpired",
+			mockCall: func() {
+				mockRepo.EXPECT().RestoreSegment(gomock.Any(), gomock.Any(), 24*time.Hour).Return(segment.ErrGracePeriodExpired)
+			},
+			args: args{
+				name: "seg-1",
+			},
+			isError:   true,
+			expectErr: segment.ErrGracePeriodExpired,
+		},
 		{
 			title: "Segment not found and should return ErrSegmentNotFound",
 			mockCall: func() {
-				mockRepo.EXPECT().DeleteSegment(gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+				mockRepo.EXPECT().RestoreSegment(gomock.Any(), gomock.Any(), 24*time.Hour).Return(segment.ErrSegmentNotFound)
 			},
 			args: args{
 				name: "seg-1",
@@ -188,7 +401,170 @@ func TestDeleteMembership(t *testing.T) {
 	for _, test := range testCases {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			err := membershipService.DeleteMembership(ctx, test.args.name)
+			err := membershipService.RestoreSegment(ctx, test.args.name)
+			if test.isError {
+				assert.Error(t, err)
+				assert.Equal(t, test.expectErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUpdateSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	type args struct {
+		name   string
+		update segment.Update
+	}
+
+	percentage := 50
+	owner := "growth"
+
+	testCases := []struct {
+		title     string
+		mockCall  mockCall
+		args      args
+		expectErr error
+		isError   bool
+	}{
+		{
+			title: "Successful segment percentage update",
+			mockCall: func() {
+				mockRepo.EXPECT().UpdateSegment(gomock.Any(), "seg-1", segment.Update{AutomaticPercentage: &percentage}).Return(nil)
+				mockCache.EXPECT().Clear()
+			},
+			args: args{
+				name:   "seg-1",
+				update: segment.Update{AutomaticPercentage: &percentage},
+			},
+		},
+		{
+			title: "Successful segment metadata update",
+			mockCall: func() {
+				mockRepo.EXPECT().UpdateSegment(gomock.Any(), "seg-1", segment.Update{Owner: &owner}).Return(nil)
+			},
+			args: args{
+				name:   "seg-1",
+				update: segment.Update{Owner: &owner},
+			},
+		},
+		{
+			title:    "Empty update and should return ErrNothingToUpdate",
+			mockCall: func() {},
+			args: args{
+				name: "seg-1",
+			},
+			isError:   true,
+			expectErr: segment.ErrNothingToUpdate,
+		},
+		{
+			title: "Segment not found and should return ErrSegmentNotFound",
+			mockCall: func() {
+				mockRepo.EXPECT().UpdateSegment(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			args: args{
+				name:   "seg-1",
+				update: segment.Update{AutomaticPercentage: &percentage},
+			},
+			isError:   true,
+			expectErr: segment.ErrSegmentNotFound,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := membershipService.UpdateSegment(ctx, test.args.name, test.args.update)
+			if test.isError {
+				assert.Error(t, err)
+				assert.Equal(t, test.expectErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSetRamp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	steps := []segment.RampStep{
+		segment.NewRampStep(99, 0),
+		segment.NewRampStep(95, 24*time.Hour),
+		segment.NewRampStep(75, 72*time.Hour),
+	}
+
+	testCases := []struct {
+		title     string
+		mockCall  mockCall
+		steps     []segment.RampStep
+		expectErr error
+		isError   bool
+	}{
+		{
+			title: "Successful ramp set",
+			mockCall: func() {
+				mockRepo.EXPECT().SetRamp(gomock.Any(), "seg-1", steps).Return(nil)
+			},
+			steps: steps,
+		},
+		{
+			title:     "Empty ramp and should return ErrInvalidRamp",
+			mockCall:  func() {},
+			isError:   true,
+			expectErr: segment.ErrInvalidRamp,
+		},
+		{
+			title:    "Unordered steps and should return ErrInvalidRamp",
+			mockCall: func() {},
+			steps: []segment.RampStep{
+				segment.NewRampStep(95, 24*time.Hour),
+				segment.NewRampStep(99, 24*time.Hour),
+			},
+			isError:   true,
+			expectErr: segment.ErrInvalidRamp,
+		},
+		{
+			title:     "Negative delay and should return ErrInvalidRamp",
+			mockCall:  func() {},
+			steps:     []segment.RampStep{segment.NewRampStep(95, -time.Hour)},
+			isError:   true,
+			expectErr: segment.ErrInvalidRamp,
+		},
+		{
+			title: "Segment not found and should return ErrSegmentNotFound",
+			mockCall: func() {
+				mockRepo.EXPECT().SetRamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(segment.ErrSegmentNotFound)
+			},
+			steps:     steps,
+			isError:   true,
+			expectErr: segment.ErrSegmentNotFound,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := membershipService.SetRamp(ctx, "seg-1", test.steps)
 			if test.isError {
 				assert.Error(t, err)
 				assert.Equal(t, test.expectErr, err)
@@ -202,11 +578,12 @@ func TestDeleteMembership(t *testing.T) {
 func TestGetUserSegments(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
 	mockCache := mocks.NewMockCache(ctrl)
-	membershipService := membership.New(mockRepo, mockCache, 1*time.Minute, &mockRandom{}, mockLogger)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -275,14 +652,177 @@ func TestGetUserSegments(t *testing.T) {
 	}
 }
 
+func TestCheckUserMembership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	userID := int64(1)
+	info := []membership.MembershipInfo{
+		{UserID: userID, SegmentName: "seg-1", ExpiredAt: time.Date(9999, 1, 1, 1, 59, 59, 0, time.UTC)},
+		{UserID: userID, SegmentName: "seg-2", Variant: "control", ExpiredAt: time.Date(9999, 1, 1, 1, 59, 59, 0, time.UTC)},
+		{UserID: userID, SegmentName: "seg-3", ExpiredAt: time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		title         string
+		mockCall      mockCall
+		segmentName   string
+		expected      membership.MembershipInfo
+		expectedError error
+	}{
+		{
+			title: "Should find the segment in the cache",
+			mockCall: func() {
+				mockCache.EXPECT().Get(userID).Return(info, true)
+			},
+			segmentName: "seg-2",
+			expected:    info[1],
+		},
+		{
+			title: "Should load the segments and cache them",
+			mockCall: func() {
+				mockCache.EXPECT().Get(userID).Return(nil, false)
+				mockRepo.EXPECT().GetUserSegments(gomock.Any(), userID).Return(info, nil)
+				mockCache.EXPECT().Set(userID, info, 1*time.Minute)
+			},
+			segmentName: "seg-1",
+			expected:    info[0],
+		},
+		{
+			title: "User isn't in the segment",
+			mockCall: func() {
+				mockCache.EXPECT().Get(userID).Return(info, true)
+			},
+			segmentName:   "seg-4",
+			expectedError: membership.ErrSegmentNotAssigned,
+		},
+		{
+			title: "Cached segment has already expired",
+			mockCall: func() {
+				mockCache.EXPECT().Get(userID).Return(info, true)
+			},
+			segmentName:   "seg-3",
+			expectedError: membership.ErrSegmentNotAssigned,
+		},
+		{
+			title: "Could not get from repository",
+			mockCall: func() {
+				mockCache.EXPECT().Get(userID).Return(nil, false)
+				mockRepo.EXPECT().GetUserSegments(gomock.Any(), userID).Return(nil, errors.New("couldn't get data"))
+			},
+			segmentName:   "seg-1",
+			expectedError: errors.New("couldn't get data"),
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := membershipService.CheckUserMembership(ctx, userID, test.segmentName)
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetUsersMembership(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	expiredAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	cached := []membership.MembershipInfo{
+		{UserID: 1, SegmentName: "seg-1", ExpiredAt: expiredAt},
+	}
+	loaded := []membership.MembershipInfo{
+		{UserID: 2, SegmentName: "seg-1", ExpiredAt: expiredAt},
+		{UserID: 2, SegmentName: "seg-2", ExpiredAt: expiredAt},
+	}
+
+	testCases := []struct {
+		title    string
+		mockCall mockCall
+		userIDs  []int64
+		expected map[int64][]membership.MembershipInfo
+		isError  bool
+	}{
+		{
+			title: "Should load only the users missing in the cache with a single query",
+			mockCall: func() {
+				mockCache.EXPECT().Get(int64(1)).Return(cached, true)
+				mockCache.EXPECT().Get(int64(2)).Return(nil, false)
+				mockCache.EXPECT().Get(int64(3)).Return(nil, false)
+				mockRepo.EXPECT().GetUsersSegments(gomock.Any(), []int64{2, 3}).Return(loaded, nil)
+				mockCache.EXPECT().Set(int64(2), loaded, 1*time.Minute)
+			},
+			userIDs: []int64{1, 2, 3},
+			expected: map[int64][]membership.MembershipInfo{
+				1: cached,
+				2: loaded,
+				3: {},
+			},
+		},
+		{
+			title: "Should serve all the users from the cache",
+			mockCall: func() {
+				mockCache.EXPECT().Get(int64(1)).Return(cached, true)
+			},
+			userIDs: []int64{1},
+			expected: map[int64][]membership.MembershipInfo{
+				1: cached,
+			},
+		},
+		{
+			title: "Could not get from repository",
+			mockCall: func() {
+				mockCache.EXPECT().Get(int64(2)).Return(nil, false)
+				mockRepo.EXPECT().GetUsersSegments(gomock.Any(), []int64{2}).Return(nil, errors.New("couldn't get data"))
+			},
+			userIDs: []int64{2},
+			isError: true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := membershipService.GetUsersMembership(ctx, test.userIDs)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, got)
+			}
+		})
+	}
+}
+
 func TestCreateUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
 	mockCache := mocks.NewMockCache(ctrl)
-	membershipService := membership.New(mockRepo, mockCache, 1*time.Minute, &mockRandom{}, mockLogger)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -303,7 +843,7 @@ func TestCreateUser(t *testing.T) {
 		{
 			title: "Successful user creation",
 			mockCall: func() {
-				mockRepo.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(userID, nil)
+				mockUsers.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(userID, nil)
 			},
 			args: args{
 				user: user.User{
@@ -315,7 +855,7 @@ func TestCreateUser(t *testing.T) {
 		{
 			title: "Invalid email error",
 			mockCall: func() {
-				mockRepo.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, user.ErrInvalidEmail)
+				mockUsers.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, user.ErrInvalidEmail)
 			},
 			args: args{
 				user: user.User{
@@ -329,7 +869,7 @@ func TestCreateUser(t *testing.T) {
 		{
 			title: "User already exists error",
 			mockCall: func() {
-				mockRepo.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, user.ErrUserAlreadyExist)
+				mockUsers.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, user.ErrUserAlreadyExist)
 			},
 			args: args{
 				user: user.User{
@@ -343,7 +883,7 @@ func TestCreateUser(t *testing.T) {
 		{
 			title: "Error while inserting new user",
 			mockCall: func() {
-				mockRepo.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, errors.New("error"))
+				mockUsers.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, errors.New("error"))
 			},
 			args: args{
 				user: user.User{
@@ -354,6 +894,70 @@ func TestCreateUser(t *testing.T) {
 			expected:      emptyID,
 			isError:       true,
 		},
+		{
+			title: "Successful user creation with registered attributes",
+			mockCall: func() {
+				mockUsers.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{
+					{Name: "country", Type: user.AttributeString},
+					{Name: "signup_date", Type: user.AttributeDate},
+				}, nil)
+				mockUsers.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any()).Return(userID, nil)
+			},
+			args: args{
+				user: user.User{
+					Email:      "email@email.com",
+					Attributes: map[string]interface{}{"country": "RU", "signup_date": "2023-08-25"},
+				},
+			},
+			expected: userID,
+		},
+		{
+			title: "Attribute is not registered",
+			mockCall: func() {
+				mockUsers.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{}, nil)
+			},
+			args: args{
+				user: user.User{
+					Email:      "email@email.com",
+					Attributes: map[string]interface{}{"country": "RU"},
+				},
+			},
+			expectedError: &user.AttributeError{Name: "country"},
+			expected:      emptyID,
+			isError:       true,
+		},
+		{
+			title: "Attribute has another type",
+			mockCall: func() {
+				mockUsers.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{
+					{Name: "signup_date", Type: user.AttributeDate},
+				}, nil)
+			},
+			args: args{
+				user: user.User{
+					Email:      "email@email.com",
+					Attributes: map[string]interface{}{"signup_date": "25.08.2023"},
+				},
+			},
+			expectedError: &user.AttributeError{Name: "signup_date", Expected: user.AttributeDate},
+			expected:      emptyID,
+			isError:       true,
+		},
+		{
+			title: "Error while getting attributes schema",
+			mockCall: func() {
+				mockUsers.EXPECT().GetAttributes(gomock.Any()).Return(nil, errors.New("error"))
+			},
+			args: args{
+				user: user.User{
+					Email:      "email@email.com",
+					Attributes: map[string]interface{}{"country": "RU"},
+				},
+			},
+			expectedError: errors.New("error"),
+			expected:      emptyID,
+			isError:       true,
+		},
 	}
 	for _, test := range testCases {
 		t.Run(test.title, func(t *testing.T) {
@@ -367,3 +971,249 @@ func TestCreateUser(t *testing.T) {
 		})
 	}
 }
+
+type record struct {
+	user user.User
+	err  error
+}
+
+type sliceSource struct {
+	records []record
+	pos     int
+}
+
+func (s *sliceSource) Next() (user.User, error) {
+	if s.pos == len(s.records) {
+		return user.User{}, io.EOF
+	}
+	r := s.records[s.pos]
+	s.pos++
+	return r.user, r.err
+}
+
+func TestImportUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	bulk := make([]record, 101)
+	bulkRows := make([]membership.ImportRow, 101)
+	for i := range bulk {
+		bulk[i] = record{user: user.User{Email: fmt.Sprintf("user%d@email.com", i)}}
+		bulkRows[i] = membership.ImportRow{Row: i + 1, Status: membership.ImportCreated, UserID: int64(i + 1)}
+	}
+
+	testCases := []struct {
+		title         string
+		mockCall      mockCall
+		records       []record
+		expected      membership.ImportReport
+		expectedError error
+	}{
+		{
+			title: "Should report created, invalid and duplicate rows",
+			mockCall: func() {
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), []user.User{
+					{Email: "first@email.com"},
+					{Email: "taken@email.com"},
+				}, gomock.Any()).Return([]int64{1, 0}, nil)
+			},
+			records: []record{
+				{user: user.User{Email: "first@email.com"}},
+				{err: &membership.InvalidRowError{Reason: "invalid json"}},
+				{user: user.User{Email: "email"}},
+				{user: user.User{Email: "taken@email.com"}},
+				{user: user.User{Email: "first@email.com"}},
+			},
+			expected: membership.ImportReport{Rows: []membership.ImportRow{
+				{Row: 1, Status: membership.ImportCreated, UserID: 1},
+				{Row: 2, Status: membership.ImportInvalid, Reason: "invalid json"},
+				{Row: 3, Status: membership.ImportInvalid, Reason: user.ErrInvalidEmail.Error()},
+				{Row: 4, Status: membership.ImportDuplicate, Reason: user.ErrUserAlreadyExist.Error()},
+				{Row: 5, Status: membership.ImportDuplicate, Reason: "email is repeated from row 1"},
+			}},
+		},
+		{
+			title: "Should load the attributes schema once",
+			mockCall: func() {
+				mockUsers.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{
+					{Name: "country", Type: user.AttributeString},
+				}, nil).Times(1)
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), gomock.Len(1), gomock.Any()).Return([]int64{2}, nil)
+			},
+			records: []record{
+				{user: user.User{Email: "first@email.com", Attributes: map[string]interface{}{"country": "RU"}}},
+				{user: user.User{Email: "second@email.com", Attributes: map[string]interface{}{"beta": true}}},
+			},
+			expected: membership.ImportReport{Rows: []membership.ImportRow{
+				{Row: 1, Status: membership.ImportCreated, UserID: 2},
+				{Row: 2, Status: membership.ImportInvalid, Reason: `attribute "beta" is not registered`},
+			}},
+		},
+		{
+			title: "Should split users into batches",
+			mockCall: func() {
+				first := make([]int64, 100)
+				for i := range first {
+					first[i] = int64(i + 1)
+				}
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), gomock.Len(100), gomock.Any()).Return(first, nil)
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), gomock.Len(1), gomock.Any()).Return([]int64{101}, nil)
+			},
+			records:  bulk,
+			expected: membership.ImportReport{Rows: bulkRows},
+		},
+		{
+			title:    "Should import nothing from an empty source",
+			mockCall: func() {},
+		},
+		{
+			title:         "Malformed source stops the import",
+			mockCall:      func() {},
+			records:       []record{{user: user.User{Email: "first@email.com"}}, {err: membership.ErrMalformedImport}},
+			expectedError: membership.ErrMalformedImport,
+			expected: membership.ImportReport{Rows: []membership.ImportRow{
+				{Row: 1, Status: membership.ImportFailed, Reason: "import stopped before the row was saved"},
+				{Row: 2, Status: membership.ImportFailed, Reason: membership.ErrMalformedImport.Error()},
+			}},
+		},
+		{
+			title: "Error while importing a batch keeps the report of the saved batches",
+			mockCall: func() {
+				first := make([]int64, 100)
+				for i := range first {
+					first[i] = int64(i + 1)
+				}
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), gomock.Len(100), gomock.Any()).Return(first, nil)
+				mockUsers.EXPECT().ImportUsers(gomock.Any(), gomock.Len(1), gomock.Any()).Return(nil, errors.New("error"))
+			},
+			records:       bulk,
+			expectedError: errors.New("error"),
+			expected: membership.ImportReport{Rows: append(append([]membership.ImportRow{}, bulkRows[:100]...), membership.ImportRow{
+				Row:    101,
+				Status: membership.ImportFailed,
+				Reason: "import stopped before the row was saved",
+			})},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := membershipService.ImportUsers(ctx, &sliceSource{records: test.records})
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	userID := int64(1)
+	anonymousID := gomock.AssignableToTypeOf("")
+
+	testCases := []struct {
+		title         string
+		mockCall      mockCall
+		expectedError error
+	}{
+		{
+			title: "Successful user erasure drops cached memberships",
+			mockCall: func() {
+				mockUsers.EXPECT().EraseUser(gomock.Any(), userID, anonymousID).Return(nil)
+				mockCache.EXPECT().Delete(userID)
+			},
+		},
+		{
+			title: "User not found",
+			mockCall: func() {
+				mockUsers.EXPECT().EraseUser(gomock.Any(), userID, anonymousID).Return(user.ErrUserNotFound)
+			},
+			expectedError: user.ErrUserNotFound,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := membershipService.EraseUser(ctx, userID)
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockRepo := mocks.NewMockMembershipRepository(ctrl)
+	mockUsers := mocks.NewMockUserRepository(ctrl)
+	defer ctrl.Finish()
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	mockCache := mocks.NewMockCache(ctrl)
+	membershipService := membership.New(mockRepo, mockUsers, mockCache, 1*time.Minute, 24*time.Hour, []byte("secret"), &mockBucketing{}, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	userID := int64(1)
+	email := "example@example.com"
+	update := user.Update{Email: &email}
+	updated := user.User{ID: userID, Email: email}
+
+	testCases := []struct {
+		title         string
+		mockCall      mockCall
+		expected      user.User
+		expectedError error
+	}{
+		{
+			title: "Successful user update drops cached memberships",
+			mockCall: func() {
+				mockUsers.EXPECT().UpdateUser(gomock.Any(), userID, update).Return(updated, nil)
+				mockCache.EXPECT().Delete(userID)
+			},
+			expected: updated,
+		},
+		{
+			title: "Email already taken",
+			mockCall: func() {
+				mockUsers.EXPECT().UpdateUser(gomock.Any(), userID, update).Return(user.User{}, user.ErrUserAlreadyExist)
+			},
+			expectedError: user.ErrUserAlreadyExist,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := membershipService.UpdateUser(ctx, userID, update)
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
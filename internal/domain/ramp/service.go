@@ -0,0 +1,59 @@
+package ramp
+
+import (
+	"context"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/pkg/logging"
+)
+
+type RampRepository interface {
+	ApplyRampSteps(ctx context.Context) (int, error)
+}
+
+// Cache holds the memberships served to the clients, a ramp step moves members of a segment
+// that can be cached for any user.
+type Cache interface {
+	Clear()
+}
+
+type service struct {
+	logger logging.Logger
+	ramp   RampRepository
+	cache  Cache
+}
+
+func New(ramp RampRepository, cache Cache, logger logging.Logger) *service {
+	return &service{
+		ramp:   ramp,
+		cache:  cache,
+		logger: logger,
+	}
+}
+
+func (s *service) Start(ctx context.Context, interval time.Duration) {
+	if interval > 0 {
+		go s.applySteps(ctx, interval)
+	}
+}
+
+func (s *service) applySteps(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		select {
+		case <-ctx.Done():
+			s.logger.Infof("context was closed, %s", ctx.Err().Error())
+			return
+		default:
+			childCtx, cancel := context.WithTimeout(ctx, interval)
+			applied, err := s.ramp.ApplyRampSteps(childCtx)
+			if err != nil {
+				s.logger.Errorf("couldn't apply ramp steps, %s", err.Error())
+			} else if applied > 0 {
+				s.cache.Clear()
+			}
+			cancel()
+		}
+	}
+}
@@ -36,18 +36,33 @@ func (m *MockSegmentRepository) EXPECT() *MockSegmentRepositoryMockRecorder {
 }
 
 // Create mocks base method.
-func (m *MockSegmentRepository) Create(ctx context.Context, name string, percentage int) (int64, error) {
+func (m *MockSegmentRepository) Create(ctx context.Context, segment segment.SegmentInfo) (int64, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", ctx, name, percentage)
+	ret := m.ctrl.Call(m, "Create", ctx, segment)
 	ret0, _ := ret[0].(int64)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Create indicates an expected call of Create.
-func (mr *MockSegmentRepositoryMockRecorder) Create(ctx, name, percentage interface{}) *gomock.Call {
+func (mr *MockSegmentRepositoryMockRecorder) Create(ctx, segment interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockSegmentRepository)(nil).Create), ctx, name, percentage)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockSegmentRepository)(nil).Create), ctx, segment)
+}
+
+// CreateAndAssign mocks base method.
+func (m *MockSegmentRepository) CreateAndAssign(ctx context.Context, segment segment.SegmentInfo) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAndAssign", ctx, segment)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateAndAssign indicates an expected call of CreateAndAssign.
+func (mr *MockSegmentRepositoryMockRecorder) CreateAndAssign(ctx, segment interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndAssign", reflect.TypeOf((*MockSegmentRepository)(nil).CreateAndAssign), ctx, segment)
 }
 
 // Get mocks base method.
@@ -66,16 +81,51 @@ func (mr *MockSegmentRepositoryMockRecorder) Get(ctx, name interface{}) *gomock.
 }
 
 // GetAll mocks base method.
-func (m *MockSegmentRepository) GetAll(ctx context.Context) ([]segment.SegmentInfo, error) {
+func (m *MockSegmentRepository) GetAll(ctx context.Context, filter segment.Filter) ([]segment.SegmentInfo, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAll", ctx)
+	ret := m.ctrl.Call(m, "GetAll", ctx, filter)
 	ret0, _ := ret[0].([]segment.SegmentInfo)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAll indicates an expected call of GetAll.
-func (mr *MockSegmentRepositoryMockRecorder) GetAll(ctx interface{}) *gomock.Call {
+func (mr *MockSegmentRepositoryMockRecorder) GetAll(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockSegmentRepository)(nil).GetAll), ctx, filter)
+}
+
+// MockCache is a mock of Cache interface.
+type MockCache struct {
+	ctrl     *gomock.Controller
+	recorder *MockCacheMockRecorder
+}
+
+// MockCacheMockRecorder is the mock recorder for MockCache.
+type MockCacheMockRecorder struct {
+	mock *MockCache
+}
+
+// NewMockCache creates a new mock instance.
+func NewMockCache(ctrl *gomock.Controller) *MockCache {
+	mock := &MockCache{ctrl: ctrl}
+	mock.recorder = &MockCacheMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCache) EXPECT() *MockCacheMockRecorder {
+	return m.recorder
+}
+
+// Clear mocks base method.
+func (m *MockCache) Clear() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Clear")
+}
+
+// Clear indicates an expected call of Clear.
+func (mr *MockCacheMockRecorder) Clear() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockSegmentRepository)(nil).GetAll), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clear", reflect.TypeOf((*MockCache)(nil).Clear))
 }
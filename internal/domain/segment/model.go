@@ -2,13 +2,119 @@ package segment
 
 import "time"
 
+// PrerequisitePolicy tells what happens to the segment when the user loses one of its prerequisites.
+const (
+	PolicyRefuse  string = "refuse"
+	PolicyCascade string = "cascade"
+)
+
+// PolicyOrDefault returns the policy, refusing the removal when none is set.
+func PolicyOrDefault(policy string) string {
+	if policy == "" {
+		return PolicyRefuse
+	}
+	return policy
+}
+
+// Segment is a membership to add, a zero StartsAt activates it at once and a zero ExpiredAt
+// is counted from the activation by TTL.
 type Segment struct {
 	ID        int64
 	Name      string
+	Layer     string
+	Capacity  *int
 	ExpiredAt time.Time
+	StartsAt  time.Time
+	TTL       time.Duration
 }
 
 type SegmentInfo struct {
-	ID   int64
-	Name string
+	ID                  int64
+	Name                string
+	Salt                string
+	Layer               string
+	AutomaticPercentage int
+	Members             int64
+	Variants            []Variant
+	Description         string
+	Owner               string
+	Tags                []string
+	Attributes          map[string]interface{}
+	ArchivedAt          *time.Time
+	ActiveFrom          *time.Time
+	ActiveUntil         *time.Time
+	Rule                string
+	Prerequisites       []string
+	PrerequisitePolicy  string
+	Capacity            *int
+}
+
+// HasValidWindow reports whether the active window, when both bounds are set, ends after it starts.
+func (s SegmentInfo) HasValidWindow() bool {
+	if s.ActiveFrom == nil || s.ActiveUntil == nil {
+		return true
+	}
+	return s.ActiveUntil.After(*s.ActiveFrom)
+}
+
+// Update holds the segment fields to change, nil fields are left as they are.
+type Update struct {
+	AutomaticPercentage *int
+	Description         *string
+	Owner               *string
+	Tags                []string
+	Attributes          map[string]interface{}
+}
+
+func (u Update) HasMetadata() bool {
+	return u.Description != nil || u.Owner != nil || u.Tags != nil || u.Attributes != nil
+}
+
+func (u Update) IsEmpty() bool {
+	return u.AutomaticPercentage == nil && !u.HasMetadata()
+}
+
+// RampStep moves the automatic percentage of the segment once After has passed since the ramp was set.
+type RampStep struct {
+	AutomaticPercentage int
+	After               time.Duration
+}
+
+func NewRampStep(automaticPercentage int, after time.Duration) RampStep {
+	return RampStep{
+		AutomaticPercentage: automaticPercentage,
+		After:               after,
+	}
+}
+
+type Variant struct {
+	Name   string
+	Weight int
+}
+
+func NewVariant(name string, weight int) Variant {
+	return Variant{
+		Name:   name,
+		Weight: weight,
+	}
+}
+
+type Filter struct {
+	Prefix   string
+	Tag      string
+	Owner    string
+	Archived bool
+	Cursor   int64
+	Limit    uint64
+}
+
+func NewFilter(prefix string, tag string, owner string, archived bool, cursor int64, limit uint64) Filter {
+	return Filter{
+		Prefix:   prefix,
+		Tag:      tag,
+		Owner:    owner,
+		Archived: archived,
+		Cursor:   cursor,
+		Limit:    limit,
+	}
 }
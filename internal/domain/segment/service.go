@@ -3,48 +3,102 @@ package segment
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/VrMolodyakov/segment-api/pkg/logging"
+	"github.com/VrMolodyakov/segment-api/pkg/rule"
 )
 
 var ErrSegmentNotFound = errors.New("sergment not found")
 var ErrSegmentAlreadyExists = errors.New("segment already exists")
+var ErrNothingToUpdate = errors.New("nothing to update")
+var ErrGracePeriodExpired = errors.New("segment grace period expired")
+var ErrInvalidWindow = errors.New("segment active window ends before it starts")
+var ErrInvalidRule = errors.New("invalid segment rule")
+var ErrRuleWithPercentage = errors.New("rule based segment can't have hit percentage")
+var ErrPrerequisiteNotFound = errors.New("prerequisite segment not found")
+var ErrSelfPrerequisite = errors.New("segment can't require itself")
+var ErrRampNotFound = errors.New("segment has no ramp schedule")
+var ErrInvalidRamp = errors.New("ramp steps must be ordered by time")
+
+const (
+	fullPercentage int = 100
+)
 
 type SegmentRepository interface {
-	Create(ctx context.Context, name string, percentage int) (int64, error)
+	Create(ctx context.Context, segment SegmentInfo) (int64, error)
+	CreateAndAssign(ctx context.Context, segment SegmentInfo) (int64, error)
 	Get(ctx context.Context, name string) (SegmentInfo, error)
-	GetAll(ctx context.Context) ([]SegmentInfo, error)
+	GetAll(ctx context.Context, filter Filter) ([]SegmentInfo, error)
+}
+
+// Cache holds the memberships served to the clients.
+type Cache interface {
+	Clear()
 }
 
 type service struct {
 	logger  logging.Logger
 	segment SegmentRepository
+	cache   Cache
 }
 
-func New(segment SegmentRepository, logger logging.Logger) *service {
+func New(segment SegmentRepository, cache Cache, logger logging.Logger) *service {
 	return &service{
 		segment: segment,
+		cache:   cache,
 		logger:  logger,
 	}
 }
 
-func (s *service) CreateSegment(ctx context.Context, name string, percentage int) (int64, error) {
-	s.logger.Debugf("try to create segment , name : %s", name)
-	if _, err := s.segment.Get(ctx, name); err != ErrSegmentNotFound {
+func (s *service) CreateSegment(ctx context.Context, segment SegmentInfo, assignExisting bool) (int64, error) {
+	s.logger.Debugf("try to create segment , name : %s", segment.Name)
+	if !segment.HasValidWindow() {
+		return 0, ErrInvalidWindow
+	}
+	if segment.Rule != "" {
+		if _, err := rule.Parse(segment.Rule); err != nil {
+			return 0, fmt.Errorf("%w, %s", ErrInvalidRule, err.Error())
+		}
+		if segment.AutomaticPercentage < fullPercentage {
+			return 0, ErrRuleWithPercentage
+		}
+	}
+	for _, prerequisite := range segment.Prerequisites {
+		if prerequisite == segment.Name {
+			return 0, ErrSelfPrerequisite
+		}
+	}
+	if _, err := s.segment.Get(ctx, segment.Name); err != ErrSegmentNotFound {
 		if err == nil {
-			s.logger.Error("segment %s already exists", name)
+			s.logger.Error("segment %s already exists", segment.Name)
 			return 0, ErrSegmentAlreadyExists
 		}
 		return 0, err
 
 	}
-	id, err := s.segment.Create(ctx, name, percentage)
+	if !assignExisting {
+		id, err := s.segment.Create(ctx, segment)
+		if err != nil {
+			s.logger.Error("cannot create segment %s", err.Error())
+		}
+		return id, err
+	}
+	id, err := s.segment.CreateAndAssign(ctx, segment)
 	if err != nil {
 		s.logger.Error("cannot create segment %s", err.Error())
+		return 0, err
 	}
-	return id, err
+	// the existing users got the new segment, their cached lists miss it
+	s.cache.Clear()
+	return id, nil
 }
 
-func (s *service) GetAllSegments(ctx context.Context) ([]SegmentInfo, error) {
-	return s.segment.GetAll(ctx)
+func (s *service) GetAllSegments(ctx context.Context, filter Filter) ([]SegmentInfo, error) {
+	s.logger.Debugf("try to get segments, prefix : %s cursor : %d", filter.Prefix, filter.Cursor)
+	segments, err := s.segment.GetAll(ctx, filter)
+	if err != nil {
+		s.logger.Errorf("cannot get segments %s", err.Error())
+	}
+	return segments, err
 }
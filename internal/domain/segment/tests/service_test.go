@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment/mocks"
@@ -15,18 +16,30 @@ import (
 func TestSaveSegment(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockSegmentRepository(ctrl)
+	mockCache := mocks.NewMockCache(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
-	segmentService := segment.New(mockRepo, mockLogger)
+	segmentService := segment.New(mockRepo, mockCache, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
 	type args struct {
-		segment    string
-		percentage int
+		segment        segment.SegmentInfo
+		assignExisting bool
 	}
 	segmentID := int64(1)
+	experiment := segment.SegmentInfo{
+		Name:                "segment1",
+		Layer:               "checkout",
+		AutomaticPercentage: 50,
+		Variants: []segment.Variant{
+			segment.NewVariant("control", 50),
+			segment.NewVariant("treatment", 50),
+		},
+	}
+	activeFrom := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	activeUntil := activeFrom.Add(-time.Hour)
 	emptyID := int64(0)
 	testCases := []struct {
 		title    string
@@ -39,11 +52,36 @@ func TestSaveSegment(t *testing.T) {
 			title: "Successful segment creation",
 			mockCall: func() {
 				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, segment.ErrSegmentNotFound)
-				mockRepo.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Return(segmentID, nil)
+				mockRepo.EXPECT().Create(gomock.Any(), gomock.Any()).Return(segmentID, nil)
 			},
 			args: args{
-				"segment1",
-				1,
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 1},
+				false,
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Successful segment creation with assignment to existing users",
+			mockCall: func() {
+				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, segment.ErrSegmentNotFound)
+				mockRepo.EXPECT().CreateAndAssign(gomock.Any(), gomock.Any()).Return(segmentID, nil)
+				mockCache.EXPECT().Clear()
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 90},
+				true,
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Successful segment creation with layer and variants",
+			mockCall: func() {
+				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, segment.ErrSegmentNotFound)
+				mockRepo.EXPECT().Create(gomock.Any(), experiment).Return(segmentID, nil)
+			},
+			args: args{
+				experiment,
+				false,
 			},
 			expected: segmentID,
 		},
@@ -53,8 +91,8 @@ func TestSaveSegment(t *testing.T) {
 				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, errors.New("db internal error"))
 			},
 			args: args{
-				"segment1",
-				10,
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 10},
+				false,
 			},
 			isError:  true,
 			expected: emptyID,
@@ -65,8 +103,64 @@ func TestSaveSegment(t *testing.T) {
 				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{Name: "segment1"}, nil)
 			},
 			args: args{
-				"segment1",
-				100,
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 100},
+				false,
+			},
+			isError:  true,
+			expected: emptyID,
+		},
+		{
+			title: "Active window ending before it starts should return error",
+			mockCall: func() {
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", ActiveFrom: &activeFrom, ActiveUntil: &activeUntil},
+				false,
+			},
+			isError:  true,
+			expected: emptyID,
+		},
+		{
+			title: "Successful rule based segment creation",
+			mockCall: func() {
+				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, segment.ErrSegmentNotFound)
+				mockRepo.EXPECT().Create(gomock.Any(), gomock.Any()).Return(segmentID, nil)
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 100, Rule: `email ends_with "@avito.ru"`},
+				false,
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Invalid rule should return error",
+			mockCall: func() {
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 100, Rule: `email ends_with`},
+				false,
+			},
+			isError:  true,
+			expected: emptyID,
+		},
+		{
+			title: "Rule together with hit percentage should return error",
+			mockCall: func() {
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 50, Rule: `email ends_with "@avito.ru"`},
+				false,
+			},
+			isError:  true,
+			expected: emptyID,
+		},
+		{
+			title: "Segment requiring itself should return error",
+			mockCall: func() {
+			},
+			args: args{
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 1, Prerequisites: []string{"segment2", "segment1"}},
+				false,
 			},
 			isError:  true,
 			expected: emptyID,
@@ -75,11 +169,11 @@ func TestSaveSegment(t *testing.T) {
 			title: "Error while creating new segment",
 			mockCall: func() {
 				mockRepo.EXPECT().Get(gomock.Any(), gomock.Any()).Return(segment.SegmentInfo{}, segment.ErrSegmentNotFound)
-				mockRepo.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Return(emptyID, errors.New("create error"))
+				mockRepo.EXPECT().Create(gomock.Any(), gomock.Any()).Return(emptyID, errors.New("create error"))
 			},
 			args: args{
-				"segment1",
-				1,
+				segment.SegmentInfo{Name: "segment1", AutomaticPercentage: 1},
+				false,
 			},
 			expected: emptyID,
 			isError:  true,
@@ -88,7 +182,7 @@ func TestSaveSegment(t *testing.T) {
 	for _, test := range testCases {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			got, err := segmentService.CreateSegment(ctx, test.args.segment, test.args.percentage)
+			got, err := segmentService.CreateSegment(ctx, test.args.segment, test.args.assignExisting)
 			if test.isError {
 				assert.Error(t, err)
 			} else {
@@ -102,10 +196,11 @@ func TestSaveSegment(t *testing.T) {
 func TestGetAllSegments(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockRepo := mocks.NewMockSegmentRepository(ctrl)
+	mockCache := mocks.NewMockCache(ctrl)
 	defer ctrl.Finish()
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
-	segmentService := segment.New(mockRepo, mockLogger)
+	segmentService := segment.New(mockRepo, mockCache, mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -121,14 +216,14 @@ func TestGetAllSegments(t *testing.T) {
 		{
 			title: "Successful getting segments",
 			mockCall: func() {
-				mockRepo.EXPECT().GetAll(gomock.All()).Return([]segment.SegmentInfo{s1, s2}, nil)
+				mockRepo.EXPECT().GetAll(gomock.Any(), gomock.Any()).Return([]segment.SegmentInfo{s1, s2}, nil)
 			},
 			expected: []segment.SegmentInfo{s1, s2},
 		},
 		{
 			title: "Couldn't get segments should return error",
 			mockCall: func() {
-				mockRepo.EXPECT().GetAll(gomock.All()).Return(nil, errors.New("db error"))
+				mockRepo.EXPECT().GetAll(gomock.Any(), gomock.Any()).Return(nil, errors.New("db error"))
 			},
 			isError:  true,
 			expected: nil,
@@ -137,7 +232,7 @@ func TestGetAllSegments(t *testing.T) {
 	for _, test := range testCases {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			got, err := segmentService.GetAllSegments(ctx)
+			got, err := segmentService.GetAllSegments(ctx, segment.NewFilter("segment", "", "", false, 0, 10))
 			if test.isError {
 				assert.Error(t, err)
 			} else {
@@ -0,0 +1,126 @@
+package user
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+type AttributeType string
+
+const (
+	AttributeString  AttributeType = "string"
+	AttributeNumber  AttributeType = "number"
+	AttributeBoolean AttributeType = "boolean"
+	// AttributeDate values are strings like 2023-08-25, so rules can compare them as strings.
+	AttributeDate AttributeType = "date"
+)
+
+const (
+	attributeDateFormat string = "2006-01-02"
+)
+
+var (
+	attributeNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// Attribute is a registered user attribute, only registered attributes can be stored in User.Attributes.
+type Attribute struct {
+	Name        string
+	Type        AttributeType
+	Description string
+	CreatedAt   time.Time
+}
+
+func NewAttribute(name string, attributeType AttributeType, description string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        attributeType,
+		Description: description,
+	}
+}
+
+func (a Attribute) Valid() error {
+	if !attributeNameRegex.MatchString(a.Name) {
+		return ErrInvalidAttribute
+	}
+	switch a.Type {
+	case AttributeString, AttributeNumber, AttributeBoolean, AttributeDate:
+		return nil
+	}
+	return ErrInvalidAttribute
+}
+
+// Accepts reports whether the value has the attribute type, null is accepted for every type.
+func (a Attribute) Accepts(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch a.Type {
+	case AttributeString:
+		_, ok := value.(string)
+		return ok
+	case AttributeNumber:
+		switch value.(type) {
+		case float64, float32, int, int32, int64:
+			return true
+		}
+		return false
+	case AttributeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case AttributeDate:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(attributeDateFormat, s)
+		return err == nil
+	}
+	return false
+}
+
+// AttributeError is returned when a user attribute isn't registered or has a value of another type.
+type AttributeError struct {
+	Name     string
+	Expected AttributeType
+}
+
+func (e *AttributeError) Error() string {
+	if e.Expected == "" {
+		return fmt.Sprintf("attribute %q is not registered", e.Name)
+	}
+	return fmt.Sprintf("attribute %q must be a %s", e.Name, e.Expected)
+}
+
+// Schema holds the registered attributes by name.
+type Schema map[string]Attribute
+
+func NewSchema(attributes []Attribute) Schema {
+	schema := make(Schema, len(attributes))
+	for _, a := range attributes {
+		schema[a.Name] = a
+	}
+	return schema
+}
+
+// Validate checks the attributes against the schema, attributes are checked in name order.
+func (s Schema) Validate(attributes map[string]interface{}) error {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		attribute, ok := s[name]
+		if !ok {
+			return &AttributeError{Name: name}
+		}
+		if !attribute.Accepts(attributes[name]) {
+			return &AttributeError{Name: name, Expected: attribute.Type}
+		}
+	}
+	return nil
+}
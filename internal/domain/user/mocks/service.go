@@ -35,19 +35,19 @@ func (m *MockUserRepository) EXPECT() *MockUserRepositoryMockRecorder {
 	return m.recorder
 }
 
-// Create mocks base method.
-func (m *MockUserRepository) Create(ctx context.Context, user user.User) (int64, error) {
+// CreateAttribute mocks base method.
+func (m *MockUserRepository) CreateAttribute(ctx context.Context, attribute user.Attribute) (user.Attribute, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", ctx, user)
-	ret0, _ := ret[0].(int64)
+	ret := m.ctrl.Call(m, "CreateAttribute", ctx, attribute)
+	ret0, _ := ret[0].(user.Attribute)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Create indicates an expected call of Create.
-func (mr *MockUserRepositoryMockRecorder) Create(ctx, user interface{}) *gomock.Call {
+// CreateAttribute indicates an expected call of CreateAttribute.
+func (mr *MockUserRepositoryMockRecorder) CreateAttribute(ctx, attribute interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockUserRepository)(nil).Create), ctx, user)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAttribute", reflect.TypeOf((*MockUserRepository)(nil).CreateAttribute), ctx, attribute)
 }
 
 // Get mocks base method.
@@ -64,3 +64,86 @@ func (mr *MockUserRepositoryMockRecorder) Get(ctx, userID interface{}) *gomock.C
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockUserRepository)(nil).Get), ctx, userID)
 }
+
+// GetAll mocks base method.
+func (m *MockUserRepository) GetAll(ctx context.Context, filter user.Filter) ([]user.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", ctx, filter)
+	ret0, _ := ret[0].([]user.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockUserRepositoryMockRecorder) GetAll(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockUserRepository)(nil).GetAll), ctx, filter)
+}
+
+// GetAttributes mocks base method.
+func (m *MockUserRepository) GetAttributes(ctx context.Context) ([]user.Attribute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAttributes", ctx)
+	ret0, _ := ret[0].([]user.Attribute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAttributes indicates an expected call of GetAttributes.
+func (mr *MockUserRepositoryMockRecorder) GetAttributes(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttributes", reflect.TypeOf((*MockUserRepository)(nil).GetAttributes), ctx)
+}
+
+// Resolve mocks base method.
+func (m *MockUserRepository) Resolve(ctx context.Context, external user.ExternalID) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Resolve", ctx, external)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Resolve indicates an expected call of Resolve.
+func (mr *MockUserRepositoryMockRecorder) Resolve(ctx, external interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Resolve", reflect.TypeOf((*MockUserRepository)(nil).Resolve), ctx, external)
+}
+
+// MockMembership is a mock of Membership interface.
+type MockMembership struct {
+	ctrl     *gomock.Controller
+	recorder *MockMembershipMockRecorder
+}
+
+// MockMembershipMockRecorder is the mock recorder for MockMembership.
+type MockMembershipMockRecorder struct {
+	mock *MockMembership
+}
+
+// NewMockMembership creates a new mock instance.
+func NewMockMembership(ctrl *gomock.Controller) *MockMembership {
+	mock := &MockMembership{ctrl: ctrl}
+	mock.recorder = &MockMembershipMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMembership) EXPECT() *MockMembershipMockRecorder {
+	return m.recorder
+}
+
+// UpdateUser mocks base method.
+func (m *MockMembership) UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateUser", ctx, userID, update)
+	ret0, _ := ret[0].(user.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateUser indicates an expected call of UpdateUser.
+func (mr *MockMembershipMockRecorder) UpdateUser(ctx, userID, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockMembership)(nil).UpdateUser), ctx, userID, update)
+}
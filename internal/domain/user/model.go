@@ -2,24 +2,136 @@ package user
 
 import (
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/VrMolodyakov/segment-api/pkg/rule"
 )
 
 var (
-	emailRegex = regexp.MustCompile(`^.+@[^\.].*\.[a-z]{2,}$`)
+	emailRegex     = regexp.MustCompile(`^.+@[^\.].*\.[a-z]{2,}$`)
+	namespaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+)
+
+const (
+	refSeparator      string = ":"
+	maxExternalIDSize int    = 255
 )
 
 type UserID int
 
 type User struct {
-	ID        int64
-	FirstName string
-	LastName  string
-	Email     string
+	ID          int64
+	FirstName   string
+	LastName    string
+	Email       string
+	Attributes  map[string]interface{}
+	ExternalIDs []ExternalID
+}
+
+// ExternalID is an id the user is known by in an upstream system, unique within its namespace.
+type ExternalID struct {
+	Namespace string
+	ID        string
+}
+
+func NewExternalID(namespace string, id string) ExternalID {
+	return ExternalID{
+		Namespace: namespace,
+		ID:        id,
+	}
+}
+
+func (e ExternalID) Valid() error {
+	if !namespaceRegex.MatchString(e.Namespace) || e.ID == "" || len(e.ID) > maxExternalIDSize {
+		return ErrInvalidExternalID
+	}
+	return nil
+}
+
+func (e ExternalID) String() string {
+	return e.Namespace + refSeparator + e.ID
+}
+
+// Ref addresses a user either by the user id or by an external id.
+type Ref struct {
+	ID       int64
+	External ExternalID
+}
+
+// ParseRef reads a user reference, which is the numeric user id or an external id written as <namespace>:<id>.
+func ParseRef(ref string) (Ref, error) {
+	namespace, id, found := strings.Cut(ref, refSeparator)
+	if !found {
+		userID, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil || userID <= 0 {
+			return Ref{}, ErrInvalidRef
+		}
+		return Ref{ID: userID}, nil
+	}
+	external := NewExternalID(namespace, id)
+	if err := external.Valid(); err != nil {
+		return Ref{}, ErrInvalidRef
+	}
+	return Ref{External: external}, nil
 }
 
-func (u User) Valid() error {
+func (r Ref) IsExternal() bool {
+	return r.ID == 0
+}
+
+// Fields exposes the user to segment rules, attributes are reached as attributes.<name>.
+func (u User) Fields() rule.Fields {
+	return rule.Fields{
+		"id":         u.ID,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"email":      u.Email,
+		"attributes": u.Attributes,
+	}
+}
+
+// Valid checks the user fields, its attributes must be registered in the schema.
+func (u User) Valid(schema Schema) error {
 	if !emailRegex.MatchString(u.Email) {
 		return ErrInvalidEmail
 	}
-	return nil
+	for _, external := range u.ExternalIDs {
+		if err := external.Valid(); err != nil {
+			return err
+		}
+	}
+	return schema.Validate(u.Attributes)
+}
+
+type Update struct {
+	FirstName  *string
+	LastName   *string
+	Email      *string
+	Attributes map[string]interface{}
+}
+
+func (u Update) IsEmpty() bool {
+	return u.FirstName == nil && u.LastName == nil && u.Email == nil && u.Attributes == nil
+}
+
+func (u Update) Valid(schema Schema) error {
+	if u.Email != nil && !emailRegex.MatchString(*u.Email) {
+		return ErrInvalidEmail
+	}
+	return schema.Validate(u.Attributes)
+}
+
+type Filter struct {
+	Email  string
+	Cursor int64
+	Limit  uint64
+}
+
+func NewFilter(email string, cursor int64, limit uint64) Filter {
+	return Filter{
+		Email:  email,
+		Cursor: cursor,
+		Limit:  limit,
+	}
 }
@@ -8,24 +8,41 @@ import (
 )
 
 var (
-	ErrUserNotFound     = errors.New("user not found")
-	ErrUserAlreadyExist = errors.New("user already exist")
-	ErrInvalidEmail     = errors.New("email validation error.include at least 1 symbol before @ and 2 symbols after and dot (example@example.com)")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrUserAlreadyExist       = errors.New("user already exist")
+	ErrInvalidEmail           = errors.New("email validation error.include at least 1 symbol before @ and 2 symbols after and dot (example@example.com)")
+	ErrNothingToUpdate        = errors.New("nothing to update")
+	ErrInvalidRef             = errors.New("user reference must be a positive user id or <namespace>:<external id>")
+	ErrInvalidExternalID      = errors.New("external id validation error.namespace must be up to 64 lowercase letters, digits, '_', '.' or '-' and id from 1 to 255 symbols")
+	ErrExternalIDAlreadyExist = errors.New("external id already exist")
+	ErrInvalidAttribute       = errors.New("attribute validation error.name must start with a lowercase letter and contain up to 64 lowercase letters, digits or '_', type must be one of string, number, boolean, date")
+	ErrAttributeAlreadyExist  = errors.New("attribute already exist")
 )
 
 type UserRepository interface {
 	Get(ctx context.Context, userID int64) (User, error)
+	GetAll(ctx context.Context, filter Filter) ([]User, error)
+	Resolve(ctx context.Context, external ExternalID) (int64, error)
+	CreateAttribute(ctx context.Context, attribute Attribute) (Attribute, error)
+	GetAttributes(ctx context.Context) ([]Attribute, error)
+}
+
+// Membership stores the user update together with the changes of its rule based segments.
+type Membership interface {
+	UpdateUser(ctx context.Context, userID int64, update Update) (User, error)
 }
 
 type service struct {
-	logger logging.Logger
-	user   UserRepository
+	logger     logging.Logger
+	user       UserRepository
+	membership Membership
 }
 
-func New(user UserRepository, logger logging.Logger) *service {
+func New(user UserRepository, membership Membership, logger logging.Logger) *service {
 	return &service{
-		user:   user,
-		logger: logger,
+		user:       user,
+		membership: membership,
+		logger:     logger,
 	}
 }
 
@@ -33,3 +50,72 @@ func (s *service) GetUser(ctx context.Context, userID int64) (User, error) {
 	s.logger.Debugf("try to get user with id: %s", userID)
 	return s.user.Get(ctx, userID)
 }
+
+func (s *service) GetUsers(ctx context.Context, filter Filter) ([]User, error) {
+	s.logger.Debugf("try to get users, email : %s cursor : %d", filter.Email, filter.Cursor)
+	users, err := s.user.GetAll(ctx, filter)
+	if err != nil {
+		s.logger.Errorf("cannot get users %s", err.Error())
+	}
+	return users, err
+}
+
+func (s *service) UpdateUser(ctx context.Context, userID int64, update Update) (User, error) {
+	s.logger.Debugf("try to update user with id: %d", userID)
+	if update.IsEmpty() {
+		return User{}, ErrNothingToUpdate
+	}
+	var schema Schema
+	if len(update.Attributes) > 0 {
+		attributes, err := s.user.GetAttributes(ctx)
+		if err != nil {
+			s.logger.Errorf("cannot get attributes schema due to %s", err.Error())
+			return User{}, err
+		}
+		schema = NewSchema(attributes)
+	}
+	if err := update.Valid(schema); err != nil {
+		s.logger.Errorf("invalid update of user %d, %s", userID, err.Error())
+		return User{}, err
+	}
+	return s.membership.UpdateUser(ctx, userID, update)
+}
+
+// ResolveUser returns the id of the user addressed by ref, see ParseRef for its format.
+func (s *service) ResolveUser(ctx context.Context, ref string) (int64, error) {
+	parsed, err := ParseRef(ref)
+	if err != nil {
+		return 0, err
+	}
+	if !parsed.IsExternal() {
+		return parsed.ID, nil
+	}
+	s.logger.Debugf("try to resolve external user id %s", parsed.External.String())
+	userID, err := s.user.Resolve(ctx, parsed.External)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		s.logger.Errorf("cannot resolve external user id %s due to %s", parsed.External.String(), err.Error())
+	}
+	return userID, err
+}
+
+func (s *service) CreateAttribute(ctx context.Context, attribute Attribute) (Attribute, error) {
+	s.logger.Debugf("try to register attribute %s", attribute.Name)
+	if err := attribute.Valid(); err != nil {
+		s.logger.Errorf("invalid attribute %s of type %s", attribute.Name, attribute.Type)
+		return Attribute{}, err
+	}
+	created, err := s.user.CreateAttribute(ctx, attribute)
+	if err != nil {
+		s.logger.Errorf("cannot register attribute %s due to %s", attribute.Name, err.Error())
+	}
+	return created, err
+}
+
+func (s *service) GetAttributes(ctx context.Context) ([]Attribute, error) {
+	s.logger.Debug("try to get attributes")
+	attributes, err := s.user.GetAttributes(ctx)
+	if err != nil {
+		s.logger.Errorf("cannot get attributes %s", err.Error())
+	}
+	return attributes, err
+}
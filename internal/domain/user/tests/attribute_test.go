@@ -0,0 +1,71 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema := user.NewSchema([]user.Attribute{
+		user.NewAttribute("country", user.AttributeString, ""),
+		user.NewAttribute("age", user.AttributeNumber, ""),
+		user.NewAttribute("beta", user.AttributeBoolean, ""),
+		user.NewAttribute("signup_date", user.AttributeDate, ""),
+	})
+
+	testCases := []struct {
+		title      string
+		attributes map[string]interface{}
+		expected   error
+	}{
+		{
+			title: "All attributes match their types",
+			attributes: map[string]interface{}{
+				"country":     "RU",
+				"age":         float64(31),
+				"beta":        true,
+				"signup_date": "2023-08-25",
+			},
+		},
+		{
+			title:      "Null clears the attribute",
+			attributes: map[string]interface{}{"country": nil},
+		},
+		{
+			title:      "No attributes",
+			attributes: nil,
+		},
+		{
+			title:      "Attribute is not registered",
+			attributes: map[string]interface{}{"city": "Moscow"},
+			expected:   &user.AttributeError{Name: "city"},
+		},
+		{
+			title:      "Number as a string",
+			attributes: map[string]interface{}{"age": "31"},
+			expected:   &user.AttributeError{Name: "age", Expected: user.AttributeNumber},
+		},
+		{
+			title:      "Boolean as a number",
+			attributes: map[string]interface{}{"beta": float64(1)},
+			expected:   &user.AttributeError{Name: "beta", Expected: user.AttributeBoolean},
+		},
+		{
+			title:      "Date in another format",
+			attributes: map[string]interface{}{"signup_date": "2023-08-25T12:00:00Z"},
+			expected:   &user.AttributeError{Name: "signup_date", Expected: user.AttributeDate},
+		},
+		{
+			title:      "The first invalid attribute by name is reported",
+			attributes: map[string]interface{}{"country": 1, "age": "31"},
+			expected:   &user.AttributeError{Name: "age", Expected: user.AttributeNumber},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			assert.Equal(t, test.expected, schema.Validate(test.attributes))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/domain/user"
 	"github.com/VrMolodyakov/segment-api/internal/domain/user/mocks"
@@ -18,7 +19,7 @@ func TestGetUser(t *testing.T) {
 	mockRepo := mocks.NewMockUserRepository(ctrl)
 	mockLogger, err := logging.MockLogger()
 	assert.NoError(t, err)
-	userService := user.New(mockRepo, mockLogger)
+	userService := user.New(mockRepo, mocks.NewMockMembership(ctrl), mockLogger)
 	ctx := context.Background()
 	type mockCall func()
 
@@ -85,3 +86,343 @@ func TestGetUser(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mocks.NewMockUserRepository(ctrl)
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	userService := user.New(mockRepo, mocks.NewMockMembership(ctrl), mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	type args struct {
+		filter user.Filter
+	}
+
+	users := []user.User{{ID: 1}, {ID: 2}}
+
+	testCases := []struct {
+		title    string
+		mockCall mockCall
+		args     args
+		expected []user.User
+		isError  bool
+	}{
+		{
+			title: "Successful getting users",
+			mockCall: func() {
+				mockRepo.EXPECT().GetAll(gomock.Any(), user.NewFilter("example", 0, 20)).Return(users, nil)
+			},
+			args: args{
+				user.NewFilter("example", 0, 20),
+			},
+			expected: users,
+		},
+		{
+			title: "DB error",
+			mockCall: func() {
+				mockRepo.EXPECT().GetAll(gomock.Any(), gomock.Any()).Return(nil, errors.New("db internal error"))
+			},
+			args: args{
+				user.NewFilter("", 0, 20),
+			},
+			isError: true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := userService.GetUsers(ctx, test.args.filter)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mocks.NewMockUserRepository(ctrl)
+	mockMembership := mocks.NewMockMembership(ctrl)
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	userService := user.New(mockRepo, mockMembership, mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	type args struct {
+		id     int64
+		update user.Update
+	}
+
+	userID := int64(1)
+	email := "example@example.com"
+	invalidEmail := "example"
+	updated := user.User{
+		ID:    userID,
+		Email: email,
+	}
+
+	testCases := []struct {
+		title    string
+		mockCall mockCall
+		args     args
+		expected user.User
+		err      error
+	}{
+		{
+			title: "Successful updating user",
+			mockCall: func() {
+				mockMembership.EXPECT().UpdateUser(gomock.Any(), userID, user.Update{Email: &email}).Return(updated, nil)
+			},
+			args: args{
+				id:     userID,
+				update: user.Update{Email: &email},
+			},
+			expected: updated,
+		},
+		{
+			title:    "Nothing to update",
+			mockCall: func() {},
+			args: args{
+				id: userID,
+			},
+			err: user.ErrNothingToUpdate,
+		},
+		{
+			title:    "Invalid email",
+			mockCall: func() {},
+			args: args{
+				id:     userID,
+				update: user.Update{Email: &invalidEmail},
+			},
+			err: user.ErrInvalidEmail,
+		},
+		{
+			title: "Email already taken",
+			mockCall: func() {
+				mockMembership.EXPECT().UpdateUser(gomock.Any(), userID, gomock.Any()).Return(user.User{}, user.ErrUserAlreadyExist)
+			},
+			args: args{
+				id:     userID,
+				update: user.Update{Email: &email},
+			},
+			err: user.ErrUserAlreadyExist,
+		},
+		{
+			title: "Successful updating user attributes",
+			mockCall: func() {
+				mockRepo.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{{Name: "beta", Type: user.AttributeBoolean}}, nil)
+				mockMembership.EXPECT().UpdateUser(gomock.Any(), userID, gomock.Any()).Return(updated, nil)
+			},
+			args: args{
+				id:     userID,
+				update: user.Update{Attributes: map[string]interface{}{"beta": true}},
+			},
+			expected: updated,
+		},
+		{
+			title: "Attribute has another type",
+			mockCall: func() {
+				mockRepo.EXPECT().GetAttributes(gomock.Any()).Return([]user.Attribute{{Name: "beta", Type: user.AttributeBoolean}}, nil)
+			},
+			args: args{
+				id:     userID,
+				update: user.Update{Attributes: map[string]interface{}{"beta": "yes"}},
+			},
+			err: &user.AttributeError{Name: "beta", Expected: user.AttributeBoolean},
+		},
+		{
+			title: "Error while getting attributes schema",
+			mockCall: func() {
+				mockRepo.EXPECT().GetAttributes(gomock.Any()).Return(nil, errors.New("internal error"))
+			},
+			args: args{
+				id:     userID,
+				update: user.Update{Attributes: map[string]interface{}{"beta": true}},
+			},
+			err: errors.New("internal error"),
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := userService.UpdateUser(ctx, test.args.id, test.args.update)
+			if test.err != nil {
+				assert.EqualError(t, err, test.err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mocks.NewMockUserRepository(ctrl)
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	userService := user.New(mockRepo, mocks.NewMockMembership(ctrl), mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	testCases := []struct {
+		title    string
+		mockCall mockCall
+		ref      string
+		expected int64
+		err      error
+	}{
+		{
+			title:    "User id is returned as is",
+			mockCall: func() {},
+			ref:      "42",
+			expected: 42,
+		},
+		{
+			title: "External id is resolved",
+			mockCall: func() {
+				mockRepo.EXPECT().Resolve(gomock.Any(), user.NewExternalID("crm", "550e8400-e29b-41d4-a716-446655440000")).Return(int64(7), nil)
+			},
+			ref:      "crm:550e8400-e29b-41d4-a716-446655440000",
+			expected: 7,
+		},
+		{
+			title: "Unknown external id",
+			mockCall: func() {
+				mockRepo.EXPECT().Resolve(gomock.Any(), user.NewExternalID("crm", "a-17")).Return(int64(0), user.ErrUserNotFound)
+			},
+			ref: "crm:a-17",
+			err: user.ErrUserNotFound,
+		},
+		{
+			title:    "Not a positive user id",
+			mockCall: func() {},
+			ref:      "-1",
+			err:      user.ErrInvalidRef,
+		},
+		{
+			title:    "Neither user id nor external id",
+			mockCall: func() {},
+			ref:      "bob",
+			err:      user.ErrInvalidRef,
+		},
+		{
+			title:    "Invalid namespace",
+			mockCall: func() {},
+			ref:      "CRM:a-17",
+			err:      user.ErrInvalidRef,
+		},
+		{
+			title:    "Empty external id",
+			mockCall: func() {},
+			ref:      "crm:",
+			err:      user.ErrInvalidRef,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := userService.ResolveUser(ctx, test.ref)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestCreateAttribute(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mocks.NewMockUserRepository(ctrl)
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	userService := user.New(mockRepo, mocks.NewMockMembership(ctrl), mockLogger)
+	ctx := context.Background()
+	type mockCall func()
+
+	attribute := user.NewAttribute("signup_date", user.AttributeDate, "First visit")
+	created := attribute
+	created.CreatedAt = time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		title     string
+		mockCall  mockCall
+		attribute user.Attribute
+		expected  user.Attribute
+		err       error
+	}{
+		{
+			title: "Successful attribute registration",
+			mockCall: func() {
+				mockRepo.EXPECT().CreateAttribute(gomock.Any(), attribute).Return(created, nil)
+			},
+			attribute: attribute,
+			expected:  created,
+		},
+		{
+			title:     "Invalid attribute name",
+			mockCall:  func() {},
+			attribute: user.NewAttribute("Signup-Date", user.AttributeDate, ""),
+			err:       user.ErrInvalidAttribute,
+		},
+		{
+			title:     "Unknown attribute type",
+			mockCall:  func() {},
+			attribute: user.NewAttribute("signup_date", user.AttributeType("timestamp"), ""),
+			err:       user.ErrInvalidAttribute,
+		},
+		{
+			title: "Attribute already registered",
+			mockCall: func() {
+				mockRepo.EXPECT().CreateAttribute(gomock.Any(), attribute).Return(user.Attribute{}, user.ErrAttributeAlreadyExist)
+			},
+			attribute: attribute,
+			err:       user.ErrAttributeAlreadyExist,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := userService.CreateAttribute(ctx, test.attribute)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestGetAttributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mocks.NewMockUserRepository(ctrl)
+	mockLogger, err := logging.MockLogger()
+	assert.NoError(t, err)
+	userService := user.New(mockRepo, mocks.NewMockMembership(ctrl), mockLogger)
+	ctx := context.Background()
+
+	attributes := []user.Attribute{{Name: "country", Type: user.AttributeString}}
+
+	mockRepo.EXPECT().GetAttributes(gomock.Any()).Return(attributes, nil)
+	got, err := userService.GetAttributes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, attributes, got)
+
+	mockRepo.EXPECT().GetAttributes(gomock.Any()).Return(nil, errors.New("internal error"))
+	_, err = userService.GetAttributes(ctx)
+	assert.Error(t, err)
+}
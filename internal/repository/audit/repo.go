@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	psql "github.com/VrMolodyakov/segment-api/pkg/client/postgresql"
+)
+
+const (
+	auditTable string = "segment_audit"
+)
+
+type repo struct {
+	builder sq.StatementBuilderType
+	client  psql.Client
+}
+
+func New(client psql.Client) *repo {
+	return &repo{
+		client:  client,
+		builder: sq.StatementBuilder.PlaceholderFormat(sq.Dollar),
+	}
+}
+
+// GetSegmentAudit returns the events of the segment in the order they happened,
+// the events outlive the segment, so a purged segment keeps its audit.
+func (r *repo) GetSegmentAudit(ctx context.Context, segmentName string) ([]audit.Event, error) {
+	sql, args, err := r.builder.
+		Select("audit_id", "segment_id", "segment_name", "actor", "operation", "before", "after", "operation_timestamp").
+		From(auditTable).
+		Where(sq.Eq{"segment_name": segmentName}).
+		OrderBy("operation_timestamp", "audit_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]audit.Event, 0)
+	for rows.Next() {
+		var e audit.Event
+		if err := rows.Scan(&e.ID, &e.SegmentID, &e.Segment, &e.Actor, &e.Operation, &e.Before, &e.After, &e.Time); err != nil {
+			return nil, fmt.Errorf("couldn't scan audit event : %w", err)
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSegmentAudit(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	repo := New(mockClient)
+
+	segmentName := "segment1"
+	segmentID := int64(1)
+	columns := []string{"audit_id", "segment_id", "segment_name", "actor", "operation", "before", "after", "operation_timestamp"}
+	events := []audit.Event{
+		{
+			ID:        1,
+			SegmentID: segmentID,
+			Segment:   segmentName,
+			Actor:     "admin",
+			Operation: audit.Created,
+			After:     audit.Values{"hitPercentage": float64(10)},
+			Time:      testTime,
+		},
+		{
+			ID:        2,
+			SegmentID: segmentID,
+			Segment:   segmentName,
+			Actor:     audit.SystemActor,
+			Operation: audit.RampStep,
+			Before:    audit.Values{"hitPercentage": float64(10)},
+			After:     audit.Values{"hitPercentage": float64(25)},
+			Time:      testTime.Add(time.Hour),
+		},
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		expected []audit.Event
+		mockCall func()
+	}{
+		{
+			title: "Should successfully retrieve segment audit",
+			mockCall: func() {
+				rows := pgxmock.NewRows(columns)
+				for _, e := range events {
+					rows.AddRow(e.ID, e.SegmentID, e.Segment, e.Actor, e.Operation, e.Before, e.After, e.Time)
+				}
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_audit WHERE segment_name = (.+) ORDER BY operation_timestamp, audit_id").
+					WithArgs(segmentName).
+					WillReturnRows(rows)
+			},
+			expected: events,
+		},
+		{
+			title: "Database internal error",
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_audit").
+					WithArgs(segmentName).
+					WillReturnError(errors.New("internal database error"))
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			result, err := repo.GetSegmentAudit(ctx, segmentName)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, result)
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	historyTable string = "segment_history"
+	historyTable   string = "segment_history"
+	userTable      string = "users"
+	attributeTable string = "user_attributes"
 )
 
 type repo struct {
@@ -25,16 +27,67 @@ func New(client psql.Client) *repo {
 	}
 }
 
+// Get returns the history of the month, each record carries the current attributes of its user
+// and the names of the registered attributes that are exported as CSV columns.
 func (r *repo) Get(ctx context.Context, date history.Date) ([]history.History, error) {
+	attributeNames, err := r.getAttributeNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	sql, args, err := r.builder.
-		Select("user_id", "segment_name", "operation", "operation_timestamp").
-		From(historyTable).
+		Select(
+			"COALESCE(h.user_id, 0)",
+			"COALESCE(h.anonymous_id, '')",
+			"h.segment_name",
+			"COALESCE(h.variant_name, '')",
+			"h.operation",
+			"h.operation_timestamp",
+			"COALESCE(u.attributes, '{}')").
+		From(historyTable + " h").
+		LeftJoin(userTable + " u ON u.user_id = h.user_id").
 		Where(sq.And{
-			sq.Eq{"DATE_PART('year', operation_timestamp)": date.Year},
-			sq.Eq{"DATE_PART('month', operation_timestamp)": date.Month},
+			sq.Eq{"DATE_PART('year', h.operation_timestamp)": date.Year},
+			sq.Eq{"DATE_PART('month', h.operation_timestamp)": date.Month},
 		}).
-		OrderBy("user_id").
+		OrderBy("h.user_id").
+		OrderBy("h.operation_timestamp").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	histories := make([]history.History, 0)
+	for rows.Next() {
+		history := history.History{AttributeNames: attributeNames}
+		if err := rows.Scan(&history.UserID, &history.AnonymousID, &history.Segment, &history.Variant, &history.Operation, &history.Time, &history.Attributes); err != nil {
+			return nil, fmt.Errorf("couldn't scan history : %w", err)
+		}
+		histories = append(histories, history)
+	}
+
+	return histories, nil
+}
+
+// GetUserHistory returns the whole history of the user in the order it happened.
+func (r *repo) GetUserHistory(ctx context.Context, userID int64) ([]history.History, error) {
+	sql, args, err := r.builder.
+		Select(
+			"history_id",
+			"user_id",
+			"segment_name",
+			"COALESCE(variant_name, '')",
+			"operation",
+			"operation_timestamp").
+		From(historyTable).
+		Where(sq.Eq{"user_id": userID}).
 		OrderBy("operation_timestamp").
+		OrderBy("history_id").
 		ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create query : %w", err)
@@ -48,7 +101,7 @@ func (r *repo) Get(ctx context.Context, date history.Date) ([]history.History, e
 	histories := make([]history.History, 0)
 	for rows.Next() {
 		var history history.History
-		if err := rows.Scan(&history.UserID, &history.Segment, &history.Operation, &history.Time); err != nil {
+		if err := rows.Scan(&history.ID, &history.UserID, &history.Segment, &history.Variant, &history.Operation, &history.Time); err != nil {
 			return nil, fmt.Errorf("couldn't scan history : %w", err)
 		}
 		histories = append(histories, history)
@@ -56,3 +109,29 @@ func (r *repo) Get(ctx context.Context, date history.Date) ([]history.History, e
 
 	return histories, nil
 }
+
+func (r *repo) getAttributeNames(ctx context.Context) ([]string, error) {
+	sql, args, err := r.builder.
+		Select("attribute_name").
+		From(attributeTable).
+		OrderBy("attribute_name").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("couldn't scan attribute name : %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -23,10 +23,14 @@ func TestGetUserSegments(t *testing.T) {
 
 	userID := int64(1)
 	year, month := 2013, 11
+	attributeNames := []string{"country", "platform"}
+	attributes := map[string]interface{}{"country": "RU", "platform": "ios"}
 	historyRecords := []history.History{
-		{UserID: userID, Segment: "segment1", Operation: "Added", Time: testTime},
-		{UserID: userID, Segment: "segment1", Operation: "Deleted", Time: testTime},
+		{UserID: userID, Segment: "segment1", Variant: "control", Operation: "Added", Time: testTime, Attributes: attributes, AttributeNames: attributeNames},
+		{UserID: userID, Segment: "segment1", Operation: "Deleted", Time: testTime, Attributes: attributes, AttributeNames: attributeNames},
+		{AnonymousID: "4f1c2a9b7e3d4c5a8b6e9f0a1b2c3d4e", Segment: "segment1", Operation: "Added", Time: testTime, Attributes: map[string]interface{}{}, AttributeNames: attributeNames},
 	}
+	historyColumns := []string{"user_id", "anonymous_id", "segment_name", "variant_name", "operation", "operation_timestamp", "attributes"}
 
 	type args struct {
 		date history.Date
@@ -42,11 +46,18 @@ func TestGetUserSegments(t *testing.T) {
 		{
 			title: "Should successfully retrieve user segments history",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_timestamp"}).
-					AddRow(historyRecords[0].UserID, historyRecords[0].Segment, historyRecords[0].Operation, historyRecords[0].Time).
-					AddRow(historyRecords[1].UserID, historyRecords[1].Segment, historyRecords[1].Operation, historyRecords[1].Time)
+				names := pgxmock.NewRows([]string{"attribute_name"}).
+					AddRow("country").
+					AddRow("platform")
+				rows := pgxmock.NewRows(historyColumns).
+					AddRow(historyRecords[0].UserID, "", historyRecords[0].Segment, historyRecords[0].Variant, historyRecords[0].Operation, historyRecords[0].Time, attributes).
+					AddRow(historyRecords[1].UserID, "", historyRecords[1].Segment, historyRecords[1].Variant, historyRecords[1].Operation, historyRecords[1].Time, attributes).
+					AddRow(int64(0), historyRecords[2].AnonymousID, historyRecords[2].Segment, historyRecords[2].Variant, historyRecords[2].Operation, historyRecords[2].Time, map[string]interface{}{})
 				mockClient.
-					ExpectQuery("SELECT user_id, segment_name, operation, operation_timestamp FROM segment_history").
+					ExpectQuery("SELECT attribute_name FROM user_attributes ORDER BY attribute_name").
+					WillReturnRows(names)
+				mockClient.
+					ExpectQuery("SELECT (.+), h.segment_name, (.+), h.operation, h.operation_timestamp, (.+) FROM segment_history h LEFT JOIN users u ON u.user_id = h.user_id").
 					WithArgs(year, month).
 					WillReturnRows(rows)
 			},
@@ -60,7 +71,10 @@ func TestGetUserSegments(t *testing.T) {
 			title: "Database internal error",
 			mockCall: func() {
 				mockClient.
-					ExpectQuery("SELECT user_id, segment_name, operation, operation_timestamp FROM segment_history").
+					ExpectQuery("SELECT attribute_name FROM user_attributes").
+					WillReturnRows(pgxmock.NewRows([]string{"attribute_name"}))
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_history h").
 					WithArgs(year, month).
 					WillReturnError(errors.New("internal database error"))
 			},
@@ -70,6 +84,19 @@ func TestGetUserSegments(t *testing.T) {
 			isError:  true,
 			expected: nil,
 		},
+		{
+			title: "Couldn't get attribute names",
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT attribute_name FROM user_attributes").
+					WillReturnError(errors.New("internal database error"))
+			},
+			args: args{
+				history.Date{Year: year, Month: month},
+			},
+			isError:  true,
+			expected: nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -86,3 +113,64 @@ func TestGetUserSegments(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUserHistory(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	repo := New(mockClient)
+
+	userID := int64(1)
+	historyRecords := []history.History{
+		{ID: 1, UserID: userID, Segment: "segment1", Variant: "control", Operation: history.Added, Time: testTime},
+		{ID: 2, UserID: userID, Segment: "segment1", Operation: history.Deleted, Time: testTime.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		expected []history.History
+		mockCall func()
+	}{
+		{
+			title: "Should successfully retrieve the user history",
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"history_id", "user_id", "segment_name", "variant_name", "operation", "operation_timestamp"}).
+					AddRow(historyRecords[0].ID, historyRecords[0].UserID, historyRecords[0].Segment, historyRecords[0].Variant, historyRecords[0].Operation, historyRecords[0].Time).
+					AddRow(historyRecords[1].ID, historyRecords[1].UserID, historyRecords[1].Segment, historyRecords[1].Variant, historyRecords[1].Operation, historyRecords[1].Time)
+				mockClient.
+					ExpectQuery("SELECT history_id, user_id, segment_name, (.+), operation, operation_timestamp FROM segment_history WHERE user_id = \\$1 ORDER BY operation_timestamp, history_id").
+					WithArgs(userID).
+					WillReturnRows(rows)
+			},
+			expected: historyRecords,
+		},
+		{
+			title: "Database internal error",
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT history_id, user_id, segment_name, (.+), operation, operation_timestamp FROM segment_history").
+					WithArgs(userID).
+					WillReturnError(errors.New("internal database error"))
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			result, err := repo.GetUserHistory(ctx, userID)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
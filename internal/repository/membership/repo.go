@@ -4,31 +4,50 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
 	"github.com/VrMolodyakov/segment-api/internal/domain/history"
 	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	"github.com/VrMolodyakov/segment-api/internal/domain/user"
 	psql "github.com/VrMolodyakov/segment-api/pkg/client/postgresql"
 	"github.com/VrMolodyakov/segment-api/pkg/clock"
+	"github.com/VrMolodyakov/segment-api/pkg/random"
+	"github.com/VrMolodyakov/segment-api/pkg/rule"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
 const (
-	segmentTable      string = "segments"
-	userTable         string = "users"
-	userSegmentsTable string = "user_segments"
-	historyTable      string = "segment_history"
+	segmentTable       string = "segments"
+	userTable          string = "users"
+	userSegmentsTable  string = "user_segments"
+	historyTable       string = "segment_history"
+	variantTable       string = "segment_variants"
+	prerequisiteTable  string = "segment_prerequisites"
+	rampTable          string = "segment_ramps"
+	rampStepTable      string = "segment_ramp_steps"
+	auditTable         string = "segment_audit"
+	layerIndex         string = "user_segments_layer_idx"
+	maxPercentage      int    = 100
+	reconcileBatchSize uint64 = 500
+	// insertChunkSize keeps a multi-row insert below the 65535 bind parameters of a statement
+	insertChunkSize int = 5000
 )
 
 var (
 	maxFutureTime = time.Date(9999, 1, 1, 1, 59, 59, 0, time.UTC)
 )
 
+// rowQuerier is satisfied by both the client and a transaction.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 type repo struct {
 	client  psql.Client
 	builder sq.StatementBuilderType
@@ -43,7 +62,18 @@ func New(client psql.Client, clock clock.Clock) *repo {
 	}
 }
 
-func (r *repo) UpdateUserSegments(ctx context.Context, userID int64, addSegments []segment.Segment, deleteSegments []string) error {
+// UpdateUserSegments removes and then adds the user segments, so a segment can be swapped for another one
+// of the same layer. With an upsert policy the added segments that the user already has get a new expiration
+// instead of failing with ErrSegmentAlreadyAssigned.
+// Segments starting in the future are recorded as added by ActivateScheduled, removing them
+// before they start leaves no history.
+func (r *repo) UpdateUserSegments(
+	ctx context.Context,
+	userID int64,
+	addSegments []segment.Segment,
+	deleteSegments []string,
+	policy membership.UpsertPolicy,
+) error {
 	tx, err := r.client.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("couldn't begin transaction: %w", err)
@@ -58,15 +88,45 @@ func (r *repo) UpdateUserSegments(ctx context.Context, userID int64, addSegments
 		}
 	}()
 
-	if err = r.insertIfExists(ctx, tx, userID, addSegments); err != nil {
+	var pending map[string]struct{}
+	if len(deleteSegments) > 0 {
+		if pending, err = r.getPendingNames(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	deleteIDs, err := r.deleteIfExists(ctx, tx, userID, deleteSegments)
+	if err != nil {
+		return err
+	}
+
+	cascaded, err := r.deleteDependents(ctx, tx, userID, deleteIDs)
+	if err != nil {
+		return err
+	}
+
+	extended, err := r.insertIfExists(ctx, tx, userID, addSegments, policy)
+	if err != nil {
 		return err
 	}
 
-	if err = r.deleteIfExists(ctx, tx, userID, deleteSegments); err != nil {
+	if err = r.checkPrerequisites(ctx, tx, userID, addSegments); err != nil {
 		return err
 	}
 
-	if err = r.registerUpdateUserEvent(ctx, tx, userID, addSegments, deleteSegments, r.clock.Now()); err != nil {
+	deleted := make([]string, 0, len(deleteSegments)+len(cascaded))
+	for _, name := range append(append([]string{}, deleteSegments...), cascaded...) {
+		if _, ok := pending[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	inserted := make([]segment.Segment, 0, len(addSegments))
+	for i := range addSegments {
+		if addSegments[i].StartsAt.IsZero() && !containsSegment(extended, addSegments[i].ID) {
+			inserted = append(inserted, addSegments[i])
+		}
+	}
+	if err = r.registerUpdateUserEvent(ctx, tx, userID, inserted, deleted, extended, r.clock.Now()); err != nil {
 		return err
 	}
 
@@ -77,7 +137,98 @@ func (r *repo) UpdateUserSegments(ctx context.Context, userID int64, addSegments
 	return nil
 }
 
-func (r *repo) DeleteSegment(ctx context.Context, name string) error {
+// PreviewDelete counts the active members of the segment without changing anything,
+// sampleSize limits the number of returned user ids.
+func (r *repo) PreviewDelete(ctx context.Context, name string, sampleSize int) (membership.DeletePreview, error) {
+	sql, args, err := r.builder.
+		Select("segment_id", "segment_name", "salt").
+		From(segmentTable).
+		Where(sq.Eq{"segment_name": name, "archived_at": nil}).
+		ToSql()
+	if err != nil {
+		return membership.DeletePreview{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	var preview membership.DeletePreview
+	err = r.client.
+		QueryRow(ctx, sql, args...).
+		Scan(&preview.Segment.ID, &preview.Segment.Name, &preview.Segment.Salt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return membership.DeletePreview{}, segment.ErrSegmentNotFound
+		}
+		return membership.DeletePreview{}, fmt.Errorf("couldn't run query : %w", err)
+	}
+
+	if err = r.countMembers(ctx, r.client, &preview); err != nil {
+		return membership.DeletePreview{}, err
+	}
+
+	if sampleSize <= 0 || preview.Affected() == 0 {
+		return preview, nil
+	}
+
+	sql, args, err = r.builder.
+		Select("user_id").
+		From(userSegmentsTable).
+		Where(r.activeMembers(preview.Segment.ID)).
+		OrderBy("user_id").
+		Limit(uint64(sampleSize)).
+		ToSql()
+	if err != nil {
+		return membership.DeletePreview{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return membership.DeletePreview{}, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	preview.Sample = make([]int64, 0, sampleSize)
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return membership.DeletePreview{}, fmt.Errorf("couldn't scan user id : %w", err)
+		}
+		preview.Sample = append(preview.Sample, userID)
+	}
+
+	return preview, rows.Err()
+}
+
+// countMembers fills the manual and automatic member counts and the members digest of the preview segment.
+func (r *repo) countMembers(ctx context.Context, q rowQuerier, preview *membership.DeletePreview) error {
+	sql, args, err := r.builder.
+		Select(
+			"COUNT(*) FILTER (WHERE NOT automatic)",
+			"COUNT(*) FILTER (WHERE automatic)",
+			"COALESCE(md5(string_agg(user_id::text, ',' ORDER BY user_id)), '')").
+		From(userSegmentsTable).
+		Where(r.activeMembers(preview.Segment.ID)).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	err = q.QueryRow(ctx, sql, args...).Scan(&preview.Manual, &preview.Automatic, &preview.MembersDigest)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) activeMembers(segmentID int64) sq.Sqlizer {
+	return sq.And{
+		sq.Eq{"segment_id": segmentID},
+		sq.Gt{"expired_at": r.clock.Now()},
+		sq.Eq{"starts_at": nil},
+	}
+}
+
+// ArchiveSegment archives the segment once confirm accepts the preview of its members,
+// the preview is taken with the segment locked so that it can't change before the archive.
+func (r *repo) ArchiveSegment(ctx context.Context, name string, confirm func(membership.DeletePreview) error) error {
 	tx, err := r.client.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("couldn't begin transaction: %w", err)
@@ -92,73 +243,64 @@ func (r *repo) DeleteSegment(ctx context.Context, name string) error {
 		}
 	}()
 
-	segmentID, err := r.getDeleteID(ctx, tx, name)
+	current, err := r.lockSegment(ctx, tx, name)
 	if err != nil {
 		return err
 	}
 
-	users, err := r.getUsersBySegmentId(ctx, tx, segmentID)
-	if err != nil {
+	preview := membership.DeletePreview{Segment: current}
+	if err = r.countMembers(ctx, tx, &preview); err != nil {
 		return err
 	}
-
-	if len(users) > 0 {
-		if err = r.deleteBySegmentID(ctx, tx, segmentID); err != nil {
-			return err
-		}
-
-		if err = r.registerDeleteUsersEvent(ctx, tx, users, name, r.clock.Now()); err != nil {
-			return err
-		}
+	if err = confirm(preview); err != nil {
+		return err
 	}
 
-	if err = r.deleteSegment(ctx, tx, segmentID); err != nil {
+	segmentID := current.ID
+	now := r.clock.Now()
+	if err = r.setArchivedAt(ctx, tx, segmentID, now); err != nil {
 		return err
 	}
 
-	if err = tx.Commit(ctx); err != nil {
-		return fmt.Errorf("couldn't commit transaction: %w", err)
+	err = r.registerSegmentAudit(
+		ctx,
+		tx,
+		segment.SegmentInfo{ID: segmentID, Name: name},
+		audit.Archived,
+		audit.Values{"archivedAt": nil},
+		audit.Values{"archivedAt": now},
+		now,
+	)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func (r *repo) GetUserSegments(ctx context.Context, id int64) ([]membership.MembershipInfo, error) {
-	sql, args, err := r.builder.
-		Select("user_id", "segment_name", "expired_at").
-		From(userSegmentsTable).
-		Join("segments USING (segment_id)").
-		Where(sq.Eq{"user_id": id}).
-		Where(sq.Gt{"expired_at": r.clock.Now()}).
-		ToSql()
-	if err != nil {
-		return nil, fmt.Errorf("couldn't create query : %w", err)
+	if err = r.closeExpiredMembers(ctx, tx, segmentID, name, now); err != nil {
+		return err
 	}
 
-	rows, err := r.client.Query(ctx, sql, args...)
+	users, err := r.getUsersBySegmentId(ctx, tx, segmentID, now)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't run query : %w", err)
+		return err
 	}
-	defer rows.Close()
 
-	memberships := make([]membership.MembershipInfo, 0)
-	for rows.Next() {
-		var m membership.MembershipInfo
-		if err := rows.Scan(
-			&m.UserID,
-			&m.SegmentName,
-			&m.ExpiredAt); err != nil {
-			return nil, fmt.Errorf("couldn't scan membership info : %w", err)
+	if len(users) > 0 {
+		if err = r.registerUsersEvent(ctx, tx, users, name, history.Archived, now); err != nil {
+			return err
 		}
-		memberships = append(memberships, m)
 	}
-	return memberships, nil
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
 }
 
-func (r *repo) CreateUser(ctx context.Context, user user.User, hitPercentage int) (int64, error) {
+func (r *repo) RestoreSegment(ctx context.Context, name string, grace time.Duration) error {
 	tx, err := r.client.Begin(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+		return fmt.Errorf("couldn't begin transaction: %w", err)
 	}
 
 	defer func() {
@@ -170,33 +312,60 @@ func (r *repo) CreateUser(ctx context.Context, user user.User, hitPercentage int
 		}
 	}()
 
-	userID, err := r.createUser(ctx, tx, user)
+	archived, err := r.lockArchived(ctx, tx, name)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	now := r.clock.Now()
+	if archived.ArchivedAt.Before(now.Add(-grace)) {
+		err = segment.ErrGracePeriodExpired
+		return err
+	}
+
+	if err = r.setArchivedAt(ctx, tx, archived.ID, nil); err != nil {
+		return err
 	}
 
-	segments, err := r.hitPercentage(ctx, tx, hitPercentage)
+	err = r.registerSegmentAudit(
+		ctx,
+		tx,
+		archived,
+		audit.Restored,
+		audit.Values{"archivedAt": archived.ArchivedAt},
+		audit.Values{"archivedAt": nil},
+		now,
+	)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if len(segments) > 0 {
-		if err = r.insertDefault(ctx, tx, userID, segments); err != nil {
-			return 0, err
-		}
 
-		if err = r.registerInsertUserEvents(ctx, tx, userID, segments, r.clock.Now()); err != nil {
-			return 0, err
+	// the archived event already closed the memberships that expired in the meantime
+	if err = r.deleteSegmentExpired(ctx, tx, archived.ID, now); err != nil {
+		return err
+	}
+
+	users, err := r.getUsersBySegmentId(ctx, tx, archived.ID, now)
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		if err = r.registerUsersEvent(ctx, tx, users, name, history.Restored, now); err != nil {
+			return err
 		}
 	}
 
 	if err = tx.Commit(ctx); err != nil {
-		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+		return fmt.Errorf("couldn't commit transaction: %w", err)
 	}
 
-	return userID, nil
+	return nil
 }
 
-func (r *repo) DeleteExpired(ctx context.Context) error {
+// PurgeArchived hard-deletes the segments that were archived longer than grace ago
+// together with their memberships.
+func (r *repo) PurgeArchived(ctx context.Context, grace time.Duration) error {
 	tx, err := r.client.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("couldn't begin transaction: %w", err)
@@ -211,17 +380,42 @@ func (r *repo) DeleteExpired(ctx context.Context) error {
 		}
 	}()
 
-	expired, err := r.getExpiredRows(ctx, tx)
+	now := r.clock.Now()
+	segments, err := r.getArchivedBefore(ctx, tx, now.Add(-grace))
 	if err != nil {
 		return err
 	}
 
-	if len(expired) > 0 {
-		if err = r.registerCleanupUserEvents(ctx, tx, expired); err != nil {
+	for i := range segments {
+		var users []int64
+		if users, err = r.getUsersBySegmentId(ctx, tx, segments[i].ID, now); err != nil {
 			return err
 		}
 
-		if err = r.deleteExpired(ctx, tx); err != nil {
+		if len(users) > 0 {
+			if err = r.registerUsersEvent(ctx, tx, users, segments[i].Name, history.Purged, now); err != nil {
+				return err
+			}
+		}
+
+		if err = r.deleteBySegmentID(ctx, tx, segments[i].ID); err != nil {
+			return err
+		}
+
+		if err = r.deleteSegment(ctx, tx, segments[i].ID); err != nil {
+			return err
+		}
+
+		err = r.registerSegmentAudit(
+			ctx,
+			tx,
+			segments[i],
+			audit.Purged,
+			audit.Values{"archivedAt": segments[i].ArchivedAt},
+			nil,
+			now,
+		)
+		if err != nil {
 			return err
 		}
 	}
@@ -233,115 +427,1798 @@ func (r *repo) DeleteExpired(ctx context.Context) error {
 	return nil
 }
 
-func (r *repo) getExpiredRows(ctx context.Context, tx pgx.Tx) ([]membership.MembershipInfo, error) {
-	sql, args, err := r.builder.
-		Select("user_id", "segment_name", "expired_at").
-		From(userSegmentsTable).
-		Join("segments USING (segment_id)").
-		Where(sq.Lt{"expired_at": r.clock.Now()}).
-		ToSql()
+func (r *repo) UpdateSegment(ctx context.Context, name string, update segment.Update) error {
+	tx, err := r.client.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create query : %w", err)
+		return fmt.Errorf("couldn't begin transaction: %w", err)
 	}
 
-	rows, err := tx.Query(ctx, sql, args...)
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	current, err := r.lockSegment(ctx, tx, name)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't run query : %w", err)
+		return err
+	}
+	if update.AutomaticPercentage != nil && current.Rule != "" {
+		err = segment.ErrRuleWithPercentage
+		return err
 	}
-	defer rows.Close()
 
-	memberships := make([]membership.MembershipInfo, 0)
-	for rows.Next() {
-		var m membership.MembershipInfo
-		if err := rows.Scan(
-			&m.UserID,
-			&m.SegmentName,
-			&m.ExpiredAt); err != nil {
-			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+	before, after := audit.Values{}, audit.Values{}
+	if update.HasMetadata() {
+		if current, err = r.getMetadata(ctx, tx, current); err != nil {
+			return err
 		}
-		memberships = append(memberships, m)
+		if err = r.updateMetadata(ctx, tx, current.ID, update); err != nil {
+			return err
+		}
+		metadataChanges(current, update, before, after)
 	}
 
-	return memberships, nil
-}
-
-func (r *repo) deleteExpired(ctx context.Context, tx pgx.Tx) error {
-	sql, args, err := r.builder.
-		Delete(userSegmentsTable).
-		Where(sq.Lt{"expired_at": r.clock.Now()}).
-		ToSql()
-	if err != nil {
-		return fmt.Errorf("couldn't create query : %w", err)
+	if update.AutomaticPercentage != nil {
+		if err = r.updatePercentage(ctx, tx, current.ID, *update.AutomaticPercentage); err != nil {
+			return err
+		}
+		if err = r.reconcileMembers(ctx, tx, current, *update.AutomaticPercentage); err != nil {
+			return err
+		}
+		before["hitPercentage"] = maxPercentage - current.AutomaticPercentage
+		after["hitPercentage"] = maxPercentage - *update.AutomaticPercentage
 	}
 
-	_, err = tx.Exec(ctx, sql, args...)
-	if err != nil {
-		return fmt.Errorf("couldn't run query : %w", err)
+	if err = r.registerSegmentAudit(ctx, tx, current, audit.Updated, before, after, r.clock.Now()); err != nil {
+		return err
 	}
-	return nil
-}
 
-func (r *repo) hitPercentage(ctx context.Context, tx pgx.Tx, percentage int) ([]segment.SegmentInfo, error) {
-	sql, args, err := r.builder.
-		Select(
-			"segment_id",
-			"segment_name").
-		From(segmentTable).
-		Where(sq.Lt{"automatic_percentage": percentage}).
-		ToSql()
-	if err != nil {
-		return nil, fmt.Errorf("couldn't create query : %w", err)
-	}
-	rows, err := tx.Query(ctx, sql, args...)
-	if err != nil {
-		return nil, err
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
 	}
-	defer rows.Close()
 
-	var segmentIDs []segment.SegmentInfo
+	return nil
+}
 
-	for rows.Next() {
-		var s segment.SegmentInfo
-		if err := rows.Scan(&s.ID, &s.Name); err != nil {
-			return nil, fmt.Errorf("couldn't scan id : %w", err)
+// reconcileMembers adds or removes the users whose bucket lies between
+// the current and the new percentage of the segment.
+func (r *repo) reconcileMembers(ctx context.Context, tx pgx.Tx, current segment.SegmentInfo, percentage int) error {
+	var err error
+	switch {
+	case percentage < current.AutomaticPercentage:
+		var added []int64
+		if added, err = r.insertByBucket(ctx, tx, current, percentage, current.AutomaticPercentage); err != nil {
+			return err
+		}
+		if len(added) > 0 {
+			if err = r.registerUsersEvent(ctx, tx, added, current.Name, history.Added, r.clock.Now()); err != nil {
+				return err
+			}
+		}
+	case percentage > current.AutomaticPercentage:
+		var deleted []int64
+		if deleted, err = r.deleteByBucket(ctx, tx, current, current.AutomaticPercentage, percentage); err != nil {
+			return err
+		}
+		if len(deleted) > 0 {
+			if err = r.registerUsersEvent(ctx, tx, deleted, current.Name, history.Deleted, r.clock.Now()); err != nil {
+				return err
+			}
 		}
-		segmentIDs = append(segmentIDs, s)
 	}
 
-	return segmentIDs, nil
+	return nil
 }
 
-func (r *repo) createUser(ctx context.Context, tx pgx.Tx, newUser user.User) (int64, error) {
-	sql, args, err := r.builder.
-		Insert(userTable).
-		Columns(
-			"first_name",
-			"last_name",
-			"email").
-		Values(newUser.FirstName, newUser.LastName, newUser.Email).
-		Suffix("RETURNING user_id").
-		ToSql()
+// SetRamp replaces the ramp schedule of the segment, the steps are due relative to now.
+func (r *repo) SetRamp(ctx context.Context, name string, steps []segment.RampStep) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	current, err := r.lockSegment(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	if current.Rule != "" {
+		err = segment.ErrRuleWithPercentage
+		return err
+	}
+
+	now := r.clock.Now()
+	if err = r.upsertRamp(ctx, tx, current.ID, now); err != nil {
+		return err
+	}
+
+	previous, err := r.deleteRampSteps(ctx, tx, current.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = r.insertRampSteps(ctx, tx, current.ID, steps, now); err != nil {
+		return err
+	}
+
+	next := make([]audit.Values, len(steps))
+	for i := range steps {
+		next[i] = audit.Values{
+			"hitPercentage": maxPercentage - steps[i].AutomaticPercentage,
+			"dueAt":         now.Add(steps[i].After),
+		}
+	}
+
+	err = r.registerSegmentAudit(
+		ctx,
+		tx,
+		current,
+		audit.RampSet,
+		audit.Values{"steps": previous},
+		audit.Values{"steps": next},
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// PauseRamp stops or resumes the ramp of the segment, on resume the pending steps
+// are postponed by the time the ramp spent paused.
+func (r *repo) PauseRamp(ctx context.Context, name string, paused bool) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	current, err := r.lockSegment(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	pausedAt, err := r.lockRamp(ctx, tx, current.ID)
+	if err != nil {
+		return err
+	}
+
+	if (pausedAt != nil) == paused {
+		if err = tx.Commit(ctx); err != nil {
+			return fmt.Errorf("couldn't commit transaction: %w", err)
+		}
+		return nil
+	}
+
+	now := r.clock.Now()
+	operation := audit.RampResumed
+	if paused {
+		operation = audit.RampPaused
+		if err = r.setRampPausedAt(ctx, tx, current.ID, now); err != nil {
+			return err
+		}
+	} else {
+		if err = r.postponeRampSteps(ctx, tx, current.ID, now.Sub(*pausedAt)); err != nil {
+			return err
+		}
+		if err = r.setRampPausedAt(ctx, tx, current.ID, nil); err != nil {
+			return err
+		}
+	}
+
+	err = r.registerSegmentAudit(
+		ctx,
+		tx,
+		current,
+		operation,
+		audit.Values{"paused": !paused},
+		audit.Values{"paused": paused},
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyRampSteps moves the segments of running ramps to the percentage of their due steps
+// and records every applied step in the segment audit. It returns the number of applied steps.
+func (r *repo) ApplyRampSteps(ctx context.Context) (int, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	now := r.clock.Now()
+	steps, err := r.getDueSteps(ctx, tx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for i := range steps {
+		var ok bool
+		if ok, err = r.applyRampStep(ctx, tx, steps[i], now); err != nil {
+			return 0, err
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return applied, nil
+}
+
+// applyRampStep locks the segment before claiming the step, the same order SetRamp and PauseRamp use,
+// the step is skipped when the segment was archived or the ramp was replaced or paused meanwhile.
+// A claimed step of a rule based segment is dropped without touching its members.
+func (r *repo) applyRampStep(ctx context.Context, tx pgx.Tx, step rampStep, now time.Time) (bool, error) {
+	current, err := r.lockSegment(ctx, tx, step.segmentName)
+	if err != nil {
+		if errors.Is(err, segment.ErrSegmentNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	claimed, err := r.claimRampStep(ctx, tx, step, now)
+	if err != nil || !claimed {
+		return false, err
+	}
+	if current.Rule != "" {
+		return false, nil
+	}
+
+	if step.automaticPercentage != current.AutomaticPercentage {
+		if err = r.updatePercentage(ctx, tx, current.ID, step.automaticPercentage); err != nil {
+			return false, err
+		}
+		if err = r.reconcileMembers(ctx, tx, current, step.automaticPercentage); err != nil {
+			return false, err
+		}
+	}
+
+	err = r.registerSegmentAudit(
+		ctx,
+		tx,
+		current,
+		audit.RampStep,
+		audit.Values{"hitPercentage": maxPercentage - current.AutomaticPercentage},
+		audit.Values{"hitPercentage": maxPercentage - step.automaticPercentage},
+		now,
+	)
+	return err == nil, err
+}
+
+func (r *repo) GetUserSegments(ctx context.Context, id int64) ([]membership.MembershipInfo, error) {
+	return r.getMemberships(ctx, sq.Eq{"us.user_id": id})
+}
+
+// GetUsersSegments returns the active segments of all the users with a single query.
+func (r *repo) GetUsersSegments(ctx context.Context, userIDs []int64) ([]membership.MembershipInfo, error) {
+	return r.getMemberships(ctx, sq.Expr("us.user_id = ANY(?)", userIDs))
+}
+
+func (r *repo) getMemberships(ctx context.Context, users sq.Sqlizer) ([]membership.MembershipInfo, error) {
+	sql, args, err := r.builder.
+		Select("us.user_id", "s.segment_name", "COALESCE(sv.variant_name, '')", "us.expired_at").
+		From(userSegmentsTable + " us").
+		Join(segmentTable + " s ON s.segment_id = us.segment_id").
+		LeftJoin(variantTable + " sv ON sv.variant_id = us.variant_id").
+		Where(users).
+		Where(sq.Eq{"s.archived_at": nil}).
+		Where(activeAt("s.", r.clock.Now())).
+		Where(sq.Gt{"us.expired_at": r.clock.Now()}).
+		Where(sq.Eq{"us.starts_at": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	memberships := make([]membership.MembershipInfo, 0)
+	for rows.Next() {
+		var m membership.MembershipInfo
+		if err := rows.Scan(
+			&m.UserID,
+			&m.SegmentName,
+			&m.Variant,
+			&m.ExpiredAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership info : %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, nil
+}
+
+// AssignNewUsers gives the created users the automatic segments they hit and the rule based
+// segments they match, within the transaction that created them.
+func (r *repo) AssignNewUsers(ctx context.Context, tx pgx.Tx, users []user.User, bucketing random.Bucketing) error {
+	percentage, err := r.getPercentageSegments(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	rules, err := r.getRuleSegments(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	assignments := make([]assignment, 0, len(users))
+	for i := range users {
+		segments := hitPercentage(percentage, users[i].ID, bucketing)
+		matched, _ := ruleChanges(rules, users[i].Fields(), newRuleState(segments))
+		if segments = append(segments, matched...); len(segments) > 0 {
+			assignments = append(assignments, assignment{userID: users[i].ID, segments: segments})
+		}
+	}
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	if assignments, err = r.withinCapacity(ctx, tx, assignments); err != nil {
+		return err
+	}
+	if err = r.insertAssignments(ctx, tx, assignments); err != nil {
+		return err
+	}
+	return r.registerAssignmentEvents(ctx, tx, assignments, history.Added, r.clock.Now())
+}
+
+// ReconcileUser brings the rule based segments of the updated user in line with its new fields,
+// within the transaction that updated it, so the user is never matched against stale fields.
+func (r *repo) ReconcileUser(ctx context.Context, tx pgx.Tx, u user.User) error {
+	rules, err := r.getRuleSegments(ctx, tx)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	return r.reconcileUsers(ctx, tx, rules, []user.User{u})
+}
+
+// EraseMemberships removes the memberships of the erased user within the transaction that erases it.
+// Open memberships are closed with deleted events and the whole history of the user is moved
+// to anonymousID, so history aggregates don't change.
+func (r *repo) EraseMemberships(ctx context.Context, tx pgx.Tx, userID int64, anonymousID string) error {
+	open, err := r.getOpenRows(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if len(open) > 0 {
+		if err = r.registerCleanupUserEvents(ctx, tx, open); err != nil {
+			return err
+		}
+	}
+
+	if err = r.deleteUserMemberships(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	return r.anonymizeHistory(ctx, tx, userID, anonymousID)
+}
+
+func (r *repo) DeleteExpired(ctx context.Context) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	expired, err := r.getExpiredRows(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if len(expired) > 0 {
+		if err = r.registerCleanupUserEvents(ctx, tx, expired); err != nil {
+			return err
+		}
+
+		if err = r.deleteExpired(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *repo) getExpiredRows(ctx context.Context, tx pgx.Tx) ([]membership.MembershipInfo, error) {
+	sql, args, err := r.builder.
+		Select("user_id", "segment_name", "expired_at").
+		From(userSegmentsTable).
+		Join("segments USING (segment_id)").
+		Where(sq.Lt{"expired_at": r.clock.Now()}).
+		Where(sq.Eq{"starts_at": nil}).
+		Where(sq.Eq{"archived_at": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	memberships := make([]membership.MembershipInfo, 0)
+	for rows.Next() {
+		var m membership.MembershipInfo
+		if err := rows.Scan(
+			&m.UserID,
+			&m.SegmentName,
+			&m.ExpiredAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+
+	return memberships, nil
+}
+
+func (r *repo) deleteExpired(ctx context.Context, tx pgx.Tx) error {
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Lt{"expired_at": r.clock.Now()}).
+		Where(sq.Eq{"starts_at": nil}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// ActivateScheduled records the memberships whose start has passed as added at their start
+// and makes them regular memberships. Memberships whose layer was taken or whose segment
+// filled up while they were waiting are removed without history, earlier starts win.
+func (r *repo) ActivateScheduled(ctx context.Context) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	started, err := r.getStartedRows(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if len(started) > 0 {
+		var admitted, dropped []activation
+		if admitted, dropped, err = r.admitStarted(ctx, tx, started); err != nil {
+			return err
+		}
+
+		if len(dropped) > 0 {
+			if err = r.deleteStarted(ctx, tx, dropped); err != nil {
+				return err
+			}
+		}
+
+		if len(admitted) > 0 {
+			if err = r.registerActivationEvents(ctx, tx, admitted); err != nil {
+				return err
+			}
+
+			if err = r.clearStarted(ctx, tx, admitted); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *repo) getStartedRows(ctx context.Context, tx pgx.Tx) ([]activation, error) {
+	sql, args, err := r.builder.
+		Select(
+			"us.user_id",
+			"us.segment_id",
+			"s.segment_name",
+			"COALESCE(s.layer, '')",
+			"s.capacity",
+			"us.starts_at").
+		From(userSegmentsTable+" us").
+		Join(segmentTable+" s ON s.segment_id = us.segment_id").
+		Where(sq.LtOrEq{"us.starts_at": r.clock.Now()}).
+		Where(sq.Eq{"s.archived_at": nil}).
+		OrderBy("us.starts_at", "us.user_id", "us.segment_id").
+		Suffix("FOR UPDATE OF us").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	started := make([]activation, 0)
+	for rows.Next() {
+		var a activation
+		if err := rows.Scan(&a.userID, &a.segmentID, &a.segmentName, &a.layer, &a.capacity, &a.startsAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		started = append(started, a)
+	}
+
+	return started, rows.Err()
+}
+
+// admitStarted splits the started memberships into the ones that become regular and the ones
+// that would put the user twice into a layer or exceed the segment capacity.
+func (r *repo) admitStarted(ctx context.Context, tx pgx.Tx, started []activation) ([]activation, []activation, error) {
+	limited := make([]int64, 0)
+	layered := make([]int64, 0)
+	for i := range started {
+		if started[i].capacity != nil {
+			limited = append(limited, started[i].segmentID)
+		}
+		if started[i].layer != "" {
+			layered = append(layered, started[i].userID)
+		}
+	}
+
+	members := make(map[int64]int64)
+	taken := make(map[userLayer]struct{})
+	var err error
+	if len(limited) > 0 {
+		if members, err = r.lockMembers(ctx, tx, limited); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(layered) > 0 {
+		if taken, err = r.getTakenLayers(ctx, tx, layered); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	admitted := make([]activation, 0, len(started))
+	dropped := make([]activation, 0)
+	for _, a := range started {
+		key := userLayer{userID: a.userID, layer: a.layer}
+		if _, ok := taken[key]; ok && a.layer != "" {
+			dropped = append(dropped, a)
+			continue
+		}
+		if a.capacity != nil && members[a.segmentID] >= int64(*a.capacity) {
+			dropped = append(dropped, a)
+			continue
+		}
+		if a.layer != "" {
+			taken[key] = struct{}{}
+		}
+		members[a.segmentID]++
+		admitted = append(admitted, a)
+	}
+
+	return admitted, dropped, nil
+}
+
+// getTakenLayers returns the layers the users already occupy.
+func (r *repo) getTakenLayers(ctx context.Context, tx pgx.Tx, userIDs []int64) (map[userLayer]struct{}, error) {
+	sql, args, err := r.builder.
+		Select("user_id", "layer").
+		From(userSegmentsTable).
+		Where(sq.Expr("user_id = ANY(?)", userIDs)).
+		Where(sq.NotEq{"layer": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	taken := make(map[userLayer]struct{})
+	for rows.Next() {
+		var key userLayer
+		if err := rows.Scan(&key.userID, &key.layer); err != nil {
+			return nil, fmt.Errorf("couldn't scan user layer : %w", err)
+		}
+		taken[key] = struct{}{}
+	}
+
+	return taken, rows.Err()
+}
+
+// clearStarted makes the read memberships regular ones holding the layer of their segment,
+// memberships that started after they were read are left for the next run so that none
+// of them misses its history.
+func (r *repo) clearStarted(ctx context.Context, tx pgx.Tx, started []activation) error {
+	userIDs, segmentIDs := activationPairs(started)
+	sql, args, err := r.builder.
+		Update(userSegmentsTable).
+		Set("starts_at", nil).
+		Set("layer", sq.Expr("(SELECT s.layer FROM segments s WHERE s.segment_id = user_segments.segment_id)")).
+		Where(sq.Expr("(user_id, segment_id) IN (SELECT * FROM unnest(?::BIGINT[], ?::BIGINT[]))", userIDs, segmentIDs)).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) deleteStarted(ctx context.Context, tx pgx.Tx, started []activation) error {
+	userIDs, segmentIDs := activationPairs(started)
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Expr("(user_id, segment_id) IN (SELECT * FROM unnest(?::BIGINT[], ?::BIGINT[]))", userIDs, segmentIDs)).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// RetireEnded removes the memberships of segments whose active window has ended
+// and records the removal of every affected user at the end of the window.
+// Members of archived segments were already closed by the archive and get no event.
+func (r *repo) RetireEnded(ctx context.Context) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	// the same moment selects and deletes the rows, so a segment ending in between is left for the next run
+	now := r.clock.Now()
+	ended, err := r.getEndedRows(ctx, tx, now)
+	if err != nil {
+		return err
+	}
+
+	if len(ended) > 0 {
+		if err = r.registerCleanupUserEvents(ctx, tx, ended); err != nil {
+			return err
+		}
+
+		if err = r.deleteEnded(ctx, tx, now); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *repo) getEndedRows(ctx context.Context, tx pgx.Tx, now time.Time) ([]membership.MembershipInfo, error) {
+	sql, args, err := r.builder.
+		Select("us.user_id", "s.segment_name", "s.active_until").
+		From(userSegmentsTable + " us").
+		Join(segmentTable + " s ON s.segment_id = us.segment_id").
+		Where(sq.LtOrEq{"s.active_until": now}).
+		Where(sq.Eq{"us.starts_at": nil}).
+		Where(sq.Eq{"s.archived_at": nil}).
+		Suffix("FOR UPDATE OF us").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	memberships := make([]membership.MembershipInfo, 0)
+	for rows.Next() {
+		var m membership.MembershipInfo
+		if err := rows.Scan(
+			&m.UserID,
+			&m.SegmentName,
+			&m.ExpiredAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+
+	return memberships, nil
+}
+
+func (r *repo) deleteEnded(ctx context.Context, tx pgx.Tx, now time.Time) error {
+	ended := sq.
+		Select("segment_id").
+		From(segmentTable).
+		Where(sq.LtOrEq{"active_until": now})
+
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Expr("segment_id IN (?)", ended)).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// ReconcileRules brings the members of rule based segments in line with their rules,
+// matching users are added and automatic members that no longer match are removed.
+// Users are reconciled in batches of reconcileBatchSize, each batch in its own transaction.
+func (r *repo) ReconcileRules(ctx context.Context) error {
+	afterID := int64(0)
+	for {
+		lastID, err := r.reconcileRulesBatch(ctx, afterID)
+		if err != nil {
+			return err
+		}
+		if lastID == afterID {
+			return nil
+		}
+		afterID = lastID
+	}
+}
+
+// reconcileRulesBatch reconciles the batch of users following afterID and returns the last of them,
+// afterID is returned when no users are left.
+func (r *repo) reconcileRulesBatch(ctx context.Context, afterID int64) (int64, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	rules, err := r.getRuleSegments(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	lastID := afterID
+	if len(rules) > 0 {
+		var users []user.User
+		users, err = r.getUsers(ctx, tx, afterID, reconcileBatchSize)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(users) > 0 {
+			if err = r.reconcileUsers(ctx, tx, rules, users); err != nil {
+				return 0, err
+			}
+			lastID = users[len(users)-1].ID
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return lastID, nil
+}
+
+// reconcileUsers applies the rule changes of all the users with a fixed number of statements.
+func (r *repo) reconcileUsers(ctx context.Context, tx pgx.Tx, rules []ruleSegment, users []user.User) error {
+	userIDs := make([]int64, len(users))
+	for i := range users {
+		userIDs[i] = users[i].ID
+	}
+	states, err := r.getRuleStates(ctx, tx, rules, userIDs)
+	if err != nil {
+		return err
+	}
+
+	added := make([]assignment, 0)
+	removed := make([]assignment, 0)
+	for i := range users {
+		add, remove := ruleChanges(rules, users[i].Fields(), states[users[i].ID])
+		if len(add) > 0 {
+			added = append(added, assignment{userID: users[i].ID, segments: add})
+		}
+		if len(remove) > 0 {
+			removed = append(removed, assignment{userID: users[i].ID, segments: remove})
+		}
+	}
+
+	if added, err = r.withinCapacity(ctx, tx, added); err != nil {
+		return err
+	}
+	if err = r.insertAssignments(ctx, tx, added); err != nil {
+		return err
+	}
+	if err = r.deleteAssignments(ctx, tx, removed); err != nil {
+		return err
+	}
+
+	now := r.clock.Now()
+	if err = r.registerAssignmentEvents(ctx, tx, added, history.Added, now); err != nil {
+		return err
+	}
+	return r.registerAssignmentEvents(ctx, tx, removed, history.Deleted, now)
+}
+
+func (r *repo) getRuleSegments(ctx context.Context, tx pgx.Tx) ([]ruleSegment, error) {
+	sql, args, err := r.builder.
+		Select(
+			"segment_id",
+			"segment_name",
+			"COALESCE(layer, '')",
+			"rule",
+			"capacity").
+		From(segmentTable).
+		Where(sq.NotEq{"rule": nil}).
+		Where(sq.Eq{"archived_at": nil}).
+		Where(notEnded("", r.clock.Now())).
+		OrderBy("segment_id").
+		Suffix("FOR KEY SHARE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	segments := make([]ruleSegment, 0)
+	for rows.Next() {
+		var s ruleSegment
+		if err := rows.Scan(&s.ID, &s.Name, &s.Layer, &s.Rule, &s.Capacity); err != nil {
+			return nil, fmt.Errorf("couldn't scan rule segment : %w", err)
+		}
+		if s.rule, err = rule.Parse(s.Rule); err != nil {
+			return nil, fmt.Errorf("couldn't parse rule of segment %s : %w", s.Name, err)
+		}
+		segments = append(segments, s)
+	}
+
+	return segments, nil
+}
+
+func (r *repo) getUsers(ctx context.Context, tx pgx.Tx, afterID int64, limit uint64) ([]user.User, error) {
+	sql, args, err := r.builder.
+		Select(
+			"user_id",
+			"first_name",
+			"last_name",
+			"email",
+			"attributes").
+		From(userTable).
+		Where(sq.Gt{"user_id": afterID}).
+		OrderBy("user_id").
+		Limit(limit).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]user.User, 0)
+	for rows.Next() {
+		var u user.User
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Attributes); err != nil {
+			return nil, fmt.Errorf("couldn't scan user : %w", err)
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// getRuleStates loads the active memberships of the users that matter for rule evaluation:
+// the rule segments themselves and everything that occupies the layers of rule segments.
+func (r *repo) getRuleStates(ctx context.Context, tx pgx.Tx, rules []ruleSegment, userIDs []int64) (map[int64]ruleState, error) {
+	ids := make([]int64, 0, len(rules))
+	layers := make([]string, 0, len(rules))
+	for i := range rules {
+		ids = append(ids, rules[i].ID)
+		if rules[i].Layer != "" {
+			layers = append(layers, rules[i].Layer)
+		}
+	}
+
+	sql, args, err := r.builder.
+		Select(
+			"user_id",
+			"segment_id",
+			"COALESCE(layer, '')",
+			"automatic").
+		From(userSegmentsTable).
+		Where(sq.Expr("user_id = ANY(?)", userIDs)).
+		Where(sq.Or{sq.Eq{"segment_id": ids}, sq.Eq{"layer": layers}}).
+		Where(sq.Gt{"expired_at": r.clock.Now()}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[int64]ruleState)
+	for rows.Next() {
+		var userID, segmentID int64
+		var layer string
+		var automatic bool
+		if err := rows.Scan(&userID, &segmentID, &layer, &automatic); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		state, ok := states[userID]
+		if !ok {
+			state = newRuleState(nil)
+			states[userID] = state
+		}
+		state.add(segmentID, layer, automatic)
+	}
+
+	return states, nil
+}
+
+func (r *repo) getPercentageSegments(ctx context.Context, tx pgx.Tx) ([]segment.SegmentInfo, error) {
+	sql, args, err := r.builder.
+		Select(
+			"segment_id",
+			"segment_name",
+			"automatic_percentage",
+			"salt",
+			"COALESCE(layer, '')",
+			"capacity").
+		From(segmentTable).
+		Where(sq.Lt{"automatic_percentage": maxPercentage}).
+		Where(sq.Eq{"archived_at": nil}).
+		Where(notEnded("", r.clock.Now())).
+		OrderBy("segment_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []segment.SegmentInfo
+	for rows.Next() {
+		var s segment.SegmentInfo
+		if err := rows.Scan(&s.ID, &s.Name, &s.AutomaticPercentage, &s.Salt, &s.Layer, &s.Capacity); err != nil {
+			return nil, fmt.Errorf("couldn't scan id : %w", err)
+		}
+		segments = append(segments, s)
+	}
+
+	return segments, nil
+}
+
+// hitPercentage picks the percentage segments the user falls into.
+func hitPercentage(segments []segment.SegmentInfo, userID int64, bucketing random.Bucketing) []segment.SegmentInfo {
+	var hit []segment.SegmentInfo
+	layers := make(map[string]struct{})
+
+	for _, s := range segments {
+		if s.AutomaticPercentage >= bucketing.Bucket(userID, s.Salt) {
+			continue
+		}
+		if s.Layer != "" {
+			// the oldest segment of the layer wins, the rest are skipped to keep the layer exclusive
+			if _, ok := layers[s.Layer]; ok {
+				continue
+			}
+			layers[s.Layer] = struct{}{}
+		}
+		hit = append(hit, s)
+	}
+
+	return hit
+}
+
+// getOpenRows returns the memberships of the user that have no closing history event yet,
+// each with the moment it ends: its expiration, the end of the segment window or now.
+// Memberships of archived segments were already closed by the archived event and
+// scheduled memberships that never started have no history to close.
+func (r *repo) getOpenRows(ctx context.Context, tx pgx.Tx, userID int64) ([]membership.MembershipInfo, error) {
+	sql, args, err := r.builder.
+		Select("us.user_id", "s.segment_name").
+		Column(sq.Expr("LEAST(us.expired_at, COALESCE(s.active_until, us.expired_at), ?::TIMESTAMPTZ)", r.clock.Now())).
+		From(userSegmentsTable + " us").
+		Join(segmentTable + " s ON s.segment_id = us.segment_id").
+		Where(sq.Eq{"us.user_id": userID}).
+		Where(sq.Eq{"s.archived_at": nil}).
+		Where(sq.Eq{"us.starts_at": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	memberships := make([]membership.MembershipInfo, 0)
+	for rows.Next() {
+		var m membership.MembershipInfo
+		if err := rows.Scan(
+			&m.UserID,
+			&m.SegmentName,
+			&m.ExpiredAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+
+	return memberships, nil
+}
+
+func (r *repo) deleteUserMemberships(ctx context.Context, tx pgx.Tx, userID int64) error {
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Eq{"user_id": userID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) anonymizeHistory(ctx context.Context, tx pgx.Tx, userID int64, anonymousID string) error {
+	sql, args, err := r.builder.
+		Update(historyTable).
+		Set("user_id", nil).
+		Set("anonymous_id", anonymousID).
+		Where(sq.Eq{"user_id": userID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) deleteSegment(ctx context.Context, tx pgx.Tx, segmentID int64) error {
+	sql, args, err := r.builder.
+		Delete(segmentTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	rowsAffected := result.RowsAffected()
+	if rowsAffected == 0 {
+		return segment.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+// insertIfExists adds the segments to the user, the segments the user already has are updated
+// according to the policy and returned.
+func (r *repo) insertIfExists(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID int64,
+	addSegments []segment.Segment,
+	policy membership.UpsertPolicy,
+) ([]segment.Segment, error) {
+	if len(addSegments) == 0 {
+		return nil, nil
+	}
+	if err := schedule(addSegments, r.clock.Now()); err != nil {
+		return nil, err
+	}
+	if err := r.fillInsertIDs(ctx, tx, addSegments); err != nil {
+		return nil, err
+	}
+
+	inserted := addSegments
+	var extended []segment.Segment
+	if policy != membership.UpsertNone {
+		now := r.clock.Now()
+		assigned, err := r.lockAssigned(ctx, tx, userID, addSegments, now)
+		if err != nil {
+			return nil, err
+		}
+		pending, err := r.lockPending(ctx, tx, userID, addSegments, now)
+		if err != nil {
+			return nil, err
+		}
+		inserted = make([]segment.Segment, 0, len(addSegments))
+		extended = make([]segment.Segment, 0, len(assigned))
+		rescheduled := make([]segment.Segment, 0, len(pending))
+		for i, s := range addSegments {
+			if _, ok := pending[s.ID]; ok {
+				// a membership that hasn't started has nothing to extend, it takes the new schedule
+				// and an immediate start is left to ActivateScheduled, which records it as added
+				if s.StartsAt.IsZero() {
+					addSegments[i].StartsAt = now
+					s.StartsAt = now
+				}
+				rescheduled = append(rescheduled, s)
+				continue
+			}
+			current, ok := assigned[s.ID]
+			if !ok {
+				inserted = append(inserted, s)
+				continue
+			}
+			s.ExpiredAt = upsertExpiration(policy, current, s, now)
+			extended = append(extended, s)
+		}
+		if err := r.updateExpiration(ctx, tx, userID, extended); err != nil {
+			return nil, err
+		}
+		if err := r.reschedule(ctx, tx, userID, rescheduled); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(inserted) > 0 {
+		if err := r.checkLayers(ctx, tx, userID, inserted); err != nil {
+			return nil, err
+		}
+
+		if err := r.insertWithExpirity(ctx, tx, userID, inserted); err != nil {
+			return nil, err
+		}
+	}
+	return extended, nil
+}
+
+// lockAssigned locks the started memberships of the user in the segments and returns their expirations by segment id.
+func (r *repo) lockAssigned(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID int64,
+	segments []segment.Segment,
+	now time.Time,
+) (map[int64]time.Time, error) {
+	segmentIDs := make([]int64, len(segments))
+	for i := range segments {
+		segmentIDs[i] = segments[i].ID
+	}
+	sql, args, err := r.builder.
+		Select("segment_id", "expired_at").
+		From(userSegmentsTable).
+		Where(sq.Eq{"user_id": userID}).
+		Where(sq.Eq{"segment_id": segmentIDs}).
+		Where(sq.Or{sq.Eq{"starts_at": nil}, sq.LtOrEq{"starts_at": now}}).
+		OrderBy("segment_id").
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	assigned := make(map[int64]time.Time)
+	for rows.Next() {
+		var segmentID int64
+		var expiredAt time.Time
+		if err := rows.Scan(&segmentID, &expiredAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership : %w", err)
+		}
+		assigned[segmentID] = expiredAt
+	}
+
+	return assigned, rows.Err()
+}
+
+// lockPending locks the memberships of the user in the segments that haven't started yet.
+func (r *repo) lockPending(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID int64,
+	segments []segment.Segment,
+	now time.Time,
+) (map[int64]struct{}, error) {
+	segmentIDs := make([]int64, len(segments))
+	for i := range segments {
+		segmentIDs[i] = segments[i].ID
+	}
+	sql, args, err := r.builder.
+		Select("segment_id").
+		From(userSegmentsTable).
+		Where(sq.Eq{"user_id": userID}).
+		Where(sq.Eq{"segment_id": segmentIDs}).
+		Where(sq.Gt{"starts_at": now}).
+		OrderBy("segment_id").
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[int64]struct{})
+	for rows.Next() {
+		var segmentID int64
+		if err := rows.Scan(&segmentID); err != nil {
+			return nil, fmt.Errorf("couldn't scan membership : %w", err)
+		}
+		pending[segmentID] = struct{}{}
+	}
+
+	return pending, rows.Err()
+}
+
+// reschedule moves the start and the expiration of the pending memberships of the user.
+func (r *repo) reschedule(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.Segment) error {
+	for _, s := range segments {
+		expiredAt := s.ExpiredAt
+		if expiredAt.IsZero() {
+			expiredAt = maxFutureTime
+		}
+		sql, args, err := r.builder.
+			Update(userSegmentsTable).
+			Set("starts_at", s.StartsAt).
+			Set("expired_at", expiredAt).
+			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"segment_id": s.ID}).
+			ToSql()
+		if err != nil {
+			return fmt.Errorf("couldn't create query : %w", err)
+		}
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("couldn't run update query : %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *repo) updateExpiration(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.Segment) error {
+	for _, s := range segments {
+		sql, args, err := r.builder.
+			Update(userSegmentsTable).
+			Set("expired_at", s.ExpiredAt).
+			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"segment_id": s.ID}).
+			ToSql()
+		if err != nil {
+			return fmt.Errorf("couldn't create query : %w", err)
+		}
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("couldn't run update query : %w", err)
+		}
+	}
+	return nil
+}
+
+// getPendingNames returns the segments of the user whose scheduled membership hasn't started yet.
+func (r *repo) getPendingNames(ctx context.Context, tx pgx.Tx, userID int64) (map[string]struct{}, error) {
+	sql, args, err := r.builder.
+		Select("s.segment_name").
+		From(userSegmentsTable + " us").
+		Join(segmentTable + " s ON s.segment_id = us.segment_id").
+		Where(sq.Eq{"us.user_id": userID}).
+		Where(sq.NotEq{"us.starts_at": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("couldn't scan segment name : %w", err)
+		}
+		pending[name] = struct{}{}
+	}
+
+	return pending, rows.Err()
+}
+
+func (r *repo) deleteIfExists(ctx context.Context, tx pgx.Tx, userID int64, deleteSegments []string) ([]int64, error) {
+	var deleteIDs []int64
+	var err error
+	if len(deleteSegments) > 0 {
+		if deleteIDs, err = r.getDeleteIDs(ctx, tx, deleteSegments...); err != nil {
+			return nil, err
+		}
+		if err = r.deleteUserSegments(ctx, tx, userID, deleteIDs); err != nil {
+			return nil, err
+		}
+	}
+	return deleteIDs, nil
+}
+
+// checkPrerequisites makes sure that after the update the user has every segment
+// required by the added ones, a scheduled membership doesn't count until it starts.
+func (r *repo) checkPrerequisites(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.Segment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(segments))
+	for i := range segments {
+		ids[i] = segments[i].ID
+	}
+
+	sql, args, err := r.builder.
+		Select("s.segment_name", "p.segment_name").
+		From(prerequisiteTable+" sp").
+		Join(segmentTable+" s ON s.segment_id = sp.segment_id").
+		Join(segmentTable+" p ON p.segment_id = sp.prerequisite_id").
+		Where(sq.Eq{"sp.segment_id": ids}).
+		Where("NOT EXISTS (SELECT 1 FROM user_segments us WHERE us.user_id = ? AND us.segment_id = sp.prerequisite_id "+
+			"AND us.starts_at IS NULL AND us.expired_at > ?)", userID, r.clock.Now()).
+		OrderBy("s.segment_name", "p.segment_name").
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	var missing *membership.MissingPrerequisiteError
+	for rows.Next() {
+		var name, prerequisite string
+		if err := rows.Scan(&name, &prerequisite); err != nil {
+			return fmt.Errorf("couldn't scan prerequisite : %w", err)
+		}
+		if missing == nil {
+			missing = &membership.MissingPrerequisiteError{Segment: name}
+		}
+		if missing.Segment == name {
+			missing.Prerequisites = append(missing.Prerequisites, prerequisite)
+		}
+	}
+	if missing != nil {
+		return fmt.Errorf("insert user: %w", missing)
+	}
+
+	return nil
+}
+
+// deleteDependents follows the removed segments to the user segments that require them.
+// Dependents with the cascade policy are removed as well, recursively, while a single
+// dependent with the refuse policy fails the whole update. Only explicit removals go through
+// here, expiry, archiving, percentage and rule changes and erasure leave the dependents as they are.
+func (r *repo) deleteDependents(ctx context.Context, tx pgx.Tx, userID int64, removed []int64) ([]string, error) {
+	var cascaded []string
+	for len(removed) > 0 {
+		dependents, err := r.getUserDependents(ctx, tx, userID, removed)
+		if err != nil {
+			return nil, err
+		}
+
+		var refused *membership.DependentSegmentError
+		ids := make([]int64, 0, len(dependents))
+		seen := make(map[int64]struct{}, len(dependents))
+		for i := range dependents {
+			if dependents[i].policy == segment.PolicyRefuse {
+				if refused == nil {
+					refused = &membership.DependentSegmentError{Segment: dependents[i].prerequisite}
+				}
+				if refused.Segment == dependents[i].prerequisite {
+					refused.Dependents = append(refused.Dependents, dependents[i].name)
+				}
+				continue
+			}
+			if _, ok := seen[dependents[i].id]; ok {
+				continue
+			}
+			seen[dependents[i].id] = struct{}{}
+			ids = append(ids, dependents[i].id)
+			cascaded = append(cascaded, dependents[i].name)
+		}
+		if refused != nil {
+			return nil, fmt.Errorf("delete user segments: %w", refused)
+		}
+
+		if len(ids) > 0 {
+			if err = r.deleteUserSegments(ctx, tx, userID, ids); err != nil {
+				return nil, err
+			}
+		}
+		removed = ids
+	}
+	return cascaded, nil
+}
+
+type dependent struct {
+	id           int64
+	name         string
+	policy       string
+	prerequisite string
+}
+
+func (r *repo) getUserDependents(ctx context.Context, tx pgx.Tx, userID int64, prerequisites []int64) ([]dependent, error) {
+	sql, args, err := r.builder.
+		Select(
+			"d.segment_id",
+			"d.segment_name",
+			"d.prerequisite_policy",
+			"p.segment_name").
+		From(prerequisiteTable+" sp").
+		Join(segmentTable+" d ON d.segment_id = sp.segment_id").
+		Join(segmentTable+" p ON p.segment_id = sp.prerequisite_id").
+		Join(userSegmentsTable+" us ON us.segment_id = sp.segment_id AND us.user_id = ?", userID).
+		Where(sq.Eq{"sp.prerequisite_id": prerequisites}).
+		OrderBy("d.segment_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	dependents := make([]dependent, 0)
+	for rows.Next() {
+		var d dependent
+		if err := rows.Scan(&d.id, &d.name, &d.policy, &d.prerequisite); err != nil {
+			return nil, fmt.Errorf("couldn't scan dependent segment : %w", err)
+		}
+		dependents = append(dependents, d)
+	}
+
+	return dependents, nil
+}
+
+func (r *repo) getUsersBySegmentId(ctx context.Context, tx pgx.Tx, segmentID int64, now time.Time) ([]int64, error) {
+	sql, args, err := r.builder.
+		Select("user_id").
+		From(userSegmentsTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		Where(sq.Eq{"starts_at": nil}).
+		Where(sq.Gt{"expired_at": now}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("couldn't scan user id : %w", err)
+		}
+		ids = append(ids, userID)
+	}
+	return ids, nil
+}
+
+// closeExpiredMembers records the expired but not yet cleaned up memberships of the segment
+// as deleted and removes them, so that archiving closes only the memberships that are still open.
+func (r *repo) closeExpiredMembers(ctx context.Context, tx pgx.Tx, segmentID int64, name string, now time.Time) error {
+	sql, args, err := r.builder.
+		Select("user_id", "expired_at").
+		From(userSegmentsTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		Where(sq.Eq{"starts_at": nil}).
+		Where(sq.LtOrEq{"expired_at": now}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	expired := make([]membership.MembershipInfo, 0)
+	for rows.Next() {
+		m := membership.MembershipInfo{SegmentName: name}
+		if err := rows.Scan(&m.UserID, &m.ExpiredAt); err != nil {
+			return fmt.Errorf("couldn't scan membership data : %w", err)
+		}
+		expired = append(expired, m)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("couldn't read expired memberships : %w", err)
+	}
+	rows.Close()
+
+	if len(expired) == 0 {
+		return nil
+	}
+	if err = r.registerCleanupUserEvents(ctx, tx, expired); err != nil {
+		return err
+	}
+
+	return r.deleteSegmentExpired(ctx, tx, segmentID, now)
+}
+
+func (r *repo) deleteSegmentExpired(ctx context.Context, tx pgx.Tx, segmentID int64, now time.Time) error {
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		Where(sq.Eq{"starts_at": nil}).
+		Where(sq.LtOrEq{"expired_at": now}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) getDeleteIDs(ctx context.Context, tx pgx.Tx, names ...string) ([]int64, error) {
+	sql, args, err := r.builder.
+		Select("segment_id").
+		From(segmentTable).
+		Where(sq.Eq{"segment_name": names, "archived_at": nil}).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run select segment id query : %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, len(names))
+	for rows.Next() {
+		var segmentID int64
+		if err := rows.Scan(&segmentID); err != nil {
+			return nil, fmt.Errorf("couldn't scan segment id : %w", err)
+		}
+		ids = append(ids, segmentID)
+	}
+
+	if len(ids) != len(names) {
+		return nil, segment.ErrSegmentNotFound
+	}
+
+	return ids, nil
+}
+
+func (r *repo) lockSegment(ctx context.Context, tx pgx.Tx, name string) (segment.SegmentInfo, error) {
+	sql, args, err := r.builder.
+		Select(
+			"segment_id",
+			"segment_name",
+			fmt.Sprintf("COALESCE(automatic_percentage, %d)", maxPercentage),
+			"salt",
+			"COALESCE(layer, '')",
+			"capacity",
+			"COALESCE(rule, '')").
+		From(segmentTable).
+		Where(sq.Eq{"segment_name": name, "archived_at": nil}).
+		Suffix("FOR UPDATE").
+		ToSql()
 	if err != nil {
-		return 0, fmt.Errorf("couldn't create query : %w", err)
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't create query : %w", err)
 	}
-	var id int64
-	err = tx.QueryRow(ctx, sql, args...).Scan(&id)
+	var s segment.SegmentInfo
+	err = tx.QueryRow(ctx, sql, args...).Scan(&s.ID, &s.Name, &s.AutomaticPercentage, &s.Salt, &s.Layer, &s.Capacity, &s.Rule)
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == pgerrcode.UniqueViolation {
-				return 0, fmt.Errorf("couldn't create an account: %w", user.ErrUserAlreadyExist)
-			}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return segment.SegmentInfo{}, segment.ErrSegmentNotFound
+		}
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't lock segment : %w", err)
+	}
+
+	return s, nil
+}
+
+func (r *repo) lockArchived(ctx context.Context, tx pgx.Tx, name string) (segment.SegmentInfo, error) {
+	sql, args, err := r.builder.
+		Select("segment_id", "segment_name", "archived_at").
+		From(segmentTable).
+		Where(sq.Eq{"segment_name": name}).
+		Where(sq.NotEq{"archived_at": nil}).
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+	var s segment.SegmentInfo
+	err = tx.QueryRow(ctx, sql, args...).Scan(&s.ID, &s.Name, &s.ArchivedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return segment.SegmentInfo{}, segment.ErrSegmentNotFound
 		}
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't lock segment : %w", err)
+	}
+
+	return s, nil
+}
+
+func (r *repo) getArchivedBefore(ctx context.Context, tx pgx.Tx, before time.Time) ([]segment.SegmentInfo, error) {
+	sql, args, err := r.builder.
+		Select("segment_id", "segment_name", "archived_at").
+		From(segmentTable).
+		Where(sq.Lt{"archived_at": before}).
+		OrderBy("segment_id").
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
 
-		return 0, fmt.Errorf("couldn't create an account: %w", err)
+	segments := make([]segment.SegmentInfo, 0)
+	for rows.Next() {
+		var s segment.SegmentInfo
+		if err := rows.Scan(&s.ID, &s.Name, &s.ArchivedAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan segment : %w", err)
+		}
+		segments = append(segments, s)
 	}
-	return id, nil
+
+	return segments, rows.Err()
 }
 
-func (r *repo) deleteSegment(ctx context.Context, tx pgx.Tx, segmentID int64) error {
+// setArchivedAt archives the segment with the given timestamp, nil restores it.
+func (r *repo) setArchivedAt(ctx context.Context, tx pgx.Tx, segmentID int64, archivedAt interface{}) error {
 	sql, args, err := r.builder.
-		Delete(segmentTable).
+		Update(segmentTable).
+		Set("archived_at", archivedAt).
 		Where(sq.Eq{"segment_id": segmentID}).
 		ToSql()
 	if err != nil {
@@ -352,51 +2229,353 @@ func (r *repo) deleteSegment(ctx context.Context, tx pgx.Tx, segmentID int64) er
 	if err != nil {
 		return fmt.Errorf("couldn't run query : %w", err)
 	}
-	rowsAffected := result.RowsAffected()
-	if rowsAffected == 0 {
+	if result.RowsAffected() == 0 {
 		return segment.ErrSegmentNotFound
 	}
 
 	return nil
 }
 
-func (r *repo) insertIfExists(ctx context.Context, tx pgx.Tx, userID int64, addSegments []segment.Segment) error {
-	if len(addSegments) > 0 {
-		if err := r.fillInsertIDs(ctx, tx, addSegments); err != nil {
-			return err
-		}
+func (r *repo) updatePercentage(ctx context.Context, tx pgx.Tx, segmentID int64, percentage int) error {
+	sql, args, err := r.builder.
+		Update(segmentTable).
+		Set("automatic_percentage", percentage).
+		Where(sq.Eq{"segment_id": segmentID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
 
-		if err := r.insertWithExpirity(ctx, tx, userID, addSegments); err != nil {
-			return err
-		}
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return segment.ErrSegmentNotFound
 	}
+
 	return nil
 }
 
-func (r *repo) deleteIfExists(ctx context.Context, tx pgx.Tx, userID int64, deleteSegments []string) error {
-	var deleteIDs []int64
-	var err error
-	if len(deleteSegments) > 0 {
-		if deleteIDs, err = r.getDeleteIDs(ctx, tx, deleteSegments...); err != nil {
-			return err
+// getMetadata fills the metadata of the locked segment, the audit records it as the state before the update.
+func (r *repo) getMetadata(ctx context.Context, tx pgx.Tx, s segment.SegmentInfo) (segment.SegmentInfo, error) {
+	sql, args, err := r.builder.
+		Select("description", "owner", "tags", "attributes").
+		From(segmentTable).
+		Where(sq.Eq{"segment_id": s.ID}).
+		ToSql()
+	if err != nil {
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	err = tx.QueryRow(ctx, sql, args...).Scan(&s.Description, &s.Owner, &s.Tags, &s.Attributes)
+	if err != nil {
+		return segment.SegmentInfo{}, fmt.Errorf("couldn't get segment metadata : %w", err)
+	}
+
+	return s, nil
+}
+
+func (r *repo) updateMetadata(ctx context.Context, tx pgx.Tx, segmentID int64, update segment.Update) error {
+	query := r.builder.
+		Update(segmentTable).
+		Where(sq.Eq{"segment_id": segmentID})
+
+	if update.Description != nil {
+		query = query.Set("description", *update.Description)
+	}
+	if update.Owner != nil {
+		query = query.Set("owner", *update.Owner)
+	}
+	if update.Tags != nil {
+		query = query.Set("tags", update.Tags)
+	}
+	if update.Attributes != nil {
+		query = query.Set("attributes", update.Attributes)
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return segment.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+func (r *repo) upsertRamp(ctx context.Context, tx pgx.Tx, segmentID int64, startedAt time.Time) error {
+	sql, args, err := r.builder.
+		Insert(rampTable).
+		Columns("segment_id", "started_at", "paused_at").
+		Values(segmentID, startedAt, nil).
+		Suffix("ON CONFLICT (segment_id) DO UPDATE SET started_at = EXCLUDED.started_at, paused_at = NULL").
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// deleteRampSteps removes the steps of the replaced ramp and returns them for the audit.
+func (r *repo) deleteRampSteps(ctx context.Context, tx pgx.Tx, segmentID int64) ([]audit.Values, error) {
+	sql, args, err := r.builder.
+		Delete(rampStepTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		Suffix("RETURNING automatic_percentage, due_at").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	steps := make([]audit.Values, 0)
+	for rows.Next() {
+		var percentage int
+		var dueAt time.Time
+		if err := rows.Scan(&percentage, &dueAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan ramp step : %w", err)
 		}
-		if err = r.deleteUserSegments(ctx, tx, userID, deleteIDs); err != nil {
-			return err
+		steps = append(steps, audit.Values{"hitPercentage": maxPercentage - percentage, "dueAt": dueAt})
+	}
+
+	return steps, rows.Err()
+}
+
+func (r *repo) insertRampSteps(ctx context.Context, tx pgx.Tx, segmentID int64, steps []segment.RampStep, startedAt time.Time) error {
+	insertState := r.builder.Insert(rampStepTable).Columns("segment_id", "automatic_percentage", "due_at")
+	for i := range steps {
+		insertState = insertState.Values(segmentID, steps[i].AutomaticPercentage, startedAt.Add(steps[i].After))
+	}
+
+	sql, args, err := insertState.ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// lockRamp returns the moment the ramp of the segment was paused, nil for a running ramp.
+func (r *repo) lockRamp(ctx context.Context, tx pgx.Tx, segmentID int64) (*time.Time, error) {
+	sql, args, err := r.builder.
+		Select("paused_at").
+		From(rampTable).
+		Where(sq.Eq{"segment_id": segmentID}).
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	var pausedAt *time.Time
+	err = tx.QueryRow(ctx, sql, args...).Scan(&pausedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, segment.ErrRampNotFound
 		}
+		return nil, fmt.Errorf("couldn't lock ramp : %w", err)
+	}
+
+	return pausedAt, nil
+}
+
+// setRampPausedAt pauses the ramp with the given timestamp, nil resumes it.
+func (r *repo) setRampPausedAt(ctx context.Context, tx pgx.Tx, segmentID int64, pausedAt interface{}) error {
+	sql, args, err := r.builder.
+		Update(rampTable).
+		Set("paused_at", pausedAt).
+		Where(sq.Eq{"segment_id": segmentID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return segment.ErrRampNotFound
+	}
+
+	return nil
+}
+
+func (r *repo) postponeRampSteps(ctx context.Context, tx pgx.Tx, segmentID int64, delay time.Duration) error {
+	sql, args, err := r.builder.
+		Update(rampStepTable).
+		Set("due_at", sq.Expr("due_at + ? * INTERVAL '1 microsecond'", delay.Microseconds())).
+		Where(sq.Eq{"segment_id": segmentID, "applied_at": nil}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
 	}
 	return nil
 }
 
-func (r *repo) getUsersBySegmentId(ctx context.Context, tx pgx.Tx, segmentID int64) ([]int64, error) {
+// getDueSteps reads the pending steps of running ramps without locking,
+// every step is claimed again under the segment lock before it is applied.
+func (r *repo) getDueSteps(ctx context.Context, tx pgx.Tx, now time.Time) ([]rampStep, error) {
+	sql, args, err := r.builder.
+		Select("st.segment_id", "s.segment_name", "st.automatic_percentage", "st.due_at").
+		From(rampStepTable+" st").
+		Join(rampTable+" r ON r.segment_id = st.segment_id").
+		Join(segmentTable+" s ON s.segment_id = st.segment_id").
+		Where(sq.Eq{"st.applied_at": nil, "r.paused_at": nil, "s.archived_at": nil}).
+		Where(sq.LtOrEq{"st.due_at": now}).
+		OrderBy("st.segment_id", "st.due_at").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	steps := make([]rampStep, 0)
+	for rows.Next() {
+		var step rampStep
+		if err := rows.Scan(&step.segmentID, &step.segmentName, &step.automaticPercentage, &step.dueAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan ramp step : %w", err)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, rows.Err()
+}
+
+// claimRampStep marks the step as applied, it reports false when the step is no longer pending
+// or its ramp is paused.
+func (r *repo) claimRampStep(ctx context.Context, tx pgx.Tx, step rampStep, now time.Time) (bool, error) {
+	running := sq.
+		Select("1").
+		From(rampTable + " r").
+		Where("r.segment_id = " + rampStepTable + ".segment_id").
+		Where(sq.Eq{"r.paused_at": nil})
+
 	sql, args, err := r.builder.
+		Update(rampStepTable).
+		Set("applied_at", now).
+		Where(sq.Eq{"segment_id": step.segmentID, "due_at": step.dueAt, "applied_at": nil}).
+		Where(sq.Expr("EXISTS (?)", running)).
+		ToSql()
+	if err != nil {
+		return false, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("couldn't run query : %w", err)
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// insertByBucket assigns users whose bucket falls into (from, to],
+// i.e. the users that hit the segment only after its percentage was raised.
+func (r *repo) insertByBucket(ctx context.Context, tx pgx.Tx, s segment.SegmentInfo, from int, to int) ([]int64, error) {
+	assigned := sq.
+		Select("1").
+		From(userSegmentsTable + " us").
+		Where("us.user_id = users.user_id").
+		Where(sq.Eq{"us.segment_id": s.ID})
+
+	candidates := sq.
 		Select("user_id").
-		From(userSegmentsTable).
-		Where(sq.Eq{"segment_id": segmentID}).
+		Column("?::BIGINT", s.ID).
+		Column("?::TIMESTAMPTZ", maxFutureTime).
+		Column("segment_variant(?::BIGINT, user_id)", s.ID).
+		Column("?::VARCHAR", nullable(s.Layer)).
+		Column("TRUE").
+		From(userTable).
+		Where(sq.Expr("segment_bucket(?, user_id) > ?", s.Salt, from)).
+		Where(sq.Expr("segment_bucket(?, user_id) <= ?", s.Salt, to)).
+		Where(sq.Expr("NOT EXISTS (?)", assigned))
+
+	if s.Layer != "" {
+		sameLayer := sq.
+			Select("1").
+			From(userSegmentsTable + " ul").
+			Where("ul.user_id = users.user_id").
+			Where(sq.Eq{"ul.layer": s.Layer})
+		candidates = candidates.Where(sq.Expr("NOT EXISTS (?)", sameLayer))
+	}
+
+	if s.Capacity != nil {
+		// the segment row is already locked by UpdateSegment, the count can't change under us
+		members, err := r.lockMembers(ctx, tx, []int64{s.ID})
+		if err != nil {
+			return nil, err
+		}
+		free := int64(*s.Capacity) - members[s.ID]
+		if free <= 0 {
+			return []int64{}, nil
+		}
+		candidates = candidates.OrderBy("user_id").Limit(uint64(free))
+	}
+
+	sql, args, err := r.builder.
+		Insert(userSegmentsTable).
+		Columns("user_id", "segment_id", "expired_at", "variant_id", "layer", "automatic").
+		Select(candidates).
+		Suffix("RETURNING user_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	return r.queryUserIDs(ctx, tx, sql, args...)
+}
+
+// deleteByBucket removes automatic members whose bucket falls into (from, to],
+// i.e. the users that no longer hit the segment after its percentage was lowered.
+// Members added by hand stay in the segment.
+func (r *repo) deleteByBucket(ctx context.Context, tx pgx.Tx, s segment.SegmentInfo, from int, to int) ([]int64, error) {
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Eq{"segment_id": s.ID}).
+		Where(sq.Eq{"automatic": true}).
+		Where(sq.Expr("segment_bucket(?, user_id) > ?", s.Salt, from)).
+		Where(sq.Expr("segment_bucket(?, user_id) <= ?", s.Salt, to)).
+		Suffix("RETURNING user_id").
 		ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create query : %w", err)
 	}
 
+	return r.queryUserIDs(ctx, tx, sql, args...)
+}
+
+func (r *repo) queryUserIDs(ctx context.Context, tx pgx.Tx, sql string, args ...interface{}) ([]int64, error) {
 	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't run query : %w", err)
@@ -411,71 +2590,80 @@ func (r *repo) getUsersBySegmentId(ctx context.Context, tx pgx.Tx, segmentID int
 		}
 		ids = append(ids, userID)
 	}
-	return ids, nil
+	return ids, rows.Err()
 }
 
-func (r *repo) getDeleteIDs(ctx context.Context, tx pgx.Tx, names ...string) ([]int64, error) {
+func (r *repo) fillInsertIDs(ctx context.Context, tx pgx.Tx, segments []segment.Segment) error {
+	names := make([]string, len(segments))
+	for i := range segments {
+		names[i] = segments[i].Name
+	}
 	sql, args, err := r.builder.
-		Select("segment_id").
+		Select("segment_id", "segment_name", "COALESCE(layer, '')", "capacity").
 		From(segmentTable).
-		Where(sq.Eq{"segment_name": names}).
+		Where(sq.Eq{"segment_name": names, "archived_at": nil}).
 		ToSql()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create query : %w", err)
+		return fmt.Errorf("couldn't create query : %w", err)
 	}
 
 	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't run select segment id query : %w", err)
+		return fmt.Errorf("couldn't run fill insert id query: %w", err)
 	}
 	defer rows.Close()
 
-	ids := make([]int64, 0, len(names))
+	found := make(map[string]segment.Segment)
 	for rows.Next() {
-		var segmentID int64
-		if err := rows.Scan(&segmentID); err != nil {
-			return nil, fmt.Errorf("couldn't scan segment id : %w", err)
+		var s segment.Segment
+		if err := rows.Scan(&s.ID, &s.Name, &s.Layer, &s.Capacity); err != nil {
+			return fmt.Errorf("scan segment id,name: %w", err)
 		}
-		ids = append(ids, segmentID)
+		found[s.Name] = s
 	}
 
-	if len(ids) != len(names) {
-		return nil, segment.ErrSegmentNotFound
+	if len(found) != len(names) {
+		return segment.ErrSegmentNotFound
 	}
 
-	return ids, nil
-}
-
-func (r *repo) getDeleteID(ctx context.Context, tx pgx.Tx, name string) (int64, error) {
-	sql, args, err := r.builder.
-		Select("segment_id").
-		From(segmentTable).
-		Where(sq.Eq{"segment_name": name}).
-		ToSql()
-	if err != nil {
-		return 0, fmt.Errorf("couldn't create query : %w", err)
-	}
-	var segmentID int64
-	err = tx.QueryRow(ctx, sql, args...).Scan(&segmentID)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return 0, segment.ErrSegmentNotFound
-		}
-		return 0, fmt.Errorf("couldn't find segment id : %w", err)
+	for i := range segments {
+		segments[i].ID = found[segments[i].Name].ID
+		segments[i].Layer = found[segments[i].Name].Layer
+		segments[i].Capacity = found[segments[i].Name].Capacity
 	}
 
-	return segmentID, nil
+	return nil
 }
 
-func (r *repo) fillInsertIDs(ctx context.Context, tx pgx.Tx, segments []segment.Segment) error {
-	names := make([]string, len(segments))
+// checkLayers makes sure the user doesn't end up in two segments of the same layer,
+// neither inside one request nor together with the segments already assigned.
+// Expired memberships that the cleaner hasn't removed yet don't hold their layer,
+// they are removed here with their deleted event.
+func (r *repo) checkLayers(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.Segment) error {
+	layers := make([]string, 0, len(segments))
+	seen := make(map[string]struct{})
 	for i := range segments {
-		names[i] = segments[i].Name
+		if segments[i].Layer == "" {
+			continue
+		}
+		if _, ok := seen[segments[i].Layer]; ok {
+			return &membership.LayerConflictError{Layer: segments[i].Layer}
+		}
+		seen[segments[i].Layer] = struct{}{}
+		layers = append(layers, segments[i].Layer)
+	}
+
+	if len(layers) == 0 {
+		return nil
 	}
+
 	sql, args, err := r.builder.
-		Select("segment_id", "segment_name").
-		From(segmentTable).
-		Where(sq.Eq{"segment_name": names}).
+		Select("us.segment_id", "s.segment_name", "us.layer", "us.expired_at").
+		From(userSegmentsTable + " us").
+		Join(segmentTable + " s ON s.segment_id = us.segment_id").
+		Where(sq.Eq{"us.user_id": userID}).
+		Where(sq.Eq{"us.layer": layers}).
+		Suffix("FOR UPDATE OF us").
 		ToSql()
 	if err != nil {
 		return fmt.Errorf("couldn't create query : %w", err)
@@ -483,26 +2671,43 @@ func (r *repo) fillInsertIDs(ctx context.Context, tx pgx.Tx, segments []segment.
 
 	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("couldn't run fill insert id query: %w", err)
+		return fmt.Errorf("couldn't run query : %w", err)
 	}
 	defer rows.Close()
 
-	ids := make(map[string]int64)
+	now := r.clock.Now()
+	var conflict string
+	expiredIDs := make([]int64, 0)
+	expired := make([]membership.MembershipInfo, 0)
 	for rows.Next() {
-		var id int64
-		var s string
-		if err := rows.Scan(&id, &s); err != nil {
-			return fmt.Errorf("scan segment id,name: %w", err)
+		var segmentID int64
+		var layer string
+		m := membership.MembershipInfo{UserID: userID}
+		if err := rows.Scan(&segmentID, &m.SegmentName, &layer, &m.ExpiredAt); err != nil {
+			return fmt.Errorf("couldn't scan user layer : %w", err)
+		}
+		if m.ExpiredAt.After(now) {
+			conflict = layer
+			continue
 		}
-		ids[s] = id
+		expiredIDs = append(expiredIDs, segmentID)
+		expired = append(expired, m)
 	}
-
-	if len(ids) != len(names) {
-		return segment.ErrSegmentNotFound
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("couldn't read user layers : %w", err)
 	}
+	rows.Close()
 
-	for i := range segments {
-		segments[i].ID = ids[segments[i].Name]
+	if conflict != "" {
+		return &membership.LayerConflictError{Layer: conflict}
+	}
+	if len(expired) > 0 {
+		if err = r.registerCleanupUserEvents(ctx, tx, expired); err != nil {
+			return err
+		}
+		if err = r.deleteUserSegments(ctx, tx, userID, expiredIDs); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -538,26 +2743,54 @@ func (r *repo) deleteBySegmentID(ctx context.Context, tx pgx.Tx, segmentID int64
 	if err != nil {
 		return fmt.Errorf("couldn't create query : %w", err)
 	}
-	rows, err := tx.Exec(ctx, sql, args...)
+	_, err = tx.Exec(ctx, sql, args...)
 	if err != nil {
 		return fmt.Errorf("couldn't run query : %w", err)
 	}
-	if rows.RowsAffected() == int64(0) {
-		return fmt.Errorf(
-			"couldn't delete rows, rows affected %d", rows.RowsAffected(),
-		)
-	}
 	return nil
 }
 
 func (r *repo) insertWithExpirity(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.Segment) error {
-	insertState := r.builder.Insert(userSegmentsTable).Columns("user_id", "segment_id", "expired_at")
+	limited := make([]int64, 0, len(segments))
+	for i := range segments {
+		if segments[i].Capacity != nil {
+			limited = append(limited, segments[i].ID)
+		}
+	}
+	if len(limited) > 0 {
+		members, err := r.lockMembers(ctx, tx, limited)
+		if err != nil {
+			return err
+		}
+		for i := range segments {
+			if segments[i].Capacity != nil && members[segments[i].ID] >= int64(*segments[i].Capacity) {
+				return fmt.Errorf("insert user: %w", &membership.SegmentFullError{
+					Segment:  segments[i].Name,
+					Capacity: *segments[i].Capacity,
+				})
+			}
+		}
+	}
+
+	insertState := r.builder.Insert(userSegmentsTable).Columns("user_id", "segment_id", "expired_at", "variant_id", "layer", "starts_at")
 	for i := range segments {
-		if segments[i].ExpiredAt.IsZero() {
-			insertState = insertState.Values(userID, segments[i].ID, maxFutureTime)
-		} else {
-			insertState = insertState.Values(userID, segments[i].ID, segments[i].ExpiredAt)
+		expiredAt := segments[i].ExpiredAt
+		if expiredAt.IsZero() {
+			expiredAt = maxFutureTime
 		}
+		// a scheduled membership takes its layer when ActivateScheduled admits it
+		layer := segments[i].Layer
+		if !segments[i].StartsAt.IsZero() {
+			layer = ""
+		}
+		insertState = insertState.Values(
+			userID,
+			segments[i].ID,
+			expiredAt,
+			variantID(segments[i].ID, userID),
+			nullable(layer),
+			nullableTime(segments[i].StartsAt),
+		)
 	}
 
 	sql, args, err := insertState.ToSql()
@@ -568,6 +2801,9 @@ func (r *repo) insertWithExpirity(ctx context.Context, tx pgx.Tx, userID int64,
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == layerIndex {
+				return fmt.Errorf("insert user: %w", &membership.LayerConflictError{Layer: conflictingLayer(segments, pgErr.Detail)})
+			}
 			if pgErr.Code == pgerrcode.UniqueViolation {
 				return fmt.Errorf("insert user: %w", membership.ErrSegmentAlreadyAssigned)
 			}
@@ -589,25 +2825,92 @@ func (r *repo) insertWithExpirity(ctx context.Context, tx pgx.Tx, userID int64,
 	return nil
 }
 
-func (r *repo) insertDefault(ctx context.Context, tx pgx.Tx, userID int64, segments []segment.SegmentInfo) error {
-	insertState := r.builder.Insert(userSegmentsTable).Columns("user_id", "segment_id", "expired_at")
-	for i := range segments {
-		insertState = insertState.Values(userID, segments[i].ID, maxFutureTime)
+func (r *repo) insertAssignments(ctx context.Context, tx pgx.Tx, assignments []assignment) error {
+	values := make([][]interface{}, 0, len(assignments))
+	for _, a := range assignments {
+		for i := range a.segments {
+			values = append(values, []interface{}{
+				a.userID,
+				a.segments[i].ID,
+				maxFutureTime,
+				variantID(a.segments[i].ID, a.userID),
+				nullable(a.segments[i].Layer),
+				sq.Expr("TRUE"),
+			})
+		}
 	}
 
-	sql, args, err := insertState.ToSql()
+	columns := []string{"user_id", "segment_id", "expired_at", "variant_id", "layer", "automatic"}
+	return r.insertChunks(ctx, tx, userSegmentsTable, columns, values)
+}
+
+// insertChunks inserts the rows with as few statements as the insertChunkSize allows.
+func (r *repo) insertChunks(ctx context.Context, tx pgx.Tx, table string, columns []string, values [][]interface{}) error {
+	for len(values) > 0 {
+		chunk := values
+		if len(chunk) > insertChunkSize {
+			chunk = chunk[:insertChunkSize]
+		}
+		values = values[len(chunk):]
+
+		insertState := r.builder.Insert(table).Columns(columns...)
+		for i := range chunk {
+			insertState = insertState.Values(chunk[i]...)
+		}
+
+		sql, args, err := insertState.ToSql()
+		if err != nil {
+			return fmt.Errorf("couldn't create query : %w", err)
+		}
+		rows, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return fmt.Errorf("couldn't run insert query : %w", err)
+		}
+
+		if rows.RowsAffected() != int64(len(chunk)) {
+			return fmt.Errorf(
+				"couldn't insert all the necessary rows, want %d , got %d",
+				len(chunk),
+				rows.RowsAffected(),
+			)
+		}
+	}
+
+	return nil
+}
+
+// deleteAssignments removes the automatic memberships of the assignments,
+// memberships added by hand are left in place.
+func (r *repo) deleteAssignments(ctx context.Context, tx pgx.Tx, assignments []assignment) error {
+	userIDs := make([]int64, 0, len(assignments))
+	segmentIDs := make([]int64, 0, len(assignments))
+	for _, a := range assignments {
+		for i := range a.segments {
+			userIDs = append(userIDs, a.userID)
+			segmentIDs = append(segmentIDs, a.segments[i].ID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	sql, args, err := r.builder.
+		Delete(userSegmentsTable).
+		Where(sq.Eq{"automatic": true}).
+		Where(sq.Expr("(user_id, segment_id) IN (SELECT * FROM unnest(?::BIGINT[], ?::BIGINT[]))", userIDs, segmentIDs)).
+		ToSql()
 	if err != nil {
 		return fmt.Errorf("couldn't create query : %w", err)
 	}
+
 	rows, err := tx.Exec(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("couldn't run insert query : %w", err)
+		return fmt.Errorf("couldn't run query : %w", err)
 	}
-
-	if rows.RowsAffected() != int64(len(segments)) {
+	if rows.RowsAffected() != int64(len(userIDs)) {
 		return fmt.Errorf(
-			"couldn't insert all the necessary rows, want %d , got %d",
-			len(segments),
+			"couldn't delete all the necessary rows, want %d , got %d",
+			len(userIDs),
 			rows.RowsAffected(),
 		)
 	}
@@ -615,23 +2918,119 @@ func (r *repo) insertDefault(ctx context.Context, tx pgx.Tx, userID int64, segme
 	return nil
 }
 
+// withinCapacity drops the segments that have no free places left,
+// the assignments take the free places in their order.
+func (r *repo) withinCapacity(ctx context.Context, tx pgx.Tx, assignments []assignment) ([]assignment, error) {
+	limited := make([]int64, 0)
+	seen := make(map[int64]struct{})
+	for _, a := range assignments {
+		for i := range a.segments {
+			if _, ok := seen[a.segments[i].ID]; a.segments[i].Capacity != nil && !ok {
+				seen[a.segments[i].ID] = struct{}{}
+				limited = append(limited, a.segments[i].ID)
+			}
+		}
+	}
+	if len(limited) == 0 {
+		return assignments, nil
+	}
+
+	members, err := r.lockMembers(ctx, tx, limited)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make([]assignment, 0, len(assignments))
+	for _, a := range assignments {
+		segments := make([]segment.SegmentInfo, 0, len(a.segments))
+		for i := range a.segments {
+			if a.segments[i].Capacity != nil {
+				if members[a.segments[i].ID] >= int64(*a.segments[i].Capacity) {
+					continue
+				}
+				members[a.segments[i].ID]++
+			}
+			segments = append(segments, a.segments[i])
+		}
+		available = append(available, assignment{userID: a.userID, segments: segments})
+	}
+	return available, nil
+}
+
+// lockMembers locks the capacity limited segments in the id order, so that concurrent
+// assignments to the same segment are serialized without deadlocks, and counts their
+// active members. FOR NO KEY UPDATE doesn't conflict with the FOR KEY SHARE locks
+// taken by foreign key checks and by the rule evaluation.
+func (r *repo) lockMembers(ctx context.Context, tx pgx.Tx, segmentIDs []int64) (map[int64]int64, error) {
+	sql, args, err := r.builder.
+		Select("segment_id").
+		From(segmentTable).
+		Where(sq.Eq{"segment_id": segmentIDs}).
+		OrderBy("segment_id").
+		Suffix("FOR NO KEY UPDATE").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return nil, fmt.Errorf("couldn't lock segments : %w", err)
+	}
+
+	sql, args, err = r.builder.
+		Select("segment_id", "COUNT(*)").
+		From(userSegmentsTable).
+		Where(sq.Eq{"segment_id": segmentIDs}).
+		Where(sq.Gt{"expired_at": r.clock.Now()}).
+		Where(sq.Eq{"starts_at": nil}).
+		GroupBy("segment_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	members := make(map[int64]int64, len(segmentIDs))
+	for rows.Next() {
+		var segmentID, count int64
+		if err := rows.Scan(&segmentID, &count); err != nil {
+			return nil, fmt.Errorf("couldn't scan members count : %w", err)
+		}
+		members[segmentID] = count
+	}
+
+	return members, rows.Err()
+}
+
 func (r *repo) registerUpdateUserEvent(
 	ctx context.Context,
 	tx pgx.Tx,
 	userID int64,
 	inserted []segment.Segment,
 	deleted []string,
+	extended []segment.Segment,
 	timestamp time.Time,
 ) error {
+	if len(inserted)+len(deleted)+len(extended) == 0 {
+		return nil
+	}
 
-	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp")
+	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp", "variant_name")
 
 	for i := range inserted {
-		insertState = insertState.Values(userID, inserted[i].Name, history.Added, timestamp)
+		insertState = insertState.Values(userID, inserted[i].Name, history.Added, timestamp, variantName(inserted[i].Name, userID))
 	}
 
 	for _, id := range deleted {
-		insertState = insertState.Values(userID, id, history.Deleted, timestamp)
+		insertState = insertState.Values(userID, id, history.Deleted, timestamp, variantName(id, userID))
+	}
+
+	for _, s := range extended {
+		insertState = insertState.Values(userID, s.Name, history.Extended, timestamp, variantName(s.Name, userID))
 	}
 
 	sql, args, err := insertState.ToSql()
@@ -642,7 +3041,7 @@ func (r *repo) registerUpdateUserEvent(
 	if err != nil {
 		return fmt.Errorf("couldn't run query : %w", err)
 	}
-	neededLen := int64(len(inserted) + len(deleted))
+	neededLen := int64(len(inserted) + len(deleted) + len(extended))
 	if rows.RowsAffected() != neededLen {
 		return fmt.Errorf(
 			"couldn't insert all the necessary rows, want %d , got %d",
@@ -654,18 +3053,19 @@ func (r *repo) registerUpdateUserEvent(
 	return nil
 }
 
-func (r *repo) registerDeleteUsersEvent(
+func (r *repo) registerUsersEvent(
 	ctx context.Context,
 	tx pgx.Tx,
 	users []int64,
 	segment string,
+	operation history.Operation,
 	timestamp time.Time,
 ) error {
 
-	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp")
+	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp", "variant_name")
 
 	for i := range users {
-		insertState = insertState.Values(users[i], segment, history.Deleted, timestamp)
+		insertState = insertState.Values(users[i], segment, operation, timestamp, variantName(segment, users[i]))
 	}
 
 	sql, args, err := insertState.ToSql()
@@ -688,18 +3088,42 @@ func (r *repo) registerDeleteUsersEvent(
 	return nil
 }
 
-func (r *repo) registerInsertUserEvents(
+func (r *repo) registerAssignmentEvents(
 	ctx context.Context,
 	tx pgx.Tx,
-	user int64,
-	segments []segment.SegmentInfo,
+	assignments []assignment,
+	operation history.Operation,
 	timestamp time.Time,
 ) error {
 
-	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp")
+	values := make([][]interface{}, 0, len(assignments))
+	for _, a := range assignments {
+		for i := range a.segments {
+			values = append(values, []interface{}{
+				a.userID,
+				a.segments[i].Name,
+				operation,
+				timestamp,
+				variantName(a.segments[i].Name, a.userID),
+			})
+		}
+	}
+
+	columns := []string{"user_id", "segment_name", "operation", "operation_timestamp", "variant_name"}
+	return r.insertChunks(ctx, tx, historyTable, columns, values)
+}
 
-	for i := range segments {
-		insertState = insertState.Values(user, segments[i].Name, history.Added, timestamp)
+func (r *repo) registerActivationEvents(ctx context.Context, tx pgx.Tx, started []activation) error {
+	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp", "variant_name")
+
+	for i := range started {
+		insertState = insertState.Values(
+			started[i].userID,
+			started[i].segmentName,
+			history.Added,
+			started[i].startsAt,
+			variantName(started[i].segmentName, started[i].userID),
+		)
 	}
 
 	sql, args, err := insertState.ToSql()
@@ -710,11 +3134,10 @@ func (r *repo) registerInsertUserEvents(
 	if err != nil {
 		return fmt.Errorf("couldn't run query : %w", err)
 	}
-	neededLen := int64(len(segments))
-	if rows.RowsAffected() != neededLen {
+	if rows.RowsAffected() != int64(len(started)) {
 		return fmt.Errorf(
 			"couldn't insert all the necessary rows, want %d , got %d",
-			neededLen,
+			len(started),
 			rows.RowsAffected(),
 		)
 	}
@@ -728,7 +3151,7 @@ func (r *repo) registerCleanupUserEvents(
 	memberships []membership.MembershipInfo,
 ) error {
 
-	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp")
+	insertState := r.builder.Insert(historyTable).Columns("user_id", "segment_name", "operation", "operation_timestamp", "variant_name")
 
 	for i := range memberships {
 		insertState = insertState.Values(
@@ -736,6 +3159,7 @@ func (r *repo) registerCleanupUserEvents(
 			memberships[i].SegmentName,
 			history.Deleted,
 			memberships[i].ExpiredAt,
+			variantName(memberships[i].SegmentName, memberships[i].UserID),
 		)
 	}
 
@@ -758,3 +3182,247 @@ func (r *repo) registerCleanupUserEvents(
 
 	return nil
 }
+
+// registerSegmentAudit records a segment mutation made by the actor of the request.
+func (r *repo) registerSegmentAudit(
+	ctx context.Context,
+	tx pgx.Tx,
+	s segment.SegmentInfo,
+	operation audit.Operation,
+	before audit.Values,
+	after audit.Values,
+	timestamp time.Time,
+) error {
+
+	sql, args, err := r.builder.
+		Insert(auditTable).
+		Columns("segment_id", "segment_name", "actor", "operation", "before", "after", "operation_timestamp").
+		Values(s.ID, s.Name, audit.ActorFrom(ctx), operation, before, after, timestamp).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+// metadataChanges puts the current and the new value of every updated metadata field into before and after.
+func metadataChanges(current segment.SegmentInfo, update segment.Update, before audit.Values, after audit.Values) {
+	if update.Description != nil {
+		before["description"], after["description"] = current.Description, *update.Description
+	}
+	if update.Owner != nil {
+		before["owner"], after["owner"] = current.Owner, *update.Owner
+	}
+	if update.Tags != nil {
+		before["tags"], after["tags"] = current.Tags, update.Tags
+	}
+	if update.Attributes != nil {
+		before["attributes"], after["attributes"] = current.Attributes, update.Attributes
+	}
+}
+
+// activeAt keeps segments whose active window contains the given moment.
+func activeAt(prefix string, now time.Time) sq.Sqlizer {
+	return sq.And{
+		sq.Or{sq.Eq{prefix + "active_from": nil}, sq.LtOrEq{prefix + "active_from": now}},
+		notEnded(prefix, now),
+	}
+}
+
+// notEnded keeps segments whose active window is open-ended or still running.
+func notEnded(prefix string, now time.Time) sq.Sqlizer {
+	return sq.Or{sq.Eq{prefix + "active_until": nil}, sq.Gt{prefix + "active_until": now}}
+}
+
+// rampStep is a pending ramp step, due_at identifies it within the ramp.
+type rampStep struct {
+	segmentID           int64
+	segmentName         string
+	automaticPercentage int
+	dueAt               time.Time
+}
+
+type ruleSegment struct {
+	segment.SegmentInfo
+	rule *rule.Rule
+}
+
+// activation is a scheduled membership whose start has passed.
+type activation struct {
+	userID      int64
+	segmentID   int64
+	segmentName string
+	layer       string
+	capacity    *int
+	startsAt    time.Time
+}
+
+type userLayer struct {
+	userID int64
+	layer  string
+}
+
+// assignment is the automatic segments of a single user.
+type assignment struct {
+	userID   int64
+	segments []segment.SegmentInfo
+}
+
+// ruleState is what the user already has: segment memberships, telling whether they are automatic,
+// and the segments occupying layers.
+type ruleState struct {
+	segments map[int64]bool
+	layers   map[string]int64
+}
+
+func newRuleState(segments []segment.SegmentInfo) ruleState {
+	state := ruleState{
+		segments: make(map[int64]bool),
+		layers:   make(map[string]int64),
+	}
+	for i := range segments {
+		state.add(segments[i].ID, segments[i].Layer, true)
+	}
+	return state
+}
+
+func (s ruleState) add(segmentID int64, layer string, automatic bool) {
+	s.segments[segmentID] = automatic
+	if layer != "" {
+		s.layers[layer] = segmentID
+	}
+}
+
+// ruleChanges evaluates the rules for the user, a matching segment is added unless its layer
+// is already taken by another segment, an automatic member that stopped matching is removed.
+func ruleChanges(rules []ruleSegment, fields rule.Fields, state ruleState) ([]segment.SegmentInfo, []segment.SegmentInfo) {
+	if state.segments == nil {
+		state = newRuleState(nil)
+	}
+	var add, remove []segment.SegmentInfo
+	for i := range rules {
+		automatic, member := state.segments[rules[i].ID]
+		matches := rules[i].rule.Match(fields)
+		switch {
+		case matches && !member:
+			if owner, taken := state.layers[rules[i].Layer]; rules[i].Layer != "" && taken && owner != rules[i].ID {
+				continue
+			}
+			state.add(rules[i].ID, rules[i].Layer, true)
+			add = append(add, rules[i].SegmentInfo)
+		case !matches && member && automatic:
+			remove = append(remove, rules[i].SegmentInfo)
+		}
+	}
+	return add, remove
+}
+
+// conflictingLayer finds the layer of the inserted segment named by the unique violation detail,
+// "Key (user_id, layer)=(1, checkout) already exists.", and falls back to the first layered segment.
+func conflictingLayer(segments []segment.Segment, detail string) string {
+	layer := ""
+	for i := range segments {
+		if segments[i].Layer == "" || !segments[i].StartsAt.IsZero() {
+			continue
+		}
+		if strings.HasSuffix(strings.TrimSuffix(detail, " already exists."), ", "+segments[i].Layer+")") {
+			return segments[i].Layer
+		}
+		if layer == "" {
+			layer = segments[i].Layer
+		}
+	}
+	return layer
+}
+
+func activationPairs(started []activation) ([]int64, []int64) {
+	userIDs := make([]int64, len(started))
+	segmentIDs := make([]int64, len(started))
+	for i := range started {
+		userIDs[i] = started[i].userID
+		segmentIDs[i] = started[i].segmentID
+	}
+	return userIDs, segmentIDs
+}
+
+func containsSegment(segments []segment.Segment, segmentID int64) bool {
+	for i := range segments {
+		if segments[i].ID == segmentID {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule resolves the activation and the expiration of the added segments: a start that has passed
+// activates the segment at once and a ttl is counted from the activation.
+func schedule(segments []segment.Segment, now time.Time) error {
+	for i := range segments {
+		if !segments[i].StartsAt.After(now) {
+			segments[i].StartsAt = time.Time{}
+		}
+		activation := now
+		if !segments[i].StartsAt.IsZero() {
+			activation = segments[i].StartsAt
+		}
+		if segments[i].ExpiredAt.IsZero() && segments[i].TTL > 0 {
+			segments[i].ExpiredAt = activation.Add(segments[i].TTL)
+		}
+		if !segments[i].ExpiredAt.IsZero() && segments[i].ExpiredAt.Before(activation) {
+			return membership.ErrInvalidSchedule
+		}
+	}
+	return nil
+}
+
+// upsertExpiration is the new expiration of an assigned segment, a segment without expiration never expires.
+// An absolute expiration has nothing to extend, so extend keeps the later one like max.
+func upsertExpiration(policy membership.UpsertPolicy, current time.Time, s segment.Segment, now time.Time) time.Time {
+	if s.ExpiredAt.IsZero() {
+		return maxFutureTime
+	}
+	if policy == membership.UpsertExtend && s.TTL > 0 {
+		if !current.Before(maxFutureTime) {
+			return maxFutureTime
+		}
+		if current.Before(now) {
+			current = now
+		}
+		return current.Add(s.TTL)
+	}
+	if policy != membership.UpsertReplace && current.After(s.ExpiredAt) {
+		return current
+	}
+	return s.ExpiredAt
+}
+
+// nullableTime stores a zero time as NULL.
+func nullableTime(value time.Time) interface{} {
+	if value.IsZero() {
+		return nil
+	}
+	return value
+}
+
+// nullable stores an empty layer as NULL so the membership stays outside of any layer.
+func nullable(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// variantID picks the variant of the segment for the user, NULL for segments without variants.
+func variantID(segmentID int64, userID int64) sq.Sqlizer {
+	return sq.Expr("segment_variant(?::BIGINT, ?::BIGINT)", segmentID, userID)
+}
+
+// variantName resolves the name of the variant the user gets in the segment for the history record.
+func variantName(segmentName string, userID int64) sq.Sqlizer {
+	return sq.Expr("segment_variant_name(?, ?::BIGINT)", segmentName, userID)
+}
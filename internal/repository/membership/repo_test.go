@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
 	"github.com/VrMolodyakov/segment-api/internal/domain/history"
 	"github.com/VrMolodyakov/segment-api/internal/domain/membership"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
@@ -36,6 +37,26 @@ func (tc *mockClock) Until(t time.Time) time.Duration {
 	return t.Sub(tc.currentTime)
 }
 
+// tickingClock moves forward by a second on every call, so a query built from a later
+// Now sees a different moment.
+type tickingClock struct {
+	mockClock
+}
+
+func (tc *tickingClock) Now() time.Time {
+	now := tc.currentTime
+	tc.currentTime = tc.currentTime.Add(time.Second)
+	return now
+}
+
+type mockBucketing struct {
+	bucket int
+}
+
+func (m *mockBucketing) Bucket(userID int64, salt string) int {
+	return m.bucket
+}
+
 func TestUpdateUserSegments(t *testing.T) {
 	ctx := context.Background()
 	mockClient, err := pgxmock.NewPool()
@@ -50,11 +71,15 @@ func TestUpdateUserSegments(t *testing.T) {
 
 	userID := int64(1)
 	insertID1, insertID2, deleteID1, deleteID2 := int64(1), int64(2), int64(3), int64(4)
+	dependentColumns := []string{"segment_id", "segment_name", "prerequisite_policy", "segment_name"}
+	prerequisiteColumns := []string{"segment_name", "segment_name"}
+	layerColumns := []string{"segment_id", "segment_name", "layer", "expired_at"}
 
 	type args struct {
 		addSegments        []segment.Segment
 		deleteSegmentNames []string
 		userID             int64
+		policy             membership.UpsertPolicy
 	}
 
 	tests := []struct {
@@ -68,41 +93,53 @@ func TestUpdateUserSegments(t *testing.T) {
 			mockCall: func() {
 				insertNames := []interface{}{"segment1", "segment2"}
 				deleteNames := []interface{}{"segment3", "segment4"}
-				insertRecors := []interface{}{userID, insertID1, testTime, userID, insertID2, testTime}
+				insertRecors := []interface{}{userID, insertID1, testTime, insertID1, userID, nil, nil, userID, insertID2, testTime, insertID2, userID, nil, nil}
 				deleteRecors := []interface{}{userID, deleteID1, deleteID2}
 				insertRows := pgxmock.
-					NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(insertID1, "segment1").
-					AddRow(insertID2, "segment2")
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
 				deleteRows := pgxmock.
 					NewRows([]string{"segment_id"}).
 					AddRow(deleteID1).
 					AddRow(deleteID2)
 				historyRows := []interface{}{
-					userID, "segment1", history.Added, testTime,
-					userID, "segment2", history.Added, testTime,
-					userID, "segment3", history.Deleted, testTime,
-					userID, "segment4", history.Deleted, testTime,
+					userID, "segment1", history.Added, testTime, "segment1", userID,
+					userID, "segment2", history.Added, testTime, "segment2", userID,
+					userID, "segment3", history.Deleted, testTime, "segment3", userID,
+					userID, "segment4", history.Deleted, testTime, "segment4", userID,
 				}
 
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
-					WithArgs(insertNames...).
-					WillReturnRows(insertRows)
-				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(deleteNames...).
 					WillReturnRows(deleteRows)
 				mockClient.
 					ExpectExec("DELETE FROM user_segments WHERE ").
 					WithArgs(deleteRecors...).
 					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+				mockClient.
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(userID, deleteID1, deleteID2).
+					WillReturnRows(pgxmock.NewRows(dependentColumns))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs(insertNames...).
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, insertID2, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
@@ -121,14 +158,175 @@ func TestUpdateUserSegments(t *testing.T) {
 			isError: false,
 		},
 		{
+			title: "Should extend the assigned segment and insert the new one with the extend policy",
+			mockCall: func() {
+				current := testTime.Add(time.Hour)
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
+				historyRows := []interface{}{
+					userID, "segment2", history.Added, testTime, "segment2", userID,
+					userID, "segment1", history.Extended, testTime, "segment1", userID,
+				}
+
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment1", "segment2").
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, expired_at FROM user_segments WHERE user_id = \\$1 AND segment_id IN \\(\\$2,\\$3\\) AND \\(starts_at IS NULL OR starts_at <= \\$4\\) ORDER BY segment_id FOR UPDATE").
+					WithArgs(userID, insertID1, insertID2, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id", "expired_at"}).AddRow(insertID1, current))
+				mockClient.
+					ExpectQuery("SELECT segment_id FROM user_segments WHERE user_id = \\$1 AND segment_id IN \\(\\$2,\\$3\\) AND starts_at > \\$4 ORDER BY segment_id FOR UPDATE").
+					WithArgs(userID, insertID1, insertID2, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id"}))
+				mockClient.
+					ExpectExec("UPDATE user_segments SET expired_at = \\$1 WHERE user_id = \\$2 AND segment_id = \\$3").
+					WithArgs(current.Add(24*time.Hour), userID, insertID1).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(userID, insertID2, testTime, insertID2, userID, nil, nil).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, insertID2, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1", ExpiredAt: testTime, TTL: 24 * time.Hour},
+					{Name: "segment2", ExpiredAt: testTime, TTL: time.Hour},
+				},
+				userID: userID,
+				policy: membership.UpsertExtend,
+			},
+			isError: false,
+		},
+		{
+			title: "Should reschedule the pending segment without registering it as extended",
+			mockCall: func() {
+				startsAt := testTime.Add(2 * time.Hour)
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
+
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment1", "segment2").
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, expired_at FROM user_segments WHERE (.+) AND \\(starts_at IS NULL OR starts_at <= (.+)\\) ORDER BY segment_id FOR UPDATE").
+					WithArgs(userID, insertID1, insertID2, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id", "expired_at"}))
+				mockClient.
+					ExpectQuery("SELECT segment_id FROM user_segments WHERE (.+) AND starts_at > (.+) ORDER BY segment_id FOR UPDATE").
+					WithArgs(userID, insertID1, insertID2, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id"}).AddRow(insertID1).AddRow(insertID2))
+				mockClient.
+					ExpectExec("UPDATE user_segments SET starts_at = \\$1, expired_at = \\$2 WHERE user_id = \\$3 AND segment_id = \\$4").
+					WithArgs(startsAt, startsAt.Add(time.Hour), userID, insertID1).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("UPDATE user_segments SET starts_at = \\$1, expired_at = \\$2 WHERE user_id = \\$3 AND segment_id = \\$4").
+					WithArgs(testTime, testTime.Add(time.Hour), userID, insertID2).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, insertID2, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1", StartsAt: testTime.Add(2 * time.Hour), TTL: time.Hour},
+					{Name: "segment2", TTL: time.Hour},
+				},
+				userID: userID,
+				policy: membership.UpsertExtend,
+			},
+			isError: false,
+		},
+		{
+			title: "Should insert the scheduled segment without registering it as added",
+			mockCall: func() {
+				startsAt := testTime.Add(time.Hour)
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
+				insertRecords := []interface{}{
+					userID, insertID1, startsAt.Add(time.Hour), insertID1, userID, nil, startsAt,
+					userID, insertID2, testTime.Add(time.Hour), insertID2, userID, nil, nil,
+				}
 
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment1", "segment2").
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments \\(user_id,segment_id,expired_at,variant_id,layer,starts_at\\)").
+					WithArgs(insertRecords...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, insertID2, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "segment2", history.Added, testTime, "segment2", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1", StartsAt: testTime.Add(time.Hour), TTL: time.Hour},
+					{Name: "segment2", StartsAt: testTime.Add(-time.Hour), TTL: time.Hour},
+				},
+				userID: userID,
+			},
+			isError: false,
+		},
+		{
+			title: "Segment expires before it starts",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.ExpectRollback()
+			},
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1", StartsAt: testTime.Add(2 * time.Hour), ExpiredAt: testTime.Add(time.Hour)},
+				},
+				userID: userID,
+			},
+			isError: true,
+		},
+		{
 			title: "Couldn't find all the ids by the name to add and got an error",
 			mockCall: func() {
 				insertNames := []interface{}{"segment1", "segment2"}
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(insertNames...).
 					WillReturnError(errors.New("couldn't find some id"))
 				mockClient.ExpectRollback()
@@ -138,34 +336,23 @@ func TestUpdateUserSegments(t *testing.T) {
 					{ID: 1, Name: "segment1", ExpiredAt: testTime},
 					{ID: 2, Name: "segment2", ExpiredAt: testTime},
 				},
-				deleteSegmentNames: []string{"segment3", "segment4"},
-				userID:             userID,
+				userID: userID,
 			},
 			isError: true,
 		},
 		{
 			title: "Couldn't find all the ids by the name to delete and got an error",
 			mockCall: func() {
-				insertNames := []interface{}{"segment1", "segment2"}
 				deleteNames := []interface{}{"segment3", "segment4"}
-				insertRecors := []interface{}{userID, insertID1, testTime, userID, insertID2, testTime}
-				insertRows := pgxmock.
-					NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(insertID1, "segment1").
-					AddRow(insertID2, "segment2")
 
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
-					WithArgs(insertNames...).
-					WillReturnRows(insertRows)
-				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(deleteNames...).
 					WillReturnError(errors.New("couldn't find some id"))
 				mockClient.ExpectRollback()
@@ -183,14 +370,8 @@ func TestUpdateUserSegments(t *testing.T) {
 		{
 			title: "Couldn't delete the necessary columns and got an error",
 			mockCall: func() {
-				insertNames := []interface{}{"segment1", "segment2"}
 				deleteNames := []interface{}{"segment3", "segment4"}
-				insertRecors := []interface{}{userID, insertID1, testTime, userID, insertID2, testTime}
 				deleteRecors := []interface{}{userID, deleteID1, deleteID2}
-				insertRows := pgxmock.
-					NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(insertID1, "segment1").
-					AddRow(insertID2, "segment2")
 				deleteRows := pgxmock.
 					NewRows([]string{"segment_id"}).
 					AddRow(deleteID1).
@@ -199,15 +380,11 @@ func TestUpdateUserSegments(t *testing.T) {
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
-					WithArgs(insertNames...).
-					WillReturnRows(insertRows)
-				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(deleteNames...).
 					WillReturnRows(deleteRows)
 				mockClient.
@@ -231,15 +408,15 @@ func TestUpdateUserSegments(t *testing.T) {
 			title: "Couldn't insert the necessary columns and got an error",
 			mockCall: func() {
 				insertNames := []interface{}{"segment1", "segment2"}
-				insertRecors := []interface{}{userID, insertID1, testTime, userID, insertID2, testTime}
+				insertRecors := []interface{}{userID, insertID1, testTime, insertID1, userID, nil, nil, userID, insertID2, testTime, insertID2, userID, nil, nil}
 				insertRows := pgxmock.
-					NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(insertID1, "segment1").
-					AddRow(insertID2, "segment2")
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(insertNames...).
 					WillReturnRows(insertRows)
 				mockClient.
@@ -254,8 +431,7 @@ func TestUpdateUserSegments(t *testing.T) {
 					{ID: 1, Name: "segment1", ExpiredAt: testTime},
 					{ID: 2, Name: "segment2", ExpiredAt: testTime},
 				},
-				deleteSegmentNames: []string{"segment3", "segment4"},
-				userID:             userID,
+				userID: userID,
 			},
 			isError: true,
 		},
@@ -264,41 +440,53 @@ func TestUpdateUserSegments(t *testing.T) {
 			mockCall: func() {
 				insertNames := []interface{}{"segment1", "segment2"}
 				deleteNames := []interface{}{"segment3", "segment4"}
-				insertRecors := []interface{}{userID, insertID1, testTime, userID, insertID2, testTime}
+				insertRecors := []interface{}{userID, insertID1, testTime, insertID1, userID, nil, nil, userID, insertID2, testTime, insertID2, userID, nil, nil}
 				deleteRecors := []interface{}{userID, deleteID1, deleteID2}
 				insertRows := pgxmock.
-					NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(insertID1, "segment1").
-					AddRow(insertID2, "segment2")
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil).
+					AddRow(insertID2, "segment2", "", nil)
 				deleteRows := pgxmock.
 					NewRows([]string{"segment_id"}).
 					AddRow(deleteID1).
 					AddRow(deleteID2)
 				historyRows := []interface{}{
-					userID, "segment1", history.Added, testTime,
-					userID, "segment2", history.Added, testTime,
-					userID, "segment3", history.Deleted, testTime,
-					userID, "segment4", history.Deleted, testTime,
+					userID, "segment1", history.Added, testTime, "segment1", userID,
+					userID, "segment2", history.Added, testTime, "segment2", userID,
+					userID, "segment3", history.Deleted, testTime, "segment3", userID,
+					userID, "segment4", history.Deleted, testTime, "segment4", userID,
 				}
 
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE segment_name IN ").
-					WithArgs(insertNames...).
-					WillReturnRows(insertRows)
-				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE segment_name IN ").
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
 					WithArgs(deleteNames...).
 					WillReturnRows(deleteRows)
 				mockClient.
 					ExpectExec("DELETE FROM user_segments WHERE ").
 					WithArgs(deleteRecors...).
 					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+				mockClient.
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(userID, deleteID1, deleteID2).
+					WillReturnRows(pgxmock.NewRows(dependentColumns))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs(insertNames...).
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, insertID2, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
@@ -316,389 +504,2500 @@ func TestUpdateUserSegments(t *testing.T) {
 			},
 			isError: true,
 		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.title, func(t *testing.T) {
-			test.mockCall()
-			err := repo.UpdateUserSegments(
-				ctx,
-				test.args.userID,
-				test.args.addSegments,
-				test.args.deleteSegmentNames,
-			)
-			if test.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
-			if err := mockClient.ExpectationsWereMet(); err != nil {
-				t.Errorf("there were unfulfilled expectations: %s", err)
-			}
-
-		})
-	}
-}
-
-func TestGetUserSegments(t *testing.T) {
-	ctx := context.Background()
-	mockClient, err := pgxmock.NewPool()
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer mockClient.Close()
-	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
-	clock := NewTestClock(testTime)
-	repo := New(mockClient, clock)
-
-	userID := int64(1)
-
-	membershipRecords := []membership.MembershipInfo{
-		{UserID: userID, SegmentName: "segment1", ExpiredAt: testTime},
-		{UserID: userID, SegmentName: "segment1", ExpiredAt: testTime},
-	}
-
-	type args struct {
-		userID int64
-	}
-
-	tests := []struct {
-		title    string
-		isError  bool
-		expected []membership.MembershipInfo
-		args     args
-		mockCall func()
-	}{
 		{
-			title: "Should successfully retrieve user membership",
+			title: "User already belongs to a segment of the same layer",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id", "segment_name", "expired_at"}).
-					AddRow(membershipRecords[0].UserID, membershipRecords[0].SegmentName, membershipRecords[0].ExpiredAt).
-					AddRow(membershipRecords[1].UserID, membershipRecords[1].SegmentName, membershipRecords[1].ExpiredAt)
+				insertNames := []interface{}{"segment1", "segment2"}
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "checkout", nil).
+					AddRow(insertID2, "segment2", "", nil)
 				mockClient.
-					ExpectQuery("SELECT user_id, segment_name, expired_at FROM user_segments").
-					WithArgs(userID, testTime).
-					WillReturnRows(rows)
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs(insertNames...).
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectQuery("SELECT us.segment_id, s.segment_name, us.layer, us.expired_at FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.layer IN (.+) FOR UPDATE OF us").
+					WithArgs(userID, "checkout").
+					WillReturnRows(pgxmock.NewRows(layerColumns).AddRow(insertID2, "segment3", "checkout", testTime.Add(time.Hour)))
+				mockClient.ExpectRollback()
 			},
-			args:     args{userID: userID},
-			isError:  false,
-			expected: membershipRecords,
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1"},
+					{Name: "segment2"},
+				},
+				userID: userID,
+			},
+			isError: true,
 		},
 		{
-			title: "Database internal error",
+			title: "Should free a layer held by an expired segment",
 			mockCall: func() {
+				insertNames := []interface{}{"segment1"}
+				insertRecors := []interface{}{userID, insertID1, testTime.Add(time.Hour), insertID1, userID, "checkout", nil}
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "checkout", nil)
+				layerRows := pgxmock.
+					NewRows(layerColumns).
+					AddRow(insertID2, "segment3", "checkout", testTime.Add(-time.Hour))
 				mockClient.
-					ExpectQuery("SELECT user_id, segment_name, expired_at FROM user_segments").
-					WithArgs(userID, testTime).
-					WillReturnError(errors.New("internal database error"))
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs(insertNames...).
+					WillReturnRows(insertRows)
+				mockClient.
+					ExpectQuery("SELECT us.segment_id, s.segment_name, us.layer, us.expired_at FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.layer IN (.+) FOR UPDATE OF us").
+					WithArgs(userID, "checkout").
+					WillReturnRows(layerRows)
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "segment3", history.Deleted, testTime.Add(-time.Hour), "segment3", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE ").
+					WithArgs(userID, insertID2).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(insertID1, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "segment1", history.Added, testTime, "segment1", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectCommit()
 			},
-			args:     args{userID: userID},
-			isError:  true,
-			expected: nil,
+			args: args{
+				addSegments: []segment.Segment{
+					{Name: "segment1", ExpiredAt: testTime.Add(time.Hour)},
+				},
+				userID: userID,
+			},
+			isError: false,
 		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.title, func(t *testing.T) {
-			test.mockCall()
-			result, err := repo.GetUserSegments(ctx, test.args.userID)
-			if test.isError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-
-			}
-			assert.Equal(t, test.expected, result)
-			if err := mockClient.ExpectationsWereMet(); err != nil {
-				t.Errorf("there were unfulfilled expectations: %s", err)
-			}
-		})
-	}
-}
-
-func TestDeleteSegment(t *testing.T) {
-	ctx := context.Background()
-	mockClient, err := pgxmock.NewPool()
-	if err != nil {
-		t.Error(err)
-	}
-	defer mockClient.Close()
-
-	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
-	clock := NewTestClock(testTime)
-	repo := New(mockClient, clock)
-
-	userID1, userID2 := int64(1), int64(2)
-	deleteID1 := int64(1)
-
-	type args struct {
-		name string
-	}
-
-	tests := []struct {
-		title    string
-		isError  bool
-		args     args
-		mockCall func()
-	}{
 		{
-			title: "Should successfully delete 2 users for given segment and segment itself",
+			title: "Attempt to add two segments of the same layer at once",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-				userRows := pgxmock.
-					NewRows([]string{"user_id"}).
-					AddRow(userID1).
-					AddRow(userID2)
-				historyRows := []interface{}{
-					userID1, "segment1", history.Deleted, testTime,
-					userID2, "segment1", history.Deleted, testTime,
-				}
-
+				insertNames := []interface{}{"segment1", "segment2"}
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "checkout", nil).
+					AddRow(insertID2, "segment2", "checkout", nil)
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
-				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnRows(userRows)
-				mockClient.
-					ExpectExec("DELETE FROM user_segments WHERE ").
-					WithArgs(segmentIDs...).
-					WillReturnResult(pgxmock.NewResult("DELETE", 2))
-				mockClient.
-					ExpectExec("INSERT INTO segment_history").
-					WithArgs(historyRows...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
-				mockClient.
-					ExpectExec("DELETE FROM segments").
-					WithArgs(segmentIDs...).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
-				mockClient.
-					ExpectCommit()
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs(insertNames...).
+					WillReturnRows(insertRows)
+				mockClient.ExpectRollback()
 			},
 			args: args{
-				name: "segment1",
+				addSegments: []segment.Segment{
+					{Name: "segment1"},
+					{Name: "segment2"},
+				},
+				userID: userID,
 			},
-			isError: false,
+			isError: true,
 		},
 		{
-			title: "Error while searching for segment id",
+			title: "Segment reached its capacity",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
+				capacity := 2
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", &capacity)
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnError(errors.New("id not found"))
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment1").
+					WillReturnRows(insertRows)
 				mockClient.
-					ExpectRollback()
+					ExpectExec("SELECT segment_id FROM segments WHERE segment_id IN (.+) FOR NO KEY UPDATE").
+					WithArgs(insertID1).
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				mockClient.
+					ExpectQuery("SELECT segment_id, COUNT\\(\\*\\) FROM user_segments").
+					WithArgs(insertID1, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id", "count"}).AddRow(insertID1, int64(2)))
+				mockClient.ExpectRollback()
 			},
 			args: args{
-				name: "segment1",
+				addSegments: []segment.Segment{
+					{Name: "segment1", ExpiredAt: testTime},
+				},
+				userID: userID,
 			},
 			isError: true,
 		},
 		{
-			title: "Error while searching for user",
+			title: "User doesn't have a prerequisite of the added segment",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-
+				insertRows := pgxmock.
+					NewRows([]string{"segment_id", "segment_name", "layer", "capacity"}).
+					AddRow(insertID1, "segment1", "", nil)
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment1").
+					WillReturnRows(insertRows)
 				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnError(errors.New("users not found"))
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(userID, insertID1, testTime, insertID1, userID, nil, nil).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				mockClient.
-					ExpectRollback()
+					ExpectQuery("SELECT s.segment_name, p.segment_name FROM segment_prerequisites sp (.+) WHERE sp.segment_id IN (.+) AND NOT EXISTS").
+					WithArgs(insertID1, userID, testTime).
+					WillReturnRows(pgxmock.NewRows(prerequisiteColumns).AddRow("segment1", "segment3"))
+				mockClient.ExpectRollback()
 			},
 			args: args{
-				name: "segment1",
+				addSegments: []segment.Segment{
+					{Name: "segment1", ExpiredAt: testTime},
+				},
+				userID: userID,
 			},
 			isError: true,
 		},
 		{
-			title: "Couldn't delete users and got an error",
+			title: "Deleted segment is required by a user segment with the refuse policy",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-				userRows := pgxmock.
-					NewRows([]string{"user_id"}).
-					AddRow(userID1).
-					AddRow(userID2)
-
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnRows(userRows)
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment3").
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id"}).AddRow(deleteID1))
 				mockClient.
 					ExpectExec("DELETE FROM user_segments WHERE ").
-					WithArgs(segmentIDs...).
-					WillReturnError(errors.New("cannot delete users"))
+					WithArgs(userID, deleteID1).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
 				mockClient.
-					ExpectRollback()
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp (.+) AND us.user_id = (.+) WHERE sp.prerequisite_id IN").
+					WithArgs(userID, deleteID1).
+					WillReturnRows(pgxmock.NewRows(dependentColumns).AddRow(deleteID2, "segment4", segment.PolicyRefuse, "segment3"))
+				mockClient.ExpectRollback()
 			},
 			args: args{
-				name: "segment1",
+				deleteSegmentNames: []string{"segment3"},
+				userID:             userID,
 			},
 			isError: true,
 		},
 		{
-			title: "Couldn't save delete history and got an error",
+			title: "Should cascade the removal to the dependent user segments",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-				userRows := pgxmock.
-					NewRows([]string{"user_id"}).
-					AddRow(userID1).
-					AddRow(userID2)
 				historyRows := []interface{}{
-					userID1, "segment1", history.Deleted, testTime,
-					userID2, "segment1", history.Deleted, testTime,
+					userID, "segment3", history.Deleted, testTime, "segment3", userID,
+					userID, "segment4", history.Deleted, testTime, "segment4", userID,
 				}
-
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnRows(userRows)
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment3").
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id"}).AddRow(deleteID1))
 				mockClient.
 					ExpectExec("DELETE FROM user_segments WHERE ").
-					WithArgs(segmentIDs...).
-					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+					WithArgs(userID, deleteID1).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(userID, deleteID1).
+					WillReturnRows(pgxmock.NewRows(dependentColumns).AddRow(deleteID2, "segment4", segment.PolicyCascade, "segment3"))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE ").
+					WithArgs(userID, deleteID2).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(userID, deleteID2).
+					WillReturnRows(pgxmock.NewRows(dependentColumns))
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
-					WillReturnError(errors.New("cannot save history row"))
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectRollback()
+					ExpectCommit()
 			},
 			args: args{
-				name: "segment1",
+				deleteSegmentNames: []string{"segment3"},
+				userID:             userID,
 			},
-			isError: true,
+			isError: false,
 		},
 		{
-			title: "Couldn't delete segment and got an error",
+			title: "Should not register the removal of a scheduled segment that hasn't started",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-				userRows := pgxmock.
-					NewRows([]string{"user_id"}).
-					AddRow(userID1).
-					AddRow(userID2)
 				historyRows := []interface{}{
-					userID1, "segment1", history.Deleted, testTime,
-					userID2, "segment1", history.Deleted, testTime,
+					userID, "segment3", history.Deleted, testTime, "segment3", userID,
 				}
-
 				mockClient.
 					ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
+					ExpectQuery("SELECT s.segment_name FROM user_segments us (.+) WHERE us.user_id = (.+) AND us.starts_at IS NOT NULL").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).AddRow("segment4"))
 				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnRows(userRows)
+					ExpectQuery("SELECT segment_id FROM segments WHERE archived_at IS NULL AND segment_name IN ").
+					WithArgs("segment3", "segment4").
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id"}).AddRow(deleteID1).AddRow(deleteID2))
 				mockClient.
 					ExpectExec("DELETE FROM user_segments WHERE ").
-					WithArgs(segmentIDs...).
+					WithArgs(userID, deleteID1, deleteID2).
 					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+				mockClient.
+					ExpectQuery("SELECT d.segment_id, d.segment_name, d.prerequisite_policy, p.segment_name FROM segment_prerequisites sp").
+					WithArgs(userID, deleteID1, deleteID2).
+					WillReturnRows(pgxmock.NewRows(dependentColumns))
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				mockClient.
-					ExpectExec("DELETE FROM segments").
-					WithArgs(segmentIDs...).
-					WillReturnError(errors.New("cannot delete segment"))
-				mockClient.
-					ExpectRollback()
+					ExpectCommit()
 			},
 			args: args{
-				name: "segment1",
+				deleteSegmentNames: []string{"segment3", "segment4"},
+				userID:             userID,
+			},
+			isError: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.UpdateUserSegments(
+				ctx,
+				test.args.userID,
+				test.args.addSegments,
+				test.args.deleteSegmentNames,
+				test.args.policy,
+			)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+
+		})
+	}
+}
+
+func TestGetUserSegments(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID := int64(1)
+
+	membershipRecords := []membership.MembershipInfo{
+		{UserID: userID, SegmentName: "segment1", Variant: "control", ExpiredAt: testTime},
+		{UserID: userID, SegmentName: "segment2", ExpiredAt: testTime},
+	}
+
+	type args struct {
+		userID int64
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		expected []membership.MembershipInfo
+		args     args
+		mockCall func()
+	}{
+		{
+			title: "Should successfully retrieve user membership",
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"user_id", "segment_name", "variant_name", "expired_at"}).
+					AddRow(membershipRecords[0].UserID, membershipRecords[0].SegmentName, membershipRecords[0].Variant, membershipRecords[0].ExpiredAt).
+					AddRow(membershipRecords[1].UserID, membershipRecords[1].SegmentName, membershipRecords[1].Variant, membershipRecords[1].ExpiredAt)
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name, (.+), us.expired_at FROM user_segments us JOIN segments s (.+) LEFT JOIN segment_variants sv (.+)s.active_from IS NULL OR s.active_from <= (.+) AND \\(s.active_until IS NULL OR s.active_until > ").
+					WithArgs(userID, testTime, testTime, testTime).
+					WillReturnRows(rows)
+			},
+			args:     args{userID: userID},
+			isError:  false,
+			expected: membershipRecords,
+		},
+		{
+			title: "Database internal error",
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name, (.+), us.expired_at FROM user_segments").
+					WithArgs(userID, testTime, testTime, testTime).
+					WillReturnError(errors.New("internal database error"))
+			},
+			args:     args{userID: userID},
+			isError:  true,
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			result, err := repo.GetUserSegments(ctx, test.args.userID)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+
+			}
+			assert.Equal(t, test.expected, result)
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetUsersSegments(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userIDs := []int64{1, 2, 3}
+	membershipRecords := []membership.MembershipInfo{
+		{UserID: 1, SegmentName: "segment1", Variant: "control", ExpiredAt: testTime},
+		{UserID: 3, SegmentName: "segment1", ExpiredAt: testTime},
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		expected []membership.MembershipInfo
+		mockCall func()
+	}{
+		{
+			title: "Should retrieve membership of all the users with a single query",
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"user_id", "segment_name", "variant_name", "expired_at"}).
+					AddRow(membershipRecords[0].UserID, membershipRecords[0].SegmentName, membershipRecords[0].Variant, membershipRecords[0].ExpiredAt).
+					AddRow(membershipRecords[1].UserID, membershipRecords[1].SegmentName, membershipRecords[1].Variant, membershipRecords[1].ExpiredAt)
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name, (.+) FROM user_segments us (.+) WHERE us.user_id = ANY\\(\\$1\\) AND ").
+					WithArgs(userIDs, testTime, testTime, testTime).
+					WillReturnRows(rows)
+			},
+			expected: membershipRecords,
+		},
+		{
+			title: "Database internal error",
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name, (.+), us.expired_at FROM user_segments").
+					WithArgs(userIDs, testTime, testTime, testTime).
+					WillReturnError(errors.New("internal database error"))
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			result, err := repo.GetUsersSegments(ctx, userIDs)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, result)
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestPreviewDelete(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentID := int64(1)
+	segmentColumns := []string{"segment_id", "segment_name", "salt"}
+
+	tests := []struct {
+		title      string
+		sampleSize int
+		isError    bool
+		expected   membership.DeletePreview
+		mockCall   func()
+	}{
+		{
+			title:      "Should count manual and automatic members and return a sample",
+			sampleSize: 2,
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, salt FROM segments WHERE archived_at IS NULL AND segment_name = ").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(segmentColumns).AddRow(segmentID, "segment1", "salt"))
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(4), "digest"))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE (.+) ORDER BY user_id LIMIT 2").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(int64(1)).AddRow(int64(2)))
+			},
+			expected: membership.DeletePreview{
+				Segment:       segment.SegmentInfo{ID: segmentID, Name: "segment1", Salt: "salt"},
+				Manual:        1,
+				Automatic:     4,
+				MembersDigest: "digest",
+				Sample:        []int64{1, 2},
+			},
+		},
+		{
+			title:      "Should skip the sample for an empty segment",
+			sampleSize: 2,
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, salt FROM segments").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(segmentColumns).AddRow(segmentID, "segment1", "salt"))
+				mockClient.
+					ExpectQuery("SELECT COUNT(.+) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(0), int64(0), ""))
+			},
+			expected: membership.DeletePreview{
+				Segment: segment.SegmentInfo{ID: segmentID, Name: "segment1", Salt: "salt"},
+			},
+		},
+		{
+			title:   "Segment not found",
+			isError: true,
+			mockCall: func() {
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, salt FROM segments").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(segmentColumns))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.PreviewDelete(ctx, "segment1", test.sampleSize)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestArchiveSegment(t *testing.T) {
+	ctx := audit.WithActor(context.Background(), "admin")
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID1, userID2 := int64(1), int64(2)
+	segmentID := int64(1)
+
+	lockedColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}
+	lockedRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows(lockedColumns).AddRow(segmentID, "segment1", 100, "salt", "", nil, "")
+	}
+
+	type args struct {
+		name    string
+		confirm func(membership.DeletePreview) error
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		args     args
+		mockCall func()
+	}{
+		{
+			title: "Should archive segment and register archived event for its members",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(lockedRows())
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(1), "digest"))
+				mockClient.
+					ExpectExec("UPDATE segments SET archived_at = (.+) WHERE segment_id = ").
+					WithArgs(testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID, "segment1", "admin", audit.Archived,
+						audit.Values{"archivedAt": nil}, audit.Values{"archivedAt": testTime}, testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id, expired_at FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "expired_at"}))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at > ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1).AddRow(userID2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(
+						userID1, "segment1", history.Archived, testTime, "segment1", userID1,
+						userID2, "segment1", history.Archived, testTime, "segment1", userID2,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				name: "segment1",
+			},
+		},
+		{
+			title: "Should record already expired members as deleted instead of archived",
+			mockCall: func() {
+				expiredAt := testTime.Add(-time.Hour)
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(lockedRows())
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(0), "digest"))
+				mockClient.
+					ExpectExec("UPDATE segments SET archived_at").
+					WithArgs(testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID, "segment1", "admin", audit.Archived,
+						audit.Values{"archivedAt": nil}, audit.Values{"archivedAt": testTime}, testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id, expired_at FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "expired_at"}).AddRow(userID2, expiredAt))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID2, "segment1", history.Deleted, expiredAt, "segment1", userID2).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at > ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID1, "segment1", history.Archived, testTime, "segment1", userID1).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				name: "segment1",
+			},
+		},
+		{
+			title: "Should archive segment without members",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(lockedRows())
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(1), "digest"))
+				mockClient.
+					ExpectExec("UPDATE segments SET archived_at").
+					WithArgs(testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID, "segment1", "admin", audit.Archived,
+						audit.Values{"archivedAt": nil}, audit.Values{"archivedAt": testTime}, testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id, expired_at FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "expired_at"}))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at > ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				mockClient.
+					ExpectCommit()
+			},
+			args: args{
+				name: "segment1",
+			},
+		},
+		{
+			title: "Active segment not found",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE ").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(lockedColumns))
+				mockClient.
+					ExpectRollback()
+			},
+			args: args{
+				name: "segment1",
+			},
+			isError: true,
+		},
+		{
+			title: "Confirmation rejected the members preview",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(lockedRows())
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(1), "digest"))
+				mockClient.
+					ExpectRollback()
+			},
+			args: args{
+				name: "segment1",
+				confirm: func(preview membership.DeletePreview) error {
+					if preview.Affected() != 2 {
+						return errors.New("unexpected preview")
+					}
+					return membership.ErrConfirmationMismatch
+				},
+			},
+			isError: true,
+		},
+		{
+			title: "Couldn't save archive history and got an error",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(lockedRows())
+				mockClient.
+					ExpectQuery("SELECT COUNT\\(\\*\\) FILTER \\(WHERE NOT automatic\\), COUNT\\(\\*\\) FILTER \\(WHERE automatic\\), COALESCE\\(md5\\(string_agg(.+)\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(1), int64(1), "digest"))
+				mockClient.
+					ExpectExec("UPDATE segments SET archived_at").
+					WithArgs(testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID, "segment1", "admin", audit.Archived,
+						audit.Values{"archivedAt": nil}, audit.Values{"archivedAt": testTime}, testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id, expired_at FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "expired_at"}))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at > ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID1, "segment1", history.Archived, testTime, "segment1", userID1).
+					WillReturnError(errors.New("cannot save history row"))
+				mockClient.
+					ExpectRollback()
+			},
+			args: args{
+				name: "segment1",
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			confirm := test.args.confirm
+			if confirm == nil {
+				confirm = func(membership.DeletePreview) error { return nil }
+			}
+			err := repo.ArchiveSegment(ctx, test.args.name, confirm)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRestoreSegment(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID := int64(1)
+	segmentID := int64(1)
+	grace := 24 * time.Hour
+	lockColumns := []string{"segment_id", "segment_name", "archived_at"}
+
+	tests := []struct {
+		title     string
+		isError   bool
+		expectErr error
+		mockCall  func()
+	}{
+		{
+			title: "Should restore segment within grace period",
+			mockCall: func() {
+				archivedAt := testTime.Add(-time.Hour)
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments WHERE segment_name = (.+) AND archived_at IS NOT NULL FOR UPDATE").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, "segment1", &archivedAt))
+				mockClient.
+					ExpectExec("UPDATE segments SET archived_at = (.+) WHERE segment_id = ").
+					WithArgs(nil, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID, "segment1", audit.SystemActor, audit.Restored,
+						audit.Values{"archivedAt": &archivedAt}, audit.Values{"archivedAt": nil}, testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at <= ").
+					WithArgs(segmentID, testTime).
+					WillReturnResult(pgxmock.NewResult("DELETE", 0))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL AND expired_at > ").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "segment1", history.Restored, testTime, "segment1", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectCommit()
+			},
+		},
+		{
+			title:     "Grace period expired",
+			isError:   true,
+			expectErr: segment.ErrGracePeriodExpired,
+			mockCall: func() {
+				archivedAt := testTime.Add(-48 * time.Hour)
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, "segment1", &archivedAt))
+				mockClient.
+					ExpectRollback()
+			},
+		},
+		{
+			title:     "Archived segment not found",
+			isError:   true,
+			expectErr: segment.ErrSegmentNotFound,
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows(lockColumns))
+				mockClient.
+					ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.RestoreSegment(ctx, "segment1", grace)
+			if test.isError {
+				assert.ErrorIs(t, err, test.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestPurgeArchived(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID := int64(1)
+	segmentID1, segmentID2 := int64(1), int64(2)
+	grace := 24 * time.Hour
+	cutoff := testTime.Add(-grace)
+	archivedAt := cutoff.Add(-time.Hour)
+	archivedColumns := []string{"segment_id", "segment_name", "archived_at"}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should purge expired archived segments with their members",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments WHERE archived_at < (.+) ORDER BY segment_id FOR UPDATE").
+					WithArgs(cutoff).
+					WillReturnRows(pgxmock.NewRows(archivedColumns).
+						AddRow(segmentID1, "segment1", &archivedAt).
+						AddRow(segmentID2, "segment2", &archivedAt))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND starts_at IS NULL").
+					WithArgs(segmentID1, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "segment1", history.Purged, testTime, "segment1", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE ").
+					WithArgs(segmentID1).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("DELETE FROM segments").
+					WithArgs(segmentID1).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID1, "segment1", audit.SystemActor, audit.Purged, audit.Values{"archivedAt": &archivedAt}, audit.Values(nil), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
+					WithArgs(segmentID2, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE ").
+					WithArgs(segmentID2).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("DELETE FROM segments").
+					WithArgs(segmentID2).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID2, "segment2", audit.SystemActor, audit.Purged, audit.Values{"archivedAt": &archivedAt}, audit.Values(nil), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectCommit()
+			},
+		},
+		{
+			title: "Nothing to purge",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments WHERE archived_at").
+					WithArgs(cutoff).
+					WillReturnRows(pgxmock.NewRows(archivedColumns))
+				mockClient.
+					ExpectCommit()
+			},
+		},
+		{
+			title:   "Couldn't delete segment and got an error",
+			isError: true,
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments WHERE archived_at").
+					WithArgs(cutoff).
+					WillReturnRows(pgxmock.NewRows(archivedColumns).AddRow(segmentID1, "segment1", &archivedAt))
+				mockClient.
+					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
+					WithArgs(segmentID1, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE ").
+					WithArgs(segmentID1).
+					WillReturnResult(pgxmock.NewResult("DELETE", 0))
+				mockClient.
+					ExpectExec("DELETE FROM segments").
+					WithArgs(segmentID1).
+					WillReturnError(errors.New("cannot delete segment"))
+				mockClient.
+					ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.PurgeArchived(ctx, grace)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpdateSegment(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentName := "segment1"
+	segmentID := int64(1)
+	salt := "salt"
+	userID1, userID2 := int64(1), int64(2)
+	lockColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}
+	metadataRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"description", "owner", "tags", "attributes"}).
+			AddRow("", "", []string{}, map[string]interface{}{})
+	}
+
+	tests := []struct {
+		title    string
+		update   segment.Update
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title:  "Should raise percentage and add users by bucket",
+			update: segment.Update{AutomaticPercentage: intPtr(50)},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(50, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("INSERT INTO user_segments (.+) SELECT (.+) WHERE segment_bucket(.+) AND segment_bucket(.+) AND NOT EXISTS (.+) RETURNING user_id").
+					WithArgs(segmentID, maxFutureTime, segmentID, nil, salt, 50, salt, 70, segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1).AddRow(userID2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(
+						userID1, segmentName, history.Added, testTime, segmentName, userID1,
+						userID2, segmentName, history.Added, testTime, segmentName, userID2,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"hitPercentage": 30}, audit.Values{"hitPercentage": 50}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should raise percentage and add users only up to the capacity",
+			update: segment.Update{AutomaticPercentage: intPtr(50)},
+			mockCall: func() {
+				capacity := 10
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", &capacity, ""))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(50, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("SELECT segment_id FROM segments WHERE segment_id IN (.+) FOR NO KEY UPDATE").
+					WithArgs(segmentID).
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				mockClient.
+					ExpectQuery("SELECT segment_id, COUNT\\(\\*\\) FROM user_segments").
+					WithArgs(segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id", "count"}).AddRow(segmentID, int64(9)))
+				mockClient.
+					ExpectQuery("INSERT INTO user_segments (.+) SELECT (.+) AND NOT EXISTS (.+) ORDER BY user_id LIMIT 1 RETURNING user_id").
+					WithArgs(segmentID, maxFutureTime, segmentID, nil, salt, 50, salt, 70, segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID1, segmentName, history.Added, testTime, segmentName, userID1).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"hitPercentage": 30}, audit.Values{"hitPercentage": 50}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should raise percentage and skip users of the same layer",
+			update: segment.Update{AutomaticPercentage: intPtr(50)},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "checkout", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(50, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("INSERT INTO user_segments (.+) SELECT (.+) AND NOT EXISTS (.+) AND NOT EXISTS \\(SELECT 1 FROM user_segments ul (.+)\\) RETURNING user_id").
+					WithArgs(segmentID, maxFutureTime, segmentID, "checkout", salt, 50, salt, 70, segmentID, "checkout").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID1, segmentName, history.Added, testTime, segmentName, userID1).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"hitPercentage": 30}, audit.Values{"hitPercentage": 50}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should lower percentage and delete users by bucket",
+			update: segment.Update{AutomaticPercentage: intPtr(90)},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(90, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("DELETE FROM user_segments WHERE segment_id = \\$1 AND automatic = \\$2 AND segment_bucket(.+) AND segment_bucket(.+) RETURNING user_id").
+					WithArgs(segmentID, true, salt, 70, salt, 90).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID2, segmentName, history.Deleted, testTime, segmentName, userID2).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"hitPercentage": 30}, audit.Values{"hitPercentage": 10}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should only update percentage when no bucket is affected",
+			update: segment.Update{AutomaticPercentage: intPtr(70)},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(70, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"hitPercentage": 30}, audit.Values{"hitPercentage": 30}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Should update metadata and keep members",
+			update: segment.Update{
+				Description: strPtr("checkout experiment"),
+				Owner:       strPtr("growth"),
+				Tags:        []string{"checkout"},
+			},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT description, owner, tags, attributes FROM segments WHERE segment_id = (.+)").
+					WithArgs(segmentID).
+					WillReturnRows(metadataRows())
+				mockClient.
+					ExpectExec("UPDATE segments SET description = (.+), owner = (.+), tags = (.+) WHERE segment_id = (.+)").
+					WithArgs("checkout experiment", "growth", []string{"checkout"}, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"description": "", "owner": "", "tags": []string{}}, audit.Values{"description": "checkout experiment", "owner": "growth", "tags": []string{"checkout"}}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Should update metadata and percentage in one transaction",
+			update: segment.Update{
+				AutomaticPercentage: intPtr(90),
+				Owner:               strPtr("growth"),
+			},
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT description, owner, tags, attributes FROM segments WHERE segment_id = (.+)").
+					WithArgs(segmentID).
+					WillReturnRows(metadataRows())
+				mockClient.
+					ExpectExec("UPDATE segments SET owner = (.+) WHERE segment_id = (.+)").
+					WithArgs("growth", segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(90, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("DELETE FROM user_segments WHERE segment_id = \\$1 AND automatic = \\$2 AND segment_bucket(.+) AND segment_bucket(.+) RETURNING user_id").
+					WithArgs(segmentID, true, salt, 70, salt, 90).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Updated, audit.Values{"owner": "", "hitPercentage": 30}, audit.Values{"owner": "growth", "hitPercentage": 10}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:   "Rule based segment can't have hit percentage",
+			update:  segment.Update{AutomaticPercentage: intPtr(50)},
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 70, salt, "", nil, `email ends_with "@avito.ru"`))
+				mockClient.ExpectRollback()
+			},
+		},
+		{
+			title:   "Segment not found",
+			update:  segment.Update{AutomaticPercentage: intPtr(50)},
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns))
+				mockClient.ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.UpdateSegment(ctx, segmentName, test.update)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSetRamp(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentName := "segment1"
+	segmentID := int64(1)
+	lockColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}
+	steps := []segment.RampStep{
+		segment.NewRampStep(99, 0),
+		segment.NewRampStep(95, 24*time.Hour),
+	}
+	previousDueAt := testTime.Add(-time.Hour)
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should replace ramp steps",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 100, "salt", "", nil, ""))
+				mockClient.
+					ExpectExec("INSERT INTO segment_ramps (.+) ON CONFLICT \\(segment_id\\) DO UPDATE").
+					WithArgs(segmentID, testTime, nil).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectQuery("DELETE FROM segment_ramp_steps WHERE segment_id = (.+) RETURNING automatic_percentage, due_at").
+					WithArgs(segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"automatic_percentage", "due_at"}).AddRow(90, previousDueAt))
+				mockClient.
+					ExpectExec("INSERT INTO segment_ramp_steps").
+					WithArgs(segmentID, 99, testTime, segmentID, 95, testTime.Add(24*time.Hour)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID,
+						segmentName,
+						audit.SystemActor,
+						audit.RampSet,
+						audit.Values{"steps": []audit.Values{{"hitPercentage": 10, "dueAt": previousDueAt}}},
+						audit.Values{"steps": []audit.Values{
+							{"hitPercentage": 1, "dueAt": testTime},
+							{"hitPercentage": 5, "dueAt": testTime.Add(24 * time.Hour)},
+						}},
+						testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:   "Rule based segment can't have a ramp",
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 100, "salt", "", nil, `email ends_with "@avito.ru"`))
+				mockClient.ExpectRollback()
+			},
+		},
+		{
+			title:   "Segment not found",
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns))
+				mockClient.ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.SetRamp(ctx, segmentName, steps)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestPauseRamp(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentName := "segment1"
+	segmentID := int64(1)
+	pausedAt := testTime.Add(-2 * time.Hour)
+	lockColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}
+
+	tests := []struct {
+		title    string
+		paused   bool
+		err      error
+		mockCall func()
+	}{
+		{
+			title:  "Should pause running ramp",
+			paused: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, "salt", "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT paused_at FROM segment_ramps WHERE segment_id = (.+) FOR UPDATE").
+					WithArgs(segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"paused_at"}).AddRow(nil))
+				mockClient.
+					ExpectExec("UPDATE segment_ramps SET paused_at = (.+) WHERE segment_id = (.+)").
+					WithArgs(testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.RampPaused, audit.Values{"paused": false}, audit.Values{"paused": true}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should resume paused ramp and postpone pending steps",
+			paused: false,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, "salt", "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT paused_at FROM segment_ramps WHERE segment_id = (.+) FOR UPDATE").
+					WithArgs(segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"paused_at"}).AddRow(&pausedAt))
+				mockClient.
+					ExpectExec("UPDATE segment_ramp_steps SET due_at = due_at \\+ (.+) WHERE applied_at IS NULL AND segment_id = (.+)").
+					WithArgs((2 * time.Hour).Microseconds(), segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				mockClient.
+					ExpectExec("UPDATE segment_ramps SET paused_at = (.+) WHERE segment_id = (.+)").
+					WithArgs(nil, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.RampResumed, audit.Values{"paused": true}, audit.Values{"paused": false}, testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Should keep paused ramp as it is",
+			paused: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, "salt", "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT paused_at FROM segment_ramps WHERE segment_id = (.+) FOR UPDATE").
+					WithArgs(segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"paused_at"}).AddRow(&pausedAt))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:  "Ramp not found",
+			paused: true,
+			err:    segment.ErrRampNotFound,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, "salt", "", nil, ""))
+				mockClient.
+					ExpectQuery("SELECT paused_at FROM segment_ramps WHERE segment_id = (.+) FOR UPDATE").
+					WithArgs(segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"paused_at"}))
+				mockClient.ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.PauseRamp(ctx, segmentName, test.paused)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestApplyRampSteps(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentName := "segment1"
+	segmentID := int64(1)
+	salt := "salt"
+	userID := int64(1)
+	dueAt := testTime.Add(-time.Minute)
+	stepColumns := []string{"segment_id", "segment_name", "automatic_percentage", "due_at"}
+	lockColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		applied  int
+		mockCall func()
+	}{
+		{
+			title:   "Should apply due step and record audit event",
+			applied: 1,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_ramp_steps st JOIN segment_ramps r (.+) JOIN segments s (.+) WHERE (.+) AND st.due_at <= (.+) ORDER BY st.segment_id, st.due_at").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(stepColumns).AddRow(segmentID, segmentName, 95, dueAt))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segment_ramp_steps SET applied_at = (.+) WHERE (.+) AND EXISTS \\(SELECT 1 FROM segment_ramps r (.+)\\)").
+					WithArgs(testTime, dueAt, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("UPDATE segments SET automatic_percentage").
+					WithArgs(95, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectQuery("INSERT INTO user_segments (.+) SELECT (.+) RETURNING user_id").
+					WithArgs(segmentID, maxFutureTime, segmentID, nil, salt, 95, salt, 99, segmentID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, segmentName, history.Added, testTime, segmentName, userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID,
+						segmentName,
+						audit.SystemActor,
+						audit.RampStep,
+						audit.Values{"hitPercentage": 1},
+						audit.Values{"hitPercentage": 5},
+						testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Should drop step of rule based segment",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_ramp_steps st").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(stepColumns).AddRow(segmentID, segmentName, 95, dueAt))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, salt, "", nil, `email ends_with "@avito.ru"`))
+				mockClient.
+					ExpectExec("UPDATE segment_ramp_steps SET applied_at").
+					WithArgs(testTime, dueAt, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Should skip step claimed by paused ramp",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_ramp_steps st").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(stepColumns).AddRow(segmentID, segmentName, 95, dueAt))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segment_ramp_steps SET applied_at").
+					WithArgs(testTime, dueAt, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Should skip step of archived segment",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_ramp_steps st").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(stepColumns).AddRow(segmentID, segmentName, 95, dueAt))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title:   "Audit insert error",
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT (.+) FROM segment_ramp_steps st").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(stepColumns).AddRow(segmentID, segmentName, 99, dueAt))
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), salt, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows(lockColumns).AddRow(segmentID, segmentName, 99, salt, "", nil, ""))
+				mockClient.
+					ExpectExec("UPDATE segment_ramp_steps SET applied_at").
+					WithArgs(testTime, dueAt, segmentID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID,
+						segmentName,
+						audit.SystemActor,
+						audit.RampStep,
+						audit.Values{"hitPercentage": 1},
+						audit.Values{"hitPercentage": 1},
+						testTime,
+					).
+					WillReturnError(errors.New("audit error"))
+				mockClient.ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			applied, err := repo.ApplyRampSteps(ctx)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.applied, applied)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAssignNewUsers(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+	bucketing := &mockBucketing{bucket: 50}
+	userID := int64(1)
+	segmentID1, segmentID2 := int64(1), int64(2)
+	newUser := user.User{
+		ID:        userID,
+		FirstName: "Arnold",
+		LastName:  "Jones",
+		Email:     "t2000@mail.ru",
+	}
+	ruleColumns := []string{"segment_id", "segment_name", "layer", "rule", "capacity"}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should automatically add the new user to 2 segments",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "", nil).
+					AddRow(segmentID2, "segment2", 40, "salt2", "", nil).
+					AddRow(int64(3), "segment3", 90, "salt3", "", nil)
+				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, segmentID1, userID, nil, userID, segmentID2, maxFutureTime, segmentID2, userID, nil}
+				historyRows := []interface{}{
+					userID, "segment1", history.Added, testTime, "segment1", userID,
+					userID, "segment2", history.Added, testTime, "segment2", userID,
+				}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+			},
+			isError: false,
+		},
+		{
+			title: "Should skip automatic segments that reached their capacity",
+			mockCall: func() {
+				full, limited := 3, 5
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "", &full).
+					AddRow(segmentID2, "segment2", 40, "salt2", "", &limited)
+				membersRows := pgxmock.NewRows([]string{"segment_id", "count"}).
+					AddRow(segmentID1, int64(3)).
+					AddRow(segmentID2, int64(4))
+				insertRecors := []interface{}{userID, segmentID2, maxFutureTime, segmentID2, userID, nil}
+				historyRows := []interface{}{userID, "segment2", history.Added, testTime, "segment2", userID}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.
+					ExpectExec("SELECT segment_id FROM segments WHERE segment_id IN (.+) ORDER BY segment_id FOR NO KEY UPDATE").
+					WithArgs(segmentID1, segmentID2).
+					WillReturnResult(pgxmock.NewResult("SELECT", 2))
+				mockClient.
+					ExpectQuery("SELECT segment_id, COUNT\\(\\*\\) FROM user_segments WHERE segment_id IN (.+) AND expired_at > (.+) GROUP BY segment_id").
+					WithArgs(segmentID1, segmentID2, testTime).
+					WillReturnRows(membersRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+			isError: false,
+		},
+		{
+			title: "Should add the new user only to the first hit segment of the layer",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "checkout", nil).
+					AddRow(segmentID2, "segment2", 40, "salt2", "checkout", nil)
+				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, segmentID1, userID, "checkout"}
+				historyRows := []interface{}{userID, "segment1", history.Added, testTime, "segment1", userID}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+			isError: false,
+		},
+		{
+			title: "Should add the new user to matching rule segments unless the layer is taken",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "checkout", nil)
+				ruleRows := pgxmock.NewRows(ruleColumns).
+					AddRow(segmentID2, "mail_users", "", `email ends_with "@mail.ru"`, nil).
+					AddRow(int64(3), "checkout_mail", "checkout", `email ends_with "@mail.ru"`, nil).
+					AddRow(int64(4), "avito_users", "", `email ends_with "@avito.ru"`, nil)
+				insertRecors := []interface{}{
+					userID, segmentID1, maxFutureTime, segmentID1, userID, "checkout",
+					userID, segmentID2, maxFutureTime, segmentID2, userID, nil,
+				}
+				historyRows := []interface{}{
+					userID, "segment1", history.Added, testTime, "segment1", userID,
+					userID, "mail_users", history.Added, testTime, "mail_users", userID,
+				}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(ruleRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+			},
+			isError: false,
+		},
+		{
+			title: "Error while searching segments to add to the user",
+			mockCall: func() {
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnError(errors.New("cannot find"))
+			},
+			isError: true,
+		},
+		{
+			title: "Couldn't insert the user segments",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "", nil).
+					AddRow(segmentID2, "segment2", 40, "salt2", "", nil).
+					AddRow(int64(3), "segment3", 90, "salt3", "", nil)
+				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, segmentID1, userID, nil, userID, segmentID2, maxFutureTime, segmentID2, userID, nil}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnError(errors.New("cannot insert"))
+			},
+			isError: true,
+		},
+		{
+			title: "Couldn't insert the segments in history table",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}).
+					AddRow(segmentID1, "segment1", 10, "salt1", "", nil).
+					AddRow(segmentID2, "segment2", 40, "salt2", "", nil).
+					AddRow(int64(3), "segment3", 90, "salt3", "", nil)
+				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, segmentID1, userID, nil, userID, segmentID2, maxFutureTime, segmentID2, userID, nil}
+				historyRows := []interface{}{
+					userID, "segment1", history.Added, testTime, "segment1", userID,
+					userID, "segment2", history.Added, testTime, "segment2", userID,
+				}
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(insertRecors...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnError(errors.New("cannot insert event row"))
+			},
+			isError: true,
+		},
+		{
+			title: "Should leave the new user without segments",
+			mockCall: func() {
+				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"})
+				mockClient.
+					ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+					WithArgs(maxPercentage, testTime).
+					WillReturnRows(segmentsRows)
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+			},
+			isError: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			tx, err := mockClient.Begin(ctx)
+			assert.NoError(t, err)
+			err = repo.AssignNewUsers(ctx, tx, []user.User{newUser}, bucketing)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpsertExpiration(t *testing.T) {
+	now := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	later := now.Add(48 * time.Hour)
+	earlier := now.Add(-48 * time.Hour)
+	added := segment.Segment{Name: "segment1", ExpiredAt: now.Add(24 * time.Hour), TTL: 24 * time.Hour}
+
+	tests := []struct {
+		title    string
+		policy   membership.UpsertPolicy
+		current  time.Time
+		added    segment.Segment
+		expected time.Time
+	}{
+		{title: "Replace sets the new expiration", policy: membership.UpsertReplace, current: later, added: added, expected: added.ExpiredAt},
+		{title: "Extend adds the ttl to the current expiration", policy: membership.UpsertExtend, current: later, added: added, expected: later.Add(24 * time.Hour)},
+		{title: "Extend of a passed expiration starts from now", policy: membership.UpsertExtend, current: earlier, added: added, expected: now.Add(24 * time.Hour)},
+		{title: "Extend keeps the segment that never expires", policy: membership.UpsertExtend, current: maxFutureTime, added: added, expected: maxFutureTime},
+		{title: "Max keeps the later current expiration", policy: membership.UpsertMax, current: later, added: added, expected: later},
+		{title: "Max takes the later new expiration", policy: membership.UpsertMax, current: earlier, added: added, expected: added.ExpiredAt},
+		{title: "Segment without ttl never expires", policy: membership.UpsertReplace, current: later, added: segment.Segment{Name: "segment1"}, expected: maxFutureTime},
+		{title: "Extend keeps the later absolute expiration", policy: membership.UpsertExtend, current: later, added: segment.Segment{Name: "segment1", ExpiredAt: now.Add(time.Hour)}, expected: later},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			assert.Equal(t, test.expected, upsertExpiration(test.policy, test.current, test.added, now))
+		})
+	}
+}
+
+func TestReconcileUser(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID := int64(1)
+	segmentID := int64(10)
+	updated := user.User{
+		ID:         userID,
+		FirstName:  "Arnold",
+		LastName:   "Connor",
+		Email:      "t1000@mail.ru",
+		Attributes: map[string]interface{}{"city": "Kazan"},
+	}
+	ruleColumns := []string{"segment_id", "segment_name", "layer", "rule", "capacity"}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should add the user to the segments its new fields match",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE rule IS NOT NULL (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns).AddRow(segmentID, "kazan", "", `attributes.city == "Kazan"`, nil))
+				mockClient.
+					ExpectQuery("SELECT user_id, segment_id, (.+), automatic FROM user_segments WHERE user_id = ANY").
+					WithArgs([]int64{userID}, segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_id", "layer", "automatic"}))
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(userID, segmentID, maxFutureTime, segmentID, userID, nil).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "kazan", history.Added, testTime, "kazan", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+		},
+		{
+			title: "Should leave the memberships alone without rule based segments",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+			},
+		},
+		{
+			title: "Should remove the user from the segments its new fields no longer match",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns).AddRow(segmentID, "avito", "", `email ends_with "@avito.ru"`, nil))
+				mockClient.
+					ExpectQuery("SELECT user_id, segment_id, (.+), automatic FROM user_segments WHERE user_id = ANY").
+					WithArgs([]int64{userID}, segmentID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_id", "layer", "automatic"}).AddRow(userID, segmentID, "", true))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE automatic = \\$1 AND \\(user_id, segment_id\\) IN \\(SELECT \\* FROM unnest").
+					WithArgs(true, []int64{userID}, []int64{segmentID}).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(userID, "avito", history.Deleted, testTime, "avito", userID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+		},
+		{
+			title:   "Couldn't get the rule based segments",
+			isError: true,
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnError(errors.New("internal database error"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			tx, err := mockClient.Begin(ctx)
+			assert.NoError(t, err)
+			err = repo.ReconcileUser(ctx, tx, updated)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAssignNewUsersBatch(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Error(err)
+	}
+	defer mockClient.Close()
+
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+	bucketing := &mockBucketing{bucket: 50}
+	userID1, userID2 := int64(10), int64(11)
+	segmentID1, segmentID2 := int64(1), int64(2)
+	users := []user.User{
+		{ID: userID1, FirstName: "Arnold", LastName: "Jones", Email: "t800@mail.ru"},
+		{ID: userID2, FirstName: "John", LastName: "Connor", Email: "john@mail.ru", Attributes: map[string]interface{}{"city": "LA"}},
+	}
+	ruleColumns := []string{"segment_id", "segment_name", "layer", "rule", "capacity"}
+	segmentColumns := []string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity"}
+
+	capacity := 1
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectQuery("SELECT segment_id, segment_name, automatic_percentage, salt, (.+) FROM segments WHERE ").
+		WithArgs(maxPercentage, testTime).
+		WillReturnRows(pgxmock.NewRows(segmentColumns).
+			AddRow(segmentID1, "segment1", 10, "salt1", "", &capacity))
+	mockClient.
+		ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE (.+) FOR KEY SHARE").
+		WithArgs(testTime).
+		WillReturnRows(pgxmock.NewRows(ruleColumns).
+			AddRow(segmentID2, "segment2", "", `attributes.city == "LA"`, nil))
+	mockClient.
+		ExpectExec("SELECT segment_id FROM segments WHERE segment_id IN (.+) FOR NO KEY UPDATE").
+		WithArgs(segmentID1).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mockClient.
+		ExpectQuery("SELECT segment_id, COUNT\\(\\*\\) FROM user_segments").
+		WithArgs(segmentID1, testTime).
+		WillReturnRows(pgxmock.NewRows([]string{"segment_id", "count"}))
+	mockClient.
+		ExpectExec("INSERT INTO user_segments").
+		WithArgs(
+			userID1, segmentID1, maxFutureTime, segmentID1, userID1, nil,
+			userID2, segmentID2, maxFutureTime, segmentID2, userID2, nil,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mockClient.
+		ExpectExec("INSERT INTO segment_history").
+		WithArgs(
+			userID1, "segment1", history.Added, testTime, "segment1", userID1,
+			userID2, "segment2", history.Added, testTime, "segment2", userID2,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+
+	tx, err := mockClient.Begin(ctx)
+	assert.NoError(t, err)
+	err = repo.AssignNewUsers(ctx, tx, users, bucketing)
+	assert.NoError(t, err)
+	if err := mockClient.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInsertAssignments(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	repo := New(mockClient, NewTestClock(time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)))
+
+	segments := make([]segment.SegmentInfo, insertChunkSize+1)
+	firstChunk := make([]interface{}, 0, insertChunkSize*6)
+	for i := range segments {
+		segments[i] = segment.SegmentInfo{ID: int64(i + 1)}
+		if i < insertChunkSize {
+			firstChunk = append(firstChunk, int64(1), int64(i+1), maxFutureTime, int64(i+1), int64(1), nil)
+		}
+	}
+
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectExec("INSERT INTO user_segments").
+		WithArgs(firstChunk...).
+		WillReturnResult(pgxmock.NewResult("INSERT", int64(insertChunkSize)))
+	mockClient.
+		ExpectExec("INSERT INTO user_segments").
+		WithArgs(int64(1), int64(insertChunkSize+1), maxFutureTime, int64(insertChunkSize+1), int64(1), nil).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	tx, err := mockClient.Begin(ctx)
+	assert.NoError(t, err)
+	err = repo.insertAssignments(ctx, tx, []assignment{{userID: 1, segments: segments}})
+	assert.NoError(t, err)
+	if err := mockClient.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReconcileRules(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	segmentID := int64(10)
+	ruleColumns := []string{"segment_id", "segment_name", "layer", "rule", "capacity"}
+	ruleRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows(ruleColumns).AddRow(segmentID, "mail_users", "", `email ends_with "@mail.ru"`, nil)
+	}
+	userColumns := []string{"user_id", "first_name", "last_name", "email", "attributes"}
+	usersRows := pgxmock.NewRows(userColumns).
+		AddRow(int64(1), "Arnold", "Jones", "t2000@mail.ru", map[string]interface{}{}).
+		AddRow(int64(2), "Ivan", "Petrov", "ivan@avito.ru", map[string]interface{}{}).
+		AddRow(int64(3), "Petr", "Ivanov", "petr@mail.ru", map[string]interface{}{"city": "Moscow"}).
+		AddRow(int64(4), "Olga", "Sidorova", "olga@avito.ru", map[string]interface{}{})
+	statesRows := pgxmock.NewRows([]string{"user_id", "segment_id", "layer", "automatic"}).
+		AddRow(int64(2), segmentID, "", true).
+		AddRow(int64(3), segmentID, "", true).
+		AddRow(int64(4), segmentID, "", false)
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should add matching users and remove automatic members that no longer match",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments WHERE rule IS NOT NULL (.+) FOR KEY SHARE").
+					WithArgs(testTime).
+					WillReturnRows(ruleRows())
+				mockClient.
+					ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users WHERE user_id > \\$1 ORDER BY user_id LIMIT 500").
+					WithArgs(int64(0)).
+					WillReturnRows(usersRows)
+				mockClient.
+					ExpectQuery("SELECT user_id, segment_id, (.+), automatic FROM user_segments WHERE user_id = ANY\\(\\$1\\) (.+) AND expired_at > \\$3").
+					WithArgs([]int64{1, 2, 3, 4}, segmentID, testTime).
+					WillReturnRows(statesRows)
+				mockClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(int64(1), segmentID, maxFutureTime, segmentID, int64(1), nil).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE automatic = \\$1 AND \\(user_id, segment_id\\) IN \\(SELECT \\* FROM unnest").
+					WithArgs(true, []int64{2}, []int64{segmentID}).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(int64(1), "mail_users", history.Added, testTime, "mail_users", int64(1)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(int64(2), "mail_users", history.Deleted, testTime, "mail_users", int64(2)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockClient.ExpectCommit()
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(ruleRows())
+				mockClient.
+					ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
+					WithArgs(int64(4)).
+					WillReturnRows(pgxmock.NewRows(userColumns))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "No rule based segments",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Stored rule couldn't be parsed",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(ruleColumns).AddRow(segmentID, "broken", "", `email ==`, nil))
+				mockClient.ExpectRollback()
+			},
+			isError: true,
+		},
+		{
+			title: "Couldn't get users",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT segment_id, segment_name, (.+), rule, capacity FROM segments").
+					WithArgs(testTime).
+					WillReturnRows(ruleRows())
+				mockClient.
+					ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
+					WithArgs(int64(0)).
+					WillReturnError(errors.New("internal database error"))
+				mockClient.ExpectRollback()
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.ReconcileRules(ctx)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestEraseMemberships(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	userID := int64(1)
+	anonymousID := "4f1c2a9b7e3d4c5a8b6e9f0a1b2c3d4e"
+	expiredAt := testTime.Add(-time.Hour)
+	openRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"user_id", "segment_name", "closed_at"}).
+			AddRow(userID, "segment1", testTime).
+			AddRow(userID, "segment2", expiredAt)
+	}
+	historyRows := []interface{}{
+		userID, "segment1", history.Deleted, testTime, "segment1", userID,
+		userID, "segment2", history.Deleted, expiredAt, "segment2", userID,
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should close memberships and anonymize history",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name, LEAST\\(us.expired_at, COALESCE\\(s.active_until, us.expired_at\\), \\$1::TIMESTAMPTZ\\) FROM user_segments us JOIN segments s (.+) WHERE us.user_id = \\$2 AND s.archived_at IS NULL").
+					WithArgs(testTime, userID).
+					WillReturnRows(openRows())
+				mockClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments WHERE user_id = \\$1").
+					WithArgs(userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 3))
+				mockClient.
+					ExpectExec("UPDATE segment_history SET user_id = \\$1, anonymous_id = \\$2 WHERE user_id = \\$3").
+					WithArgs(nil, anonymousID, userID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 5))
+			},
+		},
+		{
+			title: "User without memberships",
+			mockCall: func() {
+				mockClient.ExpectBegin()
+				mockClient.
+					ExpectQuery("SELECT us.user_id, s.segment_name").
+					WithArgs(testTime, userID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "closed_at"}))
+				mockClient.
+					ExpectExec("DELETE FROM user_segments").
+					WithArgs(userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 0))
+				mockClient.
+					ExpectExec("UPDATE segment_history").
+					WithArgs(nil, anonymousID, userID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 0))
 			},
-			isError: true,
 		},
 		{
-			title: "Should successfully delete just segment",
+			title: "Couldn't anonymize history",
 			mockCall: func() {
-				deleteNames := []interface{}{"segment1"}
-				segmentIDs := []interface{}{deleteID1}
-				deleteRows := pgxmock.
-					NewRows([]string{"segment_id"}).
-					AddRow(deleteID1)
-				userRows := pgxmock.
-					NewRows([]string{"user_id"})
-				mockClient.
-					ExpectBegin()
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT segment_id FROM segments WHERE ").
-					WithArgs(deleteNames...).
-					WillReturnRows(deleteRows)
+					ExpectQuery("SELECT us.user_id, s.segment_name").
+					WithArgs(testTime, userID).
+					WillReturnRows(openRows())
 				mockClient.
-					ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id ").
-					WithArgs(segmentIDs...).
-					WillReturnRows(userRows)
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectExec("DELETE FROM segments").
-					WithArgs(segmentIDs...).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+					ExpectExec("DELETE FROM user_segments").
+					WithArgs(userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 2))
 				mockClient.
-					ExpectCommit()
+					ExpectExec("UPDATE segment_history").
+					WithArgs(nil, anonymousID, userID).
+					WillReturnError(errors.New("error while updating"))
 			},
-			args: args{
-				name: "segment1",
-			},
-			isError: false,
+			isError: true,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			err := repo.DeleteSegment(
-				ctx,
-				test.args.name,
-			)
+			tx, err := mockClient.Begin(ctx)
+			assert.NoError(t, err)
+			err = repo.EraseMemberships(ctx, tx, userID, anonymousID)
 			if test.isError {
 				assert.Error(t, err)
 			} else {
@@ -707,204 +3006,286 @@ func TestDeleteSegment(t *testing.T) {
 			if err := mockClient.ExpectationsWereMet(); err != nil {
 				t.Errorf("there were unfulfilled expectations: %s", err)
 			}
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	now := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		title    string
+		segment  segment.Segment
+		expected segment.Segment
+		isError  bool
+	}{
+		{
+			title:    "Ttl is counted from now",
+			segment:  segment.Segment{Name: "segment1", TTL: time.Hour},
+			expected: segment.Segment{Name: "segment1", TTL: time.Hour, ExpiredAt: now.Add(time.Hour)},
+		},
+		{
+			title:    "Ttl is counted from the start",
+			segment:  segment.Segment{Name: "segment1", TTL: time.Hour, StartsAt: now.Add(time.Hour)},
+			expected: segment.Segment{Name: "segment1", TTL: time.Hour, StartsAt: now.Add(time.Hour), ExpiredAt: now.Add(2 * time.Hour)},
+		},
+		{
+			title:    "Passed start activates the segment at once",
+			segment:  segment.Segment{Name: "segment1", StartsAt: now.Add(-time.Hour), ExpiredAt: now.Add(time.Hour)},
+			expected: segment.Segment{Name: "segment1", ExpiredAt: now.Add(time.Hour)},
+		},
+		{
+			title:    "Segment without expiration stays without it",
+			segment:  segment.Segment{Name: "segment1", StartsAt: now.Add(time.Hour)},
+			expected: segment.Segment{Name: "segment1", StartsAt: now.Add(time.Hour)},
+		},
+		{
+			title:   "Passed expiration",
+			segment: segment.Segment{Name: "segment1", ExpiredAt: now.Add(-time.Hour)},
+			isError: true,
+		},
+		{
+			title:   "Expiration before the start",
+			segment: segment.Segment{Name: "segment1", StartsAt: now.Add(2 * time.Hour), ExpiredAt: now.Add(time.Hour)},
+			isError: true,
+		},
+	}
 
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			segments := []segment.Segment{test.segment}
+			err := schedule(segments, now)
+			if test.isError {
+				assert.ErrorIs(t, err, membership.ErrInvalidSchedule)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, segments[0])
+			}
 		})
 	}
 }
 
-func TestCreateUser(t *testing.T) {
+func TestActivateScheduled(t *testing.T) {
 	ctx := context.Background()
 	mockClient, err := pgxmock.NewPool()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer mockClient.Close()
-
 	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
 	clock := NewTestClock(testTime)
 	repo := New(mockClient, clock)
-	hitPercentage := 10
-	userID := int64(1)
-	segmentID1, segmentID2 := int64(1), int64(2)
-	newUser := user.User{
-		FirstName: "Arnold",
-		LastName:  "Jones",
-		Email:     "t2000@mail.ru",
+
+	segmentID := int64(10)
+	layeredID := int64(11)
+	limitedID := int64(12)
+	capacity := 1
+	startsAt := testTime.Add(-time.Minute)
+	startedColumns := []string{"user_id", "segment_id", "segment_name", "layer", "capacity", "starts_at"}
+	startedRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows(startedColumns).
+			AddRow(int64(1), segmentID, "campaign", "", nil, startsAt).
+			AddRow(int64(2), segmentID, "campaign", "", nil, startsAt)
+	}
+	historyRows := []interface{}{
+		int64(1), "campaign", history.Added, startsAt, "campaign", int64(1),
+		int64(2), "campaign", history.Added, startsAt, "campaign", int64(2),
 	}
 
 	tests := []struct {
 		title    string
 		isError  bool
-		expected int64
 		mockCall func()
 	}{
 		{
-			title: "Should successfully create user and automatically add it to 2 segments",
+			title: "Should activate started memberships and register history",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(userID)
-				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(segmentID1, "segment1").
-					AddRow(segmentID2, "segment2")
-				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, userID, segmentID2, maxFutureTime}
-				historyRows := []interface{}{
-					userID, "segment1", history.Added, testTime,
-					userID, "segment2", history.Added, testTime,
-				}
-				mockClient.
-					ExpectBegin()
-				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnRows(rows)
-				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE ").
-					WithArgs(hitPercentage).
-					WillReturnRows(segmentsRows)
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT us.user_id, us.segment_id, s.segment_name, COALESCE\\(s.layer, ''\\), s.capacity, us.starts_at FROM user_segments us JOIN segments s (.+) WHERE us.starts_at <= (.+) AND s.archived_at IS NULL ORDER BY us.starts_at, us.user_id, us.segment_id FOR UPDATE OF us").
+					WithArgs(testTime).
+					WillReturnRows(startedRows())
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
 					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectCommit()
+					ExpectExec("UPDATE user_segments SET starts_at = \\$1, layer = \\(SELECT s.layer FROM segments s (.+)\\) WHERE \\(user_id, segment_id\\) IN \\(SELECT \\* FROM unnest\\(\\$2::BIGINT\\[\\], \\$3::BIGINT\\[\\]\\)\\)").
+					WithArgs(nil, []int64{1, 2}, []int64{segmentID, segmentID}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				mockClient.ExpectCommit()
 			},
-			expected: userID,
-			isError:  false,
 		},
 		{
-			title: "Error while inserting user",
+			title: "Should remove the started memberships whose layer is taken or whose segment is full",
 			mockCall: func() {
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectBegin()
+					ExpectQuery("SELECT us.user_id, us.segment_id, s.segment_name, (.+) FROM user_segments").
+					WithArgs(testTime).
+					WillReturnRows(startedRows().
+						AddRow(int64(1), layeredID, "banner", "hero", nil, startsAt).
+						AddRow(int64(2), limitedID, "promo", "", &capacity, startsAt))
 				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnError(errors.New("cannot insert new user"))
+					ExpectExec("SELECT segment_id FROM segments WHERE segment_id IN (.+) FOR NO KEY UPDATE").
+					WithArgs(limitedID).
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
 				mockClient.
-					ExpectRollback()
-			},
-			expected: int64(0),
-			isError:  true,
-		},
-		{
-			title: "Error while searching segments to add to the user",
-			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(userID)
+					ExpectQuery("SELECT segment_id, COUNT\\(\\*\\) FROM user_segments (.+) AND starts_at IS NULL").
+					WithArgs(limitedID, testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_id", "count"}).AddRow(limitedID, int64(1)))
 				mockClient.
-					ExpectBegin()
+					ExpectQuery("SELECT user_id, layer FROM user_segments WHERE user_id = ANY(.+) AND layer IS NOT NULL").
+					WithArgs([]int64{1}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "layer"}).AddRow(int64(1), "hero"))
 				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnRows(rows)
+					ExpectExec("DELETE FROM user_segments WHERE \\(user_id, segment_id\\) IN").
+					WithArgs([]int64{1, 2}, []int64{layeredID, limitedID}).
+					WillReturnResult(pgxmock.NewResult("DELETE", 2))
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE ").
-					WithArgs(hitPercentage).
-					WillReturnError(errors.New("cannot find"))
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectRollback()
+					ExpectExec("UPDATE user_segments SET starts_at").
+					WithArgs(nil, []int64{1, 2}, []int64{segmentID, segmentID}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				mockClient.ExpectCommit()
 			},
-			expected: int64(0),
-			isError:  true,
 		},
 		{
-			title: "Couldn't insert user and its segments",
+			title: "No started memberships",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(userID)
-				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(segmentID1, "segment1").
-					AddRow(segmentID2, "segment2")
-				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, userID, segmentID2, maxFutureTime}
-				mockClient.
-					ExpectBegin()
-				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnRows(rows)
-				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE ").
-					WithArgs(hitPercentage).
-					WillReturnRows(segmentsRows)
-				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnError(errors.New("cannot insert"))
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectRollback()
+					ExpectQuery("SELECT us.user_id, us.segment_id, s.segment_name, (.+) FROM user_segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows(startedColumns))
+				mockClient.ExpectCommit()
 			},
-			expected: int64(0),
-			isError:  true,
 		},
 		{
-			title: "Couldn't insert user and segments in history table",
+			title: "Couldn't register the activation",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(userID)
-				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(segmentID1, "segment1").
-					AddRow(segmentID2, "segment2")
-				insertRecors := []interface{}{userID, segmentID1, maxFutureTime, userID, segmentID2, maxFutureTime}
-				historyRows := []interface{}{
-					userID, "segment1", history.Added, testTime,
-					userID, "segment2", history.Added, testTime,
-				}
-				mockClient.
-					ExpectBegin()
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnRows(rows)
+					ExpectQuery("SELECT us.user_id, us.segment_id, s.segment_name, (.+) FROM user_segments").
+					WithArgs(testTime).
+					WillReturnRows(startedRows())
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE ").
-					WithArgs(hitPercentage).
-					WillReturnRows(segmentsRows)
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnError(errors.New("error while inserting"))
+				mockClient.ExpectRollback()
+			},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			err := repo.ActivateScheduled(ctx)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if err := mockClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRetireEnded(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	clock := NewTestClock(testTime)
+	repo := New(mockClient, clock)
+
+	activeUntil := testTime.Add(-time.Hour)
+	endedRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"user_id", "segment_name", "active_until"}).
+			AddRow(int64(1), "campaign", activeUntil).
+			AddRow(int64(2), "campaign", activeUntil)
+	}
+	historyRows := []interface{}{
+		int64(1), "campaign", history.Deleted, activeUntil, "campaign", int64(1),
+		int64(2), "campaign", history.Deleted, activeUntil, "campaign", int64(2),
+	}
+
+	tests := []struct {
+		title    string
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should remove members of ended segments and register history",
+			mockCall: func() {
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectExec("INSERT INTO user_segments").
-					WithArgs(insertRecors...).
-					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+					ExpectQuery("SELECT us.user_id, s.segment_name, s.active_until FROM user_segments us JOIN segments s (.+) WHERE s.active_until <= (.+) AND s.archived_at IS NULL FOR UPDATE OF us").
+					WithArgs(testTime).
+					WillReturnRows(endedRows())
 				mockClient.
 					ExpectExec("INSERT INTO segment_history").
 					WithArgs(historyRows...).
-					WillReturnError(errors.New("cannot insert event row"))
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectRollback()
+					ExpectExec("DELETE FROM user_segments WHERE segment_id IN \\(SELECT segment_id FROM segments WHERE active_until <= (.+)\\)").
+					WithArgs(testTime).
+					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+				mockClient.ExpectCommit()
 			},
-			expected: int64(0),
-			isError:  true,
 		},
 		{
-			title: "Should successfully create user without segments",
+			title: "No ended segments",
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(userID)
-				segmentsRows := pgxmock.NewRows([]string{"segment_id", "segment_name"})
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectBegin()
+					ExpectQuery("SELECT us.user_id, s.segment_name, s.active_until FROM user_segments").
+					WithArgs(testTime).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "active_until"}))
+				mockClient.ExpectCommit()
+			},
+		},
+		{
+			title: "Couldn't delete memberships of ended segments",
+			mockCall: func() {
+				mockClient.ExpectBegin()
 				mockClient.
-					ExpectQuery("INSERT INTO users").
-					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email).
-					WillReturnRows(rows)
+					ExpectQuery("SELECT us.user_id, s.segment_name, s.active_until FROM user_segments").
+					WithArgs(testTime).
+					WillReturnRows(endedRows())
 				mockClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments WHERE ").
-					WithArgs(hitPercentage).
-					WillReturnRows(segmentsRows)
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(historyRows...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
 				mockClient.
-					ExpectCommit()
+					ExpectExec("DELETE FROM user_segments").
+					WithArgs(testTime).
+					WillReturnError(errors.New("error while deleting"))
+				mockClient.ExpectRollback()
 			},
-			expected: userID,
-			isError:  false,
+			isError: true,
 		},
 	}
+
 	for _, test := range tests {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			got, err := repo.CreateUser(ctx, newUser, hitPercentage)
+			err := repo.RetireEnded(ctx)
 			if test.isError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
 			}
-			assert.Equal(t, test.expected, got)
 			if err := mockClient.ExpectationsWereMet(); err != nil {
 				t.Errorf("there were unfulfilled expectations: %s", err)
 			}
@@ -912,6 +3293,38 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestRetireEndedUsesOneMoment(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+	testTime := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	repo := New(mockClient, &tickingClock{mockClock{currentTime: testTime}})
+
+	activeUntil := testTime.Add(-time.Hour)
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectQuery("SELECT us.user_id, s.segment_name, s.active_until FROM user_segments").
+		WithArgs(testTime).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "active_until"}).AddRow(int64(1), "campaign", activeUntil))
+	mockClient.
+		ExpectExec("INSERT INTO segment_history").
+		WithArgs(int64(1), "campaign", history.Deleted, activeUntil, "campaign", int64(1)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mockClient.
+		ExpectExec("DELETE FROM user_segments").
+		WithArgs(testTime).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mockClient.ExpectCommit()
+
+	assert.NoError(t, repo.RetireEnded(ctx))
+	if err := mockClient.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestDeleteExpired(t *testing.T) {
 	ctx := context.Background()
 	mockClient, err := pgxmock.NewPool()
@@ -944,12 +3357,12 @@ func TestDeleteExpired(t *testing.T) {
 					AddRow(membershipRecords[0].UserID, membershipRecords[0].SegmentName, membershipRecords[0].ExpiredAt).
 					AddRow(membershipRecords[1].UserID, membershipRecords[1].SegmentName, membershipRecords[1].ExpiredAt)
 				historyRows := []interface{}{
-					userID1, "segment1", history.Deleted, testTime,
-					userID2, "segment2", history.Deleted, testTime,
+					userID1, "segment1", history.Deleted, testTime, "segment1", userID1,
+					userID2, "segment2", history.Deleted, testTime, "segment2", userID2,
 				}
 				mockClient.ExpectBegin()
 				mockClient.
-					ExpectQuery("SELECT user_id, segment_name, expired_at FROM user_segments JOIN ").
+					ExpectQuery("SELECT user_id, segment_name, expired_at FROM user_segments JOIN (.+) AND archived_at IS NULL").
 					WithArgs(testTime).
 					WillReturnRows(rows)
 				mockClient.
@@ -983,8 +3396,8 @@ func TestDeleteExpired(t *testing.T) {
 					AddRow(membershipRecords[0].UserID, membershipRecords[0].SegmentName, membershipRecords[0].ExpiredAt).
 					AddRow(membershipRecords[1].UserID, membershipRecords[1].SegmentName, membershipRecords[1].ExpiredAt)
 				historyRows := []interface{}{
-					userID1, "segment1", history.Deleted, testTime,
-					userID2, "segment2", history.Deleted, testTime,
+					userID1, "segment1", history.Deleted, testTime, "segment1", userID1,
+					userID2, "segment2", history.Deleted, testTime, "segment2", userID2,
 				}
 				mockClient.ExpectBegin()
 				mockClient.
@@ -1030,3 +3443,157 @@ func TestDeleteExpired(t *testing.T) {
 		})
 	}
 }
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func strPtr(v string) *string {
+	return &v
+}
+
+func TestArchiveExpireRestore(t *testing.T) {
+	ctx := context.Background()
+	mockClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockClient.Close()
+
+	archivedAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	restoredAt := archivedAt.Add(2 * time.Hour)
+	clock := NewTestClock(archivedAt)
+	repo := New(mockClient, clock)
+
+	segmentID := int64(1)
+	staying, expiring := int64(1), int64(2)
+
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectQuery("SELECT segment_id, segment_name, (.+) FROM segments WHERE archived_at IS NULL AND segment_name = (.+) FOR UPDATE").
+		WithArgs("segment1").
+		WillReturnRows(pgxmock.NewRows([]string{"segment_id", "segment_name", "automatic_percentage", "salt", "layer", "capacity", "rule"}).
+			AddRow(segmentID, "segment1", 0, "salt", "", nil, ""))
+	mockClient.
+		ExpectQuery("SELECT COUNT\\(\\*\\) FILTER").
+		WithArgs(segmentID, archivedAt).
+		WillReturnRows(pgxmock.NewRows([]string{"manual", "automatic", "digest"}).AddRow(int64(2), int64(0), "digest"))
+	mockClient.
+		ExpectExec("UPDATE segments SET archived_at").
+		WithArgs(archivedAt, segmentID).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockClient.
+		ExpectExec("INSERT INTO segment_audit").
+		WithArgs(
+			segmentID, "segment1", audit.SystemActor, audit.Archived,
+			audit.Values{"archivedAt": nil}, audit.Values{"archivedAt": archivedAt}, archivedAt,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mockClient.
+		ExpectQuery("SELECT user_id, expired_at FROM user_segments WHERE segment_id = (.+) AND expired_at <= ").
+		WithArgs(segmentID, archivedAt).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "expired_at"}))
+	mockClient.
+		ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND expired_at > ").
+		WithArgs(segmentID, archivedAt).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(staying).AddRow(expiring))
+	mockClient.
+		ExpectExec("INSERT INTO segment_history").
+		WithArgs(
+			staying, "segment1", history.Archived, archivedAt, "segment1", staying,
+			expiring, "segment1", history.Archived, archivedAt, "segment1", expiring,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mockClient.ExpectCommit()
+
+	err = repo.ArchiveSegment(ctx, "segment1", func(membership.DeletePreview) error { return nil })
+	assert.NoError(t, err)
+
+	// the membership of the second user expires while the segment is archived,
+	// the archived event already closed it, so the cleanup records nothing
+	clock.currentTime = archivedAt.Add(time.Hour)
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectQuery("SELECT user_id, segment_name, expired_at FROM user_segments JOIN (.+) AND archived_at IS NULL").
+		WithArgs(clock.currentTime).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "expired_at"}))
+	mockClient.ExpectCommit()
+
+	err = repo.DeleteExpired(ctx)
+	assert.NoError(t, err)
+
+	clock.currentTime = restoredAt
+	mockClient.ExpectBegin()
+	mockClient.
+		ExpectQuery("SELECT segment_id, segment_name, archived_at FROM segments").
+		WithArgs("segment1").
+		WillReturnRows(pgxmock.NewRows([]string{"segment_id", "segment_name", "archived_at"}).AddRow(segmentID, "segment1", &archivedAt))
+	mockClient.
+		ExpectExec("UPDATE segments SET archived_at").
+		WithArgs(nil, segmentID).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockClient.
+		ExpectExec("INSERT INTO segment_audit").
+		WithArgs(
+			segmentID, "segment1", audit.SystemActor, audit.Restored,
+			audit.Values{"archivedAt": &archivedAt}, audit.Values{"archivedAt": nil}, restoredAt,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mockClient.
+		ExpectExec("DELETE FROM user_segments WHERE segment_id = (.+) AND expired_at <= ").
+		WithArgs(segmentID, restoredAt).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mockClient.
+		ExpectQuery("SELECT user_id FROM user_segments WHERE segment_id = (.+) AND expired_at > ").
+		WithArgs(segmentID, restoredAt).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(staying))
+	mockClient.
+		ExpectExec("INSERT INTO segment_history").
+		WithArgs(staying, "segment1", history.Restored, restoredAt, "segment1", staying).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mockClient.ExpectCommit()
+
+	err = repo.RestoreSegment(ctx, "segment1", 24*time.Hour)
+	assert.NoError(t, err)
+
+	if err := mockClient.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestConflictingLayer(t *testing.T) {
+	segments := []segment.Segment{
+		{Name: "segment1"},
+		{Name: "segment2", Layer: "checkout"},
+		{Name: "segment3", Layer: "search"},
+		{Name: "segment4", Layer: "pricing", StartsAt: time.Date(2023, 8, 26, 0, 0, 0, 0, time.UTC)},
+	}
+
+	tests := []struct {
+		title    string
+		detail   string
+		expected string
+	}{
+		{
+			title:    "Should take the layer from the violation detail",
+			detail:   "Key (user_id, layer)=(1, search) already exists.",
+			expected: "search",
+		},
+		{
+			title:    "Should fall back to the first active layer",
+			detail:   "",
+			expected: "checkout",
+		},
+		{
+			title:    "Should skip the layers of scheduled segments",
+			detail:   "Key (user_id, layer)=(1, pricing) already exists.",
+			expected: "checkout",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			assert.Equal(t, test.expected, conflictingLayer(segments, test.detail))
+		})
+	}
+}
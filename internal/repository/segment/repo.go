@@ -4,45 +4,133 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	psql "github.com/VrMolodyakov/segment-api/pkg/client/postgresql"
+	"github.com/VrMolodyakov/segment-api/pkg/clock"
 	"github.com/jackc/pgx/v5"
 )
 
 const (
-	segmentTable string = "segments"
+	segmentTable      string = "segments"
+	userTable         string = "users"
+	userSegmentsTable string = "user_segments"
+	historyTable      string = "segment_history"
+	variantTable      string = "segment_variants"
+	prerequisiteTable string = "segment_prerequisites"
+	auditTable        string = "segment_audit"
+	maxPercentage     int    = 100
+)
+
+var (
+	maxFutureTime = time.Date(9999, 1, 1, 1, 59, 59, 0, time.UTC)
+	likeEscaper   = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
 )
 
 type repo struct {
 	builder sq.StatementBuilderType
 	client  psql.Client
+	clock   clock.Clock
 }
 
-func New(client psql.Client) *repo {
+func New(client psql.Client, clock clock.Clock) *repo {
 	return &repo{
 		client:  client,
+		clock:   clock,
 		builder: sq.StatementBuilder.PlaceholderFormat(sq.Dollar),
 	}
 }
 
-func (r *repo) Create(ctx context.Context, name string, percentage int) (int64, error) {
-	sql, args, err := r.builder.
-		Insert(segmentTable).
-		Columns("segment_name", "automatic_percentage").
-		Values(name, percentage).
-		Suffix("RETURNING segment_id").
-		ToSql()
+func (r *repo) Create(ctx context.Context, s segment.SegmentInfo) (int64, error) {
+	tx, err := r.client.Begin(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("couldn't create query : %w", err)
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
 	}
-	var id int64
-	err = r.client.QueryRow(ctx, sql, args...).Scan(&id)
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	segmentID, err := r.insert(ctx, tx, s)
 	if err != nil {
-		return 0, fmt.Errorf("couldn't run query : %w", err)
+		return 0, err
 	}
-	return id, nil
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return segmentID, nil
+}
+
+func (r *repo) CreateAndAssign(ctx context.Context, s segment.SegmentInfo) (int64, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	segmentID, err := r.insert(ctx, tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	assigned, err := r.assignExistingUsers(ctx, tx, segmentID, s.AutomaticPercentage, s.Capacity)
+	if err != nil {
+		return 0, err
+	}
+
+	if assigned > 0 {
+		if err = r.registerAssignEvents(ctx, tx, segmentID, s.Name, assigned, r.clock.Now()); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return segmentID, nil
+}
+
+// insert creates the segment with its variants and prerequisites and records it in the audit.
+func (r *repo) insert(ctx context.Context, tx pgx.Tx, s segment.SegmentInfo) (int64, error) {
+	segmentID, err := r.create(ctx, tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = r.insertVariants(ctx, tx, segmentID, s.Variants); err != nil {
+		return 0, err
+	}
+
+	if err = r.insertPrerequisites(ctx, tx, segmentID, s.Prerequisites); err != nil {
+		return 0, err
+	}
+
+	if err = r.registerCreatedAudit(ctx, tx, segmentID, s, r.clock.Now()); err != nil {
+		return 0, err
+	}
+
+	return segmentID, nil
 }
 
 func (r *repo) Get(ctx context.Context, name string) (segment.SegmentInfo, error) {
@@ -69,28 +157,84 @@ func (r *repo) Get(ctx context.Context, name string) (segment.SegmentInfo, error
 	return s, nil
 }
 
-func (r *repo) GetAll(ctx context.Context) ([]segment.SegmentInfo, error) {
-	sql, args, err := r.builder.
+func (r *repo) GetAll(ctx context.Context, filter segment.Filter) ([]segment.SegmentInfo, error) {
+	query := r.builder.
 		Select(
-			"segment_id",
-			"segment_name").
-		From(segmentTable).
-		ToSql()
+			"s.segment_id",
+			"s.segment_name",
+			fmt.Sprintf("COALESCE(s.automatic_percentage, %d)", maxPercentage),
+			"COUNT(us.user_id)",
+			"s.description",
+			"s.owner",
+			"s.tags",
+			"s.attributes",
+			"s.archived_at",
+			"s.active_from",
+			"s.active_until",
+			"COALESCE(s.rule, '')",
+			"s.prerequisite_policy",
+			"ARRAY(SELECT p.segment_name FROM segment_prerequisites sp "+
+				"JOIN segments p ON p.segment_id = sp.prerequisite_id "+
+				"WHERE sp.segment_id = s.segment_id ORDER BY p.segment_name)",
+			"s.capacity").
+		From(segmentTable+" s").
+		LeftJoin(userSegmentsTable+" us ON us.segment_id = s.segment_id AND us.expired_at > ? "+
+			"AND us.starts_at IS NULL", r.clock.Now()).
+		Where(sq.Gt{"s.segment_id": filter.Cursor}).
+		GroupBy("s.segment_id").
+		OrderBy("s.segment_id")
+
+	if filter.Prefix != "" {
+		query = query.Where(sq.Like{"s.segment_name": likeEscaper.Replace(filter.Prefix) + "%"})
+	}
+	if filter.Archived {
+		query = query.Where(sq.NotEq{"s.archived_at": nil})
+	} else {
+		query = query.Where(sq.Eq{"s.archived_at": nil})
+	}
+	if filter.Tag != "" {
+		// containment, unlike ANY, can use the GIN index on tags
+		query = query.Where("s.tags @> ARRAY[?]::text[]", filter.Tag)
+	}
+	if filter.Owner != "" {
+		query = query.Where(sq.Eq{"s.owner": filter.Owner})
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	sql, args, err := query.ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create query : %w", err)
 	}
 
 	rows, err := r.client.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("couldn't run query : %w", err)
 	}
 	defer rows.Close()
 
-	var segments []segment.SegmentInfo
-
+	segments := make([]segment.SegmentInfo, 0)
 	for rows.Next() {
 		var s segment.SegmentInfo
-		if err := rows.Scan(&s.ID, &s.Name); err != nil {
+		err := rows.Scan(
+			&s.ID,
+			&s.Name,
+			&s.AutomaticPercentage,
+			&s.Members,
+			&s.Description,
+			&s.Owner,
+			&s.Tags,
+			&s.Attributes,
+			&s.ArchivedAt,
+			&s.ActiveFrom,
+			&s.ActiveUntil,
+			&s.Rule,
+			&s.PrerequisitePolicy,
+			&s.Prerequisites,
+			&s.Capacity,
+		)
+		if err != nil {
 			return nil, fmt.Errorf("couldn't scan query : %w", err)
 		}
 		segments = append(segments, s)
@@ -98,3 +242,251 @@ func (r *repo) GetAll(ctx context.Context) ([]segment.SegmentInfo, error) {
 
 	return segments, nil
 }
+
+func (r *repo) create(ctx context.Context, tx pgx.Tx, s segment.SegmentInfo) (int64, error) {
+	sql, args, err := r.builder.
+		Insert(segmentTable).
+		Columns(
+			"segment_name",
+			"automatic_percentage",
+			"layer",
+			"description",
+			"owner",
+			"tags",
+			"attributes",
+			"active_from",
+			"active_until",
+			"rule",
+			"prerequisite_policy",
+			"capacity").
+		Values(
+			s.Name,
+			s.AutomaticPercentage,
+			nullable(s.Layer),
+			s.Description,
+			s.Owner,
+			tagsOrEmpty(s.Tags),
+			attributesOrEmpty(s.Attributes),
+			s.ActiveFrom,
+			s.ActiveUntil,
+			nullable(s.Rule),
+			segment.PolicyOrDefault(s.PrerequisitePolicy),
+			s.Capacity).
+		Suffix("RETURNING segment_id").
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create query : %w", err)
+	}
+	var id int64
+	err = tx.QueryRow(ctx, sql, args...).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't run query : %w", err)
+	}
+	return id, nil
+}
+
+// assignExistingUsers adds the existing users that hit the new segment, at most capacity of them.
+// The segment isn't visible to other transactions yet, so the capacity needs no locking here.
+func (r *repo) assignExistingUsers(ctx context.Context, tx pgx.Tx, segmentID int64, percentage int, capacity *int) (int64, error) {
+	if percentage >= maxPercentage {
+		return 0, nil
+	}
+
+	hits := sq.
+		Select("u.user_id", "s.segment_id").
+		Column("?::TIMESTAMPTZ", maxFutureTime).
+		Column("segment_variant(s.segment_id, u.user_id)").
+		Column("s.layer").
+		Column("TRUE").
+		From(userTable+" u").
+		Join(segmentTable+" s ON s.segment_id = ?", segmentID).
+		Where("s.automatic_percentage < segment_bucket(s.salt, u.user_id)").
+		Where("NOT EXISTS (SELECT 1 FROM user_segments us WHERE us.user_id = u.user_id AND us.layer = s.layer)")
+	if capacity != nil {
+		hits = hits.OrderBy("u.user_id").Limit(uint64(*capacity))
+	}
+
+	sql, args, err := r.builder.
+		Insert(userSegmentsTable).
+		Columns("user_id", "segment_id", "expired_at", "variant_id", "layer", "automatic").
+		Select(hits).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't run insert query : %w", err)
+	}
+	return rows.RowsAffected(), nil
+}
+
+func (r *repo) registerAssignEvents(
+	ctx context.Context,
+	tx pgx.Tx,
+	segmentID int64,
+	name string,
+	assigned int64,
+	timestamp time.Time,
+) error {
+
+	members := sq.
+		Select("us.user_id").
+		Column("?::VARCHAR", name).
+		Column("?::operation_enum", history.Added).
+		Column("?::TIMESTAMPTZ", timestamp).
+		Column("sv.variant_name").
+		From(userSegmentsTable + " us").
+		LeftJoin(variantTable + " sv USING (variant_id)").
+		Where(sq.Eq{"us.segment_id": segmentID})
+
+	sql, args, err := r.builder.
+		Insert(historyTable).
+		Columns("user_id", "segment_name", "operation", "operation_timestamp", "variant_name").
+		Select(members).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	if rows.RowsAffected() != assigned {
+		return fmt.Errorf(
+			"couldn't insert all the necessary rows, want %d , got %d",
+			assigned,
+			rows.RowsAffected(),
+		)
+	}
+
+	return nil
+}
+
+func (r *repo) insertVariants(ctx context.Context, tx pgx.Tx, segmentID int64, variants []segment.Variant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	insertState := r.builder.Insert(variantTable).Columns("segment_id", "variant_name", "weight")
+	for i := range variants {
+		insertState = insertState.Values(segmentID, variants[i].Name, variants[i].Weight)
+	}
+
+	sql, args, err := insertState.ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+	rows, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run insert query : %w", err)
+	}
+
+	if rows.RowsAffected() != int64(len(variants)) {
+		return fmt.Errorf(
+			"couldn't insert all the necessary rows, want %d , got %d",
+			len(variants),
+			rows.RowsAffected(),
+		)
+	}
+
+	return nil
+}
+
+// insertPrerequisites links the segment with the active segments it requires.
+func (r *repo) insertPrerequisites(ctx context.Context, tx pgx.Tx, segmentID int64, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	prerequisites := sq.
+		Select().
+		Column("?::BIGINT", segmentID).
+		Column("segment_id").
+		From(segmentTable).
+		Where(sq.Eq{"segment_name": names, "archived_at": nil})
+
+	sql, args, err := r.builder.
+		Insert(prerequisiteTable).
+		Columns("segment_id", "prerequisite_id").
+		Select(prerequisites).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run insert query : %w", err)
+	}
+	if rows.RowsAffected() != int64(len(names)) {
+		return segment.ErrPrerequisiteNotFound
+	}
+
+	return nil
+}
+
+// registerCreatedAudit records the settings of the new segment made by the actor of the request.
+func (r *repo) registerCreatedAudit(ctx context.Context, tx pgx.Tx, segmentID int64, s segment.SegmentInfo, timestamp time.Time) error {
+	sql, args, err := r.builder.
+		Insert(auditTable).
+		Columns("segment_id", "segment_name", "actor", "operation", "before", "after", "operation_timestamp").
+		Values(segmentID, s.Name, audit.ActorFrom(ctx), audit.Created, nil, createdValues(s), timestamp).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func createdValues(s segment.SegmentInfo) audit.Values {
+	variants := make([]audit.Values, len(s.Variants))
+	for i := range s.Variants {
+		variants[i] = audit.Values{"name": s.Variants[i].Name, "weight": s.Variants[i].Weight}
+	}
+	return audit.Values{
+		"hitPercentage":      maxPercentage - s.AutomaticPercentage,
+		"layer":              s.Layer,
+		"description":        s.Description,
+		"owner":              s.Owner,
+		"tags":               tagsOrEmpty(s.Tags),
+		"attributes":         attributesOrEmpty(s.Attributes),
+		"activeFrom":         s.ActiveFrom,
+		"activeUntil":        s.ActiveUntil,
+		"rule":               s.Rule,
+		"prerequisites":      s.Prerequisites,
+		"prerequisitePolicy": segment.PolicyOrDefault(s.PrerequisitePolicy),
+		"capacity":           s.Capacity,
+		"variants":           variants,
+	}
+}
+
+// nullable stores an empty layer or rule as NULL so the segment stays outside of any layer or rule.
+func nullable(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// tagsOrEmpty and attributesOrEmpty keep NOT NULL metadata columns from receiving NULL.
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+func attributesOrEmpty(attributes map[string]interface{}) map[string]interface{} {
+	if attributes == nil {
+		return map[string]interface{}{}
+	}
+	return attributes
+}
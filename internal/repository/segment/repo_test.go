@@ -4,24 +4,55 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/VrMolodyakov/segment-api/internal/domain/audit"
+	"github.com/VrMolodyakov/segment-api/internal/domain/history"
 	"github.com/VrMolodyakov/segment-api/internal/domain/segment"
 	"github.com/pashagolub/pgxmock/v2"
 	"github.com/stretchr/testify/assert"
 )
 
+type mockClock struct {
+	currentTime time.Time
+}
+
+func NewTestClock(currentTime time.Time) *mockClock {
+	return &mockClock{
+		currentTime: currentTime,
+	}
+}
+
+func (tc *mockClock) Now() time.Time {
+	return tc.currentTime
+}
+
+func (tc *mockClock) Since(t time.Time) time.Duration {
+	return tc.currentTime.Sub(t)
+}
+
+func (tc *mockClock) Until(t time.Time) time.Duration {
+	return t.Sub(tc.currentTime)
+}
+
+var testTime = time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+
+var (
+	noWindow   *time.Time
+	noCapacity *int
+)
+
 func TestCreateSegment(t *testing.T) {
-	ctx := context.Background()
+	ctx := audit.WithActor(context.Background(), "admin")
 	mockPSQLClient, err := pgxmock.NewPool()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer mockPSQLClient.Close()
-	repo := New(mockPSQLClient)
+	repo := New(mockPSQLClient, NewTestClock(testTime))
 
 	type args struct {
-		segment    string
-		percentage int
+		segment segment.SegmentInfo
 	}
 
 	segmentID := int64(1)
@@ -31,6 +62,14 @@ func TestCreateSegment(t *testing.T) {
 		Name: "discount",
 	}
 
+	layer := "checkout"
+	activeFrom := testTime
+	activeUntil := testTime.Add(24 * time.Hour)
+	variants := []segment.Variant{
+		segment.NewVariant("control", 50),
+		segment.NewVariant("treatment", 50),
+	}
+
 	tests := []struct {
 		title    string
 		args     args
@@ -41,30 +80,237 @@ func TestCreateSegment(t *testing.T) {
 		{
 			title: "Should successfully insert a new segment",
 			args: args{
-				segment:    newSegment.Name,
-				percentage: percentage,
+				segment: segment.SegmentInfo{Name: newSegment.Name, AutomaticPercentage: percentage},
+			},
+			isError: false,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(newSegment.Name, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(
+						segmentID,
+						newSegment.Name,
+						"admin",
+						audit.Created,
+						nil,
+						audit.Values{
+							"hitPercentage":      90,
+							"layer":              "",
+							"description":        "",
+							"owner":              "",
+							"tags":               []string{},
+							"attributes":         map[string]interface{}{},
+							"activeFrom":         noWindow,
+							"activeUntil":        noWindow,
+							"rule":               "",
+							"prerequisites":      []string(nil),
+							"prerequisitePolicy": segment.PolicyRefuse,
+							"capacity":           noCapacity,
+							"variants":           []audit.Values{},
+						},
+						testTime,
+					).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Should successfully insert a new segment with layer and variants",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					Layer:               layer,
+					AutomaticPercentage: percentage,
+					Variants:            variants,
+				},
+			},
+			isError: false,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(newSegment.Name, percentage, layer, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_variants").
+					WithArgs(segmentID, "control", 50, segmentID, "treatment", 50).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, newSegment.Name, "admin", audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Should successfully insert a new segment with metadata",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					AutomaticPercentage: percentage,
+					Description:         "Discount for new users",
+					Owner:               "growth",
+					Tags:                []string{"pricing"},
+					Attributes:          map[string]interface{}{"jira": "GRW-1"},
+				},
+			},
+			isError: false,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments \\(segment_name,automatic_percentage,layer,description,owner,tags,attributes,active_from,active_until,rule,prerequisite_policy,capacity\\)").
+					WithArgs(
+						newSegment.Name,
+						percentage,
+						nil,
+						"Discount for new users",
+						"growth",
+						[]string{"pricing"},
+						map[string]interface{}{"jira": "GRW-1"},
+						noWindow,
+						noWindow,
+						nil,
+						segment.PolicyRefuse,
+						noCapacity,
+					).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, newSegment.Name, "admin", audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Should successfully insert a new segment with active window",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					AutomaticPercentage: percentage,
+					ActiveFrom:          &activeFrom,
+					ActiveUntil:         &activeUntil,
+				},
+			},
+			isError: false,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(newSegment.Name, percentage, nil, "", "", []string{}, map[string]interface{}{}, &activeFrom, &activeUntil, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, newSegment.Name, "admin", audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title: "Should successfully insert a new segment with prerequisites",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					AutomaticPercentage: percentage,
+					Prerequisites:       []string{"vas", "performance"},
+					PrerequisitePolicy:  segment.PolicyCascade,
+				},
 			},
 			isError: false,
 			mockCall: func() {
 				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
 				mockPSQLClient.
 					ExpectQuery("INSERT INTO segments").
-					WithArgs(newSegment.Name, percentage).
+					WithArgs(newSegment.Name, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyCascade, noCapacity).
 					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_prerequisites \\(segment_id,prerequisite_id\\) SELECT (.+) FROM segments WHERE archived_at IS NULL AND segment_name IN").
+					WithArgs(segmentID, "vas", "performance").
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, newSegment.Name, "admin", audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
 			},
 			expected: segmentID,
 		},
+		{
+			title: "Prerequisite segment wasn't found",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					AutomaticPercentage: percentage,
+					Prerequisites:       []string{"vas", "unknown"},
+				},
+			},
+			isError: true,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(newSegment.Name, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_prerequisites").
+					WithArgs(segmentID, "vas", "unknown").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectRollback()
+			},
+			expected: int64(0),
+		},
+		{
+			title: "Couldn't insert variants",
+			args: args{
+				segment: segment.SegmentInfo{
+					Name:                newSegment.Name,
+					Layer:               layer,
+					AutomaticPercentage: percentage,
+					Variants:            variants,
+				},
+			},
+			isError: true,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(newSegment.Name, percentage, layer, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_variants").
+					WithArgs(segmentID, "control", 50, segmentID, "treatment", 50).
+					WillReturnError(errors.New("internal database error"))
+				mockPSQLClient.ExpectRollback()
+			},
+			expected: int64(0),
+		},
 		{
 			title: "Database internal error",
 			args: args{
-				segment: newSegment.Name,
+				segment: segment.SegmentInfo{Name: newSegment.Name},
 			},
 			isError: true,
 			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
 				mockPSQLClient.
 					ExpectQuery("INSERT INTO segments").
-					WithArgs(newSegment.Name, percentage).
+					WithArgs(newSegment.Name, 0, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
 					WillReturnError(errors.New("internal database error"))
+				mockPSQLClient.ExpectRollback()
 			},
 			expected: int64(0),
 		},
@@ -73,14 +319,158 @@ func TestCreateSegment(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			got, err := repo.Create(ctx, test.args.segment, test.args.percentage)
+			got, err := repo.Create(ctx, test.args.segment)
 			if test.isError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
 			}
 			assert.Equal(t, test.expected, got)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
 
+func TestCreateAndAssign(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+	repo := New(mockPSQLClient, NewTestClock(testTime))
+
+	segmentName := "discount"
+	segmentID := int64(1)
+	percentage := 90
+	capacity := 5
+
+	tests := []struct {
+		title      string
+		percentage int
+		capacity   *int
+		isError    bool
+		expected   int64
+		mockCall   func()
+	}{
+		{
+			title:      "Should create segment and assign existing users by bucket",
+			percentage: percentage,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(segmentName, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO user_segments (.+) SELECT (.+), segment_variant\\(s.segment_id, u.user_id\\), s.layer, TRUE FROM users u JOIN segments s ON (.+) WHERE s.automatic_percentage < segment_bucket\\(s.salt, u.user_id\\) AND NOT EXISTS (.+) us.layer = s.layer\\)").
+					WithArgs(maxFutureTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 3))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_history (.+) SELECT us.user_id, (.+), sv.variant_name FROM user_segments us LEFT JOIN segment_variants sv (.+) WHERE us.segment_id = ").
+					WithArgs(segmentName, history.Added, testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 3))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title:      "Should assign no more existing users than the segment capacity",
+			percentage: percentage,
+			capacity:   &capacity,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(segmentName, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, &capacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO user_segments (.+) us.layer = s.layer\\) ORDER BY u.user_id LIMIT 5").
+					WithArgs(maxFutureTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 5))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(segmentName, history.Added, testTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 5))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title:      "Should create segment without assignment when hit percentage is zero",
+			percentage: 100,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(segmentName, 100, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: segmentID,
+		},
+		{
+			title:      "Couldn't register history events",
+			percentage: percentage,
+			isError:    true,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"segment_id"}).AddRow(segmentID)
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.
+					ExpectQuery("INSERT INTO segments").
+					WithArgs(segmentName, percentage, nil, "", "", []string{}, map[string]interface{}{}, noWindow, noWindow, nil, segment.PolicyRefuse, noCapacity).
+					WillReturnRows(rows)
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_audit").
+					WithArgs(segmentID, segmentName, audit.SystemActor, audit.Created, nil, pgxmock.AnyArg(), testTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO user_segments").
+					WithArgs(maxFutureTime, segmentID).
+					WillReturnResult(pgxmock.NewResult("INSERT", 3))
+				mockPSQLClient.
+					ExpectExec("INSERT INTO segment_history").
+					WithArgs(segmentName, history.Added, testTime, segmentID).
+					WillReturnError(errors.New("internal database error"))
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.CreateAndAssign(ctx, segment.SegmentInfo{
+				Name:                segmentName,
+				AutomaticPercentage: test.percentage,
+				Capacity:            test.capacity,
+			})
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
 		})
 	}
 }
@@ -92,37 +482,118 @@ func TestGetAllSegments(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer mockPSQLClient.Close()
-	repo := New(mockPSQLClient)
+	repo := New(mockPSQLClient, NewTestClock(testTime))
 
+	capacity := 10
 	segments := []segment.SegmentInfo{
-		{ID: int64(1), Name: "segment1"},
-		{ID: int64(2), Name: "segment2"},
+		{
+			ID:                  int64(1),
+			Name:                "segment1",
+			AutomaticPercentage: 90,
+			Members:             3,
+			Description:         "Checkout redesign",
+			Owner:               "growth",
+			Tags:                []string{"checkout"},
+			Attributes:          map[string]interface{}{"jira": "GRW-1"},
+			Prerequisites:       []string{"segment2"},
+			PrerequisitePolicy:  segment.PolicyCascade,
+			Capacity:            &capacity,
+		},
+		{
+			ID:                  int64(2),
+			Name:                "segment2",
+			AutomaticPercentage: 100,
+			Members:             0,
+			Tags:                []string{},
+			Attributes:          map[string]interface{}{},
+			Prerequisites:       []string{},
+			PrerequisitePolicy:  segment.PolicyRefuse,
+		},
+	}
+
+	archivedAt := testTime.Add(-time.Hour)
+	archived := segment.SegmentInfo{
+		ID:                  int64(3),
+		Name:                "segment3",
+		AutomaticPercentage: 100,
+		Tags:                []string{},
+		Attributes:          map[string]interface{}{},
+		ArchivedAt:          &archivedAt,
+		Prerequisites:       []string{},
+		PrerequisitePolicy:  segment.PolicyRefuse,
+	}
+
+	columns := []string{"segment_id", "segment_name", "automatic_percentage", "count", "description", "owner", "tags", "attributes", "archived_at", "active_from", "active_until", "rule", "prerequisite_policy", "prerequisites", "capacity"}
+	addRow := func(rows *pgxmock.Rows, s segment.SegmentInfo) *pgxmock.Rows {
+		return rows.AddRow(s.ID, s.Name, s.AutomaticPercentage, s.Members, s.Description, s.Owner, s.Tags, s.Attributes, s.ArchivedAt, s.ActiveFrom, s.ActiveUntil, s.Rule, s.PrerequisitePolicy, s.Prerequisites, s.Capacity)
 	}
 
 	tests := []struct {
 		title    string
+		filter   segment.Filter
 		isError  bool
 		expected []segment.SegmentInfo
 		mockCall func()
 	}{
 		{
-			title: "Should successfully retrieve all segments",
+			title:  "Should successfully retrieve all segments",
+			filter: segment.NewFilter("", "", "", false, 0, 0),
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"segment_id", "segment_name"}).
-					AddRow(segments[0].ID, segments[0].Name).
-					AddRow(segments[1].ID, segments[1].Name)
+				rows := addRow(addRow(pgxmock.NewRows(columns), segments[0]), segments[1])
 				mockPSQLClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments").
+					ExpectQuery("SELECT s.segment_id, s.segment_name, (.+) FROM segments s LEFT JOIN user_segments us ON (.+) AND us.expired_at > \\$1 ").
+					WithArgs(testTime, int64(0)).
 					WillReturnRows(rows)
 			},
 			isError:  false,
 			expected: segments,
 		},
 		{
-			title: "Database internal error",
+			title:  "Should retrieve segments page filtered by prefix",
+			filter: segment.NewFilter("seg_", "", "", false, 1, 10),
 			mockCall: func() {
+				rows := addRow(pgxmock.NewRows(columns), segments[1])
 				mockPSQLClient.
-					ExpectQuery("SELECT segment_id, segment_name FROM segments").
+					ExpectQuery("SELECT (.+) FROM segments s (.+) WHERE s.segment_id > (.+) AND s.segment_name LIKE (.+) LIMIT 10").
+					WithArgs(testTime, int64(1), `seg\_%`).
+					WillReturnRows(rows)
+			},
+			isError:  false,
+			expected: segments[1:],
+		},
+		{
+			title:  "Should retrieve segments filtered by tag and owner",
+			filter: segment.NewFilter("", "checkout", "growth", false, 0, 0),
+			mockCall: func() {
+				rows := addRow(pgxmock.NewRows(columns), segments[0])
+				mockPSQLClient.
+					ExpectQuery("SELECT (.+), s.description, s.owner, s.tags, s.attributes, s.archived_at, s.active_from, s.active_until, (.+) FROM segments s (.+) WHERE s.segment_id > (.+) AND s.archived_at IS NULL AND s.tags @> ARRAY\\[(.+)\\]::text\\[\\] AND s.owner = (.+) GROUP BY").
+					WithArgs(testTime, int64(0), "checkout", "growth").
+					WillReturnRows(rows)
+			},
+			isError:  false,
+			expected: segments[:1],
+		},
+		{
+			title:  "Should retrieve archived segments",
+			filter: segment.NewFilter("", "", "", true, 0, 0),
+			mockCall: func() {
+				rows := addRow(pgxmock.NewRows(columns), archived)
+				mockPSQLClient.
+					ExpectQuery("SELECT (.+), s.archived_at, s.active_from, s.active_until, (.+) FROM segments s (.+) WHERE s.segment_id > (.+) AND s.archived_at IS NOT NULL GROUP BY").
+					WithArgs(testTime, int64(0)).
+					WillReturnRows(rows)
+			},
+			isError:  false,
+			expected: []segment.SegmentInfo{archived},
+		},
+		{
+			title:  "Database internal error",
+			filter: segment.NewFilter("", "", "", false, 0, 0),
+			mockCall: func() {
+				mockPSQLClient.
+					ExpectQuery("SELECT s.segment_id, s.segment_name, (.+) FROM segments s").
+					WithArgs(testTime, int64(0)).
 					WillReturnError(errors.New("internal database error"))
 			},
 			isError: true,
@@ -132,7 +603,7 @@ func TestGetAllSegments(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.title, func(t *testing.T) {
 			test.mockCall()
-			result, err := repo.GetAll(ctx)
+			result, err := repo.GetAll(ctx, test.filter)
 			if test.isError {
 				assert.Error(t, err)
 			} else {
@@ -150,7 +621,7 @@ func TestGetSegment(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer mockPSQLClient.Close()
-	repo := New(mockPSQLClient)
+	repo := New(mockPSQLClient, NewTestClock(testTime))
 
 	segmentName := "discount"
 	segmentID := int64(1)
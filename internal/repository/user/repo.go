@@ -4,27 +4,47 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/VrMolodyakov/segment-api/internal/domain/user"
 	psql "github.com/VrMolodyakov/segment-api/pkg/client/postgresql"
+	"github.com/VrMolodyakov/segment-api/pkg/random"
 
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 const (
-	userTable string = "users"
+	userTable       string = "users"
+	externalIDTable string = "user_external_ids"
+	attributeTable  string = "user_attributes"
 )
 
+var (
+	likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+)
+
+// Memberships keeps the memberships of the users in line with the user writes,
+// within the transaction of the write.
+type Memberships interface {
+	AssignNewUsers(ctx context.Context, tx pgx.Tx, users []user.User, bucketing random.Bucketing) error
+	ReconcileUser(ctx context.Context, tx pgx.Tx, u user.User) error
+	EraseMemberships(ctx context.Context, tx pgx.Tx, userID int64, anonymousID string) error
+}
+
 type repo struct {
-	builder sq.StatementBuilderType
-	client  psql.Client
+	builder     sq.StatementBuilderType
+	client      psql.Client
+	memberships Memberships
 }
 
-func New(client psql.Client) *repo {
+func New(client psql.Client, memberships Memberships) *repo {
 	return &repo{
-		client:  client,
-		builder: sq.StatementBuilder.PlaceholderFormat(sq.Dollar),
+		client:      client,
+		memberships: memberships,
+		builder:     sq.StatementBuilder.PlaceholderFormat(sq.Dollar),
 	}
 }
 
@@ -34,7 +54,8 @@ func (r *repo) Get(ctx context.Context, userID int64) (user.User, error) {
 			"user_id",
 			"first_name",
 			"last_name",
-			"email").
+			"email",
+			"attributes").
 		From(userTable).
 		Where(sq.Eq{"user_id": userID}).
 		ToSql()
@@ -44,12 +65,506 @@ func (r *repo) Get(ctx context.Context, userID int64) (user.User, error) {
 	var u user.User
 	err = r.client.
 		QueryRow(ctx, sql, args...).
-		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email)
+		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Attributes)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return user.User{}, fmt.Errorf("couldn't get an account: %w", user.ErrUserNotFound)
 		}
 		return user.User{}, fmt.Errorf("couldn't get an account: %w", err)
 	}
+	u.ExternalIDs, err = r.getExternalIDs(ctx, userID)
+	if err != nil {
+		return user.User{}, err
+	}
+	return u, nil
+}
+
+func (r *repo) CreateUser(ctx context.Context, newUser user.User, bucketing random.Bucketing) (int64, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	userID, err := r.createUser(ctx, tx, newUser)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(newUser.ExternalIDs) > 0 {
+		if err = r.insertExternalIDs(ctx, tx, userID, newUser.ExternalIDs); err != nil {
+			return 0, err
+		}
+	}
+
+	newUser.ID = userID
+	if err = r.memberships.AssignNewUsers(ctx, tx, []user.User{newUser}, bucketing); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+// UpdateUser updates the user fields and brings its rule based segments in line with
+// the new values within the same transaction, so the user is never matched against stale fields.
+func (r *repo) UpdateUser(ctx context.Context, userID int64, update user.Update) (user.User, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return user.User{}, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	updated, err := r.updateUser(ctx, tx, userID, update)
+	if err != nil {
+		return user.User{}, err
+	}
+
+	if err = r.memberships.ReconcileUser(ctx, tx, updated); err != nil {
+		return user.User{}, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return user.User{}, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return updated, nil
+}
+
+// ImportUsers creates the batch of users in a single transaction and assigns them the automatic
+// segments the same way CreateUser does. The ids follow the order of users, users whose email
+// is already taken are skipped and get 0.
+func (r *repo) ImportUsers(ctx context.Context, users []user.User, bucketing random.Bucketing) ([]int64, error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	created, err := r.insertUsers(ctx, tx, users)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(users))
+	newUsers := make([]user.User, 0, len(created))
+	for i := range users {
+		userID, ok := created[users[i].Email]
+		if !ok {
+			continue
+		}
+		ids[i] = userID
+		newUser := users[i]
+		newUser.ID = userID
+		newUsers = append(newUsers, newUser)
+	}
+
+	if len(newUsers) > 0 {
+		if err = r.memberships.AssignNewUsers(ctx, tx, newUsers, bucketing); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return ids, nil
+}
+
+// EraseUser removes the user with its memberships. Open memberships are closed with deleted events
+// and the whole history of the user is moved to anonymousID, so history aggregates don't change.
+func (r *repo) EraseUser(ctx context.Context, userID int64, anonymousID string) error {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				err = fmt.Errorf("failed to rollback transaction: %w, initial error: %s", rollbackErr, err.Error())
+			}
+
+		}
+	}()
+
+	if err = r.lockUser(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err = r.memberships.EraseMemberships(ctx, tx, userID, anonymousID); err != nil {
+		return err
+	}
+
+	if err = r.deleteUser(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *repo) Resolve(ctx context.Context, external user.ExternalID) (int64, error) {
+	sql, args, err := r.builder.
+		Select("user_id").
+		From(externalIDTable).
+		Where(sq.Eq{
+			"namespace":   external.Namespace,
+			"external_id": external.ID,
+		}).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create query : %w", err)
+	}
+	var userID int64
+	if err := r.client.QueryRow(ctx, sql, args...).Scan(&userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("couldn't resolve an external id: %w", user.ErrUserNotFound)
+		}
+		return 0, fmt.Errorf("couldn't resolve an external id: %w", err)
+	}
+	return userID, nil
+}
+
+func (r *repo) getExternalIDs(ctx context.Context, userID int64) ([]user.ExternalID, error) {
+	sql, args, err := r.builder.
+		Select(
+			"namespace",
+			"external_id").
+		From(externalIDTable).
+		Where(sq.Eq{"user_id": userID}).
+		OrderBy("namespace", "external_id").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	externalIDs := make([]user.ExternalID, 0)
+	for rows.Next() {
+		var external user.ExternalID
+		if err := rows.Scan(&external.Namespace, &external.ID); err != nil {
+			return nil, fmt.Errorf("couldn't scan external id : %w", err)
+		}
+		externalIDs = append(externalIDs, external)
+	}
+	return externalIDs, nil
+}
+
+func (r *repo) GetAll(ctx context.Context, filter user.Filter) ([]user.User, error) {
+	query := r.builder.
+		Select(
+			"user_id",
+			"first_name",
+			"last_name",
+			"email",
+			"attributes").
+		From(userTable).
+		Where(sq.Gt{"user_id": filter.Cursor}).
+		OrderBy("user_id")
+
+	if filter.Email != "" {
+		query = query.Where(sq.ILike{"email": "%" + likeEscaper.Replace(filter.Email) + "%"})
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]user.User, 0)
+	for rows.Next() {
+		var u user.User
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Attributes); err != nil {
+			return nil, fmt.Errorf("couldn't scan user : %w", err)
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+func (r *repo) CreateAttribute(ctx context.Context, attribute user.Attribute) (user.Attribute, error) {
+	sql, args, err := r.builder.
+		Insert(attributeTable).
+		Columns(
+			"attribute_name",
+			"attribute_type",
+			"description").
+		Values(attribute.Name, string(attribute.Type), attribute.Description).
+		Suffix("RETURNING created_at").
+		ToSql()
+	if err != nil {
+		return user.Attribute{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+	if err := r.client.QueryRow(ctx, sql, args...).Scan(&attribute.CreatedAt); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation {
+				return user.Attribute{}, fmt.Errorf("couldn't register an attribute: %w", user.ErrAttributeAlreadyExist)
+			}
+		}
+		return user.Attribute{}, fmt.Errorf("couldn't register an attribute: %w", err)
+	}
+	return attribute, nil
+}
+
+func (r *repo) GetAttributes(ctx context.Context) ([]user.Attribute, error) {
+	sql, args, err := r.builder.
+		Select(
+			"attribute_name",
+			"attribute_type",
+			"description",
+			"created_at").
+		From(attributeTable).
+		OrderBy("attribute_name").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := r.client.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	attributes := make([]user.Attribute, 0)
+	for rows.Next() {
+		var a user.Attribute
+		if err := rows.Scan(&a.Name, &a.Type, &a.Description, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan attribute : %w", err)
+		}
+		attributes = append(attributes, a)
+	}
+	return attributes, nil
+}
+
+func (r *repo) createUser(ctx context.Context, tx pgx.Tx, newUser user.User) (int64, error) {
+	sql, args, err := r.builder.
+		Insert(userTable).
+		Columns(
+			"first_name",
+			"last_name",
+			"email",
+			"attributes").
+		Values(newUser.FirstName, newUser.LastName, newUser.Email, attributesOrEmpty(newUser.Attributes)).
+		Suffix("RETURNING user_id").
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create query : %w", err)
+	}
+	var id int64
+	err = tx.QueryRow(ctx, sql, args...).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation {
+				return 0, fmt.Errorf("couldn't create an account: %w", user.ErrUserAlreadyExist)
+			}
+		}
+
+		return 0, fmt.Errorf("couldn't create an account: %w", err)
+	}
+	return id, nil
+}
+
+func (r *repo) updateUser(ctx context.Context, tx pgx.Tx, userID int64, update user.Update) (user.User, error) {
+	query := r.builder.
+		Update(userTable).
+		Where(sq.Eq{"user_id": userID}).
+		Suffix("RETURNING user_id, first_name, last_name, email, attributes")
+
+	if update.FirstName != nil {
+		query = query.Set("first_name", *update.FirstName)
+	}
+	if update.LastName != nil {
+		query = query.Set("last_name", *update.LastName)
+	}
+	if update.Email != nil {
+		query = query.Set("email", *update.Email)
+	}
+	if update.Attributes != nil {
+		// the sent attributes are merged into the stored ones, the rest are kept
+		query = query.Set("attributes", sq.Expr("attributes || ?::jsonb", update.Attributes))
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return user.User{}, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	var u user.User
+	err = tx.
+		QueryRow(ctx, sql, args...).
+		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Attributes)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.User{}, fmt.Errorf("couldn't update an account: %w", user.ErrUserNotFound)
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation {
+				return user.User{}, fmt.Errorf("couldn't update an account: %w", user.ErrUserAlreadyExist)
+			}
+		}
+		return user.User{}, fmt.Errorf("couldn't update an account: %w", err)
+	}
 	return u, nil
 }
+
+// insertUsers creates the users with a single statement, the users whose email is already
+// taken are skipped. The ids of the created users are returned by email.
+func (r *repo) insertUsers(ctx context.Context, tx pgx.Tx, users []user.User) (map[string]int64, error) {
+	insertState := r.builder.
+		Insert(userTable).
+		Columns(
+			"first_name",
+			"last_name",
+			"email",
+			"attributes")
+	for i := range users {
+		insertState = insertState.Values(users[i].FirstName, users[i].LastName, users[i].Email, attributesOrEmpty(users[i].Attributes))
+	}
+
+	sql, args, err := insertState.
+		Suffix("ON CONFLICT (email) DO NOTHING RETURNING user_id, email").
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't run query : %w", err)
+	}
+	defer rows.Close()
+
+	created := make(map[string]int64, len(users))
+	for rows.Next() {
+		var id int64
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, fmt.Errorf("couldn't scan user : %w", err)
+		}
+		created[email] = id
+	}
+
+	return created, rows.Err()
+}
+
+func (r *repo) insertExternalIDs(ctx context.Context, tx pgx.Tx, userID int64, externalIDs []user.ExternalID) error {
+	query := r.builder.
+		Insert(externalIDTable).
+		Columns(
+			"namespace",
+			"external_id",
+			"user_id")
+	for _, external := range externalIDs {
+		query = query.Values(external.Namespace, external.ID, userID)
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+	if _, err := tx.Exec(ctx, sql, args...); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.Code == pgerrcode.UniqueViolation {
+				return fmt.Errorf("couldn't add external ids: %w", user.ErrExternalIDAlreadyExist)
+			}
+		}
+		return fmt.Errorf("couldn't add external ids: %w", err)
+	}
+	return nil
+}
+
+func (r *repo) lockUser(ctx context.Context, tx pgx.Tx, userID int64) error {
+	sql, args, err := r.builder.
+		Select("user_id").
+		From(userTable).
+		Where(sq.Eq{"user_id": userID}).
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	var id int64
+	if err := tx.QueryRow(ctx, sql, args...).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.ErrUserNotFound
+		}
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func (r *repo) deleteUser(ctx context.Context, tx pgx.Tx, userID int64) error {
+	sql, args, err := r.builder.
+		Delete(userTable).
+		Where(sq.Eq{"user_id": userID}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("couldn't create query : %w", err)
+	}
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't run query : %w", err)
+	}
+	return nil
+}
+
+func attributesOrEmpty(attributes map[string]interface{}) map[string]interface{} {
+	if attributes == nil {
+		return map[string]interface{}{}
+	}
+	return attributes
+}
@@ -4,13 +4,465 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/VrMolodyakov/segment-api/internal/domain/user"
+	"github.com/VrMolodyakov/segment-api/pkg/random"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v2"
 	"github.com/stretchr/testify/assert"
 )
 
+type mockMemberships struct {
+	err        error
+	assigned   []user.User
+	reconciled []user.User
+	erased     []string
+}
+
+func (m *mockMemberships) AssignNewUsers(ctx context.Context, tx pgx.Tx, users []user.User, bucketing random.Bucketing) error {
+	m.assigned = append(m.assigned, users...)
+	return m.err
+}
+
+func (m *mockMemberships) ReconcileUser(ctx context.Context, tx pgx.Tx, u user.User) error {
+	m.reconciled = append(m.reconciled, u)
+	return m.err
+}
+
+func (m *mockMemberships) EraseMemberships(ctx context.Context, tx pgx.Tx, userID int64, anonymousID string) error {
+	m.erased = append(m.erased, anonymousID)
+	return m.err
+}
+
+type mockBucketing struct {
+	bucket int
+}
+
+func (m *mockBucketing) Bucket(userID int64, salt string) int {
+	return m.bucket
+}
+
+func TestCreateUser(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+
+	userID := int64(1)
+	newUser := user.User{
+		FirstName: "Arnold",
+		LastName:  "Jones",
+		Email:     "t2000@mail.ru",
+		ExternalIDs: []user.ExternalID{
+			user.NewExternalID("crm", "a-17"),
+			user.NewExternalID("crm", "b-42"),
+		},
+	}
+	created := newUser
+	created.ID = userID
+	externalArgs := []interface{}{"crm", "a-17", userID, "crm", "b-42", userID}
+
+	tests := []struct {
+		title       string
+		memberships *mockMemberships
+		expected    int64
+		assigned    []user.User
+		err         error
+		isError     bool
+		mockCall    func()
+	}{
+		{
+			title:       "Should create the user with its external ids and assign its segments",
+			memberships: &mockMemberships{},
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users \\(first_name,last_name,email,attributes\\) VALUES \\(\\$1,\\$2,\\$3,\\$4\\) RETURNING user_id").
+					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email, map[string]interface{}{}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockPSQLClient.ExpectExec("INSERT INTO user_external_ids \\(namespace,external_id,user_id\\) VALUES").
+					WithArgs(externalArgs...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: userID,
+			assigned: []user.User{created},
+		},
+		{
+			title:       "Email is already taken",
+			memberships: &mockMemberships{},
+			isError:     true,
+			err:         user.ErrUserAlreadyExist,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email, map[string]interface{}{}).
+					WillReturnError(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "External id is already taken",
+			memberships: &mockMemberships{},
+			isError:     true,
+			err:         user.ErrExternalIDAlreadyExist,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email, map[string]interface{}{}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockPSQLClient.ExpectExec("INSERT INTO user_external_ids").
+					WithArgs(externalArgs...).
+					WillReturnError(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "Couldn't assign the segments",
+			memberships: &mockMemberships{err: errors.New("internal database error")},
+			isError:     true,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(newUser.FirstName, newUser.LastName, newUser.Email, map[string]interface{}{}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockPSQLClient.ExpectExec("INSERT INTO user_external_ids").
+					WithArgs(externalArgs...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 2))
+				mockPSQLClient.ExpectRollback()
+			},
+			assigned: []user.User{created},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			repo := New(mockPSQLClient, test.memberships)
+			got, err := repo.CreateUser(ctx, newUser, &mockBucketing{})
+			if test.isError {
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+			assert.Equal(t, test.assigned, test.memberships.assigned)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+
+	userID1, userID2 := int64(10), int64(11)
+	users := []user.User{
+		{FirstName: "Arnold", LastName: "Jones", Email: "t800@mail.ru"},
+		{FirstName: "Sarah", LastName: "Connor", Email: "sarah@mail.ru"},
+		{FirstName: "John", LastName: "Connor", Email: "john@mail.ru", Attributes: map[string]interface{}{"city": "LA"}},
+	}
+	usersArgs := []interface{}{
+		"Arnold", "Jones", "t800@mail.ru", map[string]interface{}{},
+		"Sarah", "Connor", "sarah@mail.ru", map[string]interface{}{},
+		"John", "Connor", "john@mail.ru", map[string]interface{}{"city": "LA"},
+	}
+	first, third := users[0], users[2]
+	first.ID, third.ID = userID1, userID2
+
+	tests := []struct {
+		title       string
+		memberships *mockMemberships
+		expected    []int64
+		assigned    []user.User
+		isError     bool
+		mockCall    func()
+	}{
+		{
+			title:       "Should create the users with free emails and assign their segments",
+			memberships: &mockMemberships{},
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users (.+) ON CONFLICT \\(email\\) DO NOTHING RETURNING user_id, email").
+					WithArgs(usersArgs...).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "email"}).
+						AddRow(userID1, "t800@mail.ru").
+						AddRow(userID2, "john@mail.ru"))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: []int64{userID1, 0, userID2},
+			assigned: []user.User{first, third},
+		},
+		{
+			title:       "Should skip the assignment when every email is taken",
+			memberships: &mockMemberships{},
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(usersArgs...).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "email"}))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected: []int64{0, 0, 0},
+		},
+		{
+			title:       "Insert users error",
+			memberships: &mockMemberships{},
+			isError:     true,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(usersArgs...).
+					WillReturnError(errors.New("internal database error"))
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "Couldn't assign the segments",
+			memberships: &mockMemberships{err: errors.New("internal database error")},
+			isError:     true,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("INSERT INTO users").
+					WithArgs(usersArgs...).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "email"}).
+						AddRow(userID1, "t800@mail.ru").
+						AddRow(userID2, "john@mail.ru"))
+				mockPSQLClient.ExpectRollback()
+			},
+			assigned: []user.User{first, third},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			repo := New(mockPSQLClient, test.memberships)
+			got, err := repo.ImportUsers(ctx, users, &mockBucketing{})
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+			assert.Equal(t, test.assigned, test.memberships.assigned)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+
+	userID := int64(1)
+	email := "t1000@mail.ru"
+	lastName := "Connor"
+	attributes := map[string]interface{}{"plan": "pro"}
+	merged := map[string]interface{}{"city": "Kazan", "plan": "pro"}
+	updated := user.User{
+		ID:         userID,
+		FirstName:  "Arnold",
+		LastName:   lastName,
+		Email:      email,
+		Attributes: merged,
+	}
+	columns := []string{"user_id", "first_name", "last_name", "email", "attributes"}
+
+	tests := []struct {
+		title       string
+		update      user.Update
+		memberships *mockMemberships
+		expected    user.User
+		reconciled  []user.User
+		err         error
+		isError     bool
+		mockCall    func()
+	}{
+		{
+			title:       "Should update the user and reconcile its segments",
+			update:      user.Update{LastName: &lastName, Attributes: attributes},
+			memberships: &mockMemberships{},
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery(`UPDATE users SET last_name = \$1, attributes = attributes \|\| \$2::jsonb WHERE user_id = \$3 RETURNING user_id, first_name, last_name, email, attributes`).
+					WithArgs(lastName, attributes, userID).
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(updated.ID, updated.FirstName, updated.LastName, updated.Email, updated.Attributes))
+				mockPSQLClient.ExpectCommit()
+			},
+			expected:   updated,
+			reconciled: []user.User{updated},
+		},
+		{
+			title:       "User not found",
+			update:      user.Update{Email: &email},
+			memberships: &mockMemberships{},
+			isError:     true,
+			err:         user.ErrUserNotFound,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("UPDATE users SET email").
+					WithArgs(email, userID).
+					WillReturnError(pgx.ErrNoRows)
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "Email already taken",
+			update:      user.Update{Email: &email},
+			memberships: &mockMemberships{},
+			isError:     true,
+			err:         user.ErrUserAlreadyExist,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("UPDATE users SET email").
+					WithArgs(email, userID).
+					WillReturnError(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "Couldn't reconcile the segments",
+			update:      user.Update{Email: &email},
+			memberships: &mockMemberships{err: errors.New("internal database error")},
+			isError:     true,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("UPDATE users SET email").
+					WithArgs(email, userID).
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(updated.ID, updated.FirstName, updated.LastName, updated.Email, updated.Attributes))
+				mockPSQLClient.ExpectRollback()
+			},
+			reconciled: []user.User{updated},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			repo := New(mockPSQLClient, test.memberships)
+			got, err := repo.UpdateUser(ctx, userID, test.update)
+			if test.isError {
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+			assert.Equal(t, test.reconciled, test.memberships.reconciled)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+
+	userID := int64(1)
+	anonymousID := "4f1c2a9b7e3d4c5a8b6e9f0a1b2c3d4e"
+
+	tests := []struct {
+		title       string
+		memberships *mockMemberships
+		erased      []string
+		err         error
+		isError     bool
+		mockCall    func()
+	}{
+		{
+			title:       "Should erase the memberships and delete the user",
+			memberships: &mockMemberships{},
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("SELECT user_id FROM users WHERE user_id = \\$1 FOR UPDATE").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockPSQLClient.ExpectExec("DELETE FROM users WHERE user_id = \\$1").
+					WithArgs(userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mockPSQLClient.ExpectCommit()
+			},
+			erased: []string{anonymousID},
+		},
+		{
+			title:       "User not found",
+			memberships: &mockMemberships{},
+			isError:     true,
+			err:         user.ErrUserNotFound,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("SELECT user_id FROM users").
+					WithArgs(userID).
+					WillReturnError(pgx.ErrNoRows)
+				mockPSQLClient.ExpectRollback()
+			},
+		},
+		{
+			title:       "Couldn't erase the memberships",
+			memberships: &mockMemberships{err: errors.New("internal database error")},
+			isError:     true,
+			mockCall: func() {
+				mockPSQLClient.ExpectBegin()
+				mockPSQLClient.ExpectQuery("SELECT user_id FROM users").
+					WithArgs(userID).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(userID))
+				mockPSQLClient.ExpectRollback()
+			},
+			erased: []string{anonymousID},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			repo := New(mockPSQLClient, test.memberships)
+			err := repo.EraseUser(ctx, userID, anonymousID)
+			if test.isError {
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.erased, test.memberships.erased)
+			if err := mockPSQLClient.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
 func TestGetUser(t *testing.T) {
 	ctx := context.Background()
 	mockPSQLClient, err := pgxmock.NewPool()
@@ -18,7 +470,7 @@ func TestGetUser(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer mockPSQLClient.Close()
-	repo := New(mockPSQLClient)
+	repo := New(mockPSQLClient, &mockMemberships{})
 
 	userID := int64(1)
 	got := user.User{
@@ -26,6 +478,12 @@ func TestGetUser(t *testing.T) {
 		FirstName: "Arnold",
 		LastName:  "Jones",
 		Email:     "t2000@mail.ru",
+		Attributes: map[string]interface{}{
+			"city": "Moscow",
+		},
+		ExternalIDs: []user.ExternalID{
+			user.NewExternalID("crm", "a-17"),
+		},
 	}
 
 	type args struct {
@@ -46,15 +504,42 @@ func TestGetUser(t *testing.T) {
 			},
 			isError: false,
 			mockCall: func() {
-				rows := pgxmock.NewRows([]string{"user_id", "first_name", "last_name", "email"}).
-					AddRow(got.ID, got.FirstName, got.LastName, got.Email)
+				rows := pgxmock.NewRows([]string{"user_id", "first_name", "last_name", "email", "attributes"}).
+					AddRow(got.ID, got.FirstName, got.LastName, got.Email, got.Attributes)
 
-				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email FROM users").
+				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
 					WithArgs(userID).
 					WillReturnRows(rows)
+
+				externalRows := pgxmock.NewRows([]string{"namespace", "external_id"}).
+					AddRow("crm", "a-17")
+
+				mockPSQLClient.ExpectQuery("SELECT namespace, external_id FROM user_external_ids WHERE user_id = \\$1 ORDER BY namespace, external_id").
+					WithArgs(userID).
+					WillReturnRows(externalRows)
 			},
 			expected: got,
 		},
+		{
+			title: "External ids query error",
+			args: args{
+				userID: userID,
+			},
+			isError: true,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"user_id", "first_name", "last_name", "email", "attributes"}).
+					AddRow(got.ID, got.FirstName, got.LastName, got.Email, got.Attributes)
+
+				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
+					WithArgs(userID).
+					WillReturnRows(rows)
+
+				mockPSQLClient.ExpectQuery("SELECT namespace, external_id FROM user_external_ids").
+					WithArgs(userID).
+					WillReturnError(errors.New("internal database error"))
+			},
+			expected: user.User{},
+		},
 		{
 			title: "Database internal error",
 			args: args{
@@ -62,7 +547,7 @@ func TestGetUser(t *testing.T) {
 			},
 			isError: true,
 			mockCall: func() {
-				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email FROM users").
+				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
 					WithArgs(userID).
 					WillReturnError(errors.New("internal database error"))
 			},
@@ -75,7 +560,7 @@ func TestGetUser(t *testing.T) {
 			},
 			isError: true,
 			mockCall: func() {
-				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email FROM users").
+				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
 					WithArgs(userID).
 					WillReturnError(pgx.ErrNoRows)
 			},
@@ -98,3 +583,279 @@ func TestGetUser(t *testing.T) {
 	}
 
 }
+
+func TestGetAllUsers(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+	repo := New(mockPSQLClient, &mockMemberships{})
+
+	columns := []string{"user_id", "first_name", "last_name", "email", "attributes"}
+	users := []user.User{
+		{ID: 2, FirstName: "Arnold", LastName: "Jones", Email: "t2000@mail.ru", Attributes: map[string]interface{}{}},
+		{ID: 3, FirstName: "Sarah", LastName: "Connor", Email: "s_connor@mail.ru", Attributes: map[string]interface{}{}},
+	}
+
+	type args struct {
+		filter user.Filter
+	}
+
+	tests := []struct {
+		title    string
+		args     args
+		expected []user.User
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should successfully get the users page",
+			args: args{
+				filter: user.NewFilter("", 1, 2),
+			},
+			mockCall: func() {
+				rows := pgxmock.NewRows(columns).
+					AddRow(users[0].ID, users[0].FirstName, users[0].LastName, users[0].Email, users[0].Attributes).
+					AddRow(users[1].ID, users[1].FirstName, users[1].LastName, users[1].Email, users[1].Attributes)
+
+				mockPSQLClient.ExpectQuery(`SELECT user_id, first_name, last_name, email, attributes FROM users WHERE user_id > \$1 ORDER BY user_id LIMIT 2`).
+					WithArgs(int64(1)).
+					WillReturnRows(rows)
+			},
+			expected: users,
+		},
+		{
+			title: "Should search users by escaped part of the email",
+			args: args{
+				filter: user.NewFilter("s_conn", 0, 20),
+			},
+			mockCall: func() {
+				rows := pgxmock.NewRows(columns).
+					AddRow(users[1].ID, users[1].FirstName, users[1].LastName, users[1].Email, users[1].Attributes)
+
+				mockPSQLClient.ExpectQuery(`SELECT user_id, first_name, last_name, email, attributes FROM users WHERE user_id > \$1 AND email ILIKE \$2 ORDER BY user_id LIMIT 20`).
+					WithArgs(int64(0), `%s\_conn%`).
+					WillReturnRows(rows)
+			},
+			expected: users[1:],
+		},
+		{
+			title: "Database internal error",
+			args: args{
+				filter: user.NewFilter("", 0, 20),
+			},
+			isError: true,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("SELECT user_id, first_name, last_name, email, attributes FROM users").
+					WithArgs(int64(0)).
+					WillReturnError(errors.New("internal database error"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.GetAll(ctx, test.args.filter)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+	repo := New(mockPSQLClient, &mockMemberships{})
+
+	external := user.NewExternalID("crm", "a-17")
+
+	tests := []struct {
+		title    string
+		expected int64
+		isError  bool
+		err      error
+		mockCall func()
+	}{
+		{
+			title:    "Should resolve the external id",
+			expected: 7,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"user_id"}).AddRow(int64(7))
+				mockPSQLClient.ExpectQuery(`SELECT user_id FROM user_external_ids WHERE external_id = \$1 AND namespace = \$2`).
+					WithArgs(external.ID, external.Namespace).
+					WillReturnRows(rows)
+			},
+		},
+		{
+			title:   "Unknown external id",
+			isError: true,
+			err:     user.ErrUserNotFound,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("SELECT user_id FROM user_external_ids").
+					WithArgs(external.ID, external.Namespace).
+					WillReturnError(pgx.ErrNoRows)
+			},
+		},
+		{
+			title:   "Database internal error",
+			isError: true,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("SELECT user_id FROM user_external_ids").
+					WithArgs(external.ID, external.Namespace).
+					WillReturnError(errors.New("internal database error"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.Resolve(ctx, external)
+			if test.isError {
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestCreateAttribute(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+	repo := New(mockPSQLClient, &mockMemberships{})
+
+	createdAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	attribute := user.NewAttribute("country", user.AttributeString, "ISO country code")
+	created := attribute
+	created.CreatedAt = createdAt
+
+	tests := []struct {
+		title    string
+		expected user.Attribute
+		isError  bool
+		err      error
+		mockCall func()
+	}{
+		{
+			title:    "Should register the attribute",
+			expected: created,
+			mockCall: func() {
+				rows := pgxmock.NewRows([]string{"created_at"}).AddRow(createdAt)
+				mockPSQLClient.ExpectQuery(`INSERT INTO user_attributes \(attribute_name,attribute_type,description\) VALUES \(\$1,\$2,\$3\) RETURNING created_at`).
+					WithArgs("country", "string", "ISO country code").
+					WillReturnRows(rows)
+			},
+		},
+		{
+			title:   "Attribute already registered",
+			isError: true,
+			err:     user.ErrAttributeAlreadyExist,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("INSERT INTO user_attributes").
+					WithArgs("country", "string", "ISO country code").
+					WillReturnError(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+			},
+		},
+		{
+			title:   "Database internal error",
+			isError: true,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("INSERT INTO user_attributes").
+					WithArgs("country", "string", "ISO country code").
+					WillReturnError(errors.New("internal database error"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.CreateAttribute(ctx, attribute)
+			if test.isError {
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestGetAttributes(t *testing.T) {
+	ctx := context.Background()
+	mockPSQLClient, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPSQLClient.Close()
+	repo := New(mockPSQLClient, &mockMemberships{})
+
+	createdAt := time.Date(2023, 8, 25, 12, 0, 0, 0, time.UTC)
+	columns := []string{"attribute_name", "attribute_type", "description", "created_at"}
+
+	tests := []struct {
+		title    string
+		expected []user.Attribute
+		isError  bool
+		mockCall func()
+	}{
+		{
+			title: "Should get the registered attributes",
+			expected: []user.Attribute{
+				{Name: "country", Type: user.AttributeString, CreatedAt: createdAt},
+				{Name: "signup_date", Type: user.AttributeDate, Description: "First visit", CreatedAt: createdAt},
+			},
+			mockCall: func() {
+				rows := pgxmock.NewRows(columns).
+					AddRow("country", user.AttributeString, "", createdAt).
+					AddRow("signup_date", user.AttributeDate, "First visit", createdAt)
+				mockPSQLClient.ExpectQuery("SELECT attribute_name, attribute_type, description, created_at FROM user_attributes ORDER BY attribute_name").
+					WillReturnRows(rows)
+			},
+		},
+		{
+			title:   "Database internal error",
+			isError: true,
+			mockCall: func() {
+				mockPSQLClient.ExpectQuery("SELECT attribute_name, attribute_type, description, created_at FROM user_attributes").
+					WillReturnError(errors.New("internal database error"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			test.mockCall()
+			got, err := repo.GetAttributes(ctx)
+			if test.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
@@ -0,0 +1,2 @@
+DROP FUNCTION IF EXISTS segment_bucket;
+ALTER TABLE segments DROP COLUMN IF EXISTS salt;
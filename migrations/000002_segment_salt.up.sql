@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS salt VARCHAR(32) NOT NULL DEFAULT md5(random()::TEXT);
+
+CREATE OR REPLACE FUNCTION segment_bucket(salt TEXT, user_id BIGINT) RETURNS INT AS $$
+    SELECT (('x' || substr(md5(salt || ':' || user_id::TEXT), 1, 8))::BIT(32)::BIGINT % 100)::INT + 1
+$$ LANGUAGE SQL IMMUTABLE;
+
+COMMIT;
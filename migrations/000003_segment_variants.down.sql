@@ -0,0 +1,5 @@
+DROP FUNCTION IF EXISTS segment_variant_name;
+DROP FUNCTION IF EXISTS segment_variant;
+ALTER TABLE segment_history DROP COLUMN IF EXISTS variant_name;
+ALTER TABLE user_segments DROP COLUMN IF EXISTS variant_id;
+DROP TABLE IF EXISTS segment_variants;
@@ -0,0 +1,38 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS segment_variants (
+    variant_id BIGSERIAL PRIMARY KEY,
+    segment_id BIGINT NOT NULL REFERENCES segments (segment_id) ON DELETE CASCADE,
+    variant_name VARCHAR(255) NOT NULL,
+    weight INT NOT NULL CHECK (weight > 0),
+    UNIQUE (segment_id, variant_name)
+);
+
+ALTER TABLE user_segments ADD COLUMN IF NOT EXISTS variant_id BIGINT REFERENCES segment_variants (variant_id);
+
+ALTER TABLE segment_history ADD COLUMN IF NOT EXISTS variant_name VARCHAR(255);
+
+CREATE OR REPLACE FUNCTION segment_variant(p_segment_id BIGINT, p_user_id BIGINT) RETURNS BIGINT AS $$
+    SELECT v.variant_id
+    FROM (
+        SELECT
+            sv.variant_id,
+            SUM(sv.weight) OVER (ORDER BY sv.variant_id) AS upper_bound,
+            SUM(sv.weight) OVER () AS total
+        FROM segment_variants sv
+        WHERE sv.segment_id = p_segment_id
+    ) v
+    JOIN segments s ON s.segment_id = p_segment_id
+    WHERE v.upper_bound > ('x' || substr(md5(s.salt || ':variant:' || p_user_id::TEXT), 1, 8))::BIT(32)::BIGINT % v.total
+    ORDER BY v.upper_bound
+    LIMIT 1
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION segment_variant_name(p_segment_name VARCHAR, p_user_id BIGINT) RETURNS VARCHAR AS $$
+    SELECT sv.variant_name
+    FROM segments s
+    JOIN segment_variants sv ON sv.variant_id = segment_variant(s.segment_id, p_user_id)
+    WHERE s.segment_name = p_segment_name
+$$ LANGUAGE SQL STABLE;
+
+COMMIT;
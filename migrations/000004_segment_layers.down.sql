@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_segments_layer_idx;
+ALTER TABLE user_segments DROP COLUMN IF EXISTS layer;
+ALTER TABLE segments DROP COLUMN IF EXISTS layer;
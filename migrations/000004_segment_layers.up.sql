@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS layer VARCHAR(255);
+
+ALTER TABLE user_segments ADD COLUMN IF NOT EXISTS layer VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_segments_layer_idx ON user_segments (user_id, layer) WHERE layer IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS segments_owner_idx;
+DROP INDEX IF EXISTS segments_tags_idx;
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS attributes,
+    DROP COLUMN IF EXISTS tags,
+    DROP COLUMN IF EXISTS owner,
+    DROP COLUMN IF EXISTS description;
@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE segments
+    ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS owner VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS segments_tags_idx ON segments USING GIN (tags);
+
+CREATE INDEX IF NOT EXISTS segments_owner_idx ON segments (owner);
+
+COMMIT;
@@ -0,0 +1,3 @@
+-- values of operation_enum can't be dropped, archived/restored/purged stay in the type
+DROP INDEX IF EXISTS segments_archived_at_idx;
+ALTER TABLE segments DROP COLUMN IF EXISTS archived_at;
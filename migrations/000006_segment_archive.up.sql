@@ -0,0 +1,7 @@
+ALTER TYPE operation_enum ADD VALUE IF NOT EXISTS 'archived';
+ALTER TYPE operation_enum ADD VALUE IF NOT EXISTS 'restored';
+ALTER TYPE operation_enum ADD VALUE IF NOT EXISTS 'purged';
+
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS segments_archived_at_idx ON segments (archived_at) WHERE archived_at IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE user_segments DROP COLUMN IF EXISTS automatic;
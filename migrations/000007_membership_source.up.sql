@@ -0,0 +1,16 @@
+BEGIN;
+
+ALTER TABLE user_segments ADD COLUMN IF NOT EXISTS automatic BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- memberships created before the column existed become automatic only when they never
+-- expire and the user's bucket hits the segment under its salt. Memberships assigned by the
+-- random generator before 000002 salted the segments rarely match their bucket and stay
+-- manual, lowering the percentage doesn't remove them.
+UPDATE user_segments us
+SET automatic = TRUE
+FROM segments s
+WHERE s.segment_id = us.segment_id
+  AND us.expired_at = '9999-01-01 01:59:59+00'
+  AND s.automatic_percentage < segment_bucket(s.salt, us.user_id);
+
+COMMIT;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS segments_active_until_idx;
+ALTER TABLE segments DROP CONSTRAINT IF EXISTS segments_active_window_check;
+ALTER TABLE segments DROP COLUMN IF EXISTS active_until;
+ALTER TABLE segments DROP COLUMN IF EXISTS active_from;
@@ -0,0 +1,7 @@
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS active_from TIMESTAMPTZ;
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS active_until TIMESTAMPTZ;
+
+ALTER TABLE segments ADD CONSTRAINT segments_active_window_check
+    CHECK (active_from IS NULL OR active_until IS NULL OR active_until > active_from);
+
+CREATE INDEX IF NOT EXISTS segments_active_until_idx ON segments (active_until) WHERE active_until IS NOT NULL;
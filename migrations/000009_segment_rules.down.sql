@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS segments_rule_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS attributes;
+ALTER TABLE segments DROP COLUMN IF EXISTS rule;
@@ -0,0 +1,4 @@
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS rule TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS segments_rule_idx ON segments (segment_id) WHERE rule IS NOT NULL;
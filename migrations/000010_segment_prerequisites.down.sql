@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS segment_prerequisites;
+ALTER TABLE segments DROP COLUMN IF EXISTS prerequisite_policy;
+DROP TYPE IF EXISTS prerequisite_policy_enum;
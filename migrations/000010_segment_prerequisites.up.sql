@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TYPE prerequisite_policy_enum AS ENUM ('refuse', 'cascade');
+
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS prerequisite_policy prerequisite_policy_enum NOT NULL DEFAULT 'refuse';
+
+CREATE TABLE IF NOT EXISTS segment_prerequisites (
+    segment_id BIGINT NOT NULL REFERENCES segments (segment_id) ON DELETE CASCADE,
+    prerequisite_id BIGINT NOT NULL REFERENCES segments (segment_id) ON DELETE CASCADE,
+    PRIMARY KEY (segment_id, prerequisite_id),
+    CHECK (segment_id <> prerequisite_id)
+);
+
+CREATE INDEX IF NOT EXISTS segment_prerequisites_prerequisite_idx ON segment_prerequisites (prerequisite_id);
+
+COMMIT;
@@ -0,0 +1,3 @@
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS capacity INTEGER;
+
+ALTER TABLE segments ADD CONSTRAINT segments_capacity_check CHECK (capacity IS NULL OR capacity > 0);
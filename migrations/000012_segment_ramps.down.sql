@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS segment_ramp_steps;
+DROP TABLE IF EXISTS segment_ramps;
@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS segment_ramps (
+    segment_id BIGINT PRIMARY KEY REFERENCES segments (segment_id) ON DELETE CASCADE,
+    started_at TIMESTAMPTZ NOT NULL,
+    paused_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS segment_ramp_steps (
+    segment_id BIGINT NOT NULL REFERENCES segment_ramps (segment_id) ON DELETE CASCADE,
+    automatic_percentage INT NOT NULL CHECK (automatic_percentage BETWEEN 0 AND 100),
+    due_at TIMESTAMPTZ NOT NULL,
+    applied_at TIMESTAMPTZ,
+    PRIMARY KEY (segment_id, due_at)
+);
+
+CREATE INDEX IF NOT EXISTS segment_ramp_steps_pending_idx ON segment_ramp_steps (due_at) WHERE applied_at IS NULL;
+
+COMMIT;
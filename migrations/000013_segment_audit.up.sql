@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS segment_audit (
+    audit_id BIGSERIAL PRIMARY KEY,
+    segment_id BIGINT NOT NULL,
+    segment_name VARCHAR(255) NOT NULL,
+    operation VARCHAR(32) NOT NULL,
+    before JSONB,
+    after JSONB,
+    actor VARCHAR(255) NOT NULL DEFAULT 'system',
+    operation_timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS segment_audit_segment_name_idx ON segment_audit (segment_name, operation_timestamp);
+
+COMMIT;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS segment_history_user_idx;
+ALTER TABLE segment_history DROP CONSTRAINT IF EXISTS segment_history_user_check;
+ALTER TABLE segment_history DROP COLUMN IF EXISTS anonymous_id;
@@ -0,0 +1,6 @@
+ALTER TABLE segment_history ADD COLUMN IF NOT EXISTS anonymous_id VARCHAR(32);
+
+ALTER TABLE segment_history ADD CONSTRAINT segment_history_user_check
+    CHECK (user_id IS NOT NULL OR anonymous_id IS NOT NULL);
+
+CREATE INDEX IF NOT EXISTS segment_history_user_idx ON segment_history (user_id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_external_ids (
+    namespace VARCHAR(64) NOT NULL,
+    external_id VARCHAR(255) NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    PRIMARY KEY (namespace, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_external_ids_user_idx ON user_external_ids (user_id);
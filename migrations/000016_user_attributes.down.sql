@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_attributes;
+DROP TYPE IF EXISTS attribute_type_enum;
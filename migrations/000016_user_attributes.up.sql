@@ -0,0 +1,8 @@
+CREATE TYPE attribute_type_enum AS ENUM ('string', 'number', 'boolean', 'date');
+
+CREATE TABLE IF NOT EXISTS user_attributes (
+    attribute_name VARCHAR(64) PRIMARY KEY,
+    attribute_type attribute_type_enum NOT NULL,
+    description VARCHAR(1024) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
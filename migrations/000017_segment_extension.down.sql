@@ -0,0 +1 @@
+-- values of operation_enum can't be dropped, extended stays in the type
@@ -0,0 +1 @@
+ALTER TYPE operation_enum ADD VALUE IF NOT EXISTS 'extended';
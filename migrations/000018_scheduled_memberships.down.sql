@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_segments_starts_at_idx;
+ALTER TABLE user_segments DROP COLUMN IF EXISTS starts_at;
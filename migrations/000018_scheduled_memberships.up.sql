@@ -0,0 +1,5 @@
+-- starts_at is set while the membership waits for its activation, the cleaner
+-- records the membership as added and clears it once the start has passed
+ALTER TABLE user_segments ADD COLUMN IF NOT EXISTS starts_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS user_segments_starts_at_idx ON user_segments (starts_at) WHERE starts_at IS NOT NULL;
@@ -0,0 +1,28 @@
+package random
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+)
+
+type Bucketing interface {
+	Bucket(userID int64, salt string) int
+}
+
+// hashBucketing must stay in sync with the segment_bucket SQL function,
+// bulk assignment in the repositories relies on the same buckets.
+type hashBucketing struct {
+	buckets uint32
+}
+
+func NewHashBucketing(buckets int) *hashBucketing {
+	return &hashBucketing{
+		buckets: uint32(buckets),
+	}
+}
+
+func (h *hashBucketing) Bucket(userID int64, salt string) int {
+	sum := md5.Sum([]byte(salt + ":" + strconv.FormatInt(userID, 10)))
+	return int(binary.BigEndian.Uint32(sum[:4])%h.buckets) + 1
+}
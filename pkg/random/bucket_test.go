@@ -0,0 +1,49 @@
+package random
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashBucketingIsStable(t *testing.T) {
+	bucketing := NewHashBucketing(100)
+	tests := []struct {
+		userID   int64
+		salt     string
+		expected int
+	}{
+		{userID: 1, salt: "salt", expected: 8},
+		{userID: 42, salt: "salt", expected: 87},
+		{userID: 7, salt: "AVITO_VOICE_MESSAGES", expected: 46},
+		{userID: 7, salt: "other", expected: 26},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, bucketing.Bucket(test.userID, test.salt))
+		assert.Equal(t, test.expected, bucketing.Bucket(test.userID, test.salt))
+	}
+}
+
+func TestHashBucketingDistribution(t *testing.T) {
+	bucketing := NewHashBucketing(100)
+	got := make([]int, 100)
+	for userID := int64(1); userID <= 100000; userID++ {
+		bucket := bucketing.Bucket(userID, "segment")
+		assert.True(t, bucket >= 1 && bucket <= 100)
+		got[bucket-1]++
+	}
+	for i := range got {
+		assert.InDelta(t, 1000, got[i], 150)
+	}
+}
+
+func TestHashBucketingIndependentSegments(t *testing.T) {
+	bucketing := NewHashBucketing(100)
+	both := 0
+	for userID := int64(1); userID <= 10000; userID++ {
+		if bucketing.Bucket(userID, "first") > 90 && bucketing.Bucket(userID, "second") > 90 {
+			both++
+		}
+	}
+	assert.InDelta(t, 100, both, 50)
+}
@@ -0,0 +1,141 @@
+package rule
+
+import (
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type lexer struct {
+	src []rune
+	pos int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: []rune(src)}
+}
+
+func (l *lexer) tokens() ([]token, error) {
+	var tokens []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, value: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, value: ")", pos: start}, nil
+	case c == '"':
+		return l.string()
+	case c == '-' || unicode.IsDigit(c):
+		return l.number()
+	case c == '=' || c == '!' || c == '<' || c == '>':
+		return l.operator()
+	case isIdentStart(c):
+		for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, value: string(l.src[start:l.pos]), pos: start}, nil
+	}
+	return token{}, newSyntaxError(start, "unexpected character %q", c)
+}
+
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, value: b.String(), pos: start}, nil
+		case '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, newSyntaxError(l.pos, "unfinished escape sequence")
+			}
+			b.WriteRune(l.src[l.pos+1])
+			l.pos += 2
+		default:
+			b.WriteRune(c)
+			l.pos++
+		}
+	}
+	return token{}, newSyntaxError(start, "unterminated string")
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	digits := 0
+	for l.pos < len(l.src) && (unicode.IsDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+		l.pos++
+		digits++
+	}
+	if digits == 0 {
+		return token{}, newSyntaxError(start, "invalid number")
+	}
+	return token{kind: tokenNumber, value: string(l.src[start:l.pos]), pos: start}, nil
+}
+
+func (l *lexer) operator() (token, error) {
+	start := l.pos
+	c := l.src[l.pos]
+	l.pos++
+	if l.pos < len(l.src) && l.src[l.pos] == '=' {
+		l.pos++
+		return token{kind: tokenOperator, value: string(c) + "=", pos: start}, nil
+	}
+	if c == '<' || c == '>' {
+		return token{kind: tokenOperator, value: string(c), pos: start}, nil
+	}
+	return token{}, newSyntaxError(start, "unknown operator %q", c)
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isIdentPart(c rune) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
@@ -0,0 +1,166 @@
+package rule
+
+import (
+	"strconv"
+)
+
+const (
+	keywordAnd        = "and"
+	keywordOr         = "or"
+	keywordNot        = "not"
+	keywordTrue       = "true"
+	keywordFalse      = "false"
+	keywordContains   = "contains"
+	keywordStartsWith = "starts_with"
+	keywordEndsWith   = "ends_with"
+)
+
+var comparisons = map[string]struct{}{
+	"==":              {},
+	"!=":              {},
+	"<":               {},
+	"<=":              {},
+	">":               {},
+	">=":              {},
+	keywordContains:   {},
+	keywordStartsWith: {},
+	keywordEndsWith:   {},
+}
+
+// parser is a recursive descent parser over the grammar:
+//
+//	expr       = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" expr ")" | comparison
+//	comparison = field operator literal
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) parse() (node, error) {
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, newSyntaxError(t.pos, "unexpected %q", t.value)
+	}
+	return root, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword(keywordOr) {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword(keywordAnd) {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.keyword(keywordNot) {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+
+	if t := p.peek(); t.kind == tokenLParen {
+		p.pos++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing.kind != tokenRParen {
+			return nil, newSyntaxError(closing.pos, "expected \")\"")
+		}
+		p.pos++
+		return inner, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	field := p.peek()
+	if field.kind != tokenIdent || isKeyword(field.value) {
+		return nil, newSyntaxError(field.pos, "expected field name")
+	}
+	p.pos++
+
+	operator := p.peek()
+	if _, ok := comparisons[operator.value]; !ok || (operator.kind != tokenOperator && operator.kind != tokenIdent) {
+		return nil, newSyntaxError(operator.pos, "expected comparison operator after %q", field.value)
+	}
+	p.pos++
+
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{field: field.value, operator: operator.value, value: value}, nil
+}
+
+func (p *parser) literal() (interface{}, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t.kind == tokenString:
+		return t.value, nil
+	case t.kind == tokenNumber:
+		number, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, newSyntaxError(t.pos, "invalid number %q", t.value)
+		}
+		return number, nil
+	case t.kind == tokenIdent && t.value == keywordTrue:
+		return true, nil
+	case t.kind == tokenIdent && t.value == keywordFalse:
+		return false, nil
+	}
+	return nil, newSyntaxError(t.pos, "expected string, number or boolean")
+}
+
+func (p *parser) keyword(word string) bool {
+	if t := p.peek(); t.kind == tokenIdent && t.value == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func isKeyword(word string) bool {
+	switch word {
+	case keywordAnd, keywordOr, keywordNot, keywordTrue, keywordFalse,
+		keywordContains, keywordStartsWith, keywordEndsWith:
+		return true
+	}
+	return false
+}
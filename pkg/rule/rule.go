@@ -0,0 +1,217 @@
+// Package rule implements the small expression language of dynamic segments, e.g.
+//
+//	email ends_with "@avito.ru" and (attributes.city == "Moscow" or not attributes.beta == true)
+//
+// Field names are dotted paths into the evaluated record. A comparison with a
+// field missing from the record is false.
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Fields is the record a rule is evaluated against, nested maps are reached with dotted paths.
+type Fields map[string]interface{}
+
+type SyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func newSyntaxError(pos int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("rule syntax error at position %d: %s", e.Pos, e.Message)
+}
+
+type Rule struct {
+	source string
+	root   node
+}
+
+func Parse(source string) (*Rule, error) {
+	tokens, err := newLexer(source).tokens()
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, newSyntaxError(0, "empty rule")
+	}
+	p := parser{tokens: tokens}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{
+		source: source,
+		root:   root,
+	}, nil
+}
+
+func (r *Rule) Match(fields Fields) bool {
+	return r.root.eval(fields)
+}
+
+func (r *Rule) String() string {
+	return r.source
+}
+
+type node interface {
+	eval(fields Fields) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(fields Fields) bool {
+	return n.left.eval(fields) || n.right.eval(fields)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(fields Fields) bool {
+	return n.left.eval(fields) && n.right.eval(fields)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(fields Fields) bool {
+	return !n.operand.eval(fields)
+}
+
+type compareNode struct {
+	field    string
+	operator string
+	value    interface{}
+}
+
+func (n compareNode) eval(fields Fields) bool {
+	actual, ok := lookup(fields, n.field)
+	if !ok {
+		return false
+	}
+
+	switch n.operator {
+	case keywordContains, keywordStartsWith, keywordEndsWith:
+		s, isString := actual.(string)
+		pattern, isPattern := n.value.(string)
+		if !isString || !isPattern {
+			return false
+		}
+		switch n.operator {
+		case keywordContains:
+			return strings.Contains(s, pattern)
+		case keywordStartsWith:
+			return strings.HasPrefix(s, pattern)
+		default:
+			return strings.HasSuffix(s, pattern)
+		}
+	case "==":
+		return equal(actual, n.value)
+	case "!=":
+		return !equal(actual, n.value)
+	}
+
+	cmp, comparable := order(actual, n.value)
+	if !comparable {
+		return false
+	}
+	switch n.operator {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func lookup(fields Fields, path string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(fields)
+	for _, key := range strings.Split(path, ".") {
+		var values map[string]interface{}
+		switch m := current.(type) {
+		case map[string]interface{}:
+			values = m
+		case Fields:
+			values = m
+		default:
+			return nil, false
+		}
+		value, ok := values[key]
+		if !ok || value == nil {
+			return nil, false
+		}
+		current = value
+	}
+	return normalize(current), true
+}
+
+// normalize brings record values to the literal types of the language: string, float64 and bool.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return value
+}
+
+func equal(actual interface{}, expected interface{}) bool {
+	switch e := expected.(type) {
+	case string:
+		a, ok := actual.(string)
+		return ok && a == e
+	case float64:
+		a, ok := actual.(float64)
+		return ok && a == e
+	case bool:
+		a, ok := actual.(bool)
+		return ok && a == e
+	}
+	return false
+}
+
+func order(actual interface{}, expected interface{}) (int, bool) {
+	switch e := expected.(type) {
+	case string:
+		if a, ok := actual.(string); ok {
+			return strings.Compare(a, e), true
+		}
+	case float64:
+		if a, ok := actual.(float64); ok {
+			switch {
+			case a < e:
+				return -1, true
+			case a > e:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	fields := Fields{
+		"id":    int64(7),
+		"email": "ivan@avito.ru",
+		"attributes": map[string]interface{}{
+			"city": "Moscow",
+			"age":  float64(31),
+			"beta": true,
+		},
+	}
+
+	tests := []struct {
+		rule     string
+		expected bool
+	}{
+		{rule: `email ends_with "@avito.ru"`, expected: true},
+		{rule: `email starts_with "petr"`, expected: false},
+		{rule: `email contains "@"`, expected: true},
+		{rule: `attributes.city == "Moscow"`, expected: true},
+		{rule: `attributes.city != "Moscow"`, expected: false},
+		{rule: `attributes.age >= 18 and attributes.age < 35`, expected: true},
+		{rule: `id == 7`, expected: true},
+		{rule: `attributes.beta == true`, expected: true},
+		{rule: `attributes.city == "Kazan" or attributes.beta == true`, expected: true},
+		{rule: `not (attributes.city == "Kazan" or attributes.age > 40)`, expected: true},
+		{rule: `attributes.city == "Moscow" and not email ends_with "@avito.ru"`, expected: false},
+		{rule: `attributes.country == "RU"`, expected: false},
+		{rule: `attributes.country != "RU"`, expected: false},
+		{rule: `email.domain == "avito.ru"`, expected: false},
+		{rule: `attributes.age == "31"`, expected: false},
+		{rule: `attributes.city == "Mos\"cow"`, expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			r, err := Parse(test.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, r.Match(fields))
+			assert.Equal(t, test.rule, r.String())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		pos  int
+	}{
+		{rule: ``, pos: 0},
+		{rule: `email`, pos: 5},
+		{rule: `email ends_with`, pos: 15},
+		{rule: `email = "a"`, pos: 6},
+		{rule: `email == "a`, pos: 9},
+		{rule: `(email == "a"`, pos: 13},
+		{rule: `email == "a" and`, pos: 16},
+		{rule: `email == "a" email == "b"`, pos: 13},
+		{rule: `and == "a"`, pos: 0},
+		{rule: `email == city`, pos: 9},
+		{rule: `email # "a"`, pos: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			_, err := Parse(test.rule)
+			var syntaxErr *SyntaxError
+			assert.ErrorAs(t, err, &syntaxErr)
+			assert.Equal(t, test.pos, syntaxErr.Pos)
+		})
+	}
+}